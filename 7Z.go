@@ -0,0 +1,225 @@
+/*
+File Name:  7Z.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Encryption of 7Z archives. The go7z package decrypts AES encrypted files, but only if the file headers are not encrypted.
+The headers are also read directly to list the files with their sizes, checksums and methods, which go7z does not report.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/saracen/go7z"
+	"github.com/saracen/go7z/headers"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Codec IDs of 7Z archives
+const (
+	sevenZipCodecCopy  = 0x00
+	sevenZipCodecLZMA  = 0x030101
+	sevenZipCodecLZMA2 = 0x21
+	sevenZipCodecAES   = 0x06F10701
+)
+
+// sevenZipMaxHeaderSize is the max size of the decoded header
+const sevenZipMaxHeaderSize = 64 << 20
+
+// sevenZipCodecs are the names of the known codecs
+var sevenZipCodecs = map[uint32]string{
+	sevenZipCodecCopy:  "Copy",
+	0x03:               "Delta",
+	sevenZipCodecLZMA:  "LZMA",
+	sevenZipCodecLZMA2: "LZMA2",
+	0x030401:           "PPMD",
+	0x03030103:         "BCJ",
+	0x0303011B:         "BCJ2",
+	0x03030205:         "PPC",
+	0x03030401:         "IA64",
+	0x03030501:         "ARM",
+	0x03030701:         "ARMT",
+	0x03030805:         "SPARC",
+	0x0A:               "ARM64",
+	0x040108:           "Deflate",
+	0x040109:           "Deflate64",
+	0x040202:           "BZip2",
+	0x04F71101:         "Zstandard",
+	0x04F71102:         "Brotli",
+	0x04F71104:         "LZ4",
+	sevenZipCodecAES:   "7zAES",
+}
+
+var errSevenZipHeader = errors.New("unsupported 7Z header")
+
+// sevenZipHeadersEncrypted checks if the file headers of the 7Z archive are encrypted
+func sevenZipHeadersEncrypted(file io.ReaderAt, size int64) bool {
+	reader := io.NewSectionReader(file, 0, size)
+
+	signature, err := headers.ReadSignatureHeader(reader)
+	if err != nil || signature.StartHeader.NextHeaderSize > size {
+		return false
+	} else if _, err = reader.Seek(signature.StartHeader.NextHeaderOffset, io.SeekCurrent); err != nil {
+		return false
+	}
+
+	_, encoded, err := headers.ReadPackedStreamsForHeaders(&io.LimitedReader{R: bufio.NewReader(reader), N: signature.StartHeader.NextHeaderSize})
+	if err != nil || encoded == nil || encoded.UnpackInfo == nil {
+		return false
+	}
+
+	for _, folder := range encoded.UnpackInfo.Folders {
+		for _, coder := range folder.CoderInfo {
+			if coder.CodecID == sevenZipCodecAES {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sevenZipSize returns the size of the 7Z archive stored in the signature header. The header of the files is at the end of the archive.
+func sevenZipSize(file io.ReaderAt, size int64) (archiveSize int64, err error) {
+	signature, err := headers.ReadSignatureHeader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return 0, err
+	} else if signature.StartHeader.NextHeaderOffset < 0 || signature.StartHeader.NextHeaderOffset > 1<<62 {
+		return 0, errSevenZipHeader
+	}
+
+	return headers.SignatureHeaderSize + signature.StartHeader.NextHeaderOffset + signature.StartHeader.NextHeaderSize, nil
+}
+
+// sevenZipFindPassword returns the first candidate password that decrypts the first file of the 7Z archive
+func sevenZipFindPassword(ctx context.Context, file io.ReaderAt, size int64, passwords []string) (password string, found bool) {
+	for _, password = range passwords {
+		if ctx.Err() != nil {
+			return "", false
+		}
+
+		sz, err := go7z.NewReader(file, size)
+		if err != nil {
+			return "", false
+		}
+		sz.Options.SetPassword(password)
+
+		for {
+			hdr, err := sz.Next()
+			if err != nil {
+				break
+			} else if hdr.IsEmptyStream {
+				continue
+			}
+
+			if passwordVerify(ctx, sz, 0) {
+				return password, true
+			}
+			break
+		}
+	}
+
+	return "", false
+}
+
+// sevenZipReadHeader reads the header of the 7Z archive. Encoded headers are decompressed, which requires a single Copy, LZMA or LZMA2 coder.
+// Encrypted headers return ErrPasswordRequired.
+func sevenZipReadHeader(file io.ReaderAt, size int64) (header *headers.Header, err error) {
+	reader := io.NewSectionReader(file, 0, size)
+
+	signature, err := headers.ReadSignatureHeader(reader)
+	if err != nil {
+		return nil, err
+	} else if signature.StartHeader.NextHeaderSize > size {
+		return nil, io.ErrUnexpectedEOF
+	} else if _, err = reader.Seek(signature.StartHeader.NextHeaderOffset, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+
+	header, encoded, err := headers.ReadPackedStreamsForHeaders(&io.LimitedReader{R: bufio.NewReader(reader), N: signature.StartHeader.NextHeaderSize})
+	if err != nil {
+		return nil, err
+	} else if encoded == nil {
+		return header, nil
+	}
+
+	if encoded.PackInfo == nil || encoded.UnpackInfo == nil || len(encoded.UnpackInfo.Folders) != 1 || len(encoded.PackInfo.PackSizes) == 0 {
+		return nil, errSevenZipHeader
+	}
+	folder := encoded.UnpackInfo.Folders[0]
+	if len(folder.CoderInfo) != 1 {
+		for _, coder := range folder.CoderInfo {
+			if coder.CodecID == sevenZipCodecAES {
+				return nil, ErrPasswordRequired
+			}
+		}
+		return nil, errSevenZipHeader
+	}
+
+	unpackSize := folder.UnpackSize()
+	if unpackSize > sevenZipMaxHeaderSize {
+		return nil, errSevenZipHeader
+	}
+	packed := io.NewSectionReader(file, headers.SignatureHeaderSize+int64(encoded.PackInfo.PackPos), int64(encoded.PackInfo.PackSizes[0]))
+
+	var decoder io.Reader
+	switch coder := folder.CoderInfo[0]; coder.CodecID {
+	case sevenZipCodecCopy:
+		decoder = packed
+	case sevenZipCodecLZMA:
+		// The LZMA properties are followed by the unpacked size, as in the header of .lzma files
+		lzmaHeader := bytes.NewBuffer(append([]byte{}, coder.Properties...))
+		binary.Write(lzmaHeader, binary.LittleEndian, unpackSize)
+		decoder, err = lzma.NewReader(io.MultiReader(lzmaHeader, packed))
+	case sevenZipCodecLZMA2:
+		config := lzma.Reader2Config{}
+		if len(coder.Properties) > 0 {
+			config.DictCap = int(2|(coder.Properties[0]&1)) << ((coder.Properties[0] >> 1) + 11)
+		}
+		decoder, err = config.NewReader2(packed)
+	case sevenZipCodecAES:
+		return nil, ErrPasswordRequired
+	default:
+		return nil, errSevenZipHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := make([]byte, unpackSize)
+	if _, err = io.ReadFull(decoder, decoded); err != nil {
+		return nil, err
+	}
+
+	header, _, err = headers.ReadPackedStreamsForHeaders(&io.LimitedReader{R: bytes.NewReader(decoded), N: int64(len(decoded))})
+	if err == nil && header == nil {
+		err = errSevenZipHeader
+	}
+
+	return header, err
+}
+
+// sevenZipMethod returns the names of the codecs of the folder, and whether it is encrypted
+func sevenZipMethod(folder *headers.Folder) (method string, encrypted bool) {
+	for n, coder := range folder.CoderInfo {
+		name, ok := sevenZipCodecs[coder.CodecID]
+		if !ok {
+			name = "0x" + strconv.FormatUint(uint64(coder.CodecID), 16)
+		}
+		if n > 0 {
+			method += "+"
+		}
+		method += name
+		encrypted = encrypted || coder.CodecID == sevenZipCodecAES
+	}
+
+	return method, encrypted
+}
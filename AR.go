@@ -0,0 +1,182 @@
+/*
+File Name:  AR.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Reader for Unix ar archives, including the GNU and BSD variants of long file names. Debian packages (.deb) are ar archives with the members
+debian-binary, control.tar.* and data.tar.*, the installed files are in data.tar which may be compressed with gzip, xz, bzip2, LZMA or zstd.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// arMagic is the signature of ar archives
+const arMagic = "!<arch>\n"
+
+// arHeaderSize is the size of the header of each member
+const arHeaderSize = 60
+
+// arMaxNamesSize is the max size of the GNU long names table and BSD long names
+const arMaxNamesSize = 16 << 20
+
+var errARHeader = errors.New("invalid ar header")
+var errDEBData = errors.New("missing data.tar in Debian package")
+
+// arHeader is a member of an ar archive
+type arHeader struct {
+	name string
+	size int64
+	date time.Time
+	mode uint32
+}
+
+// arReader reads the members of an ar archive sequentially, like tar.Reader. Symbol tables are skipped.
+type arReader struct {
+	reader    *bufio.Reader
+	remaining int64  // bytes of the current member that were not read
+	padding   int64  // members are aligned to 2 bytes
+	longNames []byte // GNU table of long names
+}
+
+// newARReader checks the signature of the archive
+func newARReader(reader io.Reader) (r *arReader, err error) {
+	r = &arReader{reader: bufio.NewReader(reader)}
+
+	magic := make([]byte, len(arMagic))
+	if _, err = io.ReadFull(r.reader, magic); err != nil || string(magic) != arMagic {
+		return nil, errARHeader
+	}
+
+	return r, nil
+}
+
+// Next skips the rest of the current member and reads the next header. At the end of the archive io.EOF is returned.
+func (r *arReader) Next() (header *arHeader, err error) {
+	for {
+		if _, err = io.CopyN(ioutil.Discard, r.reader, r.remaining+r.padding); err != nil {
+			return nil, err
+		}
+		r.remaining, r.padding = 0, 0
+
+		data := make([]byte, arHeaderSize)
+		if _, err = io.ReadFull(r.reader, data); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		} else if data[58] != '`' || data[59] != '\n' {
+			return nil, errARHeader
+		}
+
+		field := func(offset, length, base int) (value int64) {
+			text := strings.TrimSpace(string(data[offset : offset+length]))
+			if text == "" || err != nil {
+				return 0
+			}
+			value, err = strconv.ParseInt(text, base, 64)
+			return value
+		}
+
+		header = &arHeader{date: time.Unix(field(16, 12, 10), 0).UTC(), mode: uint32(field(40, 8, 8)), size: field(48, 10, 10)}
+		if err != nil || header.size < 0 {
+			return nil, errARHeader
+		}
+		r.remaining, r.padding = header.size, header.size%2
+
+		name := strings.TrimRight(string(data[0:16]), " ")
+		switch {
+		case name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF"):
+			// symbol table
+			continue
+
+		case name == "//":
+			// GNU table of long names
+			if header.size > arMaxNamesSize {
+				return nil, errARHeader
+			}
+			r.longNames = make([]byte, header.size)
+			if _, err = io.ReadFull(r, r.longNames); err != nil {
+				return nil, err
+			}
+			continue
+
+		case strings.HasPrefix(name, "#1/"):
+			// BSD: the name is stored before the data
+			length, errLength := strconv.Atoi(name[3:])
+			if errLength != nil || length < 0 || int64(length) > header.size || length > arMaxNamesSize {
+				return nil, errARHeader
+			}
+			longName := make([]byte, length)
+			if _, err = io.ReadFull(r, longName); err != nil {
+				return nil, err
+			}
+			header.name = string(bytes.TrimRight(longName, "\x00"))
+			header.size -= int64(length)
+
+		case len(name) > 1 && name[0] == '/' && name[1] >= '0' && name[1] <= '9':
+			// GNU: offset in the table of long names, which end with "/\n"
+			offset, errOffset := strconv.Atoi(name[1:])
+			if errOffset != nil || offset < 0 || offset >= len(r.longNames) {
+				return nil, errARHeader
+			}
+			longName := r.longNames[offset:]
+			if end := bytes.IndexByte(longName, '\n'); end >= 0 {
+				longName = longName[:end]
+			}
+			header.name = strings.TrimSuffix(string(longName), "/")
+
+		default:
+			// GNU terminates names with "/"
+			header.name = strings.TrimSuffix(name, "/")
+		}
+
+		return header, nil
+	}
+}
+
+// Read reads the data of the current member
+func (r *arReader) Read(p []byte) (n int, err error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err = r.reader.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// debDataReader returns the decompressed data.tar member of a Debian package
+func debDataReader(reader io.Reader) (data io.Reader, err error) {
+	ar, err := newARReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := ar.Next()
+		if err == io.EOF {
+			return nil, errDEBData
+		} else if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(header.name, "data.tar") {
+			return decompressPayload(ar)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+File Name:  Bomb.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Detection of decompression bombs. Compressed files and archives are checked while they are decompressed: the ratio of decompressed to compressed bytes and the total output are limited.
+ZIP archives with overlapping files, which reuse the same compressed data many times, are rejected before extraction. ContainerWalk detects archives that contain themselves.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Reasons for a decompression bomb, used in BombError
+const (
+	BombRatio   = "compression ratio"
+	BombSize    = "decompressed size"
+	BombOverlap = "overlapping files"
+	BombQuine   = "archive contains itself"
+)
+
+// BombLimits are the limits for detecting decompression bombs. A limit of 0 means no limit.
+type BombLimits struct {
+	MaxRatio     int64 // Max ratio of decompressed to compressed bytes. It is checked for each file of a container and for the container as whole.
+	MaxSize      int64 // Max decompressed bytes of a compressed file, or of all files of a container
+	MinRatioSize int64 // The ratio is only checked once more bytes are decompressed, since small files often compress very well
+}
+
+// DefaultBombLimits are used if the context has no limits attached via WithBombLimits
+var DefaultBombLimits = BombLimits{MaxRatio: 1000, MaxSize: 4 << 30, MinRatioSize: 16 << 20}
+
+// BombError is returned when a decompression bomb is detected. It matches ErrDecompressionBomb.
+// It reports how far the extraction got before it was stopped.
+type BombError struct {
+	Reason       string // One of the Bomb constants
+	Name         string // Name of the file where the bomb was detected. Empty for compressed files.
+	Files        int64  // Number of files reached in the container, including the one where the bomb was detected
+	Decompressed int64  // Bytes decompressed before the extraction was stopped
+}
+
+func (e *BombError) Error() string {
+	text := "decompression bomb: " + e.Reason
+	if e.Name != "" {
+		text += " at " + e.Name
+	}
+
+	return text + " after " + strconv.FormatInt(e.Files, 10) + " files and " + strconv.FormatInt(e.Decompressed, 10) + " bytes"
+}
+
+// Is makes errors.Is match ErrDecompressionBomb
+func (e *BombError) Is(target error) bool {
+	return target == ErrDecompressionBomb
+}
+
+type bombContextKey struct{}
+
+// WithBombLimits returns a context with the limits for detecting decompression bombs. They are used by the decompression and container functions.
+func WithBombLimits(ctx context.Context, limits BombLimits) context.Context {
+	return context.WithValue(ctx, bombContextKey{}, limits)
+}
+
+// bombLimitsFromContext returns the limits of the context, or DefaultBombLimits if none
+func bombLimitsFromContext(ctx context.Context) BombLimits {
+	if limits, ok := ctx.Value(bombContextKey{}).(BombLimits); ok {
+		return limits
+	}
+
+	return DefaultBombLimits
+}
+
+// bombTracker counts the decompressed bytes of a compressed file or all files of a container
+type bombTracker struct {
+	limits       BombLimits
+	input        func() int64 // compressed bytes of the input
+	files        int64        // files reached so far
+	decompressed int64        // bytes decompressed so far
+}
+
+// newBombTracker creates a tracker using the limits of the context. Size is the size of the compressed input.
+func newBombTracker(ctx context.Context, size int64) *bombTracker {
+	return &bombTracker{limits: bombLimitsFromContext(ctx), input: func() int64 { return size }}
+}
+
+// reader returns a reader that counts the decompressed bytes of a file. Compressed is the compressed size of the file, 0 if unknown.
+func (tracker *bombTracker) reader(name string, compressed int64, reader io.Reader) *bombReader {
+	return &bombReader{tracker: tracker, name: name, compressed: compressed, reader: reader}
+}
+
+// check returns the reason if a limit is exceeded, otherwise an empty string
+func (tracker *bombTracker) check(decompressed, compressed int64) string {
+	limits := tracker.limits
+
+	if limits.MaxSize > 0 && tracker.decompressed > limits.MaxSize {
+		return BombSize
+	} else if limits.MaxRatio <= 0 {
+		return ""
+	}
+
+	if compressed > 0 && decompressed > limits.MinRatioSize && decompressed/compressed > limits.MaxRatio {
+		return BombRatio
+	}
+	if input := tracker.input(); input > 0 && tracker.decompressed > limits.MinRatioSize && tracker.decompressed/input > limits.MaxRatio {
+		return BombRatio
+	}
+
+	return ""
+}
+
+// bombError returns the error for the reason
+func (tracker *bombTracker) bombError(reason, name string) *BombError {
+	return &BombError{Reason: reason, Name: name, Files: tracker.files, Decompressed: tracker.decompressed}
+}
+
+// bombReader stops reading once a decompression bomb is detected. The error is stored in the reader.
+type bombReader struct {
+	tracker      *bombTracker
+	name         string
+	compressed   int64 // compressed size of the file, 0 if unknown
+	decompressed int64
+	reader       io.Reader
+	err          error
+}
+
+func (r *bombReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err = r.reader.Read(p)
+	r.decompressed += int64(n)
+	r.tracker.decompressed += int64(n)
+
+	if reason := r.tracker.check(r.decompressed, r.compressed); reason != "" {
+		r.err = r.tracker.bombError(reason, r.name)
+		return n, r.err
+	}
+
+	return n, err
+}
+
+// bombCountReader counts the bytes read from the compressed input
+type bombCountReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *bombCountReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// zipOverlap checks if the compressed data of any files in the ZIP archive overlap and returns the name of the first such file.
+// Valid archives never share data between files. Overlapping files allow a small archive to decompress the same data many times.
+func zipOverlap(r *zip.Reader) (name string, overlap bool) {
+	type dataRange struct {
+		name       string
+		start, end int64
+	}
+	var ranges []dataRange
+
+	for _, f := range r.File {
+		if f.CompressedSize64 == 0 {
+			continue
+		}
+		// Files with an invalid local header fail when they are opened.
+		if offset, err := f.DataOffset(); err == nil {
+			ranges = append(ranges, dataRange{name: f.Name, start: offset, end: offset + int64(f.CompressedSize64)})
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	var end int64
+	for n, dataRange := range ranges {
+		if n > 0 && dataRange.start < end {
+			return dataRange.name, true
+		}
+		if dataRange.end > end {
+			end = dataRange.end
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,171 @@
+/*
+File Name:  Budget.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Resource budget of a single conversion. The parsers charge allocations, spreadsheet cells, decompressed bytes and picture pixels against it.
+Once a limit is exceeded, the conversion stops with ErrBudgetExceeded. This protects against files crafted to exhaust memory, like decompression bombs.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+)
+
+// Resources limited by the budget, used in BudgetError
+const (
+	ResourceAllocation   = "allocation"
+	ResourceCells        = "cells"
+	ResourceDecompressed = "decompressed bytes"
+	ResourcePixels       = "pixels"
+)
+
+// Budget limits the resources used by a conversion. A limit of 0 means no limit.
+// It can be shared by multiple conversions (for example all files of an archive) and is safe for concurrent use.
+type Budget struct {
+	MaxAllocation   int64 // Max bytes allocated by the parsers for buffers and strings that are kept. Temporary buffers, for example of a single record, are not charged.
+	MaxCells        int64 // Max spreadsheet cells (XLS, XLSX, ODS)
+	MaxDecompressed int64 // Max bytes decompressed from ZIP based documents, compressed files and archives
+	MaxPixels       int64 // Max pixels (width * height) of decoded pictures
+
+	allocated    int64
+	cells        int64
+	decompressed int64
+	pixels       int64
+}
+
+// BudgetError is returned when a limit of the budget is exceeded. It matches ErrBudgetExceeded.
+type BudgetError struct {
+	Resource string // One of the Resource constants
+	Limit    int64  // The limit that was exceeded
+}
+
+func (e *BudgetError) Error() string {
+	return "budget exceeded: " + e.Resource + " limit of " + strconv.FormatInt(e.Limit, 10)
+}
+
+// Is makes errors.Is match ErrBudgetExceeded
+func (e *BudgetError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// Allocate charges allocated bytes
+func (budget *Budget) Allocate(size int64) error {
+	if budget == nil {
+		return nil
+	}
+	return budgetCharge(ResourceAllocation, &budget.allocated, budget.MaxAllocation, size)
+}
+
+// AddCells charges spreadsheet cells
+func (budget *Budget) AddCells(count int64) error {
+	if budget == nil {
+		return nil
+	}
+	return budgetCharge(ResourceCells, &budget.cells, budget.MaxCells, count)
+}
+
+// AddDecompressed charges decompressed bytes
+func (budget *Budget) AddDecompressed(size int64) error {
+	if budget == nil {
+		return nil
+	}
+	return budgetCharge(ResourceDecompressed, &budget.decompressed, budget.MaxDecompressed, size)
+}
+
+// AddPixels charges the pixels of a picture. The decoded picture uses 4 bytes per pixel, which is charged as allocation as well.
+func (budget *Budget) AddPixels(width, height int) error {
+	if budget == nil {
+		return nil
+	}
+
+	pixels := int64(width) * int64(height)
+	if err := budgetCharge(ResourcePixels, &budget.pixels, budget.MaxPixels, pixels); err != nil {
+		return err
+	}
+	return budget.Allocate(pixels * 4)
+}
+
+// budgetCharge adds the amount to the used counter and checks the limit. The counter stops at math.MaxInt64, huge amounts must not wrap it around.
+func budgetCharge(resource string, used *int64, limit, amount int64) error {
+	for {
+		current := atomic.LoadInt64(used)
+		total := int64(math.MaxInt64)
+		if amount <= math.MaxInt64-current {
+			total = current + amount
+		}
+
+		if atomic.CompareAndSwapInt64(used, current, total) {
+			if limit > 0 && total > limit {
+				return &BudgetError{Resource: resource, Limit: limit}
+			}
+			return nil
+		}
+	}
+}
+
+type budgetContextKey struct{}
+
+// WithBudget returns a context with the budget. All Context variants of the converters charge the budget of the context.
+func WithBudget(ctx context.Context, budget *Budget) context.Context {
+	return context.WithValue(ctx, budgetContextKey{}, budget)
+}
+
+// BudgetFromContext returns the budget of the context, or nil if none. The methods of a nil budget do nothing.
+// Custom converters can use it to charge their resources.
+func BudgetFromContext(ctx context.Context) *Budget {
+	budget, _ := ctx.Value(budgetContextKey{}).(*Budget)
+	return budget
+}
+
+// budgetReader charges all bytes read as decompressed bytes
+type budgetReader struct {
+	budget *Budget
+	reader io.Reader
+	err    error // Error of the budget. Parsers that ignore read errors can check it.
+}
+
+func (r *budgetReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		if r.err = r.budget.AddDecompressed(int64(n)); r.err != nil {
+			return n, r.err
+		}
+	}
+	return n, err
+}
+
+// zipChargeDecompressed charges the uncompressed size of all files of a ZIP archive. It is used before parsers that decompress the whole file at once.
+// The archive/zip package fails if a file is larger than its declared size.
+func zipChargeDecompressed(budget *Budget, file io.ReaderAt, size int64) error {
+	if budget == nil {
+		return nil
+	}
+
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		// The parser reports the invalid file.
+		return nil
+	}
+
+	var total int64
+	for _, f := range r.File {
+		if f.UncompressedSize64 > uint64(math.MaxInt64-total) {
+			total = math.MaxInt64
+			break
+		}
+		total += int64(f.UncompressedSize64)
+	}
+
+	return budget.AddDecompressed(total)
+}
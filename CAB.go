@@ -0,0 +1,276 @@
+/*
+File Name:  CAB.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Parser for Microsoft Cabinet (CAB) files. Files are stored in folders, which are compressed as one stream: uncompressed, MSZIP or LZX.
+Each folder consists of CFDATA blocks with up to 32 KB of uncompressed data. Quantum compression is not supported.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Compression methods of CAB folders. The LZX window size is stored in bits 8-12.
+const (
+	cabCompressionNone    = 0
+	cabCompressionMSZIP   = 1
+	cabCompressionQuantum = 2
+	cabCompressionLZX     = 3
+	cabCompressionMask    = 0x000F
+)
+
+// Flags of the CAB header
+const (
+	cabFlagPrevious = 0x0001 // The cabinet continues a previous one
+	cabFlagNext     = 0x0002 // The cabinet is continued in a next one
+	cabFlagReserve  = 0x0004 // The header, folders and data blocks have reserved fields
+)
+
+// cabHeaderSize is the size of the CFHEADER structure without reserved fields
+const cabHeaderSize = 36
+
+// cabMaxBlockSize is the max uncompressed size of a CFDATA block
+const cabMaxBlockSize = 32768
+
+// cabMethods are the names of the compression methods
+var cabMethods = map[uint16]string{
+	cabCompressionNone:    "Store",
+	cabCompressionMSZIP:   "MSZIP",
+	cabCompressionQuantum: "Quantum",
+	cabCompressionLZX:     "LZX",
+}
+
+var errCABCorrupt = errors.New("invalid CAB file")
+
+// cabArchive is the directory of a CAB file
+type cabArchive struct {
+	folders     []cabFolder
+	files       []cabFile
+	dataReserve int64 // size of the reserved field in each CFDATA block
+	flags       uint16
+}
+
+// cabFolder is a compressed stream of files
+type cabFolder struct {
+	offset      int64 // offset of the first CFDATA block
+	blocks      int
+	compression uint16
+}
+
+// cabFile is a file in a folder
+type cabFile struct {
+	name       string
+	size       int64
+	offset     int64 // offset in the uncompressed folder
+	folder     uint16
+	date       time.Time
+	attributes uint16
+}
+
+// cabReadArchive reads the header, folders and files of the CAB file
+func cabReadArchive(file io.ReaderAt, size int64) (archive *cabArchive, err error) {
+	header := make([]byte, cabHeaderSize+4)
+	if _, err = file.ReadAt(header, 0); err != nil {
+		return nil, err
+	} else if string(header[0:4]) != "MSCF" {
+		return nil, errCABCorrupt
+	}
+
+	filesOffset := int64(binary.LittleEndian.Uint32(header[16:]))
+	folderCount := int(binary.LittleEndian.Uint16(header[26:]))
+	fileCount := int(binary.LittleEndian.Uint16(header[28:]))
+	archive = &cabArchive{flags: binary.LittleEndian.Uint16(header[30:])}
+
+	// The reserved fields are only present if the flag is set
+	offset := int64(cabHeaderSize)
+	folderReserve := int64(0)
+	if archive.flags&cabFlagReserve != 0 {
+		offset += 4 + int64(binary.LittleEndian.Uint16(header[36:]))
+		folderReserve = int64(header[38])
+		archive.dataReserve = int64(header[39])
+	}
+
+	// Names of the previous and next cabinet and disk
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	for n := 0; n < 4; n++ {
+		if (n < 2 && archive.flags&cabFlagPrevious != 0) || (n >= 2 && archive.flags&cabFlagNext != 0) {
+			name, err := reader.ReadString(0)
+			if err != nil {
+				return nil, err
+			}
+			offset += int64(len(name))
+		}
+	}
+
+	folders := make([]byte, folderCount*int(8+folderReserve))
+	if _, err = file.ReadAt(folders, offset); err != nil {
+		return nil, err
+	}
+	for n := 0; n < folderCount; n++ {
+		folder := folders[n*int(8+folderReserve):]
+		archive.folders = append(archive.folders, cabFolder{
+			offset:      int64(binary.LittleEndian.Uint32(folder[0:])),
+			blocks:      int(binary.LittleEndian.Uint16(folder[4:])),
+			compression: binary.LittleEndian.Uint16(folder[6:]),
+		})
+	}
+
+	if filesOffset <= 0 || filesOffset >= size {
+		return nil, errCABCorrupt
+	}
+	reader = bufio.NewReader(io.NewSectionReader(file, filesOffset, size-filesOffset))
+	for n := 0; n < fileCount; n++ {
+		entry := make([]byte, 16)
+		if _, err = io.ReadFull(reader, entry); err != nil {
+			return nil, err
+		}
+		name, err := reader.ReadString(0)
+		if err != nil {
+			return nil, err
+		}
+
+		// Directories are separated by backslashes
+		archive.files = append(archive.files, cabFile{
+			name:       strings.Replace(strings.TrimSuffix(name, "\x00"), "\\", "/", -1),
+			size:       int64(binary.LittleEndian.Uint32(entry[0:])),
+			offset:     int64(binary.LittleEndian.Uint32(entry[4:])),
+			folder:     binary.LittleEndian.Uint16(entry[8:]),
+			date:       dosDateTime(uint32(binary.LittleEndian.Uint16(entry[10:]))<<16 | uint32(binary.LittleEndian.Uint16(entry[12:]))),
+			attributes: binary.LittleEndian.Uint16(entry[14:]),
+		})
+	}
+
+	return archive, nil
+}
+
+// cabBlock is a CFDATA block
+type cabBlock struct {
+	offset       int64 // offset of the compressed data
+	compressed   int
+	uncompressed int
+}
+
+// cabFolderReader decompresses the data of a folder
+type cabFolderReader struct {
+	file        io.ReaderAt
+	compression uint16
+	blocks      []cabBlock
+	decoded     int    // number of decoded blocks
+	output      []byte // decompressed data that was not read yet
+	position    int64  // bytes read from the folder
+	history     []byte // last 32 KB of output, the dictionary for the next MSZIP block
+	lzx         *lzxDecoder
+	err         error // a failed block leaves the decoder in an undefined state
+}
+
+// newCabFolderReader reads the headers of the CFDATA blocks and prepares the decompression
+func newCabFolderReader(file io.ReaderAt, size int64, archive *cabArchive, folder cabFolder) (r *cabFolderReader, err error) {
+	r = &cabFolderReader{file: file, compression: folder.compression & cabCompressionMask}
+
+	offset := folder.offset
+	header := make([]byte, 8)
+	for n := 0; n < folder.blocks; n++ {
+		if _, err = file.ReadAt(header, offset); err != nil {
+			return nil, err
+		}
+		block := cabBlock{offset: offset + 8 + archive.dataReserve, compressed: int(binary.LittleEndian.Uint16(header[4:])), uncompressed: int(binary.LittleEndian.Uint16(header[6:]))}
+		if block.offset+int64(block.compressed) > size || block.uncompressed > cabMaxBlockSize {
+			return nil, errCABCorrupt
+		}
+		r.blocks = append(r.blocks, block)
+		offset = block.offset + int64(block.compressed)
+	}
+
+	switch r.compression {
+	case cabCompressionNone, cabCompressionMSZIP:
+	case cabCompressionLZX:
+		// The compressed data of all blocks is one stream. A frame may end within the first bytes of the next block.
+		readers := make([]io.Reader, len(r.blocks))
+		for n, block := range r.blocks {
+			readers[n] = io.NewSectionReader(file, block.offset, int64(block.compressed))
+		}
+		if r.lzx, err = newLZXDecoder(bufio.NewReader(io.MultiReader(readers...)), uint(folder.compression>>8&0x1F)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+
+	return r, nil
+}
+
+func (r *cabFolderReader) Read(p []byte) (n int, err error) {
+	for len(r.output) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		} else if r.decoded >= len(r.blocks) {
+			return 0, io.EOF
+		} else if r.err = r.decodeBlock(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	n = copy(p, r.output)
+	r.output = r.output[n:]
+	r.position += int64(n)
+	return n, nil
+}
+
+// decodeBlock decompresses the next CFDATA block
+func (r *cabFolderReader) decodeBlock() (err error) {
+	block := r.blocks[r.decoded]
+	r.decoded++
+
+	if r.compression == cabCompressionLZX {
+		r.output, err = r.lzx.decodeFrame(block.uncompressed)
+		return err
+	}
+
+	data := make([]byte, block.compressed)
+	if _, err = r.file.ReadAt(data, block.offset); err != nil {
+		return err
+	}
+
+	if r.compression == cabCompressionNone {
+		if block.compressed != block.uncompressed {
+			return errCABCorrupt
+		}
+		r.output = data
+		return nil
+	}
+
+	// MSZIP blocks start with "CK" and are deflate streams that use the previous block as dictionary
+	if len(data) < 2 || data[0] != 'C' || data[1] != 'K' {
+		return errCABCorrupt
+	}
+	output := make([]byte, block.uncompressed)
+	if _, err = io.ReadFull(flate.NewReaderDict(bytes.NewReader(data[2:]), r.history), output); err != nil {
+		return err
+	}
+
+	r.history = append(r.history, output...)
+	if len(r.history) > cabMaxBlockSize {
+		r.history = r.history[len(r.history)-cabMaxBlockSize:]
+	}
+	r.output = output
+	return nil
+}
+
+// skip discards the data up to the offset in the folder. Reader reads from the folder, it may count the bytes.
+func (r *cabFolderReader) skip(offset int64, reader io.Reader) (err error) {
+	if offset > r.position {
+		_, err = io.CopyN(ioutil.Discard, reader, offset-r.position)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+/*
+File Name:  CPIO.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Reader for cpio archives in the portable ASCII formats: newc (SVR4, also with checksum) and odc (POSIX.1). RPM packages use newc for the payload.
+The old binary format is not supported.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// Header sizes of the cpio formats
+const (
+	cpioNewcHeaderSize = 110
+	cpioOdcHeaderSize  = 76
+	cpioMaxNameSize    = 4096
+	cpioMaxLinkSize    = 4096
+)
+
+// cpioTrailer is the name of the last entry of the archive
+const cpioTrailer = "TRAILER!!!"
+
+var errCPIOHeader = errors.New("invalid cpio header")
+
+// cpioHeader is an entry of a cpio archive
+type cpioHeader struct {
+	name     string
+	mode     uint32 // Unix mode including the file type
+	size     int64
+	date     time.Time
+	linkname string // target of a symbolic link
+}
+
+// cpioReader reads the entries of a cpio archive sequentially, like tar.Reader
+type cpioReader struct {
+	reader    *bufio.Reader
+	remaining int64 // bytes of the current file that were not read
+	padding   int64 // padding after the current file
+}
+
+func newCpioReader(reader io.Reader) *cpioReader {
+	return &cpioReader{reader: bufio.NewReader(reader)}
+}
+
+// Next skips the rest of the current file and reads the next header. At the trailer io.EOF is returned.
+func (r *cpioReader) Next() (header *cpioHeader, err error) {
+	if _, err = io.CopyN(ioutil.Discard, r.reader, r.remaining+r.padding); err != nil {
+		return nil, err
+	}
+	r.remaining, r.padding = 0, 0
+
+	magic, err := r.reader.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+
+	header = &cpioHeader{}
+	var nameSize, namePadding int64
+
+	switch string(magic) {
+	case "070701", "070702":
+		// newc: numbers are 8 hexadecimal digits. The name and the data are padded to 4 bytes.
+		data := make([]byte, cpioNewcHeaderSize)
+		if _, err = io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		field := func(offset int) (value int64) {
+			if err == nil {
+				value, err = strconv.ParseInt(string(data[offset:offset+8]), 16, 64)
+			}
+			return value
+		}
+
+		header.mode = uint32(field(14))
+		header.date = time.Unix(field(46), 0).UTC()
+		header.size = field(54)
+		nameSize = field(94)
+		namePadding = (4 - (cpioNewcHeaderSize+nameSize)%4) % 4
+		r.padding = (4 - header.size%4) % 4
+
+	case "070707":
+		// odc: numbers are octal, the date and size have 11 digits. There is no padding.
+		data := make([]byte, cpioOdcHeaderSize)
+		if _, err = io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		field := func(offset, length int) (value int64) {
+			if err == nil {
+				value, err = strconv.ParseInt(string(data[offset:offset+length]), 8, 64)
+			}
+			return value
+		}
+
+		header.mode = uint32(field(18, 6))
+		header.date = time.Unix(field(48, 11), 0).UTC()
+		nameSize = field(59, 6)
+		header.size = field(65, 11)
+
+	default:
+		return nil, errCPIOHeader
+	}
+
+	if err != nil || nameSize <= 0 || nameSize > cpioMaxNameSize || header.size < 0 {
+		return nil, errCPIOHeader
+	}
+
+	name := make([]byte, nameSize+namePadding)
+	if _, err = io.ReadFull(r.reader, name); err != nil {
+		return nil, err
+	}
+	header.name = string(name[:nameSize-1])
+	r.remaining = header.size
+
+	if header.name == cpioTrailer {
+		return nil, io.EOF
+	}
+
+	// The data of symbolic links is the target
+	if header.mode&0xF000 == 0xA000 && header.size <= cpioMaxLinkSize {
+		target := make([]byte, header.size)
+		if _, err = io.ReadFull(r, target); err != nil {
+			return nil, err
+		}
+		header.linkname = string(target)
+	}
+
+	return header, nil
+}
+
+// Read reads the data of the current file
+func (r *cpioReader) Read(p []byte) (n int, err error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err = r.reader.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
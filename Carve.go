@@ -0,0 +1,484 @@
+/*
+File Name:  Carve.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Carving of files from binary data without a file system, for example memory dumps, disk slack and corrupted containers.
+The data is searched for the headers of known formats. The end of each file is determined by its structure: the segments of JPEG, the chunks of PNG,
+the blocks of GIF, the sizes stored in BMP, OLE2 and archives, the footer of PDF, the closing brace of RTF and the end of the GZIP stream.
+Each candidate is validated with the parsers of this package, pictures are decoded. Headers within a carved file are ignored.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// CarvedFile is a file found by Carve
+type CarvedFile struct {
+	Format Format            // Format of the file. ZIP and OLE2 files are detected as documents if possible, for example DOCX or DOC.
+	Offset int64             // Offset of the file in the input
+	Size   int64             // Size of the file
+	Reader *io.SectionReader // Data of the file
+}
+
+// carveSignatures are the headers of the files. Archives are found via embeddedSignatures.
+var carveSignatures = []scanSignature{
+	{FormatJPEG, []byte{0xFF, 0xD8, 0xFF}, 0},
+	{FormatPNG, []byte("\x89PNG\r\n\x1A\n"), 0},
+	{FormatGIF, []byte("GIF87a"), 0},
+	{FormatGIF, []byte("GIF89a"), 0},
+	{FormatBMP, []byte("BM"), 0},
+	{FormatPDF, []byte("%PDF-"), 0},
+	{FormatRTF, []byte("{\\rtf1"), 0},
+	{FormatOLE2, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}, 0},
+	{FormatGZ, []byte{0x1F, 0x8B, 0x08}, 0},
+}
+
+// carveMaxSize is the max size of pictures and documents that are carved. They are validated by decoding them.
+const carveMaxSize = 64 << 20
+
+// Carve searches the data for files and calls the callback for each valid one with its offset. Supported are JPEG, PNG, GIF, BMP, PDF, RTF, OLE2 (DOC, XLS, PPT, MSG),
+// GZIP and the archives of ContainerFindEmbedded: ZIP (including DOCX, XLSX, PPTX, ODF and EPUB), RAR, 7Z, TAR and CAB.
+// The files are passed in order of their offset. Files within a carved file are not passed, for example a picture in a DOC file.
+// If the callback returns an error, carving stops and the error is returned. SkipAll stops it without error.
+// The limits of ContainerFindEmbedded apply to all signatures, if they are reached the files found so far are passed and ErrLimitReached is returned.
+func Carve(file io.ReaderAt, size int64, callback func(file *CarvedFile) error) (err error) {
+	return CarveContext(context.Background(), file, size, callback)
+}
+
+// CarveContext is the same as Carve, but stops once the context is cancelled and returns its error.
+// The pixels of pictures are charged to the budget of the context before decoding them. GZIP streams are decompressed to find their end,
+// the decompressed bytes are charged to the budget and decompression bombs stop carving with a *BombError (see WithBombLimits).
+func CarveContext(ctx context.Context, file io.ReaderAt, size int64, callback func(file *CarvedFile) error) (err error) {
+	signatures := append(append([]scanSignature(nil), carveSignatures...), embeddedSignatures...)
+	candidates, limitErr := scanSignatures(ctx, file, size, signatures)
+	if limitErr != nil && limitErr != ErrLimitReached {
+		return limitErr
+	}
+
+	end := int64(0)
+	validations := 0
+	for _, candidate := range candidates {
+		if candidate.Offset < end {
+			continue
+		} else if err = ctx.Err(); err != nil {
+			return err
+		} else if validations++; validations > scanMaxValidations {
+			return ErrLimitReached
+		}
+
+		format, fileSize, err := carveValidate(ctx, candidate, file, size)
+		if err != nil {
+			return err
+		} else if fileSize == 0 {
+			continue
+		}
+
+		if err = callback(&CarvedFile{Format: format, Offset: candidate.Offset, Size: fileSize, Reader: io.NewSectionReader(file, candidate.Offset, fileSize)}); err == SkipAll {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		end = candidate.Offset + fileSize
+	}
+
+	return limitErr
+}
+
+// carveValidate determines the end of the file and validates it. If the file is not valid, size 0 is returned.
+// An error is only returned if the context is cancelled, the budget is exceeded or a decompression bomb is detected.
+func carveValidate(ctx context.Context, candidate EmbeddedArchive, file io.ReaderAt, size int64) (format Format, fileSize int64, err error) {
+	defer func() {
+		// The parsers may panic on invalid files
+		if recover() != nil {
+			format, fileSize, err = candidate.Format, 0, nil
+		}
+	}()
+
+	remaining := size - candidate.Offset
+	header := make([]byte, 16)
+	n, _ := file.ReadAt(header, candidate.Offset)
+	header = header[:n]
+	format = candidate.Format
+
+	switch candidate.Format {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatBMP:
+		fileSize = carvePictureSize(candidate.Format, file, candidate.Offset, remaining)
+		if fileSize == 0 || fileSize > carveMaxSize {
+			return format, 0, nil
+		}
+
+		data := make([]byte, fileSize)
+		if _, err := file.ReadAt(data, candidate.Offset); err != nil {
+			return format, 0, nil
+		}
+		if excessive, err := IsExcessiveLargePicture(data); err != nil {
+			return format, 0, nil
+		} else if !excessive {
+			// Only the header of large pictures is validated
+			if err = pictureChargeBudget(ctx, data); err != nil {
+				return format, 0, err
+			} else if _, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+				return format, 0, nil
+			}
+		}
+
+	case FormatPDF:
+		if fileSize = carvePDFSize(file, candidate.Offset, remaining); fileSize == 0 || !IsFilePDF(header) {
+			return format, 0, nil
+		}
+		if _, _, err := pdfOpen(ctx, io.NewSectionReader(file, candidate.Offset, fileSize)); err != nil {
+			return format, 0, ctx.Err()
+		}
+
+	case FormatRTF:
+		if fileSize = carveRTFSize(file, candidate.Offset, remaining); fileSize == 0 || !IsFileRTF(header) {
+			return format, 0, nil
+		}
+		if _, err := RTF2TextContext(ctx, io.NewSectionReader(file, candidate.Offset, fileSize), ioutil.Discard, fileSize); err != nil {
+			return format, 0, ctx.Err()
+		}
+
+	case FormatOLE2:
+		if fileSize = carveOLE2Size(file, candidate.Offset, remaining); fileSize == 0 || !IsFileDOC(header) {
+			return format, 0, nil
+		}
+		var confidence int
+		if format, confidence = detectOLE2Format(io.NewSectionReader(file, candidate.Offset, fileSize), fileSize); confidence < ConfidenceStructure {
+			return format, 0, nil
+		}
+
+	case FormatGZ:
+		// The deflate stream is decompressed to find its end. The reader does not read ahead, since it implements io.ByteReader.
+		reader := &carveReader{reader: bufio.NewReader(io.NewSectionReader(file, candidate.Offset, remaining))}
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			return format, 0, nil
+		}
+		decompressor.Multistream(false)
+		// The ratio is checked against the compressed bytes read so far, the end of the stream is not known yet
+		tracker := &bombTracker{limits: bombLimitsFromContext(ctx), input: func() int64 { return reader.offset }}
+		bomb := tracker.reader("", 0, decompressor)
+		decompressed := decompressReader(ctx, bomb)
+		if _, err = io.Copy(ioutil.Discard, decompressed); decompressed.err != nil {
+			return format, 0, decompressed.err
+		} else if bomb.err != nil {
+			return format, 0, bomb.err
+		} else if err != nil {
+			return format, 0, ctx.Err()
+		}
+		fileSize = reader.offset
+
+	case FormatZIP:
+		if !IsFileZIP(header) {
+			return format, 0, nil
+		}
+		if fileSize = embeddedValidate(candidate, file, size); fileSize > 0 {
+			zipSize := candidate.Offset + fileSize - candidate.base
+			format, _ = detectZIPFormat(io.NewSectionReader(file, candidate.base, zipSize), zipSize)
+		}
+
+	default:
+		fileSize = embeddedValidate(candidate, file, size)
+	}
+
+	return format, fileSize, nil
+}
+
+// carveReader reads the structure of a file and counts the bytes read. Errors are sticky, once an error occurs all functions return 0.
+type carveReader struct {
+	reader *bufio.Reader
+	offset int64 // bytes read
+	err    error
+}
+
+func (r *carveReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *carveReader) ReadByte() (c byte, err error) {
+	if c, err = r.reader.ReadByte(); err == nil {
+		r.offset++
+	}
+	return c, err
+}
+
+// byte reads a single byte
+func (r *carveReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	var c byte
+	c, r.err = r.ReadByte()
+	return c
+}
+
+// bytes reads n bytes
+func (r *carveReader) bytes(n int) []byte {
+	data := make([]byte, n)
+	if r.err == nil {
+		_, r.err = io.ReadFull(r, data)
+	}
+	return data
+}
+
+// skip skips n bytes
+func (r *carveReader) skip(n int64) {
+	if r.err == nil {
+		var skipped int64
+		skipped, r.err = io.CopyN(ioutil.Discard, r.reader, n)
+		r.offset += skipped
+	}
+}
+
+// carvePictureSize returns the size of the picture via its structure. If it is invalid, 0 is returned.
+func carvePictureSize(format Format, file io.ReaderAt, offset, remaining int64) (size int64) {
+	r := &carveReader{reader: bufio.NewReader(io.NewSectionReader(file, offset, remaining))}
+
+	switch format {
+	case FormatJPEG:
+		// Segments start with a marker FF xx and most have a size. The entropy coded data after the start of scan segment (DA) ends with the next marker.
+		// Restart markers (D0 to D7) and stuffed zero bytes are part of the data. The picture ends with the marker D9.
+		r.skip(2)
+		marker := byte(0) // The marker that ended the entropy coded data, which is read already
+		for r.err == nil {
+			if marker == 0 {
+				if r.byte() != 0xFF {
+					return 0
+				}
+				marker = r.byte()
+			}
+			for marker == 0xFF && r.err == nil {
+				marker = r.byte()
+			}
+
+			switch {
+			case marker == 0xD9:
+				if r.err != nil {
+					return 0
+				}
+				return r.offset
+			case (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01:
+				marker = 0
+				continue
+			}
+
+			length := binary.BigEndian.Uint16(r.bytes(2))
+			if length < 2 {
+				return 0
+			}
+			r.skip(int64(length) - 2)
+
+			segment := marker
+			marker = 0
+			if segment == 0xDA {
+				for r.err == nil {
+					if r.byte() != 0xFF {
+						continue
+					}
+					if next := r.byte(); next != 0x00 && (next < 0xD0 || next > 0xD7) {
+						marker = next
+						break
+					}
+				}
+			}
+		}
+
+	case FormatPNG:
+		// Chunks have the size (4), type (4), data and CRC (4). The last chunk is IEND.
+		r.skip(8)
+		for r.err == nil {
+			chunk := r.bytes(8)
+			length := int64(binary.BigEndian.Uint32(chunk))
+			r.skip(length + 4)
+			if string(chunk[4:]) == "IEND" && r.err == nil {
+				return r.offset
+			}
+		}
+
+	case FormatGIF:
+		// Header (6), logical screen descriptor (7) and the global color table, followed by extension and image blocks and the trailer 3B.
+		// The data of blocks is stored in sub-blocks with a size byte, the last one has the size 0.
+		screen := r.bytes(13)
+		if screen[10]&0x80 != 0 {
+			r.skip(3 << (screen[10]&7 + 1))
+		}
+		subBlocks := func() {
+			for size := r.byte(); size != 0 && r.err == nil; size = r.byte() {
+				r.skip(int64(size))
+			}
+		}
+
+		for r.err == nil {
+			switch r.byte() {
+			case 0x21: // extension
+				r.byte()
+				subBlocks()
+			case 0x2C: // image descriptor, local color table, LZW code size and the data
+				descriptor := r.bytes(9)
+				if descriptor[8]&0x80 != 0 {
+					r.skip(3 << (descriptor[8]&7 + 1))
+				}
+				r.byte()
+				subBlocks()
+			case 0x3B:
+				if r.err != nil {
+					return 0
+				}
+				return r.offset
+			default:
+				return 0
+			}
+		}
+
+	case FormatBMP:
+		// The file header has the size of the file and the offset of the pixels, followed by the size of the info header
+		header := r.bytes(18)
+		size = int64(binary.LittleEndian.Uint32(header[2:]))
+		pixels := int64(binary.LittleEndian.Uint32(header[10:]))
+		switch binary.LittleEndian.Uint32(header[14:]) {
+		case 12, 40, 52, 56, 64, 108, 124:
+			if r.err == nil && binary.LittleEndian.Uint32(header[6:]) == 0 && pixels < size && size <= remaining {
+				return size
+			}
+		}
+	}
+
+	return 0
+}
+
+// carvePDFSize returns the size of the PDF. It ends with the last %%EOF marker before the next PDF or the max size. Incremental updates append a new %%EOF marker.
+func carvePDFSize(file io.ReaderAt, offset, remaining int64) (size int64) {
+	if remaining > carveMaxSize {
+		remaining = carveMaxSize
+	}
+	buffer := make([]byte, scanChunkSize+scanMaxSignature-1)
+
+	for chunk := int64(5); chunk < remaining; chunk += scanChunkSize {
+		n, err := file.ReadAt(buffer, offset+chunk)
+		if err != nil && err != io.EOF {
+			return size
+		} else if int64(n) > remaining-chunk {
+			n = int(remaining - chunk)
+		}
+		data := buffer[:n]
+
+		next := bytes.Index(data, []byte("%PDF-"))
+		if next >= 0 {
+			data = data[:next]
+		}
+		if end := bytes.LastIndex(data, []byte("%%EOF")); end >= 0 && end < scanChunkSize {
+			size = chunk + int64(end) + 5
+			// The marker is followed by the end of line
+			if rest := data[end+5:]; bytes.HasPrefix(rest, []byte("\r\n")) {
+				size += 2
+			} else if len(rest) > 0 && (rest[0] == '\n' || rest[0] == '\r') {
+				size++
+			}
+		}
+		if next >= 0 {
+			break
+		}
+	}
+
+	return size
+}
+
+// carveRTFSize returns the size of the RTF file. It ends with the brace that closes the first group. Escaped braces and backslashes are skipped.
+// RTF is text, control characters other than line breaks and tabs indicate binary data.
+func carveRTFSize(file io.ReaderAt, offset, remaining int64) (size int64) {
+	if remaining > carveMaxSize {
+		remaining = carveMaxSize
+	}
+	r := &carveReader{reader: bufio.NewReader(io.NewSectionReader(file, offset, remaining))}
+
+	for depth, escaped := 0, false; r.err == nil; {
+		c := r.byte()
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return 0
+		} else if escaped {
+			escaped = false
+			continue
+		}
+
+		switch c {
+		case '\\':
+			escaped = true
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 && r.err == nil {
+				return r.offset
+			}
+		}
+	}
+
+	return 0
+}
+
+// carveOLE2Size returns the size of the OLE2 file via its sector allocation table (FAT). The file ends with the last sector that is used.
+// The header has the first 109 sectors of the FAT, the others are listed in a chain of DIFAT sectors.
+func carveOLE2Size(file io.ReaderAt, offset, remaining int64) (size int64) {
+	header := make([]byte, 512)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return 0
+	}
+	shift := binary.LittleEndian.Uint16(header[30:])
+	if shift != 9 && shift != 12 {
+		return 0
+	}
+	sectorSize := int64(1) << shift
+	maxSectors := remaining / sectorSize
+	fatCount := int64(binary.LittleEndian.Uint32(header[44:]))
+	if fatCount > maxSectors {
+		return 0
+	}
+
+	var fatSectors []uint32
+	for n := 0; n < 109 && int64(len(fatSectors)) < fatCount; n++ {
+		fatSectors = append(fatSectors, binary.LittleEndian.Uint32(header[76+4*n:]))
+	}
+	sector := make([]byte, sectorSize)
+	for difat, n := binary.LittleEndian.Uint32(header[68:]), int64(0); int64(len(fatSectors)) < fatCount && n < maxSectors; n++ {
+		if int64(difat) >= maxSectors {
+			return 0
+		} else if _, err := file.ReadAt(sector, offset+(int64(difat)+1)*sectorSize); err != nil {
+			return 0
+		}
+		for m := int64(0); m < sectorSize/4-1 && int64(len(fatSectors)) < fatCount; m++ {
+			fatSectors = append(fatSectors, binary.LittleEndian.Uint32(sector[4*m:]))
+		}
+		difat = binary.LittleEndian.Uint32(sector[sectorSize-4:])
+	}
+
+	// The last entry that is not free (FFFFFFFF) is the last sector used
+	last := int64(-1)
+	for n, fatSector := range fatSectors {
+		if int64(fatSector) >= maxSectors {
+			return 0
+		} else if _, err := file.ReadAt(sector, offset+(int64(fatSector)+1)*sectorSize); err != nil {
+			return 0
+		}
+		for m := int64(0); m < sectorSize/4; m++ {
+			if binary.LittleEndian.Uint32(sector[4*m:]) != 0xFFFFFFFF {
+				last = int64(n)*sectorSize/4 + m
+			}
+		}
+	}
+
+	if last < 0 || last >= maxSectors {
+		return 0
+	}
+	return (last + 2) * sectorSize
+}
@@ -0,0 +1,219 @@
+/*
+File Name:  Charset.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Detection of the encoding of file names in archives that do not mark them as UTF-8. Old archivers store names in the OEM code page of the system,
+for example CP437 in Western Europe and the US, CP866 in Russia, Shift-JIS in Japan, GBK in China and EUC-KR in Korea.
+Each candidate is rated by how common the decoded characters are. Names that cannot be decoded rule out the candidate.
+Chinese and Korean share most byte ranges, lists of the most common characters in names tell them apart.
+*/
+
+package fileconversion
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// nameEncodings are the candidates for names that are not marked as UTF-8. Some archivers store UTF-8 without the mark. CP437 is the default of ZIP if none fits better.
+var nameEncodings = []struct {
+	name     string
+	encoding encoding.Encoding // nil for UTF-8
+}{
+	{"UTF-8", nil},
+	{"IBM437", charmap.CodePage437},
+	{"IBM866", charmap.CodePage866},
+	{"Shift_JIS", japanese.ShiftJIS},
+	{"GBK", simplifiedchinese.GBK},
+	{"EUC-KR", korean.EUCKR},
+}
+
+// Common characters in names, the most frequent ones in texts and words like "document", "photo" and "report"
+var (
+	nameCommonGBK = nameCommonCharacters(simplifiedchinese.GBK, "的一是不了人我在有他这中大来上国个到说们为子和你地出道也时年得就那要下以生会自着去之过家学对可里后小么心多天而能好都然没日于起还发成事只作当想看文无开手十用主行方又如前所本见经头面公同三已老从动两长知民样现分将外但身些与高意进把法此实回二理美点月明其种声全工己话者向情部正名定女问力机给等几很业最间新什打位因重被走电四第门相次东政海口使教西再平真听世气信北少关并内加化由代军产入先山五太水万市体别处总场师书比住员通目华报立马命张活难神数件安表原车白应路期死常提感金何更反合放做系计或司利受光王果亲界及今京务制解各任至清物台象记边共风战干接许八特觉望直服林题建南度统色字请交爱让认算论百义科元社术结六功指思非流每青管夫连远资队带花快条院变联言权往展该领传近留红治决周保达办运武半候七必城父强步完革深区即求品士转量空技程告江语英基片图夹档案料照简历录议稿单版号")
+
+	nameCommonEUCKR = nameCommonCharacters(korean.EUCKR, "이다의는에을하고가지기사한대로서자리를시도어정인적나수보일주전과아여국부상게해스그우제없있것들만내면동성문위구장라학소회연신방경오생화유비실물말요개계관공미세원무발되저중모안반조거명분데음년월날파록진료영드트터프크레메베션센템플폴더새력백업본최종수정목표용품질검토결과참고양식첨부견적청구영수증계약협력업무진행현황")
+)
+
+// nameCommonCharacters returns the encoded characters for a fast lookup. All characters must be encoded with 2 bytes.
+func nameCommonCharacters(e encoding.Encoding, characters string) (common map[uint16]bool) {
+	common = make(map[uint16]bool)
+	encoded, _ := e.NewEncoder().String(characters)
+	for n := 0; n+1 < len(encoded); n += 2 {
+		common[uint16(encoded[n])<<8|uint16(encoded[n+1])] = true
+	}
+	return common
+}
+
+// decodeNames detects the encoding of the names and decodes them. All names must use the same encoding.
+func decodeNames(names []string) (decoded []string, encodingName string) {
+	bestScore := 0
+	for n, candidate := range nameEncodings {
+		candidateNames := make([]string, len(names))
+		score := 0
+
+		for m, name := range names {
+			decodedName, err := name, error(nil)
+			if candidate.encoding != nil {
+				decodedName, err = candidate.encoding.NewDecoder().String(name)
+			}
+			if err != nil || !utf8.ValidString(decodedName) || strings.ContainsRune(decodedName, utf8.RuneError) {
+				score = -1 << 30
+				break
+			}
+			candidateNames[m] = decodedName
+			score += nameScore(candidate.name, []byte(name))
+		}
+
+		if n == 0 || score > bestScore {
+			decoded, encodingName, bestScore = candidateNames, candidate.name, score
+		}
+	}
+
+	return decoded, encodingName
+}
+
+// nameScore rates how common the characters of the name are in the encoding. Multi-byte characters are rated by their lead byte.
+// ASCII characters are neutral, rare characters and ones that are unlikely in names lower the score. Latin letters are common within words
+// of ASCII letters, while Cyrillic letters are not and CJK characters only sometimes.
+func nameScore(encodingName string, name []byte) (score int) {
+	previousLetter := false // The previous character is an ASCII letter. The previous byte may be the trail byte of a multi-byte character.
+
+	for n := 0; n < len(name); n++ {
+		c := name[n]
+		if c < 0x80 {
+			previousLetter = nameIsLetter(c)
+			continue
+		}
+
+		var next, after byte
+		if n+1 < len(name) {
+			next = name[n+1]
+		}
+		if n+2 < len(name) {
+			after = name[n+2]
+		}
+		letterBefore := previousLetter
+		withinWord := letterBefore || nameIsLetter(next)
+		previousLetter = false
+
+		switch encodingName {
+		case "UTF-8":
+			// Characters with 3 or 4 bytes are unlikely by chance. Of the 2-byte ones only Latin and Cyrillic letters are common.
+			character, size := utf8.DecodeRune(name[n:])
+			switch {
+			case size >= 3:
+				score += 6
+			case (character >= 0xC0 && character <= 0xFF) || (character >= 0x400 && character <= 0x45F):
+				score += 2
+			default:
+				score -= 2
+			}
+			n += size - 1
+
+		case "IBM437":
+			// Accented Latin letters, but not the box drawing characters and Greek letters
+			switch {
+			case !(c <= 0x9A || (c >= 0xA0 && c <= 0xA5) || c == 0xE1):
+				score--
+			case withinWord:
+				score += 2
+			default:
+				score++
+			}
+
+		case "IBM866":
+			// Cyrillic letters, lower case ones are more common
+			switch {
+			case withinWord:
+				score--
+			case (c >= 0xA0 && c <= 0xAF) || (c >= 0xE0 && c <= 0xEF) || c == 0xF1:
+				score += 2
+			case c <= 0x9F || c == 0xF0:
+				score++
+			default:
+				score--
+			}
+
+		case "Shift_JIS", "GBK", "EUC-KR":
+			if encodingName == "Shift_JIS" && c >= 0xA1 && c <= 0xDF {
+				// single-byte half-width katakana
+				score--
+				continue
+			}
+			n++
+
+			points := nameScoreDoubleByte(encodingName, c, next)
+			if points > 1 && (letterBefore || nameIsLetter(after)) {
+				points = 1
+			}
+			score += points
+		}
+	}
+
+	return score
+}
+
+// nameScoreDoubleByte rates a character of Shift-JIS, GBK or EUC-KR by the lead and trail byte
+func nameScoreDoubleByte(encodingName string, lead, trail byte) (points int) {
+	switch encodingName {
+	case "Shift_JIS":
+		switch {
+		case lead == 0x82 || lead == 0x83 || (lead >= 0x88 && lead <= 0x97): // hiragana, katakana and level 1 kanji
+			return 3
+		case (lead >= 0x98 && lead <= 0x9F) || (lead >= 0xE0 && lead <= 0xEA): // level 2 kanji
+			return 2
+		case lead == 0x81: // symbols
+			return 0
+		}
+
+	case "GBK":
+		switch {
+		case trail < 0xA1: // GBK extension
+		case nameCommonGBK[uint16(lead)<<8|uint16(trail)]:
+			return 4
+		case lead >= 0xB0 && lead <= 0xD7: // GB2312 level 1 hanzi, the most common ones
+			return 2
+		case lead >= 0xD8 && lead <= 0xF7: // GB2312 level 2 hanzi
+			return 1
+		case lead >= 0xA1 && lead <= 0xA9: // symbols
+			return 0
+		}
+
+	case "EUC-KR":
+		switch {
+		case trail < 0xA1: // extension of CP949
+		case nameCommonEUCKR[uint16(lead)<<8|uint16(trail)]:
+			return 4
+		case lead >= 0xB0 && lead <= 0xC8: // Hangul syllables of KS X 1001
+			return 2
+		case lead >= 0xA1 && lead <= 0xAF: // symbols
+			return 0
+		}
+		// hanja are rare in names
+	}
+
+	return -1
+}
+
+// nameIsLetter checks if the character is an ASCII letter
+func nameIsLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// nameIsASCII checks if the name only contains ASCII characters, which are the same in all supported encodings
+func nameIsASCII(name string) bool {
+	for n := 0; n < len(name); n++ {
+		if name[n] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
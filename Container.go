@@ -0,0 +1,215 @@
+/*
+File Name:  Container.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Recursive extraction of containers. Archives (ZIP, RAR, 7Z, TAR) are extracted and compressed files (GZ, BZ2, XZ) decompressed,
+again for every file they contain, until only regular files are left. ZIP based documents like DOCX are not extracted.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultWalkDepth is the max nesting depth used if WalkOptions.MaxDepth is 0
+const DefaultWalkDepth = 8
+
+// WalkPathSeparator separates the names of nested containers in WalkFile.Path
+const WalkPathSeparator = "!"
+
+// WalkOptions limits the recursive extraction. A limit of 0 means no limit, except for MaxDepth.
+type WalkOptions struct {
+	MaxDepth     int   // Max nesting depth. Containers at this depth are not extracted, they are passed to the callback as file. 0 uses DefaultWalkDepth.
+	MaxFiles     int64 // Max number of files extracted from containers, including nested containers
+	MaxTotalSize int64 // Max total bytes of all extracted and decompressed files, including nested containers. The bytes are counted while extracting.
+}
+
+// WalkFile is a file found by ContainerWalk
+type WalkFile struct {
+	Path  string    // Full path including the names of all containers, for example "outer.zip!inner.7z!doc.docx"
+	Name  string    // Name of the file in its container
+	Depth int       // Nesting depth, 0 for the input itself
+	Date  time.Time // Date stored in the container, if available
+	Data  []byte
+}
+
+// ContainerWalk extracts containers and decompresses compressed files recursively. The callback is called for every file that is not a container, including the input itself if it is none.
+// Name is the name of the input file, it is used as first part of the paths.
+// Once MaxFiles or MaxTotalSize is exceeded the walk stops and ErrLimitReached is returned.
+// Decompression bombs, including containers that contain themselves, stop the walk with ErrDecompressionBomb.
+func ContainerWalk(data []byte, name string, options WalkOptions, callback func(file WalkFile)) (err error) {
+	return ContainerWalkContext(context.Background(), data, name, options, callback)
+}
+
+// ContainerWalkContext is the same as ContainerWalk, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes of all levels.
+func ContainerWalkContext(ctx context.Context, data []byte, name string, options WalkOptions, callback func(file WalkFile)) (err error) {
+	if options.MaxDepth <= 0 {
+		options.MaxDepth = DefaultWalkDepth
+	}
+
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// MaxTotalSize is enforced via a budget, which counts the bytes while they are read
+	walker := &containerWalker{ctx: walkCtx, cancel: cancel, options: options, callback: callback, total: &Budget{MaxDecompressed: options.MaxTotalSize}}
+	walker.walk(data, name, name, time.Time{}, 0, nil)
+
+	if walker.err != nil {
+		return walker.err
+	}
+
+	return ctx.Err()
+}
+
+// containerWalker holds the state of a recursive walk
+type containerWalker struct {
+	ctx      context.Context
+	cancel   context.CancelFunc // cancels the extraction once a limit is reached
+	options  WalkOptions
+	callback func(file WalkFile)
+	files    int64   // files extracted so far
+	total    *Budget // bytes extracted and decompressed so far
+	err      error   // error that stopped the walk
+}
+
+// walk extracts the data if it is a container, otherwise passes it to the callback.
+// Parents are the hashes of the containers that contain the data. If the data is one of them, the container contains itself.
+func (walker *containerWalker) walk(data []byte, name, filePath string, date time.Time, depth int, parents [][sha256.Size]byte) {
+	if walker.err != nil {
+		return
+	}
+
+	if depth < walker.options.MaxDepth {
+		format, _ := DetectFormat(bytes.NewReader(data), int64(len(data)))
+
+		switch format {
+		case FormatGZ, FormatBZ2, FormatXZ, FormatZSTD, FormatLZ4, FormatLZIP, FormatLZMA, FormatZ, FormatZlib, FormatZIP, FormatRAR, Format7Z, FormatTAR, FormatISO, FormatUDF, FormatCAB, FormatCPIO, FormatAR, FormatDEB, FormatRPM:
+			hash := sha256.Sum256(data)
+			for _, parent := range parents {
+				if hash == parent {
+					walker.stop(&ConversionError{Format: format, Kind: ErrDecompressionBomb, Err: &BombError{Reason: BombQuine, Name: filePath, Files: walker.files, Decompressed: walker.total.decompressed}})
+					return
+				}
+			}
+			parents = append(parents, hash)
+		}
+
+		switch format {
+		case FormatGZ, FormatBZ2, FormatXZ, FormatZSTD, FormatLZ4, FormatLZIP, FormatLZMA, FormatZ, FormatZlib:
+			var decompressed []byte
+			reader, _, err := DecompressReaderContext(walker.ctx, bytes.NewReader(data))
+			if err == nil {
+				decompressed, err = walker.read(reader)
+			}
+			if err == nil {
+				decompressedName := walkDecompressedName(name)
+				walker.walk(decompressed, decompressedName, filePath+WalkPathSeparator+decompressedName, date, depth+1, parents)
+				return
+			} else if walkInvalid(err) {
+				err = walker.ctx.Err()
+			}
+			if err != nil {
+				walker.stop(err)
+				return
+			}
+			// Invalid compressed files are passed to the callback.
+
+		case FormatZIP, FormatRAR, Format7Z, FormatTAR, FormatISO, FormatUDF, FormatCAB, FormatCPIO, FormatAR, FormatDEB, FormatRPM:
+			extracted := 0
+			err := ContainerExtractReaderContext(walker.ctx, bytes.NewReader(data), int64(len(data)), func(file *ContainerFile) error {
+				if file.Err != nil || file.Symlink || file.Hardlink {
+					return nil
+				}
+
+				memberData, err := walker.read(file.Reader)
+				if err != nil {
+					if err == ErrLimitReached || errors.Is(err, ErrBudgetExceeded) || errors.Is(err, ErrDecompressionBomb) || walker.ctx.Err() != nil {
+						return err
+					}
+					// If the file is encrypted with a password, this fails here.
+					return nil
+				}
+
+				extracted++
+				if walker.charge(1) {
+					walker.walk(memberData, file.Name, filePath+WalkPathSeparator+file.Name, file.Date, depth+1, parents)
+				}
+				return walker.err
+			})
+			if err != nil && walkInvalid(err) {
+				err = walker.ctx.Err()
+			}
+			if err != nil {
+				walker.stop(err)
+				return
+			} else if extracted > 0 {
+				return
+			}
+			// Containers without any file that could be extracted (invalid or encrypted) are passed to the callback.
+		}
+	}
+
+	walker.callback(WalkFile{Path: filePath, Name: name, Depth: depth, Date: date, Data: data})
+}
+
+// charge counts the files. If MaxFiles is exceeded, the walk is stopped and false is returned.
+func (walker *containerWalker) charge(files int64) bool {
+	walker.files += files
+
+	if walker.options.MaxFiles > 0 && walker.files > walker.options.MaxFiles {
+		walker.stop(ErrLimitReached)
+		return false
+	}
+
+	return true
+}
+
+// read reads an extracted or decompressed file. The bytes are counted while reading, a single large file stops the walk once MaxTotalSize is exceeded.
+func (walker *containerWalker) read(reader io.Reader) (data []byte, err error) {
+	counter := &budgetReader{budget: walker.total, reader: reader}
+
+	if data, err = ioutil.ReadAll(counter); counter.err != nil {
+		walker.stop(ErrLimitReached)
+		return nil, ErrLimitReached
+	}
+
+	return data, err
+}
+
+// walkInvalid checks if the error is caused by an invalid or unsupported file. Such files are passed to the callback, other errors stop the walk.
+func walkInvalid(err error) bool {
+	return errors.Is(err, ErrUnsupportedFormat) || errors.Is(err, ErrCorrupt) || errors.Is(err, ErrUnsupportedVersion)
+}
+
+// stop stops the walk with the error. Only the first error is kept, the ones caused by stopping are ignored.
+func (walker *containerWalker) stop(err error) {
+	if walker.err == nil {
+		walker.err = err
+		walker.cancel()
+	}
+}
+
+// walkDecompressedName returns the name of a decompressed file by removing the extension of the compression. Names without a known extension are returned as they are.
+func walkDecompressedName(name string) string {
+	extension := path.Ext(name)
+
+	switch strings.ToLower(extension) {
+	case ".gz", ".gzip", ".bz2", ".bz", ".xz", ".zst", ".lz4", ".lz", ".lzma", ".z", ".zlib":
+		return strings.TrimSuffix(name, extension)
+	case ".tgz", ".tbz2", ".tbz", ".txz", ".tzst", ".tlz", ".taz", ".tz":
+		return strings.TrimSuffix(name, extension) + ".tar"
+	}
+
+	return name
+}
@@ -0,0 +1,64 @@
+/*
+File Name:  Context.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Readers that fail once the context is cancelled or the deadline is exceeded.
+They are used by the Context variants of the converters, so that 3rd party parsers abort when reading the input.
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader is a reader that checks the context on every read
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.reader.Read(p)
+}
+
+// contextReaderAt is a ReaderAt that checks the context on every read
+type contextReaderAt struct {
+	ctx    context.Context
+	reader io.ReaderAt
+}
+
+func (r *contextReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.reader.ReadAt(p, off)
+}
+
+// contextReadSeeker is a ReadSeeker that checks the context on every read
+type contextReadSeeker struct {
+	ctx    context.Context
+	reader io.ReadSeeker
+}
+
+func (r *contextReadSeeker) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.reader.Read(p)
+}
+
+func (r *contextReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.reader.Seek(offset, whence)
+}
+
+// contextCheckInterval is the amount of loop iterations between context checks in tight loops
+const contextCheckInterval = 1024
@@ -1,200 +1,2343 @@
-/*
-File Name:  Conversion_test.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-*/
-
-package fileconversion
-
-import (
-	"bytes"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"testing"
-)
-
-func TestXLS(t *testing.T) {
-	// open local file to extract text and output to command line
-	file, err := os.Open("test.xls")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-
-	XLS2Text(file, os.Stdout, 1*1024*1024)
-}
-
-func TestPPTX(t *testing.T) {
-	// open local file to extract text and output to command line
-	file, err := os.Open("test.pptx")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-
-	stat, _ := file.Stat()
-
-	text, _ := PPTX2Text(file, stat.Size())
-	fmt.Print(text)
-}
-
-func TestODS(t *testing.T) {
-	// open local file to extract text and output to command line
-	file, err := os.Open("test.ods")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-	stat, _ := file.Stat()
-
-	ODS2Text(file, stat.Size(), os.Stdout, 1*1024*1024)
-}
-
-func TestExcelCell(t *testing.T) {
-	file1, err := os.Open("test.xls")
-	if err == nil {
-		cells, _ := XLS2Cells(file1)
-		for n, cell := range cells {
-			fmt.Printf("%s\n", cell)
-			if n > 20 {
-				break
-			}
-		}
-
-		file1.Close()
-	}
-
-	file1, err = os.Open("test.xlsx")
-	if err == nil {
-		stat, _ := file1.Stat()
-		cells, _ := XLSX2Cells(file1, stat.Size(), 1000)
-		for n, cell := range cells {
-			fmt.Printf("%s\n", cell)
-			if n > 20 {
-				break
-			}
-		}
-
-		file1.Close()
-	}
-
-	file1, err = os.Open("test.ods")
-	if err == nil {
-		stat, _ := file1.Stat()
-		cells, _ := ODS2Cells(file1, stat.Size())
-		for n, cell := range cells {
-			fmt.Printf("%s\n", cell)
-			if n > 20 {
-				break
-			}
-		}
-
-		file1.Close()
-	}
-
-}
-
-func TestCSV(t *testing.T) {
-	file, err := os.Open("test.txt")
-	if err != nil {
-		return
-	}
-	defer file.Close()
-
-	content, _ := ioutil.ReadAll(file)
-
-	IsCSV(content)
-}
-
-func TestEPUB(t *testing.T) {
-	// open local file to extract text and output to command line
-	file, err := os.Open("moby-dick.epub")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-
-	stat, _ := file.Stat()
-
-	text, _ := EPUB2Text(file, stat.Size(), 1000)
-	fmt.Print(text)
-}
-
-func TestMOBI(t *testing.T) {
-	// open local file to extract text and output to command line
-	file, err := os.Open("windows-1252.mobi")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-
-	text, _ := Mobi2Text(file)
-	fmt.Print(text)
-}
-
-func TestPDFImage(t *testing.T) {
-	// open local file to extract images
-	file, err := os.Open("test.pdf")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-
-	images, _ := PDFExtractImages(file)
-	fmt.Print(len(images))
-}
-
-func TestPD2Text(t *testing.T) {
-	file, err := os.Open("1.pdf")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-
-	buffer := bytes.NewBuffer(make([]byte, 0, 2*1024))
-	PDFListContentStreams(file, buffer, 2*1024)
-
-	fmt.Println(buffer.String())
-}
-
-func TestODTText(t *testing.T) {
-	file, err := os.Open("Test\\file-sample_500kB.odt")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-	stat, _ := file.Stat()
-
-	buffer := bytes.NewBuffer(make([]byte, 0, 2*1024))
-
-	ODT2Text(file, stat.Size(), buffer, 2*1024)
-
-	fmt.Println(buffer.String())
-}
-
-// TestXLSX extracts text from an XLSX file.
-// Memory usage: 100 rows = 52 MB, 500 rows = 200 MB, 1000 rows = 400 MB, 2000/5000/10000/-1 rows = 700 MB
-func TestXLSX(t *testing.T) {
-	file, err := os.Open("Test\\971bd55b-5cbd-43d2-899e-d4a2a7d0a883.xlsx")
-	if err != nil {
-		return
-	}
-
-	defer file.Close()
-	stat, _ := file.Stat()
-
-	buffer := bytes.NewBuffer(make([]byte, 0, 2*1024))
-
-	XLSX2Text(file, stat.Size(), buffer, 2*1024, -1)
-
-	fmt.Println(buffer.String())
-}
+/*
+File Name:  Conversion_test.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+*/
+
+package fileconversion
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/sorairolake/lzip-go"
+	"github.com/ulikunitz/xz/lzma"
+	"golang.org/x/image/bmp"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestXLS(t *testing.T) {
+	// open local file to extract text and output to command line
+	file, err := os.Open("test.xls")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	XLS2Text(file, os.Stdout, 1*1024*1024)
+}
+
+func TestPPTX(t *testing.T) {
+	// open local file to extract text and output to command line
+	file, err := os.Open("test.pptx")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	stat, _ := file.Stat()
+
+	text, _ := PPTX2Text(file, stat.Size())
+	fmt.Print(text)
+}
+
+func TestODS(t *testing.T) {
+	// open local file to extract text and output to command line
+	file, err := os.Open("test.ods")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+	stat, _ := file.Stat()
+
+	ODS2Text(file, stat.Size(), os.Stdout, 1*1024*1024)
+}
+
+func TestExcelCell(t *testing.T) {
+	file1, err := os.Open("test.xls")
+	if err == nil {
+		cells, _ := XLS2Cells(file1)
+		for n, cell := range cells {
+			fmt.Printf("%s\n", cell)
+			if n > 20 {
+				break
+			}
+		}
+
+		file1.Close()
+	}
+
+	file1, err = os.Open("test.xlsx")
+	if err == nil {
+		stat, _ := file1.Stat()
+		cells, _ := XLSX2Cells(file1, stat.Size(), 1000)
+		for n, cell := range cells {
+			fmt.Printf("%s\n", cell)
+			if n > 20 {
+				break
+			}
+		}
+
+		file1.Close()
+	}
+
+	file1, err = os.Open("test.ods")
+	if err == nil {
+		stat, _ := file1.Stat()
+		cells, _ := ODS2Cells(file1, stat.Size())
+		for n, cell := range cells {
+			fmt.Printf("%s\n", cell)
+			if n > 20 {
+				break
+			}
+		}
+
+		file1.Close()
+	}
+
+}
+
+func TestCSV(t *testing.T) {
+	file, err := os.Open("test.txt")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	content, _ := ioutil.ReadAll(file)
+
+	IsCSV(content)
+}
+
+func TestEPUB(t *testing.T) {
+	// open local file to extract text and output to command line
+	file, err := os.Open("moby-dick.epub")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	stat, _ := file.Stat()
+
+	text, _ := EPUB2Text(file, stat.Size(), 1000)
+	fmt.Print(text)
+}
+
+func TestMOBI(t *testing.T) {
+	// open local file to extract text and output to command line
+	file, err := os.Open("windows-1252.mobi")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	text, _ := Mobi2Text(file)
+	fmt.Print(text)
+}
+
+func TestPDFImage(t *testing.T) {
+	// open local file to extract images
+	file, err := os.Open("test.pdf")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	images, _ := PDFExtractImages(file)
+	fmt.Print(len(images))
+}
+
+func TestPD2Text(t *testing.T) {
+	file, err := os.Open("1.pdf")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	buffer := bytes.NewBuffer(make([]byte, 0, 2*1024))
+	PDFListContentStreams(file, buffer, 2*1024)
+
+	fmt.Println(buffer.String())
+}
+
+func TestODTText(t *testing.T) {
+	file, err := os.Open("Test\\file-sample_500kB.odt")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+	stat, _ := file.Stat()
+
+	buffer := bytes.NewBuffer(make([]byte, 0, 2*1024))
+
+	ODT2Text(file, stat.Size(), buffer, 2*1024)
+
+	fmt.Println(buffer.String())
+}
+
+// TestXLSX extracts text from an XLSX file.
+// Memory usage: 100 rows = 52 MB, 500 rows = 200 MB, 1000 rows = 400 MB, 2000/5000/10000/-1 rows = 700 MB
+func TestXLSX(t *testing.T) {
+	file, err := os.Open("Test\\971bd55b-5cbd-43d2-899e-d4a2a7d0a883.xlsx")
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+	stat, _ := file.Stat()
+
+	buffer := bytes.NewBuffer(make([]byte, 0, 2*1024))
+
+	XLSX2Text(file, stat.Size(), buffer, 2*1024, -1)
+
+	fmt.Println(buffer.String())
+}
+
+// testZIPFiles creates a ZIP file with pairs of file name and content
+func testZIPFiles(files ...string) []byte {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for n := 0; n+1 < len(files); n += 2 {
+		fileWriter, _ := writer.Create(files[n])
+		fileWriter.Write([]byte(files[n+1]))
+	}
+	writer.Close()
+	return archive.Bytes()
+}
+
+// testOLE2 creates an OLE2 compound file with the streams in the root storage. The first sector is the FAT, the second one the directory with up to 3 streams.
+// Streams are padded to the mini stream cutoff of 4 KB, so they are stored in regular sectors.
+func testOLE2(names []string, streams [][]byte) []byte {
+	const noStream, endOfChain, fatSector, free = 0xFFFFFFFF, 0xFFFFFFFE, 0xFFFFFFFD, 0xFFFFFFFF
+
+	fat := []uint32{fatSector, endOfChain}
+	directory := make([]byte, 512)
+	entry := func(n int, name string, entryType byte, right, child, start, size uint32) {
+		e := directory[n*128:]
+		name16 := utf16.Encode([]rune(name))
+		for m, c := range name16 {
+			binary.LittleEndian.PutUint16(e[2*m:], c)
+		}
+		binary.LittleEndian.PutUint16(e[64:], uint16(2*len(name16)+2))
+		e[66], e[67] = entryType, 1
+		binary.LittleEndian.PutUint32(e[68:], noStream)
+		binary.LittleEndian.PutUint32(e[72:], right)
+		binary.LittleEndian.PutUint32(e[76:], child)
+		binary.LittleEndian.PutUint32(e[116:], start)
+		binary.LittleEndian.PutUint32(e[120:], size)
+	}
+	entry(0, "Root Entry", 5, noStream, 1, endOfChain, 0)
+
+	var data bytes.Buffer
+	for n, stream := range streams {
+		padded := (len(stream) + 511) / 512 * 512
+		if padded < 4096 {
+			padded = 4096
+		}
+		right := uint32(noStream)
+		if n+1 < len(streams) {
+			right = uint32(n + 2)
+		}
+		entry(n+1, names[n], 2, right, noStream, uint32(len(fat)), uint32(padded))
+
+		for m := 0; m < padded/512; m++ {
+			if m+1 < padded/512 {
+				fat = append(fat, uint32(len(fat)+1))
+			} else {
+				fat = append(fat, endOfChain)
+			}
+		}
+		data.Write(stream)
+		data.Write(make([]byte, padded-len(stream)))
+	}
+
+	header := make([]byte, 512)
+	copy(header, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+	binary.LittleEndian.PutUint16(header[24:], 0x3E)
+	binary.LittleEndian.PutUint16(header[26:], 3)
+	binary.LittleEndian.PutUint16(header[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(header[30:], 9)
+	binary.LittleEndian.PutUint16(header[32:], 6)
+	binary.LittleEndian.PutUint32(header[44:], 1)
+	binary.LittleEndian.PutUint32(header[48:], 1)
+	binary.LittleEndian.PutUint32(header[56:], 4096)
+	binary.LittleEndian.PutUint32(header[60:], endOfChain)
+	binary.LittleEndian.PutUint32(header[68:], endOfChain)
+	for n := 0; n < 109; n++ {
+		binary.LittleEndian.PutUint32(header[76+4*n:], free)
+	}
+	binary.LittleEndian.PutUint32(header[76:], 0)
+
+	fatData := make([]byte, 512)
+	for n := 0; n < 128; n++ {
+		value := uint32(free)
+		if n < len(fat) {
+			value = fat[n]
+		}
+		binary.LittleEndian.PutUint32(fatData[4*n:], value)
+	}
+
+	return append(append(append(header, fatData...), directory...), data.Bytes()...)
+}
+
+// testPDF creates a PDF file with the objects, which are numbered starting at 1. The first object is the catalog. Trailer has additional entries of the trailer.
+func testPDF(trailer string, objects ...string) []byte {
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for n, object := range objects {
+		offsets[n] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", n+1, object)
+	}
+
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailer, xref)
+	return pdf.Bytes()
+}
+
+// testPDFText are the objects of a PDF file with a single page with the text
+func testPDFText(text string) []string {
+	content := "BT /F1 12 Tf 10 100 Td (" + text + ") Tj ET"
+	return []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 200] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+}
+
+// testPDFEncrypted creates a PDF file encrypted with the standard security handler (revision 2, RC4 with 40 bits) and the user password
+func testPDFEncrypted(password string) []byte {
+	padding := []byte{0x28, 0xBF, 0x4E, 0x5E, 0x4E, 0x75, 0x8A, 0x41, 0x64, 0x00, 0x4E, 0x56, 0xFF, 0xFA, 0x01, 0x08, 0x2E, 0x2E, 0x00, 0xB6, 0xD0, 0x68, 0x3E, 0x80, 0x2F, 0x0C, 0xA9, 0xFE, 0x64, 0x53, 0x69, 0x7A}
+	pad := func(password string) []byte { return append([]byte(password), padding...)[:32] }
+	rc4Encrypt := func(key, data []byte) []byte {
+		cipher, _ := rc4.NewCipher(key)
+		encrypted := make([]byte, len(data))
+		cipher.XORKeyStream(encrypted, data)
+		return encrypted
+	}
+	id := []byte("0123456789abcdef")
+	permissions := int32(-4)
+
+	ownerKey := md5.Sum(pad("owner"))
+	owner := rc4Encrypt(ownerKey[:5], pad(password))
+	hash := md5.New()
+	hash.Write(pad(password))
+	hash.Write(owner)
+	binary.Write(hash, binary.LittleEndian, permissions)
+	hash.Write(id)
+	user := rc4Encrypt(hash.Sum(nil)[:5], padding)
+
+	objects := append(testPDFText(""), fmt.Sprintf("<< /Filter /Standard /V 1 /R 2 /O <%x> /U <%x> /P %d >>", owner, user, permissions))
+	return testPDF(fmt.Sprintf("/Encrypt %d 0 R /ID [<%x> <%x>]", len(objects), id, id), objects...)
+}
+
+// testBIFFRecord creates a record of the workbook stream of an XLS file
+func testBIFFRecord(id uint16, data []byte) []byte {
+	record := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint16(record, id)
+	binary.LittleEndian.PutUint16(record[2:], uint16(len(data)))
+	return append(record, data...)
+}
+
+// testXLSWorkbook is the workbook stream of an XLS file with the BIFF8 header and the records, followed by the end of the workbook globals
+func testXLSWorkbook(records ...[]byte) []byte {
+	workbook := testBIFFRecord(0x809, []byte{0x00, 0x06, 0x05, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	for _, record := range records {
+		workbook = append(workbook, record...)
+	}
+	return append(workbook, testBIFFRecord(0x0A, nil)...)
+}
+
+func TestDetectFormat(t *testing.T) {
+	contentTypes := `<?xml version="1.0"?><Types><Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/></Types>`
+
+	for _, test := range []struct {
+		name       string
+		data       []byte
+		format     Format
+		confidence int
+	}{
+		{"docx", testZIPFiles("[Content_Types].xml", contentTypes, "word/document.xml", ""), FormatDOCX, ConfidenceDeclared},
+		{"xlsx structure", testZIPFiles("xl/workbook.xml", ""), FormatXLSX, ConfidenceStructure},
+		{"odt", testZIPFiles("mimetype", "application/vnd.oasis.opendocument.text", "content.xml", ""), FormatODT, ConfidenceDeclared},
+		{"ods template", testZIPFiles("mimetype", "application/vnd.oasis.opendocument.spreadsheet-template"), FormatODS, ConfidenceDeclared},
+		{"odp", testZIPFiles("mimetype", "application/vnd.oasis.opendocument.presentation"), FormatODP, ConfidenceDeclared},
+		{"unknown odf", testZIPFiles("mimetype", "application/vnd.oasis.opendocument.graphics"), FormatZIP, ConfidenceStructure},
+		{"oversized odf mimetype", testZIPFiles("mimetype", "application/vnd.oasis.opendocument.text"+strings.Repeat(" ", 2048)), FormatZIP, ConfidenceStructure},
+		{"epub", testZIPFiles("mimetype", "application/epub+zip", "META-INF/container.xml", ""), FormatEPUB, ConfidenceDeclared},
+		{"zip", testZIPFiles("file.txt", "text"), FormatZIP, ConfidenceStructure},
+		{"corrupt zip", []byte("PK\x03\x04 corrupt"), FormatZIP, ConfidenceSignature},
+		{"pdf", []byte("%PDF-1.4\n"), FormatPDF, ConfidenceSignature},
+		{"rtf", []byte(`{\rtf1\ansi text}`), FormatRTF, ConfidenceSignature},
+		{"tar", append(make([]byte, 257), "ustar\x0000"...), FormatTAR, ConfidenceSignature},
+		{"html", []byte("<html><body>text</body></html>"), FormatHTML, ConfidenceLow},
+		{"text", []byte("plain text"), FormatUnknown, ConfidenceNone},
+	} {
+		format, confidence := DetectFormat(bytes.NewReader(test.data), int64(len(test.data)))
+		if format != test.format || confidence < test.confidence {
+			t.Errorf("%s: expected %s with confidence %d, got %s (%d%%)", test.name, test.format, test.confidence, format, confidence)
+		}
+	}
+}
+
+func TestRTF2TextWriterLimit(t *testing.T) {
+	input := `{\rtf1\ansi Gr\u252?\'fc\'dfe 荤?}`
+
+	for limit := int64(0); limit < 12; limit++ {
+		var buffer bytes.Buffer
+		written, err := RTF2TextWriter(strings.NewReader(input), &buffer, limit)
+
+		if !utf8.Valid(buffer.Bytes()) || written != int64(buffer.Len()) || written > limit {
+			t.Errorf("limit %d: invalid output %q", limit, buffer.String())
+		}
+		if err != ErrLimitReached && limit < int64(len(RTF2Text(input))) {
+			t.Errorf("limit %d: expected ErrLimitReached, got %v", limit, err)
+		}
+	}
+}
+
+func TestConvertLimit(t *testing.T) {
+	rtf := []byte(`{\rtf1\ansi Hello Gr\'fc\'dfe}`)
+	docx := testZIPFiles("word/document.xml", `<w:document><w:body><w:p><w:r><w:t>Hello World</w:t></w:r></w:p></w:body></w:document>`)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		limit     int64
+		format    Format
+		output    string
+		truncated bool
+	}{
+		{"RTF unlimited", rtf, 0, FormatRTF, "Hello Grüße", false},
+		{"RTF truncated", rtf, 5, FormatRTF, "Hello", true},
+		{"RTF truncated in character", rtf, 9, FormatRTF, "Hello Gr", true},
+		{"RTF exact limit", rtf, 13, FormatRTF, "Hello Grüße", false},
+		{"DOCX truncated", docx, 7, FormatDOCX, "Hello W", true},
+		{"DOCX new-line truncated", docx, 11, FormatDOCX, "Hello World", true},
+		{"DOCX exact limit", docx, 12, FormatDOCX, "Hello World\n", false},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		result := Convert(context.Background(), bytes.NewReader(test.data), int64(len(test.data)), &output, Options{Limit: test.limit})
+
+		if result.Err != nil || result.Format != test.format || result.Truncated != test.truncated || result.Written != int64(len(test.output)) || output.String() != test.output {
+			t.Errorf("%s: unexpected result %+v: %q", test.name, result, output.String())
+		}
+	}
+}
+
+type panicConverter struct{}
+
+func (converter panicConverter) Detect(file io.ReaderAt, size int64) (confidence int) {
+	panic("detect")
+}
+
+func (converter panicConverter) Convert(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	var sat []int32
+	return int64(sat[1]), nil
+}
+
+func TestConvertPanic(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("panic", panicConverter{})
+
+	input := strings.NewReader("test")
+	result := registry.Convert(context.Background(), input, input.Size(), ioutil.Discard, Options{Format: "panic"})
+
+	var panicErr *PanicError
+	if !errors.Is(result.Err, ErrParserPanic) || !errors.As(result.Err, &panicErr) {
+		t.Fatalf("expected ErrParserPanic, got %v", result.Err)
+	}
+	if !strings.HasPrefix(panicErr.Stack, "github.com/IntelligenceX/fileconversion.panicConverter.Convert(") {
+		t.Errorf("stack does not start at the panicking function:\n%s", panicErr.Stack)
+	}
+
+	if format, _ := registry.Detect(input, input.Size()); format != FormatUnknown {
+		t.Errorf("expected unknown format, got %s", format)
+	}
+}
+
+// textConverter is a custom converter that writes the text. It detects files that start with the prefix.
+type textConverter struct {
+	prefix string
+	text   string
+}
+
+func (converter textConverter) Detect(file io.ReaderAt, size int64) (confidence int) {
+	header := make([]byte, len(converter.prefix))
+	if n, _ := file.ReadAt(header, 0); n == len(header) && string(header) == converter.prefix {
+		return ConfidenceDeclared
+	}
+	return ConfidenceNone
+}
+
+func (converter textConverter) Convert(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	n, err := io.WriteString(writer, converter.text)
+	return int64(n), err
+}
+
+func TestRegistry(t *testing.T) {
+	// A custom converter replaces the built-in PDF converter
+	Register(FormatPDF, textConverter{text: "custom PDF"})
+	defer Register(FormatPDF, newBuiltinConverter(FormatPDF))
+
+	pdf := []byte("%PDF-1.4\n")
+	var output bytes.Buffer
+	result := Convert(context.Background(), bytes.NewReader(pdf), int64(len(pdf)), &output, Options{})
+	if result.Err != nil || result.Format != FormatPDF || output.String() != "custom PDF" {
+		t.Errorf("expected the custom PDF converter, got %q: %+v", output.String(), result)
+	}
+
+	// Unregister restores the built-in converter, which rejects the invalid PDF
+	DefaultRegistry.Unregister(FormatPDF)
+	output.Reset()
+	result = Convert(context.Background(), bytes.NewReader(pdf), int64(len(pdf)), &output, Options{})
+	if !errors.Is(result.Err, ErrCorrupt) || output.Len() != 0 {
+		t.Errorf("expected the built-in PDF converter, got %q: %+v", output.String(), result)
+	}
+	if converter, isBuiltin := DefaultRegistry.Converter(FormatPDF).(*builtinConverter); !isBuiltin || converter.format != FormatPDF {
+		t.Errorf("expected the built-in PDF converter to be registered")
+	}
+
+	// The detection of a custom converter wins for an unknown format
+	registry := NewRegistry()
+	registry.Register("custom", textConverter{prefix: "CUSTOM", text: "custom text"})
+	custom := []byte("CUSTOM data")
+	if format, confidence := registry.Detect(bytes.NewReader(custom), int64(len(custom))); format != "custom" || confidence != ConfidenceDeclared {
+		t.Errorf("expected the custom format, got %s (%d)", format, confidence)
+	}
+	output.Reset()
+	if result = registry.Convert(context.Background(), bytes.NewReader(custom), int64(len(custom)), &output, Options{}); result.Err != nil || output.String() != "custom text" {
+		t.Errorf("expected the custom converter, got %q: %+v", output.String(), result)
+	}
+
+	// Removing a custom format leaves no converter
+	registry.Unregister("custom")
+	if result = registry.Convert(context.Background(), bytes.NewReader(custom), int64(len(custom)), &output, Options{}); result.Err != ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", result.Err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	// ODS with 1000 x 1000 repeated cells
+	var file bytes.Buffer
+	archive := zip.NewWriter(&file)
+	w, _ := archive.Create("mimetype")
+	w.Write([]byte("application/vnd.oasis.opendocument.spreadsheet"))
+	w, _ = archive.Create("content.xml")
+	w.Write([]byte(`<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"><office:body><office:spreadsheet><table:table table:name="Sheet1"><table:table-row table:number-rows-repeated="1000"><table:table-cell table:number-columns-repeated="1000"><text:p>x</text:p></table:table-cell></table:table-row></table:table></office:spreadsheet></office:body></office:document-content>`))
+	archive.Close()
+
+	input := bytes.NewReader(file.Bytes())
+	result := Convert(context.Background(), input, input.Size(), ioutil.Discard, Options{Budget: &Budget{MaxCells: 1000}})
+
+	var budgetErr *BudgetError
+	if !errors.Is(result.Err, ErrBudgetExceeded) || !errors.As(result.Err, &budgetErr) || budgetErr.Resource != ResourceCells {
+		t.Errorf("ODS: expected cells budget exceeded, got %v", result.Err)
+	}
+
+	// 1 MB of zeros
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write(make([]byte, 1024*1024))
+	gw.Close()
+
+	ctx := WithBudget(context.Background(), &Budget{MaxDecompressed: 64 * 1024})
+	if _, _, err := DecompressFileContext(ctx, compressed.Bytes()); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("GZ: expected budget exceeded, got %v", err)
+	}
+
+	// XLSX that declares a huge size, after the budget was charged before. The counter must not wrap around.
+	file.Reset()
+	archive = zip.NewWriter(&file)
+	for _, name := range []string{"xl/workbook.xml", "xl/worksheets/sheet1.xml"} {
+		w, _ = archive.CreateRaw(&zip.FileHeader{Name: name, Method: zip.Store, UncompressedSize64: math.MaxInt64 - 10})
+		w.Write([]byte("<x/>"))
+	}
+	archive.Close()
+
+	budget := &Budget{MaxDecompressed: 1 << 20}
+	budget.AddDecompressed(100)
+	ctx = WithBudget(context.Background(), budget)
+	if _, err := XLSX2TextContext(ctx, bytes.NewReader(file.Bytes()), int64(file.Len()), ioutil.Discard, 0, -1); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("XLSX: expected budget exceeded, got %v", err)
+	}
+	if err := budget.AddDecompressed(1); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected the budget to stay exceeded, got %v", err)
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	// Office Open XML files encrypted with a password are OLE2 files
+	encrypted := testOLE2([]string{"EncryptionInfo", "EncryptedPackage"}, [][]byte{{4, 0, 4, 0}, []byte("encrypted")})
+	if _, err := DOCX2TextWriter(bytes.NewReader(encrypted), int64(len(encrypted)), ioutil.Discard, 1000); !errors.Is(err, ErrPasswordRequired) || !errors.Is(err, ErrEncrypted) {
+		t.Errorf("DOCX: expected ErrPasswordRequired, got %v", err)
+	}
+	if result := Convert(context.Background(), bytes.NewReader(encrypted), int64(len(encrypted)), ioutil.Discard, Options{}); !errors.Is(result.Err, ErrPasswordRequired) {
+		t.Errorf("Convert: expected ErrPasswordRequired, got %v", result.Err)
+	}
+	docx := testZIPFiles("word/document.xml", `<w:document><w:body><w:p><w:r><w:t>Text</w:t></w:r></w:p></w:body></w:document>`)
+	if _, err := DOCX2TextWriter(bytes.NewReader(docx[:len(docx)-10]), int64(len(docx)-10), ioutil.Discard, 1000); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("DOCX: expected ErrCorrupt, got %v", err)
+	}
+
+	// XLS files with a FILEPASS record are encrypted
+	xls := testOLE2([]string{"Workbook"}, [][]byte{testXLSWorkbook(testBIFFRecord(0x2F, make([]byte, 54)))})
+	if _, err := XLS2TextContext(context.Background(), bytes.NewReader(xls), ioutil.Discard, 1000); !errors.Is(err, ErrEncrypted) || errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("XLS: expected ErrEncrypted, got %v", err)
+	}
+	xls = testOLE2([]string{"Other"}, [][]byte{testXLSWorkbook()})
+	if _, err := XLS2TextContext(context.Background(), bytes.NewReader(xls), ioutil.Discard, 1000); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("XLS: expected ErrCorrupt without workbook stream, got %v", err)
+	}
+
+	// PDF files encrypted with a user password cannot be opened, the empty password is tried
+	pdf := testPDF("", testPDFText("Text")...)
+	if _, numPages, err := pdfOpen(context.Background(), bytes.NewReader(pdf)); err != nil || numPages != 1 {
+		t.Fatalf("PDF: expected 1 page, got %d: %v", numPages, err)
+	}
+	pdf = testPDFEncrypted("secret")
+	if _, err := PDFListContentStreams(bytes.NewReader(pdf), ioutil.Discard, 1000); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("PDF: expected ErrPasswordRequired, got %v", err)
+	}
+	if result := Convert(context.Background(), bytes.NewReader(pdf), int64(len(pdf)), ioutil.Discard, Options{}); !errors.Is(result.Err, ErrEncrypted) {
+		t.Errorf("Convert: expected ErrEncrypted for the PDF, got %v", result.Err)
+	}
+	pdf = []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog\n")
+	if _, err := PDFListContentStreams(bytes.NewReader(pdf), ioutil.Discard, 1000); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("PDF: expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	// The XLS file is valid, the text is extracted without the cancelled context
+	xls := testOLE2([]string{"Workbook"}, [][]byte{testXLSWorkbook()})
+	if _, err := XLS2TextContext(context.Background(), bytes.NewReader(xls), ioutil.Discard, 1000); err != nil {
+		t.Fatalf("XLS: unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := XLS2TextContext(ctx, bytes.NewReader(xls), ioutil.Discard, 1000); !errors.Is(err, context.Canceled) {
+		t.Errorf("XLS: expected context.Canceled, got %v", err)
+	}
+	if _, err := RTF2TextContext(ctx, strings.NewReader(`{\rtf1\ansi Text}`), ioutil.Discard, 1000); !errors.Is(err, context.Canceled) {
+		t.Errorf("RTF: expected context.Canceled, got %v", err)
+	}
+	docx := testZIPFiles("word/document.xml", `<w:document><w:body><w:p><w:r><w:t>Text</w:t></w:r></w:p></w:body></w:document>`)
+	if _, err := DOCX2TextContext(ctx, bytes.NewReader(docx), int64(len(docx)), ioutil.Discard, 1000); !errors.Is(err, context.Canceled) {
+		t.Errorf("DOCX: expected context.Canceled, got %v", err)
+	}
+
+	archive := testZIPFiles("file.txt", "Text")
+	called := false
+	err := ContainerExtractReaderContext(ctx, bytes.NewReader(archive), int64(len(archive)), func(file *ContainerFile) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || called {
+		t.Errorf("ZIP: expected context.Canceled before the first file, got %v (callback called %t)", err, called)
+	}
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte("Text"))
+	gw.Close()
+	if _, valid, err := DecompressFileContext(ctx, compressed.Bytes()); !errors.Is(err, context.Canceled) || valid {
+		t.Errorf("GZ: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWriterVariants(t *testing.T) {
+	var output bytes.Buffer
+	written, err := HTML2TextWriter(strings.NewReader("<html><body><p>Grüße aus Wien</p></body></html>"), &output, 4)
+	if err != ErrLimitReached || written != 4 || output.String() != "Grü" {
+		t.Errorf("HTML: unexpected output %q (%d): %v", output.String(), written, err)
+	}
+
+	// Corrupt XML is reported instead of returning the text up to the error
+	data := testZIPFiles("word/document.xml", `<w:document><w:body><w:p><w:r><w:t>Text</w:t></w:r></w:p><w:p><w:r>`)
+	output.Reset()
+	if written, err = DOCX2TextWriter(bytes.NewReader(data), int64(len(data)), &output, 1000); !errors.Is(err, ErrCorrupt) || output.String() != "Text\n" {
+		t.Errorf("DOCX: expected ErrCorrupt, got %q: %v", output.String(), err)
+	}
+
+	// The legacy function returns the text up to the error, and no error for a missing word/document.xml
+	if text, err := DOCX2Text(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrCorrupt) || text != "Text\n" {
+		t.Errorf("DOCX2Text: expected the text and ErrCorrupt, got %q: %v", text, err)
+	}
+	data = testZIPFiles("word/styles.xml", "<w:styles/>")
+	if text, err := DOCX2Text(bytes.NewReader(data), int64(len(data))); err != nil || text != "" {
+		t.Errorf("DOCX2Text: expected no text and no error, got %q: %v", text, err)
+	}
+}
+
+func TestConvertODP(t *testing.T) {
+	data := testZIPFiles("mimetype", "application/vnd.oasis.opendocument.presentation",
+		"content.xml", `<office:document-content><office:body><office:presentation><draw:page><draw:frame><draw:text-box><text:p>Slide text</text:p></draw:text-box></draw:frame></draw:page></office:presentation></office:body></office:document-content>`)
+
+	var output bytes.Buffer
+	result := Convert(context.Background(), bytes.NewReader(data), int64(len(data)), &output, Options{})
+	if result.Err != nil || result.Format != FormatODP || !strings.Contains(output.String(), "Slide text") {
+		t.Errorf("unexpected result %+v: %q", result, output.String())
+	}
+
+	// PPT is detected, but cannot be converted
+	result = Convert(context.Background(), bytes.NewReader(data), int64(len(data)), &output, Options{Format: FormatPPT})
+	if result.Err != ErrUnsupportedFormat {
+		t.Errorf("PPT: expected ErrUnsupportedFormat, got %v", result.Err)
+	}
+}
+
+func TestConvertDocument(t *testing.T) {
+	var file bytes.Buffer
+	archive := zip.NewWriter(&file)
+	w, _ := archive.Create("word/document.xml")
+	w.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+		`<w:p><w:pPr><w:pStyle w:val="Heading2"/></w:pPr><w:r><w:t>Heading</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>Paragraph</w:t></w:r></w:p>` +
+		`<w:p><w:pPr><w:numPr><w:ilvl w:val="1"/><w:numId w:val="3"/></w:numPr><w:sectPr/></w:pPr><w:r><w:t>Item</w:t></w:r></w:p>` +
+		`<w:tbl><w:tr><w:tc><w:p><w:r><w:t>A1</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>B1</w:t></w:r></w:p></w:tc></w:tr>` +
+		`<w:tr><w:tc><w:p><w:r><w:t>A2</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>B2</w:t></w:r></w:p></w:tc></w:tr></w:tbl>` +
+		`</w:body></w:document>`))
+	archive.Close()
+
+	input := bytes.NewReader(file.Bytes())
+	document, err := ConvertDocument(context.Background(), input, input.Size(), Options{Format: FormatDOCX})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	document.WriteJSON(&output)
+
+	expected := `{"format":"docx","blocks":[{"type":"section","number":1,"blocks":[{"type":"heading","level":2,"text":"Heading"},{"type":"paragraph","text":"Paragraph"},{"type":"list item","level":2,"text":"Item"}]},` +
+		`{"type":"section","number":2,"blocks":[{"type":"table","rows":[["A1","B1"],["A2","B2"]]}]}]}` + "\n"
+	if output.String() != expected {
+		t.Errorf("unexpected JSON:\n%s", output.String())
+	}
+
+	// The limit truncates the text of the table.
+	document, err = ConvertDocument(context.Background(), input, input.Size(), Options{Format: FormatDOCX, Limit: 23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table := document.Blocks[1].Blocks[0]; !document.Truncated || len(table.Rows) != 1 || table.Rows[0][1] != "B" {
+		t.Errorf("unexpected truncated table %v", table.Rows)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	document := &Document{Format: FormatPPTX, Blocks: []Block{
+		{Type: BlockSlide, Number: 1, Blocks: []Block{
+			{Type: BlockHeading, Level: 1, Text: "Title"},
+			{Type: BlockListItem, Level: 1, Text: "One"},
+			{Type: BlockListItem, Level: 2, Text: "Two"},
+		}},
+		{Type: BlockSlide, Number: 2},
+		{Type: BlockSlide, Number: 3, Blocks: []Block{
+			{Type: BlockTable, Rows: [][]string{{"A", "B|C"}, {"1"}}},
+		}},
+	}}
+
+	var output bytes.Buffer
+	if _, err := document.WriteMarkdown(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# Title\n\n- One\n    - Two\n\n---\n\n| A | B\\|C |\n| --- | --- |\n| 1 | |\n"
+	if output.String() != expected {
+		t.Errorf("unexpected Markdown:\n%s", output.String())
+	}
+
+	input := strings.NewReader("<html><body><h2>Heading</h2><p>Text with <a href=\"https://example.com/\">link</a></p></body></html>")
+	output.Reset()
+	result := Convert(context.Background(), input, input.Size(), &output, Options{Format: FormatHTML, Output: OutputMarkdown})
+	if result.Err != nil || output.String() != "## Heading\n\nText with [link](https://example.com/)" {
+		t.Errorf("unexpected HTML Markdown %q: %v", output.String(), result.Err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	var file bytes.Buffer
+	archive := zip.NewWriter(&file)
+	w, _ := archive.Create("[Content_Types].xml")
+	w.Write([]byte(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/></Types>`))
+	w, _ = archive.Create("word/document.xml")
+	w.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body/></w:document>`))
+	w, _ = archive.Create("docProps/core.xml")
+	w.Write([]byte(`<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/">` +
+		`<dc:title>Report</dc:title><dc:subject>Testing</dc:subject><dc:creator>Alice; Bob</dc:creator><cp:keywords>one, two;three</cp:keywords>` +
+		`<dcterms:created>2019-03-01T10:00:00Z</dcterms:created><dcterms:modified>2019-03-02T11:00:00Z</dcterms:modified><cp:lastPrinted>2019-03-03T12:00:00Z</cp:lastPrinted></cp:coreProperties>`))
+	w, _ = archive.Create("docProps/app.xml")
+	w.Write([]byte(`<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties"><Application>Microsoft Office Word</Application></Properties>`))
+	archive.Close()
+
+	input := bytes.NewReader(file.Bytes())
+	metadata, err := Metadata(input, input.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DocumentMetadata{Title: "Report", Authors: []string{"Alice", "Bob"}, Subject: "Testing", Keywords: []string{"one", "two", "three"}, Creator: "Microsoft Office Word",
+		Created: time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC), Modified: time.Date(2019, 3, 2, 11, 0, 0, 0, time.UTC), Printed: time.Date(2019, 3, 3, 12, 0, 0, 0, time.UTC)}
+	if fmt.Sprint(metadata) != fmt.Sprint(expected) {
+		t.Errorf("unexpected DOCX metadata %+v", metadata)
+	}
+
+	// XMP stores lists as rdf:li elements, or properties as attributes of rdf:Description.
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreatorTool="Writer" xmp:CreateDate="2019-03-01T10:00:00+01:00"/>` +
+		`<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title><rdf:Alt><rdf:li xml:lang="x-default">XMP Title</rdf:li></rdf:Alt></dc:title>` +
+		`<dc:creator><rdf:Seq><rdf:li>Alice</rdf:li><rdf:li>Bob</rdf:li></rdf:Seq></dc:creator></rdf:Description></rdf:RDF></x:xmpmeta>`
+	metadata = xmpMetadata([]byte(xmp))
+	if metadata.Title != "XMP Title" || fmt.Sprint(metadata.Authors) != "[Alice Bob]" || metadata.Creator != "Writer" || metadata.Created.Unix() != 1551430800 {
+		t.Errorf("unexpected XMP metadata %+v", metadata)
+	}
+
+	if date := pdfDate("D:20190301100000+01'00'"); date.Unix() != 1551430800 {
+		t.Errorf("unexpected PDF date %v", date)
+	}
+}
+
+func TestContainerWalk(t *testing.T) {
+	// outer.zip contains inner.tar.gz with a.txt, and b.txt
+	var tarFile bytes.Buffer
+	tw := tar.NewWriter(&tarFile)
+	tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	var tarGz bytes.Buffer
+	gw := gzip.NewWriter(&tarGz)
+	gw.Write(tarFile.Bytes())
+	gw.Close()
+
+	var zipFile bytes.Buffer
+	archive := zip.NewWriter(&zipFile)
+	w, _ := archive.Create("inner.tar.gz")
+	w.Write(tarGz.Bytes())
+	w, _ = archive.Create("b.txt")
+	w.Write([]byte("world"))
+	archive.Close()
+
+	var paths []string
+	err := ContainerWalk(zipFile.Bytes(), "outer.zip", WalkOptions{}, func(file WalkFile) {
+		paths = append(paths, fmt.Sprintf("%s %d %s", file.Path, file.Depth, file.Data))
+	})
+	if err != nil || strings.Join(paths, ",") != "outer.zip!inner.tar.gz!inner.tar!a.txt 3 hello,outer.zip!b.txt 1 world" {
+		t.Errorf("unexpected files %v: %v", paths, err)
+	}
+
+	// Containers at the max depth are not extracted.
+	paths = nil
+	ContainerWalk(zipFile.Bytes(), "outer.zip", WalkOptions{MaxDepth: 1}, func(file WalkFile) {
+		paths = append(paths, file.Path)
+	})
+	if strings.Join(paths, ",") != "outer.zip!inner.tar.gz,outer.zip!b.txt" {
+		t.Errorf("unexpected files with max depth %v", paths)
+	}
+
+	if err = ContainerWalk(zipFile.Bytes(), "outer.zip", WalkOptions{MaxFiles: 1}, func(file WalkFile) {}); err != ErrLimitReached {
+		t.Errorf("expected ErrLimitReached, got %v", err)
+	}
+
+	// A single large file stops the walk while it is extracted
+	zipFile.Reset()
+	archive = zip.NewWriter(&zipFile)
+	w, _ = archive.Create("large.bin")
+	w.Write(make([]byte, 16*1024*1024))
+	archive.Close()
+
+	budget := &Budget{}
+	err = ContainerWalkContext(WithBudget(context.Background(), budget), zipFile.Bytes(), "outer.zip", WalkOptions{MaxTotalSize: 1024 * 1024}, func(file WalkFile) {
+		t.Errorf("unexpected file %s", file.Path)
+	})
+	if err != ErrLimitReached || budget.decompressed > 2*1024*1024 {
+		t.Errorf("expected ErrLimitReached after 1 MB, got %v after %d bytes", err, budget.decompressed)
+	}
+}
+
+func TestContainerExtractReader(t *testing.T) {
+	var zipFile bytes.Buffer
+	archive := zip.NewWriter(&zipFile)
+	w, _ := archive.Create("a.txt")
+	w.Write([]byte("hello"))
+	w, _ = archive.CreateHeader(&zip.FileHeader{Name: "encrypted.txt", Flags: 0x1})
+	w.Write([]byte("secret"))
+	w, _ = archive.Create("b.txt")
+	w.Write([]byte("world"))
+	archive.Close()
+
+	input := bytes.NewReader(zipFile.Bytes())
+	var files []string
+	err := ContainerExtractReader(input, input.Size(), func(file *ContainerFile) error {
+		if file.Err != nil {
+			files = append(files, file.Name+" "+file.Err.Error())
+			return nil
+		}
+		data, err := ioutil.ReadAll(file.Reader)
+		files = append(files, file.Name+" "+string(data))
+		return err
+	})
+	if err != nil || strings.Join(files, ",") != "a.txt hello,encrypted.txt zip: password required,b.txt world" {
+		t.Errorf("unexpected files %v: %v", files, err)
+	}
+
+	// SkipAll stops without error, other errors are returned.
+	files = nil
+	err = ContainerExtractReader(input, input.Size(), func(file *ContainerFile) error {
+		files = append(files, file.Name)
+		return SkipAll
+	})
+	if err != nil || len(files) != 1 {
+		t.Errorf("unexpected result of SkipAll %v: %v", files, err)
+	}
+
+	errAbort := errors.New("abort")
+	if err = ContainerExtractReader(input, input.Size(), func(file *ContainerFile) error { return errAbort }); err != errAbort {
+		t.Errorf("expected callback error, got %v", err)
+	}
+
+	text := strings.NewReader("no archive")
+	if err = ContainerExtractReader(text, text.Size(), func(file *ContainerFile) error { return nil }); err != ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte("compressed"))
+	gw.Close()
+
+	reader, format, err := DecompressReader(&compressed)
+	if err != nil || format != FormatGZ {
+		t.Fatalf("unexpected format %s: %v", format, err)
+	}
+	if data, err := ioutil.ReadAll(reader); err != nil || string(data) != "compressed" {
+		t.Errorf("unexpected decompressed data %q: %v", data, err)
+	}
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write(make([]byte, 4<<20))
+	gw.Close()
+
+	var bomb *BombError
+	ctx := WithBombLimits(context.Background(), BombLimits{MaxRatio: 100, MinRatioSize: 1 << 20})
+	if _, _, err := DecompressFileContext(ctx, compressed.Bytes()); !errors.As(err, &bomb) || bomb.Reason != BombRatio || bomb.Decompressed <= 1<<20 {
+		t.Errorf("expected compression ratio bomb, got %v", err)
+	}
+
+	ctx = WithBombLimits(context.Background(), BombLimits{MaxSize: 1000})
+	reader, _, err := DecompressReaderContext(ctx, bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader); !errors.Is(err, ErrDecompressionBomb) || !errors.As(err, &bomb) || bomb.Reason != BombSize {
+		t.Errorf("expected decompressed size bomb, got %v", err)
+	}
+
+	// The default limits allow it.
+	if decompressed, valid := DecompressFile(compressed.Bytes()); !valid || len(decompressed) != 4<<20 {
+		t.Errorf("unexpected decompression with default limits: %d bytes", len(decompressed))
+	}
+
+	// The central directory entry of the second file points to the data of the first one.
+	var zipFile bytes.Buffer
+	archive := zip.NewWriter(&zipFile)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, _ := archive.Create(name)
+		w.Write([]byte("same content"))
+	}
+	archive.Close()
+
+	data := zipFile.Bytes()
+	central := bytes.LastIndex(data, []byte("PK\x01\x02"))
+	copy(data[central+42:], []byte{0, 0, 0, 0})
+
+	input := bytes.NewReader(data)
+	err = ContainerExtractReader(input, input.Size(), func(file *ContainerFile) error { return nil })
+	if !errors.Is(err, ErrDecompressionBomb) || !errors.As(err, &bomb) || bomb.Reason != BombOverlap || bomb.Name != "b.txt" {
+		t.Errorf("expected overlapping files bomb, got %v", err)
+	}
+
+	// A container that contains itself
+	walker := &containerWalker{ctx: context.Background(), cancel: func() {}, options: WalkOptions{MaxDepth: DefaultWalkDepth}, callback: func(file WalkFile) {}, total: &Budget{}}
+	walker.walk(compressed.Bytes(), "b.gz", "a.gz!b.gz", time.Time{}, 1, [][sha256.Size]byte{sha256.Sum256(compressed.Bytes())})
+	if !errors.As(walker.err, &bomb) || bomb.Reason != BombQuine || bomb.Name != "a.gz!b.gz" {
+		t.Errorf("expected container that contains itself, got %v", walker.err)
+	}
+}
+
+func TestContainerPasswords(t *testing.T) {
+	// z.txt encrypted with ZipCrypto and aes.txt with WinZip AES-256, both with the password "secret"
+	archives := map[string]string{
+		"z.txt zipcrypto":    "504b03040a0009000000090c515d78bfa279150000000900000005001c007a2e747874555409000322d0d26a22d0d26a75780b0001040000000004000000007b36a75332e84b4952ad2c970f4f9bd2500c7a09cb504b070878bfa2791500000009000000504b01021e030a0009000000090c515d78bfa2791500000009000000050018000000000001000000a481000000007a2e747874555405000322d0d26a75780b000104000000000400000000504b050600000000010001004b000000640000000000",
+		"aes.txt winzip aes": "504b03040000010063000000000000000000290000000a00000007000b006165732e747874019907000200414503080037d339d213b5eaf45077c60c8beb54633c52750429bd76a523ecf9562f6eeffbf2aece4efbdd16defc504b010200000000010063000000000000000000290000000a00000007000b0000000000000000000000000000006165732e7478740199070002004145030800504b0506000000000100010040000000590000000000",
+	}
+
+	for expected, archive := range archives {
+		data, _ := hex.DecodeString(archive)
+
+		for _, passwords := range [][]string{nil, {"wrong", "secret"}} {
+			var result string
+			err := ContainerExtractReaderContext(WithPasswords(context.Background(), passwords), bytes.NewReader(data), int64(len(data)), func(file *ContainerFile) error {
+				if !file.Encrypted {
+					t.Errorf("%s is not marked as encrypted", file.Name)
+				}
+				if file.Err != nil {
+					result = file.Err.Error()
+					return nil
+				}
+
+				content, err := ioutil.ReadAll(file.Reader)
+				result = file.Name + " " + string(content) + " " + file.Password
+				return err
+			})
+
+			if passwords == nil && (err != nil || result != "zip: password required") {
+				t.Errorf("expected password required, got %q: %v", result, err)
+			} else if passwords != nil && (err != nil || result != expected+" secret") {
+				t.Errorf("unexpected result %q: %v", result, err)
+			}
+		}
+	}
+
+	// A stored file larger than 1 MB, and a wrong password that passes the check value. Only the checksum of the whole file rejects it.
+	content := bytes.Repeat([]byte("stored "), 300000)
+	header := make([]byte, zipCryptoHeaderSize)
+	header[zipCryptoHeaderSize-1] = byte(crc32.ChecksumIEEE(content) >> 24)
+	encrypted := append(header, content...)
+	keys := newZipCryptoKeys("secret")
+	for n, b := range encrypted {
+		temp := keys[2] | 2
+		encrypted[n] = b ^ byte((temp*(temp^1))>>8)
+		keys.update(b)
+	}
+
+	var wrong string
+	for n := 0; wrong == ""; n++ {
+		check := append([]byte{}, encrypted[:zipCryptoHeaderSize]...)
+		newZipCryptoKeys("wrong" + strconv.Itoa(n)).decrypt(check)
+		if check[zipCryptoHeaderSize-1] == header[zipCryptoHeaderSize-1] {
+			wrong = "wrong" + strconv.Itoa(n)
+		}
+	}
+
+	var zipFile bytes.Buffer
+	archive := zip.NewWriter(&zipFile)
+	w, _ := archive.CreateRaw(&zip.FileHeader{Name: "big.txt", Method: zip.Store, Flags: 0x1, CRC32: crc32.ChecksumIEEE(content), CompressedSize64: uint64(len(encrypted)), UncompressedSize64: uint64(len(content))})
+	w.Write(encrypted)
+	archive.Close()
+
+	err := ContainerExtractReaderContext(WithPasswords(context.Background(), []string{wrong, "secret"}), bytes.NewReader(zipFile.Bytes()), int64(zipFile.Len()), func(file *ContainerFile) error {
+		if file.Err != nil || file.Password != "secret" {
+			t.Errorf("expected password secret instead of %q: %v", file.Password, file.Err)
+			return nil
+		}
+		data, err := ioutil.ReadAll(file.Reader)
+		if !bytes.Equal(data, content) {
+			t.Errorf("unexpected content of %d bytes", len(data))
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestContainerListFiles(t *testing.T) {
+	var zipFile bytes.Buffer
+	archive := zip.NewWriter(&zipFile)
+	archive.SetComment("archive comment")
+	header := &zip.FileHeader{Name: "a.txt", Method: zip.Deflate, Comment: "file comment"}
+	header.SetMode(0640)
+	w, _ := archive.CreateHeader(header)
+	w.Write([]byte("hello hello hello"))
+	archive.Create("dir/")
+	link := &zip.FileHeader{Name: "link"}
+	link.SetMode(os.ModeSymlink | 0777)
+	w, _ = archive.CreateHeader(link)
+	w.Write([]byte("a.txt"))
+	archive.Close()
+
+	input := bytes.NewReader(zipFile.Bytes())
+	listing, err := ContainerListFiles(input, input.Size())
+	if err != nil || listing.Format != FormatZIP || listing.Comment != "archive comment" || len(listing.Files) != 3 {
+		t.Fatalf("unexpected listing %+v: %v", listing, err)
+	}
+
+	file := listing.Files[0]
+	if file.Size != 17 || file.CompressedSize <= 0 || !file.HasCRC || file.CRC32 == 0 || file.Method != "Deflate" || file.Mode != 0640 || file.Comment != "file comment" || file.HostOS != "Unix" || file.Encrypted {
+		t.Errorf("unexpected file %+v", file)
+	}
+	if !listing.Files[1].Directory || !listing.Files[2].Symlink {
+		t.Errorf("unexpected directory or symlink %+v", listing.Files[1:])
+	}
+
+	var tarFile bytes.Buffer
+	tw := tar.NewWriter(&tarFile)
+	tw.WriteHeader(&tar.Header{Name: "b.txt", Mode: 0600, Size: 5, PAXRecords: map[string]string{"comment": "tar comment"}})
+	tw.Write([]byte("world"))
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "b.txt", Mode: 0777})
+	tw.Close()
+
+	input = bytes.NewReader(tarFile.Bytes())
+	listing, err = ContainerListFiles(input, input.Size())
+	if err != nil || listing.Format != FormatTAR || len(listing.Files) != 2 {
+		t.Fatalf("unexpected listing %+v: %v", listing, err)
+	}
+	if file = listing.Files[0]; file.Size != 5 || file.Mode != 0600 || file.Comment != "tar comment" || !listing.Files[1].Symlink {
+		t.Errorf("unexpected files %+v", listing.Files)
+	}
+
+	text := strings.NewReader("no archive")
+	if _, err = ContainerListFiles(text, text.Size()); err != ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestContainerRARDate(t *testing.T) {
+	// RAR 5 stores the modification time as Unix time. It must not depend on the local time zone.
+	data, _ := hex.DecodeString("526172211a0701003392b5e50a0105060005010180800046cd35491c02029d0106bb01b483028000f35ab5ea0c23800301066173642e676fc5059a26544342f66044dd9385426a90164de83a974a08f054b664664164bc1c91cd08f7a52e4cdd9c5aecbfc7aaab93d9747ab455141f7dc7f106f807b8f10848c684711f533a4d722708b906ae0f84f0a765b462cbc3db9afc18f1db962ecd96b109441de926e8de951fe125e45bb0fd4fbb79ecc2f9885e54d02d048e47295f0093381701c91556eb30be342989d0dd073fe59027f54ad4fd54fe981d77565103050400")
+
+	local := time.Local
+	time.Local = time.FixedZone("test", 5*3600)
+	defer func() { time.Local = local }()
+
+	listing, err := ContainerListFiles(bytes.NewReader(data), int64(len(data)))
+	if err != nil || len(listing.Files) != 1 || listing.Files[0].Date.Location() != time.UTC {
+		t.Fatalf("unexpected listing %+v: %v", listing, err)
+	}
+
+	var date time.Time
+	ContainerExtractReader(bytes.NewReader(data), int64(len(data)), func(file *ContainerFile) error {
+		date = file.Date
+		return nil
+	})
+	if date != listing.Files[0].Date {
+		t.Errorf("expected date %v, got %v", listing.Files[0].Date, date)
+	}
+}
+
+func TestContainerRARPackedSize(t *testing.T) {
+	// A RAR 4 file header with 64-bit sizes. The high word 0xFFFFFFFF makes the packed size -48, the negative size of the header.
+	archiveHeader := []byte{0, 0, 0x73, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(archiveHeader, uint16(crc32.ChecksumIEEE(archiveHeader[2:])))
+	fileHeader := make([]byte, 48)
+	fileHeader[2] = 0x74
+	binary.LittleEndian.PutUint16(fileHeader[3:], 0x8100)
+	binary.LittleEndian.PutUint16(fileHeader[5:], uint16(len(fileHeader)))
+	binary.LittleEndian.PutUint32(fileHeader[7:], 1<<32-48)
+	fileHeader[25] = 0x30
+	binary.LittleEndian.PutUint16(fileHeader[26:], 8)
+	binary.LittleEndian.PutUint32(fileHeader[32:], 0xFFFFFFFF)
+	copy(fileHeader[40:], "evil.txt")
+
+	data := append(append([]byte("Rar!\x1A\x07\x00"), archiveHeader...), fileHeader...)
+	embedded := append([]byte("MZ\x90\x00"), data...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := ContainerListFiles(bytes.NewReader(data), int64(len(data))); err == nil {
+			t.Errorf("expected an error for the negative packed size")
+		}
+		if archives, err := ContainerFindEmbedded(bytes.NewReader(embedded), int64(len(embedded))); err != nil || len(archives) != 0 {
+			t.Errorf("unexpected archives %+v: %v", archives, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reading the headers does not end")
+	}
+}
+
+func TestDecompressFormats(t *testing.T) {
+	text := []byte(strings.Repeat("hello world ", 100))
+	compressed := make(map[Format][]byte)
+
+	var buffer bytes.Buffer
+	zw, _ := zstd.NewWriter(&buffer)
+	zw.Write(text)
+	zw.Close()
+	compressed[FormatZSTD] = append([]byte{}, buffer.Bytes()...)
+
+	buffer.Reset()
+	lw := lz4.NewWriter(&buffer)
+	lw.Write(text)
+	lw.Close()
+	compressed[FormatLZ4] = append([]byte{}, buffer.Bytes()...)
+
+	buffer.Reset()
+	lzw := lzip.NewWriter(&buffer)
+	lzw.Write(text)
+	lzw.Close()
+	compressed[FormatLZIP] = append([]byte{}, buffer.Bytes()...)
+
+	buffer.Reset()
+	mw, _ := lzma.NewWriter(&buffer)
+	mw.Write(text)
+	mw.Close()
+	compressed[FormatLZMA] = append([]byte{}, buffer.Bytes()...)
+
+	buffer.Reset()
+	zlw := zlib.NewWriter(&buffer)
+	zlw.Write(text)
+	zlw.Close()
+	compressed[FormatZlib] = append([]byte{}, buffer.Bytes()...)
+
+	buffer.Reset()
+	bw := brotli.NewWriter(&buffer)
+	bw.Write(text)
+	bw.Close()
+	compressed[FormatBrotli] = append([]byte{}, buffer.Bytes()...)
+
+	buffer.Reset()
+	fw, _ := flate.NewWriter(&buffer, flate.BestCompression)
+	fw.Write(text)
+	fw.Close()
+	compressed[FormatDeflate] = append([]byte{}, buffer.Bytes()...)
+
+	for format, data := range compressed {
+		if result, err := DecompressFormat(data, format); err != nil || !bytes.Equal(result.Data, text) {
+			t.Errorf("%s: unexpected decompressed data: %v", format, err)
+		}
+
+		// Brotli and deflate have no signature
+		reader, detected, err := DecompressReader(bytes.NewReader(data))
+		if format == FormatBrotli || format == FormatDeflate {
+			if _, valid := DecompressFile(data); valid || err != ErrUnsupportedFormat {
+				t.Errorf("%s: expected ErrUnsupportedFormat, got %s %v", format, detected, err)
+			}
+			continue
+		}
+		if decompressed, valid := DecompressFile(data); !valid || !bytes.Equal(decompressed, text) {
+			t.Errorf("%s: unexpected decompressed data %q", format, decompressed)
+		}
+		if err != nil || detected != format {
+			t.Errorf("%s: unexpected format %s: %v", format, detected, err)
+			continue
+		}
+		if decompressed, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(decompressed, text) {
+			t.Errorf("%s: unexpected decompressed data %q: %v", format, decompressed, err)
+		}
+	}
+
+	// "hello hello hello world\n" compressed with Unix compress
+	data, _ := hex.DecodeString("1f9d9068cab061f30644c081050f120471e78d1c36641400")
+	if decompressed, valid := DecompressFile(data); !valid || string(decompressed) != "hello hello hello world\n" {
+		t.Errorf("unexpected .Z data %q", decompressed)
+	}
+	if format, _ := DetectFormat(bytes.NewReader(data), int64(len(data))); format != FormatZ {
+		t.Errorf("unexpected format %s", format)
+	}
+
+	if _, valid := DecompressFile(text); valid {
+		t.Error("uncompressed text is decompressed")
+	}
+
+	// zlib headers with invalid check bits, a preset dictionary, or the reserved deflate block type are not detected
+	for _, header := range []string{"789d0300", "78bb0300", "789c0700", "7801000500fbff"} {
+		data, _ := hex.DecodeString(header)
+		if format, _ := decompressDetect(data); format != FormatUnknown {
+			t.Errorf("%s: unexpected format %s", header, format)
+		}
+	}
+	if format, _ := decompressDetect(compressed[FormatZlib]); format != FormatZlib {
+		t.Errorf("unexpected format %s", format)
+	}
+}
+
+func TestDecompressGzipMembers(t *testing.T) {
+	var compressed bytes.Buffer
+	for n, name := range []string{"a.txt", "b.txt"} {
+		gw := gzip.NewWriter(&compressed)
+		gw.Name = name
+		gw.Comment = "member " + name
+		gw.ModTime = time.Date(2019, 1, n+1, 0, 0, 0, 0, time.UTC)
+		gw.Write([]byte(name + "\n"))
+		gw.Close()
+	}
+
+	result, err := Decompress(compressed.Bytes())
+	if err != nil || result.Format != FormatGZ || string(result.Data) != "a.txt\nb.txt\n" || len(result.Gzip) != 2 {
+		t.Fatalf("unexpected result %+v: %v", result, err)
+	}
+	if header := result.Gzip[1]; header.Name != "b.txt" || header.Comment != "member b.txt" || !header.ModTime.Equal(time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected header of the second member %+v", header)
+	}
+
+	// Invalid data after a signature is corrupt, data without a known signature is not decompressed
+	if _, err = Decompress([]byte("BZh9 not bzip2")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err = Decompress([]byte("plain text")); err != ErrUnsupportedFormat {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+// testISORecord creates an ISO 9660 directory record
+func testISORecord(extent, size uint32, directory bool, name []byte) []byte {
+	record := make([]byte, 33+len(name)+(len(name)+1)%2)
+	record[0] = byte(len(record))
+	binary.LittleEndian.PutUint32(record[2:], extent)
+	binary.BigEndian.PutUint32(record[6:], extent)
+	binary.LittleEndian.PutUint32(record[10:], size)
+	binary.BigEndian.PutUint32(record[14:], size)
+	copy(record[18:], []byte{119, 5, 4, 13, 30, 0, 8}) // 2019-05-04 13:30:00 GMT+2
+	if directory {
+		record[25] = 0x02
+	}
+	record[32] = byte(len(name))
+	copy(record[33:], name)
+	return record
+}
+
+// testISOImage creates an image with a primary and a Joliet volume descriptor. The file data is at sector 22.
+func testISOImage(data []byte) []byte {
+	image := make([]byte, 25*2048)
+	joliet := func(name string) (encoded []byte) {
+		for _, c := range utf16.Encode([]rune(name)) {
+			encoded = append(encoded, byte(c>>8), byte(c))
+		}
+		return encoded
+	}
+	directory := func(sector int, records ...[]byte) {
+		position := sector * 2048
+		records = append([][]byte{testISORecord(uint32(sector), 2048, true, []byte{0}), testISORecord(uint32(sector), 2048, true, []byte{1})}, records...)
+		for _, record := range records {
+			position += copy(image[position:], record)
+		}
+	}
+
+	for n, descriptor := range []byte{1, 2, 255} {
+		sector := image[(16+n)*2048:]
+		sector[0] = descriptor
+		copy(sector[1:], "CD001\x01")
+		binary.LittleEndian.PutUint16(sector[128:], 2048)
+	}
+	copy(image[16*2048+156:], testISORecord(20, 2048, true, []byte{0}))
+	copy(image[17*2048+88:], "%/E")
+	copy(image[17*2048+156:], testISORecord(21, 2048, true, []byte{0}))
+
+	directory(20, testISORecord(22, uint32(len(data)), false, []byte("LONGFILE.TXT;1")))
+	directory(21, testISORecord(22, uint32(len(data)), false, joliet("Long file name.txt;1")), testISORecord(23, 2048, true, joliet("folder")))
+	directory(23, testISORecord(22, uint32(len(data)), false, joliet("nested.txt;1")))
+	copy(image[22*2048:], data)
+
+	return image
+}
+
+func TestContainerISO(t *testing.T) {
+	image := testISOImage([]byte("hello world"))
+	if format, _ := DetectFormat(bytes.NewReader(image), int64(len(image))); format != FormatISO {
+		t.Fatalf("expected format iso, got %q", format)
+	}
+
+	// The Joliet names are preferred
+	date := time.Date(2019, 5, 4, 11, 30, 0, 0, time.UTC)
+	var names []string
+	ContainerExtractFiles(image, func(name string, size int64, fileDate time.Time, data []byte) {
+		names = append(names, name)
+		if size != 11 || string(data) != "hello world" || !fileDate.Equal(date) {
+			t.Errorf("unexpected file %s size %d date %v data %q", name, size, fileDate, data)
+		}
+	})
+	if strings.Join(names, ",") != "Long file name.txt,folder/nested.txt" {
+		t.Errorf("unexpected files %v", names)
+	}
+
+	listing, err := ContainerListFiles(bytes.NewReader(image), int64(len(image)))
+	if err != nil || listing.Format != FormatISO || len(listing.Files) != 3 || !listing.Files[1].Directory || listing.Files[1].Name != "folder" {
+		t.Errorf("unexpected listing %+v: %v", listing, err)
+	}
+}
+
+// testRockRidgeImage creates an image with a primary volume descriptor and Rock Ridge entries: a file, a directory and a symbolic link in the directory
+func testRockRidgeImage(data []byte) []byte {
+	image := make([]byte, 24*2048)
+	entry := func(signature string, content ...byte) []byte {
+		return append([]byte{signature[0], signature[1], byte(4 + len(content)), 1}, content...)
+	}
+	mode := func(mode uint32) []byte {
+		px := make([]byte, 32)
+		binary.LittleEndian.PutUint32(px, mode)
+		binary.BigEndian.PutUint32(px[4:], mode)
+		return entry("PX", px...)
+	}
+	record := func(extent, size uint32, directory bool, name string, systemUse ...[]byte) []byte {
+		record := testISORecord(extent, size, directory, []byte(name))
+		for _, entry := range systemUse {
+			record = append(record, entry...)
+		}
+		record[0] = byte(len(record))
+		return record
+	}
+	directory := func(sector int, records ...[]byte) {
+		position := sector * 2048
+		for _, record := range records {
+			position += copy(image[position:], record)
+		}
+	}
+
+	for n, descriptor := range []byte{1, 255} {
+		sector := image[(16+n)*2048:]
+		sector[0] = descriptor
+		copy(sector[1:], "CD001\x01")
+		binary.LittleEndian.PutUint16(sector[128:], 2048)
+	}
+	copy(image[16*2048+156:], testISORecord(20, 2048, true, []byte{0}))
+
+	// The SP entry in the first record of the root directory indicates Rock Ridge. TF stores the modification date 2020-01-02 03:04:05 GMT+1.
+	modified := entry("TF", 0x02, 120, 1, 2, 3, 4, 5, 4)
+	directory(20, record(20, 2048, true, "\x00", entry("SP", 0xBE, 0xEF, 0)), record(20, 2048, true, "\x01"),
+		record(22, uint32(len(data)), false, "LONGNAME.TXT;1", entry("NM", 0, 'L', 'o', 'n', 'g', ' ', 'n', 'a', 'm', 'e', '.', 't', 'x', 't'), mode(0100640), modified),
+		record(21, 2048, true, "FOLDER", entry("NM", 0, 'F', 'o', 'l', 'd', 'e', 'r'), mode(040750), modified))
+	directory(21, record(21, 2048, true, "\x00"), record(20, 2048, true, "\x01"),
+		record(0, 0, false, "LINK.;1", entry("NM", 0, 'l', 'i', 'n', 'k'), mode(0120777), entry("SL", 0, 0x04, 0, 0, 13, 'L', 'o', 'n', 'g', ' ', 'n', 'a', 'm', 'e', '.', 't', 'x', 't'), modified))
+	copy(image[22*2048:], data)
+
+	return image
+}
+
+// testUDFImage creates a UDF image with a partition at sector 300. It has a file with the data, a directory and in it a symbolic link and a file with a UCS-2 name.
+func testUDFImage(data []byte) []byte {
+	const partition = 300
+	image := make([]byte, (partition+8)*2048)
+	tag := func(sector []byte, identifier uint16) {
+		binary.LittleEndian.PutUint16(sector, identifier)
+		var checksum byte
+		for n := 0; n < 16; n++ {
+			if n != 4 {
+				checksum += sector[n]
+			}
+		}
+		sector[4] = checksum
+	}
+	block := func(n int) []byte {
+		return image[(partition+n)*2048 : (partition+n+1)*2048]
+	}
+	// fileEntry writes a file entry. The content is embedded, unless extent is set.
+	fileEntry := func(n int, fileType byte, content []byte, extent uint32) {
+		entry := block(n)
+		entry[27] = fileType
+		binary.LittleEndian.PutUint32(entry[44:], 0x14A5) // read and execute for owner, group and other
+		binary.LittleEndian.PutUint64(entry[56:], uint64(len(content)))
+		// 2021-03-04 05:06:07 GMT+1
+		copy(entry[84:], []byte{60, 0x10, 0xE5, 0x07, 3, 4, 5, 6, 7, 0, 0, 0})
+		if extent == 0 {
+			binary.LittleEndian.PutUint16(entry[34:], 3)
+			binary.LittleEndian.PutUint32(entry[172:], uint32(len(content)))
+			copy(entry[176:], content)
+		} else {
+			binary.LittleEndian.PutUint32(entry[172:], 8)
+			binary.LittleEndian.PutUint32(entry[176:], uint32(len(content)))
+			binary.LittleEndian.PutUint32(entry[180:], extent)
+			copy(block(int(extent)), content)
+		}
+		tag(entry, udfTagFileEntry)
+	}
+	ucs2 := func(name string) []byte {
+		identifier := []byte{16}
+		for _, c := range utf16.Encode([]rune(name)) {
+			identifier = append(identifier, byte(c>>8), byte(c))
+		}
+		return identifier
+	}
+	fileIdentifier := func(characteristics byte, entry uint32, name []byte) []byte {
+		identifier := make([]byte, (38+len(name)+3)&^3)
+		binary.LittleEndian.PutUint16(identifier, udfTagFileIdentifier)
+		identifier[18], identifier[19] = characteristics, byte(len(name))
+		binary.LittleEndian.PutUint32(identifier[24:], entry)
+		copy(identifier[38:], name)
+		return identifier
+	}
+
+	copy(image[16*2048+1:], "BEA01")
+	copy(image[17*2048+1:], "NSR02")
+	copy(image[18*2048+1:], "TEA01")
+
+	anchor := image[256*2048:]
+	binary.LittleEndian.PutUint32(anchor[16:], 3*2048)
+	binary.LittleEndian.PutUint32(anchor[20:], 257)
+	tag(anchor, udfTagAnchor)
+
+	binary.LittleEndian.PutUint16(image[257*2048:], udfTagPartition)
+	binary.LittleEndian.PutUint32(image[257*2048+188:], partition)
+	logicalVolume := image[258*2048:]
+	binary.LittleEndian.PutUint16(logicalVolume, udfTagLogicalVolume)
+	binary.LittleEndian.PutUint32(logicalVolume[212:], 2048)
+	binary.LittleEndian.PutUint32(logicalVolume[268:], 1)
+	copy(logicalVolume[440:], []byte{1, 6, 1, 0, 0, 0})
+	binary.LittleEndian.PutUint16(image[259*2048:], udfTagTerminating)
+
+	// The file set descriptor is at block 0 and points to the root directory at block 1
+	binary.LittleEndian.PutUint32(block(0)[404:], 1)
+	tag(block(0), udfTagFileSet)
+
+	var root, folder []byte
+	root = append(root, fileIdentifier(0x08, 1, nil)...)
+	root = append(root, fileIdentifier(0, 3, []byte("\x08hello.txt"))...)
+	root = append(root, fileIdentifier(0x02, 4, []byte("\x08Folder"))...)
+	fileEntry(1, udfFileTypeDirectory, root, 2)
+	fileEntry(3, udfFileTypeFile, data, 0)
+
+	folder = append(folder, fileIdentifier(0x08, 1, nil)...)
+	folder = append(folder, fileIdentifier(0, 6, []byte("\x08link"))...)
+	folder = append(folder, fileIdentifier(0, 7, ucs2("Ünicode.txt"))...)
+	fileEntry(4, udfFileTypeDirectory, folder, 5)
+	// The path components of the link: parent directory and the name
+	fileEntry(6, udfFileTypeSymlink, []byte("\x03\x00\x00\x00\x05\x0A\x00\x00\x08hello.txt"), 0)
+	fileEntry(7, udfFileTypeFile, []byte("nested"), 0)
+
+	return image
+}
+
+func TestContainerRockRidgeUDF(t *testing.T) {
+	type expectedFile struct {
+		name, linkTarget string
+		date             time.Time
+		mode             os.FileMode
+	}
+
+	rockRidgeDate := time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC)
+	udfDate := time.Date(2021, 3, 4, 4, 6, 7, 0, time.UTC)
+	tests := []struct {
+		image  []byte
+		format Format
+		files  []expectedFile
+	}{
+		{testRockRidgeImage([]byte("hello world")), FormatISO, []expectedFile{
+			{"Long name.txt", "", rockRidgeDate, 0640},
+			{"Folder", "", rockRidgeDate, os.ModeDir | 0750},
+			{"Folder/link", "../Long name.txt", rockRidgeDate, os.ModeSymlink | 0777},
+		}},
+		{testUDFImage([]byte("hello world")), FormatUDF, []expectedFile{
+			{"hello.txt", "", udfDate, 0555},
+			{"Folder", "", udfDate, os.ModeDir | 0555},
+			{"Folder/link", "../hello.txt", udfDate, os.ModeSymlink | 0555},
+			{"Folder/Ünicode.txt", "", udfDate, 0555},
+		}},
+	}
+
+	for _, test := range tests {
+		if format, _ := DetectFormat(bytes.NewReader(test.image), int64(len(test.image))); format != test.format {
+			t.Errorf("expected format %s, got %s", test.format, format)
+		}
+
+		listing, err := ContainerListFiles(bytes.NewReader(test.image), int64(len(test.image)))
+		if err != nil || listing.Format != test.format || len(listing.Files) != len(test.files) {
+			t.Fatalf("unexpected listing %+v: %v", listing, err)
+		}
+		for n, expected := range test.files {
+			if file := listing.Files[n]; file.Name != expected.name || file.Mode != expected.mode || !file.Date.Equal(expected.date) {
+				t.Errorf("%s: expected %+v, got %+v", test.format, expected, file)
+			}
+		}
+
+		var extracted []string
+		err = ContainerExtractReader(bytes.NewReader(test.image), int64(len(test.image)), func(file *ContainerFile) error {
+			extracted = append(extracted, file.Name)
+			for _, expected := range test.files {
+				if expected.name == file.Name && (!file.Date.Equal(expected.date) || file.Symlink != (expected.linkTarget != "") || file.LinkTarget != expected.linkTarget) {
+					t.Errorf("%s: expected %+v, got %+v", test.format, expected, file)
+				}
+			}
+			if file.Name == test.files[0].name {
+				if data, err := ioutil.ReadAll(file.Reader); err != nil || string(data) != "hello world" {
+					t.Errorf("%s: unexpected data %q: %v", test.format, data, err)
+				}
+			}
+			return nil
+		})
+		if expected := len(test.files) - 1; err != nil || len(extracted) != expected {
+			t.Errorf("%s: unexpected files %v: %v", test.format, extracted, err)
+		}
+	}
+}
+
+// testCAB creates a cabinet with one MSZIP folder of two blocks. The second block uses the first one as dictionary.
+func testCAB(names []string, data []byte) []byte {
+	var files, blocks bytes.Buffer
+	folder := bytes.Repeat(data, len(names))
+	for n, name := range names {
+		binary.Write(&files, binary.LittleEndian, []uint32{uint32(len(data)), uint32(n * len(data))})
+		binary.Write(&files, binary.LittleEndian, []uint16{0, 20132, 23488, 0x20})
+		files.WriteString(strings.Replace(name, "/", "\\", -1) + "\x00")
+	}
+
+	for start := 0; start < len(folder); start += cabMaxBlockSize {
+		end := start + cabMaxBlockSize
+		if end > len(folder) {
+			end = len(folder)
+		}
+		var block bytes.Buffer
+		block.WriteString("CK")
+		writer, _ := flate.NewWriterDict(&block, flate.BestCompression, folder[:start])
+		writer.Write(folder[start:end])
+		writer.Close()
+
+		binary.Write(&blocks, binary.LittleEndian, []uint32{0})
+		binary.Write(&blocks, binary.LittleEndian, []uint16{uint16(block.Len()), uint16(end - start)})
+		blocks.Write(block.Bytes())
+	}
+
+	filesOffset := cabHeaderSize + 8
+	dataOffset := filesOffset + files.Len()
+	var cab bytes.Buffer
+	cab.WriteString("MSCF")
+	binary.Write(&cab, binary.LittleEndian, []uint32{0, uint32(dataOffset + blocks.Len()), 0, uint32(filesOffset), 0})
+	binary.Write(&cab, binary.LittleEndian, []uint8{3, 1})
+	binary.Write(&cab, binary.LittleEndian, []uint16{1, uint16(len(names)), 0, 0, 0})
+	binary.Write(&cab, binary.LittleEndian, []uint32{uint32(dataOffset)})
+	binary.Write(&cab, binary.LittleEndian, []uint16{uint16((len(folder) + cabMaxBlockSize - 1) / cabMaxBlockSize), cabCompressionMSZIP})
+	cab.Write(files.Bytes())
+	cab.Write(blocks.Bytes())
+	return cab.Bytes()
+}
+
+// testAR creates an ar archive. Names longer than 15 characters are stored in the GNU table of long names.
+func testAR(names []string, data [][]byte) []byte {
+	var archive, longNames bytes.Buffer
+	member := func(name string, data []byte) {
+		fmt.Fprintf(&archive, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, 1556969400, 0, 0, 0644, len(data))
+		archive.Write(data)
+		if len(data)%2 != 0 {
+			archive.WriteByte('\n')
+		}
+	}
+
+	archive.WriteString(arMagic)
+	headers := make([]string, len(names))
+	for n, name := range names {
+		headers[n] = name + "/"
+		if len(name) > 15 {
+			headers[n] = fmt.Sprintf("/%d", longNames.Len())
+			longNames.WriteString(name + "/\n")
+		}
+	}
+	if longNames.Len() > 0 {
+		member("//", longNames.Bytes())
+	}
+	for n := range names {
+		member(headers[n], data[n])
+	}
+	return archive.Bytes()
+}
+
+// testCPIO creates a cpio archive in the newc format, or in the odc format without padding
+func testCPIO(odc bool, names []string, modes []uint32, data [][]byte) []byte {
+	var archive bytes.Buffer
+	entry := func(name string, mode uint32, data []byte) {
+		if odc {
+			fmt.Fprintf(&archive, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o", 0, 0, mode, 0, 0, 1, 0, 1556969400, len(name)+1, len(data))
+			archive.WriteString(name + "\x00")
+			archive.Write(data)
+			return
+		}
+		fmt.Fprintf(&archive, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X", 0, mode, 0, 0, 1, 1556969400, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		archive.WriteString(name + "\x00")
+		archive.Write(make([]byte, (4-(cpioNewcHeaderSize+len(name)+1)%4)%4))
+		archive.Write(data)
+		archive.Write(make([]byte, (4-len(data)%4)%4))
+	}
+
+	for n := range names {
+		entry(names[n], modes[n], data[n])
+	}
+	entry(cpioTrailer, 0, nil)
+	return archive.Bytes()
+}
+
+// testRPM creates an RPM package with an empty signature header and the payload format in the main header
+func testRPM(payload []byte) []byte {
+	var rpm bytes.Buffer
+	lead := make([]byte, rpmLeadSize)
+	copy(lead, []byte{0xED, 0xAB, 0xEE, 0xDB, 3, 0})
+	rpm.Write(lead)
+
+	rpm.Write([]byte{0x8E, 0xAD, 0xE8, 0x01, 0, 0, 0, 0})
+	binary.Write(&rpm, binary.BigEndian, []uint32{0, 0})
+	rpm.Write([]byte{0x8E, 0xAD, 0xE8, 0x01, 0, 0, 0, 0})
+	binary.Write(&rpm, binary.BigEndian, []uint32{1, 5, rpmTagPayloadFormat, 6, 0, 1})
+	rpm.WriteString("cpio\x00")
+
+	rpm.Write(payload)
+	return rpm.Bytes()
+}
+
+func TestContainerPackages(t *testing.T) {
+	date := time.Date(2019, 5, 4, 11, 30, 0, 0, time.UTC)
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+
+	var data bytes.Buffer
+	writer := tar.NewWriter(&data)
+	writer.WriteHeader(&tar.Header{Name: "./usr/share/doc/readme.txt", Mode: 0644, Size: int64(len(text)), ModTime: date, Typeflag: tar.TypeReg})
+	writer.Write(text)
+	writer.Close()
+	var dataGzip bytes.Buffer
+	compressor := gzip.NewWriter(&dataGzip)
+	compressor.Write(data.Bytes())
+	compressor.Close()
+	var cpioGzip bytes.Buffer
+	compressor = gzip.NewWriter(&cpioGzip)
+	compressor.Write(testCPIO(false, []string{"./usr/file.txt"}, []uint32{0100644}, [][]byte{text}))
+	compressor.Close()
+
+	tests := []struct {
+		format Format
+		file   []byte
+		names  string
+	}{
+		{FormatCAB, testCAB([]string{"first.txt", "folder/second.txt"}, text), "first.txt,folder/second.txt"},
+		{FormatAR, testAR([]string{"short.o", "a_very_long_member_name.o"}, [][]byte{text, text}), "short.o,a_very_long_member_name.o"},
+		{FormatDEB, testAR([]string{"debian-binary", "control.tar.gz", "data.tar.gz"}, [][]byte{[]byte("2.0\n"), dataGzip.Bytes(), dataGzip.Bytes()}), "usr/share/doc/readme.txt"},
+		{FormatCPIO, testCPIO(false, []string{"usr", "usr/file.txt", "usr/link"}, []uint32{040755, 0100644, 0120777}, [][]byte{nil, text, []byte("file.txt")}), "usr/file.txt"},
+		{FormatCPIO, testCPIO(true, []string{"usr", "usr/file.txt", "usr/link"}, []uint32{040755, 0100644, 0120777}, [][]byte{nil, text, []byte("file.txt")}), "usr/file.txt"},
+		{FormatRPM, testRPM(cpioGzip.Bytes()), "usr/file.txt"},
+	}
+
+	for _, test := range tests {
+		if format, _ := DetectFormat(bytes.NewReader(test.file), int64(len(test.file))); format != test.format {
+			t.Errorf("expected format %s, got %q", test.format, format)
+			continue
+		}
+
+		var names []string
+		err := ContainerExtractFilesContext(context.Background(), test.file, func(name string, size int64, fileDate time.Time, data []byte) {
+			names = append(names, name)
+			if size != int64(len(text)) || !bytes.Equal(data, text) || !fileDate.Equal(date) {
+				t.Errorf("%s: unexpected file %s size %d date %v", test.format, name, size, fileDate)
+			}
+		})
+		if err != nil || strings.Join(names, ",") != test.names {
+			t.Errorf("%s: unexpected files %v: %v", test.format, names, err)
+		}
+
+		listing, err := ContainerListFiles(bytes.NewReader(test.file), int64(len(test.file)))
+		if err != nil || listing.Format != test.format || len(listing.Files) == 0 {
+			t.Errorf("%s: unexpected listing %+v: %v", test.format, listing, err)
+		}
+	}
+
+	// CAB with an LZX folder (32 KB window) of a verbatim, an aligned offset and an uncompressed block. Each file contains the sentence 10 times.
+	cab, _ := hex.DecodeString("4d5343460000000060010000000000002c00000000000000030101000200000000000000680000000100030fc2010000000000000000314a0060200066697273742e74787400c2010000c20100000000314a00602000666f6c6465725c7365636f6e642e7478740000000000f00084030010e01200000000320000442c33b3cf6534188518cef7cbf6f700000000000000088400ff1f197bdef700300000000000002031eff7fbbefcdedadf234c7c55ecc1ef8a2c07d50598d01a2b9b42f9168fac1dc97d0e01000001000000000000000000000811bf4feffb609800000000000064001f21f77dcfef40c800000000000004004f21ffbe87ef007b540000002d0000001f0000000100000069636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e2054686520717569636b2062726f776e20666f78206a756d7073206f76657220746865206c617a7920646f672e20")
+	var names []string
+	err := ContainerExtractReader(bytes.NewReader(cab), int64(len(cab)), func(file *ContainerFile) error {
+		names = append(names, file.Name)
+		if data, err := ioutil.ReadAll(file.Reader); err != nil || !bytes.Equal(data, text[:450]) {
+			t.Errorf("LZX: unexpected data of %s %q: %v", file.Name, data, err)
+		}
+		return nil
+	})
+	if err != nil || strings.Join(names, ",") != "first.txt,folder/second.txt" {
+		t.Errorf("LZX: unexpected files %v: %v", names, err)
+	}
+	if listing, err := ContainerListFiles(bytes.NewReader(cab), int64(len(cab))); err != nil || len(listing.Files) != 2 || listing.Files[0].Method != "LZX" {
+		t.Errorf("LZX: unexpected listing %+v: %v", listing, err)
+	}
+
+	// RPM headers larger than the file are rejected before they are read
+	rpm := testRPM(cpioGzip.Bytes())
+	binary.BigEndian.PutUint32(rpm[rpmLeadSize+16+12:], rpmMaxDataSize)
+	if _, err = ContainerListFiles(bytes.NewReader(rpm), int64(len(rpm))); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for invalid RPM header, got %v", err)
+	}
+
+	// CAB files listed in reverse order of their data are passed in the order of the data, the folder is decompressed once
+	block := bytes.Repeat([]byte("0123456789"), 4000)
+	cab = testCAB([]string{"f0.txt", "f1.txt", "f2.txt", "f3.txt", "f4.txt"}, block)
+	for n := 0; n < 5; n++ {
+		binary.LittleEndian.PutUint32(cab[cabHeaderSize+8+n*23+4:], uint32((4-n)*len(block)))
+	}
+	names = nil
+	err = ContainerExtractReader(bytes.NewReader(cab), int64(len(cab)), func(file *ContainerFile) error {
+		names = append(names, file.Name)
+		if data, err := ioutil.ReadAll(file.Reader); err != nil || !bytes.Equal(data, block) {
+			t.Errorf("CAB: unexpected data of %s: %v", file.Name, err)
+		}
+		return nil
+	})
+	if err != nil || strings.Join(names, ",") != "f4.txt,f3.txt,f2.txt,f1.txt,f0.txt" {
+		t.Errorf("CAB: unexpected files %v: %v", names, err)
+	}
+
+	// Data that is skipped because the callback does not read the files is charged as well
+	skip := func(file *ContainerFile) error { return nil }
+	ctx := WithBudget(context.Background(), &Budget{MaxDecompressed: 100000})
+	if err = ContainerExtractReaderContext(ctx, bytes.NewReader(cab), int64(len(cab)), skip); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("CAB: expected budget exceeded, got %v", err)
+	}
+	ctx = WithBombLimits(context.Background(), BombLimits{MaxSize: 100000})
+	if err = ContainerExtractReaderContext(ctx, bytes.NewReader(cab), int64(len(cab)), skip); !errors.Is(err, ErrDecompressionBomb) {
+		t.Errorf("CAB: expected decompression bomb, got %v", err)
+	}
+}
+
+func TestContainerSafeNames(t *testing.T) {
+	var data bytes.Buffer
+	writer := tar.NewWriter(&data)
+	for _, header := range []*tar.Header{
+		{Name: "../../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "/absolute/file.txt", Typeflag: tar.TypeReg},
+		{Name: "C:\\windows\\file.txt", Typeflag: tar.TypeReg},
+		{Name: "./dir/../file.txt", Typeflag: tar.TypeReg},
+		{Name: "file.txt", Typeflag: tar.TypeReg},
+		{Name: "FILE.txt", Typeflag: tar.TypeReg},
+		{Name: "..", Typeflag: tar.TypeReg},
+		{Name: "/.", Typeflag: tar.TypeReg},
+		{Name: "dir/inside", Typeflag: tar.TypeSymlink, Linkname: "../file.txt"},
+		{Name: "dir/outside", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+	} {
+		header.Mode = 0644
+		writer.WriteHeader(header)
+	}
+	writer.Close()
+
+	expected := []string{
+		"etc/passwd ../../etc/passwd",
+		"absolute/file.txt /absolute/file.txt",
+		"windows/file.txt C:\\windows\\file.txt",
+		"file.txt ./dir/../file.txt",
+		"file.txt file.txt duplicate",
+		"FILE.txt FILE.txt duplicate",
+		"unnamed ..",
+		"unnamed /. duplicate",
+		"dir/inside dir/inside symlink ../file.txt",
+		"dir/outside dir/outside symlink ../../etc/passwd unsafe",
+		"hardlink hardlink hardlink etc/passwd",
+	}
+
+	var files []string
+	err := ContainerExtractReader(bytes.NewReader(data.Bytes()), int64(data.Len()), func(file *ContainerFile) error {
+		description := file.Name + " " + file.OriginalName
+		if file.Duplicate {
+			description += " duplicate"
+		}
+		if file.Symlink {
+			description += " symlink " + file.LinkTarget
+		} else if file.Hardlink {
+			description += " hardlink " + file.LinkTarget
+		}
+		if file.UnsafeLink {
+			description += " unsafe"
+		}
+		if content, err := ioutil.ReadAll(file.Reader); err != nil || len(content) != 0 {
+			t.Errorf("unexpected data of %s: %v", file.Name, err)
+		}
+		files = append(files, description)
+		return nil
+	})
+	if err != nil || strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected files %q: %v", files, err)
+	}
+
+	// ZIP stores the target of symbolic links as data
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	header := &zip.FileHeader{Name: "link"}
+	header.SetMode(os.ModeSymlink | 0777)
+	fileWriter, _ := zipWriter.CreateHeader(header)
+	fileWriter.Write([]byte("/etc/passwd"))
+	zipWriter.Close()
+
+	links := 0
+	ContainerExtractReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()), func(file *ContainerFile) error {
+		links++
+		if !file.Symlink || file.LinkTarget != "/etc/passwd" || !file.UnsafeLink {
+			t.Errorf("unexpected link %+v", file)
+		}
+		return nil
+	})
+	if links != 1 {
+		t.Errorf("expected 1 link, got %d", links)
+	}
+}
+
+// testZIPNames creates a ZIP archive with the names encoded in the encoding and without the UTF-8 flag
+func testZIPNames(e encoding.Encoding, names []string, extra []byte) []byte {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for _, name := range names {
+		encoded, _ := e.NewEncoder().String(name)
+		fileWriter, _ := writer.CreateHeader(&zip.FileHeader{Name: encoded, NonUTF8: true, Extra: extra})
+		fileWriter.Write([]byte("data"))
+	}
+	writer.Close()
+	return archive.Bytes()
+}
+
+func TestZIPNameEncoding(t *testing.T) {
+	// Info-ZIP Unicode Path extra field with the CRC-32 of the name in the header
+	unicodePath := func(header []byte, name string) []byte {
+		extra := []byte{0x75, 0x70, 0, 0, 1, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(extra[5:], crc32.ChecksumIEEE(header))
+		extra = append(extra, []byte(name)...)
+		extra[2] = byte(len(extra) - 4)
+		return extra
+	}
+
+	tests := []struct {
+		file     []byte
+		names    string
+		encoding string
+	}{
+		{testZIPNames(charmap.CodePage437, []string{"Größe.txt", "Übersicht/Café.doc"}, nil), "Größe.txt,Übersicht/Café.doc", "IBM437"},
+		{testZIPNames(charmap.CodePage866, []string{"Документы/Отчёт.doc"}, nil), "Документы/Отчёт.doc", "IBM866"},
+		{testZIPNames(japanese.ShiftJIS, []string{"日本語のファイル.txt", "テスト.doc"}, nil), "日本語のファイル.txt,テスト.doc", "Shift_JIS"},
+		{testZIPNames(simplifiedchinese.GBK, []string{"中文文件名.txt", "报告.doc"}, nil), "中文文件名.txt,报告.doc", "GBK"},
+		{testZIPNames(korean.EUCKR, []string{"한국어 파일.txt", "보고서.doc"}, nil), "한국어 파일.txt,보고서.doc", "EUC-KR"},
+		{testZIPNames(encoding.Nop, []string{"naïve.txt"}, nil), "naïve.txt", "UTF-8"},
+		{testZIPNames(charmap.CodePage437, []string{"Größe"}, unicodePath([]byte{'G', 'r', 0x94, 0xE1, 'e'}, "Größe.txt")), "Größe.txt", ""},
+		// Tools that cannot encode the name store "?" in the header
+		{testZIPNames(encoding.Nop, []string{"Gr??e.txt"}, unicodePath([]byte("Gr??e.txt"), "Größe.txt")), "Größe.txt", ""},
+	}
+
+	for _, test := range tests {
+		var names []string
+		ContainerExtractReader(bytes.NewReader(test.file), int64(len(test.file)), func(file *ContainerFile) error {
+			names = append(names, file.Name)
+			if file.NameEncoding != test.encoding {
+				t.Errorf("%s: expected encoding %q, got %q", file.Name, test.encoding, file.NameEncoding)
+			}
+			return nil
+		})
+		if strings.Join(names, ",") != test.names {
+			t.Errorf("expected names %q, got %q", test.names, names)
+		}
+
+		listing, err := ContainerListFiles(bytes.NewReader(test.file), int64(len(test.file)))
+		if err != nil || listing.Files[0].Name != names[0] || listing.Files[0].NameEncoding != test.encoding {
+			t.Errorf("unexpected listing %+v: %v", listing, err)
+		}
+	}
+}
+
+// testRARVolumes creates a multi-volume RAR 5 archive. The file is stored and split into the volumes.
+func testRARVolumes(name string, data []byte, volumes int) (files [][]byte) {
+	vint := func(header *bytes.Buffer, values ...uint64) {
+		for _, value := range values {
+			for ; value >= 0x80; value >>= 7 {
+				header.WriteByte(byte(value) | 0x80)
+			}
+			header.WriteByte(byte(value))
+		}
+	}
+	block := func(volume *bytes.Buffer, header []byte) {
+		var size bytes.Buffer
+		vint(&size, uint64(len(header)))
+		binary.Write(volume, binary.LittleEndian, crc32.ChecksumIEEE(append(size.Bytes(), header...)))
+		volume.Write(size.Bytes())
+		volume.Write(header)
+	}
+
+	partSize := (len(data) + volumes - 1) / volumes
+	for n := 0; n < volumes; n++ {
+		part := data[n*partSize:]
+		if len(part) > partSize {
+			part = part[:partSize]
+		}
+		crc, split, endFlags := crc32.ChecksumIEEE(data), uint64(0), uint64(0)
+		if n > 0 {
+			split |= 0x0008
+		}
+		if n < volumes-1 {
+			crc, split, endFlags = crc32.ChecksumIEEE(part), split|0x0010, 1
+		}
+
+		var volume, main, file, end bytes.Buffer
+		volume.WriteString("Rar!\x1A\x07\x01\x00")
+		vint(&main, 1, 0, 0x0003, uint64(n))
+		block(&volume, main.Bytes())
+		vint(&file, 2, 0x0002|split, uint64(len(part)), 0x0004, uint64(len(data)), 0x20)
+		binary.Write(&file, binary.LittleEndian, crc)
+		vint(&file, 0, 0, uint64(len(name)))
+		file.WriteString(name)
+		block(&volume, file.Bytes())
+		volume.Write(part)
+		vint(&end, 5, 0, endFlags)
+		block(&volume, end.Bytes())
+		files = append(files, volume.Bytes())
+	}
+	return files
+}
+
+// test7Z creates a 7Z archive with the file stored uncompressed. The data must be smaller than 16 KB.
+func test7Z(name string, data []byte) []byte {
+	number := func(header *bytes.Buffer, value int) {
+		if value < 0x80 {
+			header.WriteByte(byte(value))
+		} else {
+			header.Write([]byte{0x80 | byte(value>>8), byte(value)})
+		}
+	}
+
+	// Header, main streams info with a single folder using the Copy coder, and files info with the name
+	var header bytes.Buffer
+	header.Write([]byte{0x01, 0x04, 0x06, 0x00, 0x01, 0x09})
+	number(&header, len(data))
+	header.Write([]byte{0x00, 0x07, 0x0B, 0x01, 0x00, 0x01, 0x01, 0x00, 0x0C})
+	number(&header, len(data))
+	header.Write([]byte{0x0A, 0x01})
+	binary.Write(&header, binary.LittleEndian, crc32.ChecksumIEEE(data))
+	header.Write([]byte{0x00, 0x00, 0x05, 0x01, 0x11})
+	number(&header, 1+2*len(name)+2)
+	header.WriteByte(0)
+	for _, char := range name {
+		binary.Write(&header, binary.LittleEndian, uint16(char))
+	}
+	header.Write([]byte{0x00, 0x00, 0x00, 0x00})
+
+	start := make([]byte, 20)
+	binary.LittleEndian.PutUint64(start[0:], uint64(len(data)))
+	binary.LittleEndian.PutUint64(start[8:], uint64(header.Len()))
+	binary.LittleEndian.PutUint32(start[16:], crc32.ChecksumIEEE(header.Bytes()))
+
+	var archive bytes.Buffer
+	archive.WriteString("7z\xBC\xAF\x27\x1C\x00\x04")
+	binary.Write(&archive, binary.LittleEndian, crc32.ChecksumIEEE(start))
+	archive.Write(start)
+	archive.Write(data)
+	archive.Write(header.Bytes())
+	return archive.Bytes()
+}
+
+// testVolumes returns the data as volumes
+func testVolumes(data ...[]byte) (volumes []ContainerVolume) {
+	for _, volume := range data {
+		volumes = append(volumes, ContainerVolume{Reader: bytes.NewReader(volume), Size: int64(len(volume))})
+	}
+	return volumes
+}
+
+// testZIPSplit creates a ZIP archive that is split into 2 volumes. The first file spans both volumes, the second one is in the second volume.
+func testZIPSplit(text []byte) (files [][]byte) {
+	var archive bytes.Buffer
+	archive.WriteString("PK\x07\x08")
+	writer := zip.NewWriter(&archive)
+	writer.SetOffset(4)
+	for _, name := range []string{"first.txt", "folder/second.txt"} {
+		fileWriter, _ := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		fileWriter.Write(text)
+	}
+	writer.Close()
+
+	// The offsets in the central directory and the end record are relative to the volume
+	data := archive.Bytes()
+	split := 4 + 30 + len("first.txt") + len(text)/2
+	end := data[len(data)-22:]
+	directory := data[binary.LittleEndian.Uint32(end[16:]):]
+	for len(directory) > 22 {
+		if offset := binary.LittleEndian.Uint32(directory[42:]); offset >= uint32(split) {
+			binary.LittleEndian.PutUint16(directory[34:], 1)
+			binary.LittleEndian.PutUint32(directory[42:], offset-uint32(split))
+		}
+		directory = directory[46+binary.LittleEndian.Uint16(directory[28:])+binary.LittleEndian.Uint16(directory[30:])+binary.LittleEndian.Uint16(directory[32:]):]
+	}
+	binary.LittleEndian.PutUint16(end[4:], 1)
+	binary.LittleEndian.PutUint16(end[6:], 1)
+	binary.LittleEndian.PutUint32(end[16:], binary.LittleEndian.Uint32(end[16:])-uint32(split))
+
+	return [][]byte{data[:split], data[split:]}
+}
+
+func TestContainerVolumes(t *testing.T) {
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+
+	var zipFile bytes.Buffer
+	writer := zip.NewWriter(&zipFile)
+	fileWriter, _ := writer.CreateHeader(&zip.FileHeader{Name: "pieces.txt", Method: zip.Store})
+	fileWriter.Write(text)
+	writer.Close()
+	pieces := [][]byte{zipFile.Bytes()[:20000], zipFile.Bytes()[20000:40000], zipFile.Bytes()[40000:]}
+
+	sevenZip := test7Z("folder/7z.txt", text[:9000])
+	sevenZipPieces := [][]byte{sevenZip[:3000], sevenZip[3000:6000], sevenZip[6000:]}
+
+	tests := []struct {
+		volumes [][]byte
+		names   string
+	}{
+		{testRARVolumes("folder/spanned.txt", text, 3), "folder/spanned.txt"},
+		{testZIPSplit(text), "first.txt,folder/second.txt"},
+		{pieces, "pieces.txt"},
+		{sevenZipPieces, "folder/7z.txt"},
+	}
+
+	for _, test := range tests {
+		var names []string
+		err := ContainerExtractVolumes(testVolumes(test.volumes...), func(file *ContainerFile) error {
+			names = append(names, file.Name)
+			data, err := ioutil.ReadAll(file.Reader)
+			if err != nil || !bytes.HasPrefix(text, data) || len(data) < 9000 {
+				t.Errorf("%s: unexpected data of size %d: %v", file.Name, len(data), err)
+			}
+			return nil
+		})
+		if err != nil || strings.Join(names, ",") != test.names {
+			t.Errorf("unexpected files %v: %v", names, err)
+		}
+	}
+
+	// Missing volumes at the end and in the middle
+	volumes := testRARVolumes("spanned.txt", text, 3)
+	missing := [][][]byte{{volumes[0], volumes[1]}, {volumes[0], volumes[2]}, {volumes[1], volumes[2]}, {sevenZipPieces[0], sevenZipPieces[2]}}
+	for n, test := range missing {
+		err := ContainerExtractVolumes(testVolumes(test...), func(file *ContainerFile) error {
+			t.Errorf("missing volumes %d: unexpected file %s", n, file.Name)
+			return nil
+		})
+		var conversionError *ConversionError
+		if !errors.Is(err, ErrCorrupt) || !errors.As(err, &conversionError) {
+			t.Errorf("missing volumes %d: expected ErrCorrupt, got %v", n, err)
+		}
+	}
+
+	// Missing volumes by name
+	for _, names := range [][]string{{"disk.7z.001", "disk.7z.003"}, {"disk.7z.002", "disk.7z.003"}, {"old.rar", "old.r01"}, {"old.r00", "old.r01"}, {"data.z02", "data.zip"}, {"Backup.part1.rar", "Backup.part3.rar"}} {
+		if missing := volumeMissing(ContainerVolumeNames(names[0], names)); missing == 0 {
+			t.Errorf("%v: expected a missing volume", names)
+		}
+	}
+	for _, names := range [][]string{{"disk.7z.001", "disk.7z.002"}, {"old.rar", "old.r00", "old.r01"}, {"data.z01", "data.z02", "data.zip"}, {"data.z01", "data.zip"}} {
+		if missing := volumeMissing(ContainerVolumeNames(names[0], names)); missing != 0 {
+			t.Errorf("%v: unexpected missing volume %d", names, missing)
+		}
+	}
+
+	directory := []string{"Backup.part10.rar", "backup.part2.rar", "Backup.part1.rar", "other.rar", "old.r00", "old.rar", "old.r01", "old.s00", "data.z01", "data.zip", "data.z02", "disk.7z.002", "disk.7z.001", "single.zip"}
+	names := map[string]string{
+		"backup.part2.rar": "Backup.part1.rar,backup.part2.rar,Backup.part10.rar",
+		"old.r01":          "old.rar,old.r00,old.r01,old.s00",
+		"data.zip":         "data.z01,data.z02,data.zip",
+		"disk.7z.001":      "disk.7z.001,disk.7z.002",
+		"single.zip":       "",
+		"other.rar":        "",
+	}
+	for name, expected := range names {
+		if volumeNames := strings.Join(ContainerVolumeNames(name, directory), ","); volumeNames != expected {
+			t.Errorf("%s: expected volumes %q, got %q", name, expected, volumeNames)
+		}
+	}
+}
+
+func TestContainerEmbedded(t *testing.T) {
+	text := []byte("The quick brown fox jumps over the lazy dog.")
+
+	var zipFile bytes.Buffer
+	writer := zip.NewWriter(&zipFile)
+	fileWriter, _ := writer.Create("zip.txt")
+	fileWriter.Write(text)
+	writer.Close()
+
+	var tarFile bytes.Buffer
+	tarWriter := tar.NewWriter(&tarFile)
+	tarWriter.WriteHeader(&tar.Header{Name: "tar.txt", Mode: 0644, Size: int64(len(text)), Typeflag: tar.TypeReg})
+	tarWriter.Write(text)
+	tarWriter.Close()
+
+	// An executable stub with signatures that are not valid archives, followed by archives and other data
+	var file bytes.Buffer
+	file.WriteString("MZ\x90\x00Rar!\x1A\x07\x00\x00\x00\x00\x00\x00\x00\x007z\xBC\xAF\x27\x1C\x00\x04")
+	file.Write(make([]byte, 1000))
+	offsets := []int64{int64(file.Len())}
+	file.Write(zipFile.Bytes())
+	file.Write(bytes.Repeat([]byte("appended data "), 10000))
+	offsets = append(offsets, int64(file.Len()))
+	file.Write(tarFile.Bytes())
+	offsets = append(offsets, int64(file.Len()))
+	file.Write(testRARVolumes("rar.txt", text, 1)[0])
+	offsets = append(offsets, int64(file.Len()))
+	file.Write(testCAB([]string{"cab.txt"}, text))
+	file.WriteString("trailer")
+
+	archives, err := ContainerFindEmbedded(bytes.NewReader(file.Bytes()), int64(file.Len()))
+	if err != nil || len(archives) != 4 {
+		t.Fatalf("unexpected archives %+v: %v", archives, err)
+	}
+	for n, format := range []Format{FormatZIP, FormatTAR, FormatRAR, FormatCAB} {
+		if archives[n].Format != format || archives[n].Offset != offsets[n] {
+			t.Errorf("expected %s at offset %d, got %+v", format, offsets[n], archives[n])
+		}
+	}
+
+	var names []string
+	err = ContainerExtractEmbedded(bytes.NewReader(file.Bytes()), int64(file.Len()), func(archive EmbeddedArchive, file *ContainerFile) error {
+		names = append(names, fmt.Sprintf("%d:%s", archive.Offset, file.Name))
+		if data, err := ioutil.ReadAll(file.Reader); err != nil || !bytes.Equal(data, text) {
+			t.Errorf("%s: unexpected data %q: %v", file.Name, data, err)
+		}
+		return nil
+	})
+	expected := fmt.Sprintf("%d:zip.txt,%d:tar.txt,%d:rar.txt,%d:cab.txt", offsets[0], offsets[1], offsets[2], offsets[3])
+	if err != nil || strings.Join(names, ",") != expected {
+		t.Errorf("expected files %s, got %v: %v", expected, names, err)
+	}
+
+	// Data full of signatures is limited. The archive in front of them is still found.
+	for _, signature := range []string{"PK\x05\x06", "7z\xBC\xAF\x27\x1C"} {
+		dense := append(append([]byte(nil), file.Bytes()[:offsets[1]]...), bytes.Repeat([]byte(signature), scanMaxCandidates+1)...)
+		archives, err := ContainerFindEmbedded(bytes.NewReader(dense), int64(len(dense)))
+		if err != ErrLimitReached || len(archives) != 1 || archives[0].Offset != offsets[0] {
+			t.Errorf("%q: expected the first archive and ErrLimitReached, got %v: %v", signature, archives, err)
+		}
+		if err = Carve(bytes.NewReader(dense), int64(len(dense)), func(file *CarvedFile) error { return nil }); err != ErrLimitReached {
+			t.Errorf("%q: expected ErrLimitReached from Carve, got %v", signature, err)
+		}
+	}
+}
+
+func TestCarve(t *testing.T) {
+	picture := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for n := range picture.Pix {
+		picture.Pix[n] = byte(n * 7)
+	}
+	var pngFile, jpegFile, gifFile, bmpFile bytes.Buffer
+	png.Encode(&pngFile, picture)
+	jpeg.Encode(&jpegFile, picture, nil)
+	gif.Encode(&gifFile, picture, nil)
+	bmp.Encode(&bmpFile, picture)
+
+	text := []byte("The quick brown fox jumps over the lazy dog.")
+	var gzipFile, zipFile bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipFile)
+	gzipWriter.Write(bytes.Repeat(text, 100))
+	gzipWriter.Close()
+	writer := zip.NewWriter(&zipFile)
+	fileWriter, _ := writer.Create("zip.txt")
+	fileWriter.Write(text)
+	writer.Close()
+
+	rtfFile := []byte(`{\rtf1\ansi {\fonttbl {\f0 Arial;}} \{braces\} and \\ {\b bold} text}`)
+	pdfFile := testPDF("", testPDFText("Carved")...)
+	docFile := testOLE2([]string{"WordDocument"}, [][]byte{text})
+
+	// Files between data that has signatures of invalid files
+	files := []struct {
+		format Format
+		data   []byte
+	}{
+		{FormatPNG, pngFile.Bytes()},
+		{FormatJPEG, jpegFile.Bytes()},
+		{FormatGIF, gifFile.Bytes()},
+		{FormatBMP, bmpFile.Bytes()},
+		{FormatPDF, pdfFile},
+		{FormatRTF, rtfFile},
+		{FormatDOC, docFile},
+		{FormatGZ, gzipFile.Bytes()},
+		{FormatZIP, zipFile.Bytes()},
+	}
+	var blob bytes.Buffer
+	var offsets []int64
+	for _, file := range files {
+		blob.WriteString("\x00\xFF\xD8\xFF\x00BM\x00{\\rtf1 GIF89a\x1F\x8B\x08\x00%PDF-1.4\x00")
+		blob.Write(bytes.Repeat([]byte{0xCC}, 777))
+		offsets = append(offsets, int64(blob.Len()))
+		blob.Write(file.data)
+	}
+	blob.WriteString("trailer")
+
+	var carved []*CarvedFile
+	err := Carve(bytes.NewReader(blob.Bytes()), int64(blob.Len()), func(file *CarvedFile) error {
+		carved = append(carved, file)
+		return nil
+	})
+	if err != nil || len(carved) != len(files) {
+		t.Fatalf("unexpected files %+v: %v", carved, err)
+	}
+	for n, file := range files {
+		data, err := ioutil.ReadAll(carved[n].Reader)
+		if carved[n].Format != file.format || carved[n].Offset != offsets[n] || err != nil || !bytes.Equal(data, file.data) {
+			t.Errorf("expected %s at offset %d with size %d, got %+v: %v", file.format, offsets[n], len(file.data), carved[n], err)
+		}
+	}
+
+	// OLE2 files with sectors in the FAT beyond the end of the data are not carved
+	docFile[512+4*100] = 0xFE
+	for n := 1; n < 4; n++ {
+		docFile[512+4*100+n] = 0xFF
+	}
+	err = Carve(bytes.NewReader(docFile), int64(len(docFile)), func(file *CarvedFile) error {
+		t.Errorf("unexpected file %+v", file)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// The callback stops carving
+	count := 0
+	err = Carve(bytes.NewReader(blob.Bytes()), int64(blob.Len()), func(file *CarvedFile) error {
+		count++
+		return SkipAll
+	})
+	if err != nil || count != 1 {
+		t.Errorf("expected SkipAll to stop after 1 file, got %d: %v", count, err)
+	}
+
+	// GZIP streams are charged to the budget and checked for decompression bombs
+	ctx := WithBudget(context.Background(), &Budget{MaxDecompressed: 1000})
+	if err = CarveContext(ctx, bytes.NewReader(blob.Bytes()), int64(blob.Len()), func(file *CarvedFile) error { return nil }); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected ErrBudgetExceeded, got %v", err)
+	}
+	ctx = WithBombLimits(context.Background(), BombLimits{MaxRatio: 10, MinRatioSize: 1 << 10})
+	if err = CarveContext(ctx, bytes.NewReader(blob.Bytes()), int64(blob.Len()), func(file *CarvedFile) error { return nil }); !errors.Is(err, ErrDecompressionBomb) {
+		t.Errorf("expected ErrDecompressionBomb, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+File Name:  Convert.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Single entry point for text conversion. It detects the format and calls the matching converter.
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/IntelligenceX/fileconversion/html2text"
+)
+
+// Options are the options for Convert
+type Options struct {
+	Limit    int64        // Max amount of bytes (not characters) to write out. 0 means unlimited.
+	RowLimit int          // Max amount of rows per sheet to extract from XLSX files. 0 means unlimited.
+	Format   Format       // Optional format. If set, the format detection is skipped.
+	Budget   *Budget      // Optional resource budget. If set, the conversion stops with ErrBudgetExceeded once a limit is exceeded.
+	Output   OutputFormat // Format of the text. The default is plain text.
+}
+
+// Result is the result of Convert
+type Result struct {
+	Format    Format // Detected format
+	Written   int64  // Bytes written to the writer
+	Truncated bool   // Indicates that the output was truncated because the limit was reached
+	Err       error  // Error, if any
+}
+
+// Convert detects the format of the input and extracts the text to the writer using the default registry.
+// Formats that are detected but have no converter, for example PPT, MSG and archives, return ErrUnsupportedFormat.
+// Size is the full size of the input file. The context is checked before any processing and on every write.
+// Truncation because of the output limit is not an error, but indicated via Result.Truncated.
+func Convert(ctx context.Context, input io.ReaderAt, size int64, writer io.Writer, options Options) (result Result) {
+	return DefaultRegistry.Convert(ctx, input, size, writer, options)
+}
+
+// builtinConverters are the conversion functions for all formats supported by this package
+var builtinConverters = map[Format]func(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error){
+	FormatDOCX: convertDOCX,
+	FormatXLSX: convertXLSX,
+	FormatPPTX: convertPPTX,
+	FormatODT:  convertODT,
+	FormatODS:  convertODS,
+	FormatODP:  convertODP,
+	FormatEPUB: convertEPUB,
+	FormatDOC:  convertDOC,
+	FormatXLS:  convertXLS,
+	FormatPDF:  convertPDF,
+	FormatMOBI: convertMOBI,
+	FormatRTF:  convertRTF,
+	FormatHTML: convertHTML,
+}
+
+// converterLimit returns the output limit for converters that accept one.
+// They get one more byte than allowed, so the limited writer can tell whether the output was truncated.
+func converterLimit(options Options) int64 {
+	if options.Limit > 0 {
+		return options.Limit + 1
+	}
+
+	return math.MaxInt64
+}
+
+// writeText writes the text returned by converters that do not support a writer
+func writeText(writer io.Writer, text string) (written int64, err error) {
+	if text == "" {
+		return 0, nil
+	}
+
+	return io.Copy(writer, strings.NewReader(text))
+}
+
+func convertDOCX(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		return markdownDocument(ctx, DOCX2Document, file, size, writer, options)
+	}
+
+	return DOCX2TextContext(ctx, file, size, writer, converterLimit(options))
+}
+
+func convertXLSX(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		return markdownDocument(ctx, XLSX2Document, file, size, writer, options)
+	}
+
+	rowLimit := options.RowLimit
+	if rowLimit <= 0 {
+		rowLimit = -1
+	}
+
+	return XLSX2TextContext(ctx, file, size, writer, converterLimit(options), rowLimit)
+}
+
+func convertPPTX(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		return markdownDocument(ctx, PPTX2Document, file, size, writer, options)
+	}
+
+	return PPTX2TextContext(ctx, file, size, writer, converterLimit(options))
+}
+
+func convertODT(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return ODT2TextContext(ctx, file, size, writer, converterLimit(options))
+}
+
+func convertODP(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return odfWriteText(ctx, FormatODP, file, size, writer, converterLimit(options))
+}
+
+func convertODS(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		return markdownDocument(ctx, ODS2Document, file, size, writer, options)
+	}
+
+	return ODS2TextContext(ctx, file, size, writer, converterLimit(options))
+}
+
+func convertEPUB(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return epubWriteText(ctx, file, size, writer, converterLimit(options), options.Output)
+}
+
+func convertDOC(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return DOC2TextWriterContext(ctx, io.NewSectionReader(file, 0, size), writer, converterLimit(options))
+}
+
+func convertXLS(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		return markdownDocument(ctx, XLS2Document, file, size, writer, options)
+	}
+
+	return XLS2TextContext(ctx, io.NewSectionReader(file, 0, size), writer, converterLimit(options))
+}
+
+func convertPDF(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		return markdownDocument(ctx, PDF2Document, file, size, writer, options)
+	}
+
+	return PDFListContentStreamsContext(ctx, io.NewSectionReader(file, 0, size), writer, converterLimit(options))
+}
+
+func convertMOBI(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	if options.Output == OutputMarkdown {
+		text, err := mobiMarkdown(ctx, io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return 0, err
+		}
+
+		return writeText(writer, text)
+	}
+
+	return Mobi2TextContext(ctx, io.NewSectionReader(file, 0, size), writer, converterLimit(options))
+}
+
+func convertRTF(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return RTF2TextContext(ctx, io.NewSectionReader(file, 0, size), writer, converterLimit(options))
+}
+
+func convertHTML(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return htmlWriteText(ctx, io.NewSectionReader(file, 0, size), html2text.Options{Markdown: options.Output == OutputMarkdown}, writer, converterLimit(options))
+}
+
+// limitWriter is a writer that enforces an output limit and checks the context on every write
+type limitWriter struct {
+	ctx       context.Context
+	writer    io.Writer
+	limit     int64 // remaining bytes, negative for unlimited
+	written   int64
+	truncated bool
+}
+
+// newLimitWriter creates a new limited writer. A limit of 0 or less means unlimited.
+func newLimitWriter(ctx context.Context, writer io.Writer, limit int64) *limitWriter {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return &limitWriter{ctx: ctx, writer: writer, limit: limit}
+}
+
+func (w *limitWriter) Write(p []byte) (n int, err error) {
+	if err = w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if w.limit < 0 {
+		n, err = w.writer.Write(p)
+		w.written += int64(n)
+		return n, err
+	}
+
+	output := p
+	if int64(len(output)) > w.limit {
+		output = truncateUTF8(output, w.limit)
+		w.truncated = true
+	}
+
+	n, err = w.writer.Write(output)
+	w.written += int64(n)
+	w.limit -= int64(n)
+
+	if w.truncated {
+		w.limit = 0
+
+		if err == nil {
+			err = ErrLimitReached
+		}
+	}
+
+	return n, err
+}
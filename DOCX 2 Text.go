@@ -1,133 +1,307 @@
-/*
-File Name:  DOCX 2 Text.go
-Copyright:  2018 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-This code is forked from https://github.com/guylaor/goword and extracts text from DOCX files.
-*/
-
-package fileconversion
-
-import (
-	"archive/zip"
-	"bytes"
-	"encoding/xml"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"strings"
-)
-
-// models.go
-
-// WordDocument is a full word doc
-type WordDocument struct {
-	Paragraphs []WordParagraph
-}
-
-// WordParagraph is a single paragraph
-type WordParagraph struct {
-	Style WordStyle `xml:"pPr>pStyle"`
-	Rows  []WordRow `xml:"r"`
-}
-
-// WordStyle ...
-type WordStyle struct {
-	Val string `xml:"val,attr"`
-}
-
-// WordRow ...
-type WordRow struct {
-	Text string `xml:"t"`
-}
-
-// AsText returns all text in the document
-func (w WordDocument) AsText() string {
-	text := ""
-	for _, v := range w.Paragraphs {
-		for _, rv := range v.Rows {
-			text += rv.Text
-		}
-		text += "\n"
-	}
-	return text
-}
-
-// goword.go
-
-// DOCX2Text extracts text of a Word document
-// Size is the full size of the input file.
-func DOCX2Text(file io.ReaderAt, size int64) (string, error) {
-
-	doc, err := openWordFile(file, size)
-	if err != nil {
-		return "", err
-	}
-
-	docx, err := WordParse(doc)
-	if err != nil {
-		return "", err
-	}
-
-	return docx.AsText(), nil
-}
-
-// WordParse parses a word file
-func WordParse(doc string) (WordDocument, error) {
-
-	docx := WordDocument{}
-	r := strings.NewReader(string(doc))
-	decoder := xml.NewDecoder(r)
-
-	for {
-		t, _ := decoder.Token()
-		if t == nil {
-			break
-		}
-		switch se := t.(type) {
-		case xml.StartElement:
-			if se.Name.Local == "p" {
-				var p WordParagraph
-				decoder.DecodeElement(&p, &se)
-				docx.Paragraphs = append(docx.Paragraphs, p)
-			}
-		}
-	}
-	return docx, nil
-}
-
-func openWordFile(file io.ReaderAt, size int64) (string, error) {
-
-	// Open a zip archive for reading. word files are zip archives
-	r, err := zip.NewReader(file, size)
-	if err != nil {
-		return "", err
-	}
-
-	// Iterate through the files in the archive,
-	// find document.xml
-	for _, f := range r.File {
-
-		//fmt.Printf("Contents of %s:\n", f.Name)
-		rc, err := f.Open()
-		if err != nil {
-			return "", err
-		}
-		defer rc.Close()
-		if f.Name == "word/document.xml" {
-			doc, err := ioutil.ReadAll(rc)
-			if err != nil {
-				return "", err
-			}
-			return fmt.Sprintf("%s", doc), nil
-		}
-	}
-
-	return "", nil
-}
-
-// IsFileDOCX checks if the data indicates a DOCX file
-// DOCX has a signature of 50 4B 03 04
-func IsFileDOCX(data []byte) bool {
-	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04})
-}
+/*
+File Name:  DOCX 2 Text.go
+Copyright:  2018 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+This code is forked from https://github.com/guylaor/goword and extracts text from DOCX files.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// models.go
+
+// WordDocument is a full word doc
+type WordDocument struct {
+	Paragraphs []WordParagraph
+}
+
+// WordParagraph is a single paragraph
+type WordParagraph struct {
+	Style        WordStyle      `xml:"pPr>pStyle"`
+	OutlineLevel *WordStyle     `xml:"pPr>outlineLvl"` // Outline level starting at 0, 9 is body text
+	Numbering    *WordNumbering `xml:"pPr>numPr"`
+	Section      *WordSection   `xml:"pPr>sectPr"`
+	Rows         []WordRow      `xml:"r"`
+}
+
+// WordStyle ...
+type WordStyle struct {
+	Val string `xml:"val,attr"`
+}
+
+// WordNumbering is the numbering of a list item
+type WordNumbering struct {
+	Level WordStyle `xml:"ilvl"` // Nesting level starting at 0
+	ID    WordStyle `xml:"numId"`
+}
+
+// WordSection are the properties of a section. The paragraph that has them is the last one of the section.
+type WordSection struct{}
+
+// WordRow ...
+type WordRow struct {
+	Text string `xml:"t"`
+}
+
+// AsText returns all text in the document
+func (w WordDocument) AsText() string {
+	text := ""
+	for _, v := range w.Paragraphs {
+		for _, rv := range v.Rows {
+			text += rv.Text
+		}
+		text += "\n"
+	}
+	return text
+}
+
+// goword.go
+
+// errDOCXNoDocument is returned for documents without word/document.xml
+var errDOCXNoDocument = errors.New("word/document.xml not found")
+
+// DOCX2Text extracts text of a Word document
+// Size is the full size of the input file. If the XML is invalid, the text up to the error is returned together with the error.
+// A document without word/document.xml has no text and returns no error, as in earlier versions.
+func DOCX2Text(file io.ReaderAt, size int64) (string, error) {
+	var buffer bytes.Buffer
+
+	_, err := DOCX2TextWriter(file, size, &buffer, math.MaxInt64)
+	if errors.Is(err, errDOCXNoDocument) {
+		return "", nil
+	}
+
+	return buffer.String(), err
+}
+
+// DOCX2TextWriter extracts text of a Word document and writes it to the writer. It returns bytes written.
+// Size is the full size of the input file. Limit is the max amount of bytes (not characters) to write out.
+// The document is parsed as stream, paragraph by paragraph. Parsing stops once the limit is reached and ErrLimitReached is returned.
+func DOCX2TextWriter(file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	return DOCX2TextContext(context.Background(), file, size, writer, limit)
+}
+
+// DOCX2TextContext is the same as DOCX2TextWriter, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed XML.
+func DOCX2TextContext(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	defer recoverPanic(FormatDOCX, &err)
+
+	rc, err := openWordDocument(&contextReaderAt{ctx: ctx, reader: file}, size)
+	if err != nil {
+		return 0, zipOpenError(FormatDOCX, file, size, err)
+	} else if rc == nil {
+		return 0, &ConversionError{Format: FormatDOCX, Kind: ErrCorrupt, Err: errDOCXNoDocument}
+	}
+	defer rc.Close()
+
+	budgetRC := &budgetReader{budget: BudgetFromContext(ctx), reader: rc}
+	decoder := xml.NewDecoder(budgetRC)
+
+	for {
+		t, err := decoder.Token()
+		if err != nil {
+			return written, docxDecodeError(ctx, budgetRC, err)
+		}
+		switch se := t.(type) {
+		case xml.StartElement:
+			if se.Name.Local == "p" {
+				if err = ctx.Err(); err != nil {
+					return written, err
+				}
+
+				var p WordParagraph
+				if err = decoder.DecodeElement(&p, &se); err != nil {
+					return written, docxDecodeError(ctx, budgetRC, err)
+				}
+
+				if err = writeOutputLimit(writer, []byte(p.text()+"\n"), &written, &limit); err != nil {
+					return written, err
+				}
+			}
+		}
+	}
+}
+
+// docxDecodeError returns the error for a failed read of the XML. A cancelled context or an exceeded budget end the XML stream early
+// and are returned instead of the syntax error. The end of the XML is no error.
+func docxDecodeError(ctx context.Context, budgetRC *budgetReader, err error) error {
+	if budgetRC.err != nil {
+		return newConversionError(FormatDOCX, ErrBudgetExceeded, budgetRC.err)
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err == io.EOF {
+		return nil
+	}
+
+	return newConversionError(FormatDOCX, ErrCorrupt, err)
+}
+
+// DOCX2Document extracts the structure of a Word document: sections with headings, paragraphs, list items and tables.
+// Size is the full size of the input file. The budget of the context is charged for the decompressed XML.
+func DOCX2Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	defer recoverPanic(FormatDOCX, &err)
+
+	builder := newDocumentBuilder(FormatDOCX, options)
+
+	rc, err := openWordDocument(&contextReaderAt{ctx: ctx, reader: file}, size)
+	if err != nil {
+		return builder.result(zipOpenError(FormatDOCX, file, size, err))
+	} else if rc == nil {
+		return builder.result(&ConversionError{Format: FormatDOCX, Kind: ErrCorrupt, Err: errors.New("word/document.xml not found")})
+	}
+	defer rc.Close()
+
+	budgetRC := &budgetReader{budget: BudgetFromContext(ctx), reader: rc}
+	decoder := xml.NewDecoder(budgetRC)
+	section := 1
+	builder.open(BlockSection, "", section)
+
+	for {
+		t, err := decoder.Token()
+		if err != nil {
+			return builder.result(docxDecodeError(ctx, budgetRC, err))
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "p":
+			if err = ctx.Err(); err != nil {
+				return builder.result(err)
+			}
+
+			var p WordParagraph
+			if err = decoder.DecodeElement(&p, &se); err != nil {
+				return builder.result(docxDecodeError(ctx, budgetRC, err))
+			}
+
+			if block := p.block(); block.Text != "" {
+				if err = builder.add(block); err != nil {
+					return builder.result(err)
+				}
+			}
+
+			if p.Section != nil {
+				section++
+				builder.open(BlockSection, "", section)
+			}
+
+		case "tbl":
+			if err = xmlReadTable(decoder, builder, docxParagraphText); err != nil {
+				return builder.result(err)
+			}
+		}
+	}
+}
+
+// text returns the text of all runs
+func (p WordParagraph) text() (text string) {
+	for _, rv := range p.Rows {
+		text += rv.Text
+	}
+	return text
+}
+
+// block returns the paragraph as block of the document model. Headings are detected by the style and outline level, list items by the numbering and style.
+func (p WordParagraph) block() (block Block) {
+	block = Block{Type: BlockParagraph, Text: strings.TrimSpace(p.text())}
+
+	style := strings.ToLower(p.Style.Val)
+
+	if style == "title" {
+		block.Type, block.Level = BlockHeading, 1
+	} else if level, err := strconv.Atoi(strings.TrimPrefix(style, "heading")); err == nil && strings.HasPrefix(style, "heading") && level >= 1 && level <= 9 {
+		block.Type, block.Level = BlockHeading, level
+	} else if level, err := strconv.Atoi(p.outlineLevel()); err == nil && level >= 0 && level <= 8 {
+		block.Type, block.Level = BlockHeading, level+1
+	} else if p.Numbering != nil && p.Numbering.ID.Val != "0" {
+		level, _ := strconv.Atoi(p.Numbering.Level.Val)
+		if level < 0 || level > 8 {
+			level = 0
+		}
+		block.Type, block.Level = BlockListItem, level+1
+	} else if strings.HasPrefix(style, "list") {
+		block.Type, block.Level = BlockListItem, 1
+	}
+
+	return block
+}
+
+// outlineLevel returns the value of the outline level, if any
+func (p WordParagraph) outlineLevel() string {
+	if p.OutlineLevel == nil {
+		return ""
+	}
+	return p.OutlineLevel.Val
+}
+
+// docxParagraphText returns the text of a paragraph in a table
+func docxParagraphText(decoder *xml.Decoder, se *xml.StartElement) string {
+	var p WordParagraph
+	decoder.DecodeElement(&p, se)
+
+	return p.text()
+}
+
+// WordParse parses a word file
+func WordParse(doc string) (WordDocument, error) {
+
+	docx := WordDocument{}
+	r := strings.NewReader(string(doc))
+	decoder := xml.NewDecoder(r)
+
+	for {
+		t, _ := decoder.Token()
+		if t == nil {
+			break
+		}
+		switch se := t.(type) {
+		case xml.StartElement:
+			if se.Name.Local == "p" {
+				var p WordParagraph
+				decoder.DecodeElement(&p, &se)
+				docx.Paragraphs = append(docx.Paragraphs, p)
+			}
+		}
+	}
+	return docx, nil
+}
+
+// openWordDocument opens the main document word/document.xml. It returns nil if it does not exist.
+func openWordDocument(file io.ReaderAt, size int64) (io.ReadCloser, error) {
+
+	// Open a zip archive for reading. word files are zip archives
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range r.File {
+		if f.Name == "word/document.xml" {
+			return f.Open()
+		}
+	}
+
+	return nil, nil
+}
+
+// IsFileDOCX checks if the data indicates a DOCX file
+// DOCX has a signature of 50 4B 03 04
+func IsFileDOCX(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04})
+}
@@ -1,135 +1,998 @@
-/*
-File Name:  Decompress.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-*/
-
-package fileconversion
-
-import (
-	"archive/tar"
-	"archive/zip"
-	"bytes"
-	"compress/bzip2"
-	"compress/gzip"
-	"io"
-	"io/ioutil"
-	"time"
-
-	"github.com/nwaples/rardecode"
-	"github.com/saracen/go7z"
-	"github.com/ulikunitz/xz"
-)
-
-// DecompressFile decompresses data. It supports: GZ, BZ, BZ2, XZ
-func DecompressFile(data []byte) (decompressed []byte, valid bool) {
-	// Try GZ
-	if gr, err := gzip.NewReader(bytes.NewBuffer(data)); err == nil {
-		defer gr.Close()
-		decompressed, err = ioutil.ReadAll(gr)
-		if err == nil {
-			return decompressed, true
-		}
-	}
-
-	// BZ, BZ2
-	br := bzip2.NewReader(bytes.NewBuffer(data))
-	decompressed, err := ioutil.ReadAll(br)
-	if err == nil {
-		return decompressed, true
-	}
-
-	// XZ
-	if xr, err := xz.NewReader(bytes.NewBuffer(data)); err == nil {
-		decompressed, err = ioutil.ReadAll(xr)
-		if err == nil {
-			return decompressed, true
-		}
-	}
-
-	return nil, false
-}
-
-// ContainerExtractFiles extracts files from supported containers: ZIP, RAR, 7Z, TAR
-func ContainerExtractFiles(data []byte, callback func(name string, size int64, date time.Time, data []byte)) {
-
-	// ZIP
-	if r, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
-		for _, f := range r.File {
-			fileReader, err := f.Open()
-			if err != nil {
-				continue
-			}
-
-			data2, err := ioutil.ReadAll(fileReader)
-			fileReader.Close()
-			if err != nil {
-				// If the file is encrypted with a password, this fails with error "4" here.
-				continue
-			}
-
-			callback(f.Name, int64(f.UncompressedSize64), f.Modified, data2)
-		}
-
-		return
-	}
-
-	// RAR
-	if rc, err := rardecode.NewReader(bytes.NewReader(data), ""); err == nil {
-		for {
-			hdr, err := rc.Next()
-			if err == io.EOF || err != nil { // break if end of archive or other error returned
-				break
-			} else if err == nil && !hdr.IsDir {
-				if data2, err := ioutil.ReadAll(rc); err == nil {
-					callback(hdr.Name, hdr.UnPackedSize, hdr.CreationTime, data2)
-				}
-			}
-		}
-	}
-
-	// 7Z
-	if sz, err := go7z.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
-		for {
-			hdr, err := sz.Next()
-			if err == io.EOF || err != nil { // break if end of archive or other error returned
-				break // End of archive
-			} else if err == nil && !hdr.IsEmptyFile {
-				if data2, err := ioutil.ReadAll(sz); err == nil {
-					callback(hdr.Name, int64(len(data2)), hdr.CreatedAt, data2)
-				}
-			}
-		}
-	} else if err == go7z.ErrDecompressorNotFound {
-		// May happen if it's 7Z, but decompressor not available (like 7zAES).
-		return
-	}
-
-	// TAR
-	tr := tar.NewReader(bytes.NewReader(data))
-	// Iterate through the files in the archive.
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			// end of tar archive
-			break
-		}
-		if err != nil {
-			// other error
-			break
-		}
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			// directories are ignored
-		case tar.TypeReg, tar.TypeRegA:
-			// file
-			data2, err := ioutil.ReadAll(tr)
-			if err != nil {
-				continue
-			}
-
-			callback(hdr.Name, hdr.Size, hdr.ModTime, data2)
-		}
-	}
-
-}
+/*
+File Name:  Decompress.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+*/
+
+package fileconversion
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nwaples/rardecode"
+	"github.com/pierrec/lz4/v4"
+	"github.com/saracen/go7z"
+	"github.com/sorairolake/lzip-go"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// DecompressFile decompresses data. It supports: GZ, BZ2, XZ, ZSTD, LZ4, LZIP, LZMA, Z (Unix compress) and zlib. The format is detected via the signature.
+// Decompression bombs are detected using DefaultBombLimits and return invalid. Use Decompress to get the detected format and the error.
+// Brotli and raw deflate are not decompressed, since they have no signature. Use DecompressFormat for them.
+func DecompressFile(data []byte) (decompressed []byte, valid bool) {
+	decompressed, valid, _ = DecompressFileContext(context.Background(), data)
+	return decompressed, valid
+}
+
+// DecompressFileContext is the same as DecompressFile, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes. Panics of the decompressors are returned as ErrParserPanic.
+// Decompression bombs are detected using the limits of the context (see WithBombLimits) and return a *BombError.
+func DecompressFileContext(ctx context.Context, data []byte) (decompressed []byte, valid bool, err error) {
+	result, err := DecompressContext(ctx, data)
+	if errors.Is(err, ErrUnsupportedFormat) || errors.Is(err, ErrCorrupt) {
+		return nil, false, ctx.Err()
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return result.Data, true, nil
+}
+
+// DecompressResult is the result of Decompress
+type DecompressResult struct {
+	Data   []byte        // Decompressed data
+	Format Format        // Compression format
+	Gzip   []gzip.Header // Headers of all members of a GZ file with the original file name, modification time and comment. Concatenated members are decompressed as one.
+}
+
+// Decompress decompresses data. It supports: GZ, BZ2, XZ, ZSTD, LZ4, LZIP, LZMA, Z (Unix compress) and zlib.
+// The format is detected via the signature, only the matching decompressor is used. If there is no known signature, ErrUnsupportedFormat is returned.
+// Invalid data returns a *ConversionError with ErrCorrupt. Brotli and raw deflate have no signature, use DecompressFormat for them.
+func Decompress(data []byte) (result *DecompressResult, err error) {
+	return DecompressContext(context.Background(), data)
+}
+
+// DecompressContext is the same as Decompress, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes. Panics of the decompressors are returned as ErrParserPanic.
+// Decompression bombs are detected using the limits of the context (see WithBombLimits) and return a *BombError.
+func DecompressContext(ctx context.Context, data []byte) (result *DecompressResult, err error) {
+	format, _ := decompressDetect(data)
+	if format == FormatUnknown {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrUnsupportedFormat
+	}
+
+	return DecompressFormatContext(ctx, data, format)
+}
+
+// DecompressFormat decompresses data in the given format. This is required for Brotli and raw deflate, which cannot be detected.
+// For example, the format may be known from the file extension or the Content-Encoding of an HTTP response.
+func DecompressFormat(data []byte, format Format) (result *DecompressResult, err error) {
+	return DecompressFormatContext(context.Background(), data, format)
+}
+
+// DecompressFormatContext is the same as DecompressFormat, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes. Decompression bombs are detected using the limits of the context (see WithBombLimits).
+func DecompressFormatContext(ctx context.Context, data []byte, format Format) (result *DecompressResult, err error) {
+	defer recoverPanic(format, &err)
+
+	decompressor, err := newDecompressor(format, bytes.NewReader(data))
+	if err == ErrUnsupportedFormat {
+		return nil, err
+	} else if err != nil {
+		return nil, newConversionError(format, ErrCorrupt, err)
+	}
+
+	bomb := newBombTracker(ctx, int64(len(data))).reader("", 0, decompressor)
+	reader := decompressReader(ctx, bomb)
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if reader.err != nil {
+		return nil, reader.err
+	} else if bomb.err != nil {
+		return nil, bomb.err
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, newConversionError(format, ErrCorrupt, err)
+	}
+
+	result = &DecompressResult{Data: decompressed, Format: format}
+	if gzipReader, ok := decompressor.(*gzipMembersReader); ok {
+		result.Gzip = gzipReader.headers
+	}
+
+	return result, nil
+}
+
+// decompressDetect detects the compression format via its signature. Brotli and raw deflate are never detected, they have no signature.
+// The signatures of zlib and LZMA alone are short or only consist of valid parameters, they are returned with ConfidenceLow.
+func decompressDetect(header []byte) (format Format, confidence int) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1F, 0x8B}):
+		return FormatGZ, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0x42, 0x5A, 0x68}): // "BZh"
+		return FormatBZ2, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}):
+		return FormatXZ, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0x28, 0xB5, 0x2F, 0xFD}):
+		return FormatZSTD, ConfidenceSignature
+	case len(header) >= 4 && header[0]&0xF0 == 0x50 && bytes.Equal(header[1:4], []byte{0x2A, 0x4D, 0x18}):
+		// Zstandard skippable frame, usually followed by a regular frame
+		return FormatZSTD, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0x04, 0x22, 0x4D, 0x18}), bytes.HasPrefix(header, []byte{0x02, 0x21, 0x4C, 0x18}): // LZ4 frame and legacy format
+		return FormatLZ4, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte("LZIP")):
+		return FormatLZIP, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0x1F, 0x9D}):
+		return FormatZ, ConfidenceSignature
+	case isZlibHeader(header):
+		return FormatZlib, ConfidenceLow
+	case isLZMAAlone(header):
+		return FormatLZMA, ConfidenceLow
+	}
+
+	return FormatUnknown, ConfidenceNone
+}
+
+// isZlibHeader checks the header of a zlib stream: deflate with a 32 KB window, no preset dictionary, and the check bits that make the first 2 bytes a multiple of 31.
+// The first deflate block must not use the reserved block type. Uncompressed blocks store the length and its complement.
+func isZlibHeader(header []byte) bool {
+	if len(header) < 3 || header[0] != 0x78 || header[1]&0x20 != 0 || binary.BigEndian.Uint16(header)%31 != 0 {
+		return false
+	}
+
+	switch header[2] >> 1 & 3 {
+	case 0:
+		return len(header) < 7 || binary.LittleEndian.Uint16(header[3:]) == ^binary.LittleEndian.Uint16(header[5:])
+	case 3:
+		return false
+	}
+
+	return true
+}
+
+// isLZMAAlone checks the header of an LZMA alone file: properties (1), dictionary size (4) and uncompressed size (8), which is -1 if unknown
+func isLZMAAlone(header []byte) bool {
+	if len(header) < 13 || header[0] >= 9*5*5 {
+		return false
+	}
+
+	// The dictionary size is 2^n or 2^n + 2^(n-1), at least 4 KB
+	dictionary := binary.LittleEndian.Uint32(header[1:])
+	if dictionary < 4096 {
+		return false
+	} else if low := dictionary & -dictionary; dictionary != low && dictionary != low*3 {
+		return false
+	}
+
+	size := binary.LittleEndian.Uint64(header[5:])
+	return size == 0xFFFFFFFFFFFFFFFF || size < 1<<40
+}
+
+// newDecompressor returns the decompressor for the format
+func newDecompressor(format Format, reader io.Reader) (decompressor io.Reader, err error) {
+	switch format {
+	case FormatGZ:
+		return newGzipMembersReader(reader)
+	case FormatBZ2:
+		return bzip2.NewReader(reader), nil
+	case FormatXZ:
+		return xz.NewReader(reader)
+	case FormatZSTD:
+		// A single goroutine decodes synchronously, so the decoder does not need to be closed
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder, nil
+	case FormatLZ4:
+		return lz4.NewReader(reader), nil
+	case FormatLZIP:
+		return lzip.NewReader(reader)
+	case FormatLZMA:
+		return lzma.NewReader(reader)
+	case FormatZ:
+		return newLZWReader(reader)
+	case FormatZlib:
+		return zlib.NewReader(reader)
+	case FormatBrotli:
+		return brotli.NewReader(reader), nil
+	case FormatDeflate:
+		return flate.NewReader(reader), nil
+	}
+
+	return nil, ErrUnsupportedFormat
+}
+
+// decompressPayload decompresses the payload of a package (RPM, Debian) if it starts with the signature of a supported compression format.
+// Otherwise it is returned as is.
+func decompressPayload(reader io.Reader) (payload io.Reader, err error) {
+	buffered := bufio.NewReader(reader)
+	header, _ := buffered.Peek(13)
+
+	format, _ := decompressDetect(header)
+	if format == FormatUnknown {
+		return buffered, nil
+	}
+
+	return newDecompressor(format, buffered)
+}
+
+// decompressReader returns a reader that checks the context and charges the budget of the context for all bytes read.
+// The error of the budget is stored in the returned reader.
+func decompressReader(ctx context.Context, reader io.Reader) *budgetReader {
+	return &budgetReader{budget: BudgetFromContext(ctx), reader: &contextReader{ctx: ctx, reader: reader}}
+}
+
+// ContainerExtractFiles extracts files from supported containers: ZIP, RAR, 7Z, TAR, CAB, cpio, ar, DEB, RPM, ISO 9660 and UDF disk images
+// Directories are skipped and empty files are passed, for all formats. The date is the modification date, including RAR and 7Z which used the creation date in earlier versions.
+func ContainerExtractFiles(data []byte, callback func(name string, size int64, date time.Time, data []byte)) {
+	ContainerExtractFilesContext(context.Background(), data, callback)
+}
+
+// ContainerExtractFilesContext is the same as ContainerExtractFiles, but stops once the context is cancelled and returns its error.
+// The context is checked before each file and while decompressing it. The budget of the context is charged for the decompressed bytes.
+// Files that cannot be extracted and invalid archives are skipped. Use ContainerExtractReader to get these errors.
+// Names are normalized to safe relative paths (see ContainerFile.Name). Links are skipped.
+// Encrypted files are extracted if one of the candidate passwords of the context (see WithPasswords) works.
+func ContainerExtractFilesContext(ctx context.Context, data []byte, callback func(name string, size int64, date time.Time, data []byte)) (err error) {
+	err = ContainerExtractReaderContext(ctx, bytes.NewReader(data), int64(len(data)), func(file *ContainerFile) error {
+		if file.Err != nil || file.Symlink || file.Hardlink {
+			return nil
+		}
+
+		data2, err := ioutil.ReadAll(file.Reader)
+		if err != nil {
+			if errors.Is(err, ErrBudgetExceeded) || errors.Is(err, ErrDecompressionBomb) || ctx.Err() != nil {
+				return err
+			}
+			// If the file is encrypted with a password, this fails here.
+			return nil
+		}
+
+		size := file.Size
+		if size < 0 {
+			size = int64(len(data2))
+		}
+		callback(file.Name, size, file.Date, data2)
+		return nil
+	})
+
+	if errors.Is(err, ErrUnsupportedFormat) || errors.Is(err, ErrCorrupt) || errors.Is(err, ErrUnsupportedVersion) {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// ContainerFile is a file in a container, passed to the callback of ContainerExtractReader
+type ContainerFile struct {
+	Name         string    // Relative path that is safe to use on disk: without drive letters, leading slashes and ".." elements. Directories are separated by "/". Names that would be empty are "unnamed".
+	OriginalName string    // Name as stored in the container, decoded to UTF-8
+	NameEncoding string    // Detected encoding of non-ASCII names that are not marked as UTF-8 (ZIP only): "UTF-8", "IBM437", "IBM866", "Shift_JIS", "GBK" or "EUC-KR"
+	Size         int64     // Uncompressed size as stored in the container, -1 if unknown
+	Date         time.Time // Modification date
+	Reader       io.Reader // Decompressed data of the file. It is only valid during the callback. Nil if Err is set.
+	Err          error     // Set if the file cannot be extracted, for example because it is encrypted or uses an unsupported compression method
+
+	Encrypted bool   // The file is encrypted. If none of the candidate passwords (see WithPasswords) decrypts it, Err is ErrPasswordRequired.
+	Password  string // Candidate password that decrypted the file
+
+	Symlink    bool   // The file is a symbolic link to LinkTarget. Links have no data.
+	Hardlink   bool   // The file is a hard link to the previous file LinkTarget (TAR and RAR 5). Links have no data.
+	LinkTarget string // Target of the link. Symbolic links are as stored, hard links are normalized like Name.
+	UnsafeLink bool   // The symbolic link is absolute or points outside of the directory the container is extracted to
+	Duplicate  bool   // A previous file of the container has the same Name, ignoring case. Writing both to disk overwrites the previous one, on case-insensitive file systems too.
+
+	compressed int64 // Compressed size as stored in the container, 0 if unknown. It is used to check the compression ratio.
+}
+
+// SkipAll can be returned by the callback of ContainerExtractReader to stop the extraction without error
+var SkipAll = errors.New("skip all remaining files")
+
+// ContainerExtractReader extracts files from supported containers: ZIP, RAR, 7Z, TAR, CAB, cpio, ar, DEB, RPM, ISO 9660 and UDF disk images. Size is the full size of the input file.
+// Unlike ContainerExtractFiles the archive and its files are not loaded into memory. The callback gets a reader for every file.
+// To skip a file, the callback returns nil without reading it. Files that cannot be extracted are passed to the callback with Err set.
+// If the callback returns an error, the extraction stops and the error is returned. SkipAll stops it without error.
+// If the input is none of the supported containers, ErrUnsupportedFormat is returned. Invalid archives return a *ConversionError.
+// Directories are not passed to the callback, empty files are. The date is the modification date for all formats.
+func ContainerExtractReader(file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	return ContainerExtractReaderContext(context.Background(), file, size, callback)
+}
+
+// ContainerExtractReaderContext is the same as ContainerExtractReader, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes. Once it is exceeded, the reader of the file returns the error and the extraction stops.
+// The same applies to decompression bombs, which are detected using the limits of the context (see WithBombLimits).
+func ContainerExtractReaderContext(ctx context.Context, file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	// Panics of the parsers are returned as ErrParserPanic. Panics of the callback are not recovered.
+	inCallback := false
+	defer func() {
+		if !inCallback {
+			if value := recover(); value != nil {
+				err = newPanicError(FormatUnknown, value)
+			}
+		}
+	}()
+
+	var format Format
+	tracker := newBombTracker(ctx, size)
+	names := make(map[string]bool) // lower case names of the previous files, to flag duplicates
+
+	call := func(containerFile *ContainerFile) error {
+		tracker.files++
+
+		containerFile.OriginalName, containerFile.Name = containerFile.Name, containerSafeName(containerFile.Name)
+		// Case-insensitive file systems (Windows, macOS) treat names that only differ in case as the same file
+		lowerName := strings.ToLower(containerFile.Name)
+		containerFile.Duplicate = names[lowerName]
+		names[lowerName] = true
+		containerLink(format, containerFile)
+
+		var reader *budgetReader
+		var bomb *bombReader
+		if containerFile.Reader != nil {
+			bomb = tracker.reader(containerFile.Name, containerFile.compressed, containerFile.Reader)
+			reader = decompressReader(ctx, bomb)
+			containerFile.Reader = &containerFileReader{format: format, reader: reader}
+		}
+
+		inCallback = true
+		err := callback(containerFile)
+		inCallback = false
+
+		if err == nil && reader != nil && reader.err != nil {
+			// The callback ignored that the budget was exceeded.
+			err = reader.err
+		} else if err == nil && bomb != nil && bomb.err != nil {
+			err = newConversionError(format, ErrDecompressionBomb, bomb.err)
+		}
+		return err
+	}
+
+	file = &contextReaderAt{ctx: ctx, reader: file}
+
+	if r, errZIP := zip.NewReader(file, size); errZIP == nil {
+		format = FormatZIP
+		err = containerExtractZIP(ctx, r, file, tracker, call)
+	} else {
+		switch format, _ = DetectFormat(file, size); format {
+		case FormatZIP:
+			err = newConversionError(FormatZIP, ErrCorrupt, errZIP)
+		case FormatRAR:
+			err = containerExtractRAR(ctx, file, size, call)
+		case Format7Z:
+			err = containerExtract7Z(ctx, file, size, call)
+		case FormatISO, FormatUDF:
+			err = containerExtractISO(ctx, file, size, call)
+		case FormatCAB:
+			err = containerExtractCAB(ctx, file, size, tracker, call)
+		case FormatCPIO:
+			err = containerExtractCPIO(ctx, io.NewSectionReader(file, 0, size), FormatCPIO, call)
+		case FormatAR:
+			err = containerExtractAR(ctx, io.NewSectionReader(file, 0, size), call)
+		case FormatDEB:
+			err = containerExtractDEB(ctx, file, size, call)
+		case FormatRPM:
+			err = containerExtractRPM(ctx, file, size, call)
+		default:
+			// Old TAR files do not have a signature. They are only detected via a valid header.
+			format = FormatTAR
+			err = containerExtractTAR(ctx, io.NewSectionReader(file, 0, size), call)
+		}
+	}
+
+	if err == SkipAll {
+		err = nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return err
+}
+
+// containerExtractZIP calls the callback for all files of the ZIP archive. Archives with overlapping files are rejected as decompression bomb.
+// Encrypted files are decrypted with the candidate passwords of the context. Input is the archive.
+func containerExtractZIP(ctx context.Context, r *zip.Reader, input io.ReaderAt, tracker *bombTracker, callback func(file *ContainerFile) error) (err error) {
+	if name, overlap := zipOverlap(r); overlap {
+		return &ConversionError{Format: FormatZIP, Kind: ErrDecompressionBomb, Err: tracker.bombError(BombOverlap, name)}
+	}
+
+	passwords := passwordsFromContext(ctx)
+	lastPassword := ""
+	names, encodings := zipNames(r)
+
+	for n, f := range r.File {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		file := &ContainerFile{Name: names[n], NameEncoding: encodings[n], Size: int64(f.UncompressedSize64), Date: f.Modified, Symlink: f.Mode()&os.ModeSymlink != 0, compressed: int64(f.CompressedSize64)}
+
+		var fileReader io.ReadCloser
+		if f.Flags&0x1 != 0 {
+			file.Encrypted = true
+			if fileReader, file.Password, err = zipOpenEncrypted(ctx, f, input, passwordFirst(passwords, lastPassword)); err != nil {
+				file.Err = err
+			} else {
+				file.Reader = fileReader
+				lastPassword = file.Password
+			}
+		} else if fileReader, err = f.Open(); err == zip.ErrAlgorithm {
+			file.Err = newConversionError(FormatZIP, ErrUnsupportedVersion, err)
+		} else if err != nil {
+			file.Err = newConversionError(FormatZIP, ErrCorrupt, err)
+		} else {
+			file.Reader = fileReader
+		}
+
+		err = callback(file)
+		if fileReader != nil {
+			fileReader.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// containerExtractRAR calls the callback for all files of the RAR archive. Encrypted files are decrypted with the candidate passwords of the context.
+func containerExtractRAR(ctx context.Context, file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	// Invalid headers are reported by rardecode
+	archive, _ := rarReadHeaders(file, size)
+	headers, encryptedHeaders := archive.files, archive.encryptedHeaders
+
+	encrypted := encryptedHeaders
+	for _, header := range headers {
+		encrypted = encrypted || header.encrypted
+	}
+
+	password, found := "", false
+	if encrypted {
+		if password, found = rarFindPassword(ctx, file, size, headers, passwordsFromContext(ctx)); !found && encryptedHeaders {
+			return &ConversionError{Format: FormatRAR, Kind: ErrPasswordRequired}
+		}
+	}
+
+	rc, err := rardecode.NewReader(io.NewSectionReader(file, 0, size), password)
+	if err != nil {
+		return newConversionError(FormatRAR, ErrCorrupt, err)
+	}
+
+	for n := 0; ; n++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := rc.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil && encrypted && !found && n < len(headers) {
+			// Without the password rardecode may fail at an encrypted file. The remaining files are listed from the headers.
+			return rarEncryptedFiles(headers[n:], callback)
+		} else if err != nil {
+			return newConversionError(FormatRAR, ErrCorrupt, err)
+		} else if hdr.IsDir {
+			continue
+		}
+
+		size := hdr.UnPackedSize
+		if hdr.UnKnownSize {
+			size = -1
+		}
+
+		// rardecode returns RAR 5 times in the local time zone. The parsed headers use UTC, as the listing does.
+		containerFile := &ContainerFile{Name: hdr.Name, Size: size, Date: hdr.ModificationTime, Reader: rc, compressed: hdr.PackedSize}
+		if n < len(headers) {
+			containerFile.Symlink, containerFile.Hardlink, containerFile.LinkTarget = headers[n].symlink, headers[n].hardlink, headers[n].linkTarget
+			containerFile.Date = headers[n].date
+		}
+		if n < len(headers) && headers[n].encrypted {
+			containerFile.Encrypted = true
+			if found {
+				containerFile.Password = password
+			} else {
+				containerFile.Reader = nil
+				containerFile.Err = &ConversionError{Format: FormatRAR, Kind: ErrPasswordRequired}
+			}
+		}
+
+		if err = callback(containerFile); err != nil {
+			return err
+		}
+	}
+}
+
+// rarEncryptedFiles calls the callback for the files of the RAR archive that cannot be decrypted
+func rarEncryptedFiles(headers []rarFileHeader, callback func(file *ContainerFile) error) (err error) {
+	for _, header := range headers {
+		if header.directory {
+			continue
+		}
+
+		containerFile := &ContainerFile{Name: header.name, Size: -1, Encrypted: header.encrypted, Symlink: header.symlink, Hardlink: header.hardlink, LinkTarget: header.linkTarget}
+		if header.encrypted {
+			containerFile.Err = &ConversionError{Format: FormatRAR, Kind: ErrPasswordRequired}
+		} else {
+			containerFile.Err = &ConversionError{Format: FormatRAR, Kind: ErrCorrupt, Err: errors.New("file follows an encrypted file")}
+		}
+
+		if err = callback(containerFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rarFindPassword returns the first candidate password that decrypts the first encrypted file of the RAR archive.
+// RAR 5 detects wrong passwords via a check value, older versions via the checksum of the file.
+func rarFindPassword(ctx context.Context, file io.ReaderAt, size int64, headers []rarFileHeader, passwords []string) (password string, found bool) {
+	for _, password = range passwords {
+		if ctx.Err() != nil {
+			return "", false
+		}
+
+		rc, err := rardecode.NewReader(io.NewSectionReader(file, 0, size), password)
+		if err != nil {
+			continue
+		}
+
+		for n := 0; ; n++ {
+			hdr, err := rc.Next()
+			if err != nil {
+				// Archives with encrypted headers and no files
+				if err == io.EOF && len(headers) == 0 {
+					return password, true
+				}
+				break
+			} else if hdr.IsDir || (n < len(headers) && !headers[n].encrypted) {
+				continue
+			}
+
+			if passwordVerify(ctx, rc, hdr.PackedSize) {
+				return password, true
+			}
+			break
+		}
+	}
+
+	return "", false
+}
+
+// containerExtract7Z calls the callback for all files of the 7Z archive. Encrypted files are decrypted with the candidate passwords of the context.
+func containerExtract7Z(ctx context.Context, file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	sz, err := go7z.NewReader(file, size)
+	if err == go7z.ErrDecompressorNotFound {
+		// May happen if it's 7Z, but decompressor not available.
+		return &ConversionError{Format: Format7Z, Kind: ErrUnsupportedVersion, Err: err}
+	} else if err != nil && sevenZipHeadersEncrypted(file, size) {
+		// go7z cannot decrypt the headers, since the password can only be set after they are read.
+		return &ConversionError{Format: Format7Z, Kind: ErrPasswordRequired, Err: err}
+	} else if err != nil {
+		return newConversionError(Format7Z, ErrCorrupt, err)
+	}
+
+	// The password is requested once the first encrypted block of files is decompressed, which happens in Next before the file is returned.
+	// Whether a file is encrypted is taken from the listing, since archives may contain both encrypted and unencrypted blocks.
+	found, searched := false, false
+	password := ""
+	var entries []ContainerEntry
+	if listing, err := list7Z(file, size); err == nil {
+		entries = listing.Files
+	}
+	sz.Options.SetPasswordCallback(func() string {
+		if !searched {
+			searched = true
+			password, found = sevenZipFindPassword(ctx, file, size, passwordsFromContext(ctx))
+		}
+		return password
+	})
+
+	for n := 0; ; n++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := sz.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return newConversionError(Format7Z, ErrCorrupt, err)
+		} else if hdr.IsEmptyStream && !hdr.IsEmptyFile {
+			// directories are ignored
+			continue
+		}
+
+		// 7-Zip stores the Unix mode in the high 16 bits of the attributes, indicated by 0x8000
+		containerFile := &ContainerFile{Name: hdr.Name, Size: -1, Date: hdr.ModifiedAt, Reader: sz}
+		containerFile.Symlink = hdr.Attrib&0x8000 != 0 && unixFileMode(hdr.Attrib>>16)&os.ModeSymlink != 0
+		if n < len(entries) && entries[n].Encrypted && !hdr.IsEmptyStream {
+			containerFile.Encrypted = true
+			if found {
+				containerFile.Password = password
+			} else {
+				containerFile.Reader = nil
+				containerFile.Err = &ConversionError{Format: Format7Z, Kind: ErrPasswordRequired}
+			}
+		}
+
+		if err = callback(containerFile); err != nil {
+			return err
+		}
+	}
+}
+
+// containerExtractISO calls the callback for all regular files and symbolic links of the ISO 9660 or UDF image
+func containerExtractISO(ctx context.Context, file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	files, format, err := isoReadFiles(file, size)
+	if err == ErrUnsupportedVersion {
+		return &ConversionError{Format: format, Kind: ErrUnsupportedVersion}
+	} else if err != nil {
+		return newConversionError(format, ErrCorrupt, err)
+	}
+
+	for _, f := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		} else if f.directory {
+			continue
+		}
+
+		// Files are stored uncompressed. The targets of symbolic links are read by isoReadFiles.
+		containerFile := &ContainerFile{Name: f.name, Size: f.size, Date: f.date, Reader: f.reader(file), compressed: f.size}
+		if f.symlink {
+			containerFile.Symlink, containerFile.LinkTarget = true, f.linkTarget
+		}
+		if err = callback(containerFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// containerExtractCAB calls the callback for all files of the CAB file. Files that continue in another cabinet cannot be extracted.
+// The files are passed in the order of their data, so that each folder is only decompressed once. Skipped data is counted by the tracker and charged to the budget.
+func containerExtractCAB(ctx context.Context, file io.ReaderAt, size int64, tracker *bombTracker, callback func(file *ContainerFile) error) (err error) {
+	archive, err := cabReadArchive(file, size)
+	if err != nil {
+		return newConversionError(FormatCAB, ErrCorrupt, err)
+	}
+
+	files := append([]cabFile(nil), archive.files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].folder != files[j].folder {
+			return files[i].folder < files[j].folder
+		}
+		return files[i].offset < files[j].offset
+	})
+
+	var folder *cabFolderReader
+	folderIndex := -1
+
+	for _, f := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		containerFile := &ContainerFile{Name: f.name, Size: f.size, Date: f.date}
+
+		if int(f.folder) >= len(archive.folders) {
+			containerFile.Err = &ConversionError{Format: FormatCAB, Kind: ErrUnsupportedVersion}
+		} else {
+			// Only files that overlap the previous one cause the folder to be decompressed again
+			if folder == nil || folderIndex != int(f.folder) || folder.position > f.offset {
+				folderIndex = int(f.folder)
+				folder, err = newCabFolderReader(file, size, archive, archive.folders[f.folder])
+			}
+			if err == nil {
+				bomb := tracker.reader(f.name, 0, folder)
+				skipped := decompressReader(ctx, bomb)
+				if err = folder.skip(f.offset, skipped); skipped.err != nil {
+					return skipped.err
+				} else if bomb.err != nil {
+					return newConversionError(FormatCAB, ErrDecompressionBomb, bomb.err)
+				} else if ctx.Err() != nil {
+					return ctx.Err()
+				}
+			}
+
+			if err == ErrUnsupportedVersion {
+				containerFile.Err = &ConversionError{Format: FormatCAB, Kind: ErrUnsupportedVersion}
+			} else if err != nil {
+				containerFile.Err = newConversionError(FormatCAB, ErrCorrupt, err)
+			} else {
+				containerFile.Reader = io.LimitReader(folder, f.size)
+			}
+			if err != nil {
+				folder = nil
+			}
+		}
+
+		if err = callback(containerFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// containerExtractCPIO calls the callback for all regular files and symbolic links of the cpio archive. Format is used for errors, since RPM packages contain cpio archives.
+func containerExtractCPIO(ctx context.Context, reader io.Reader, format Format, callback func(file *ContainerFile) error) (err error) {
+	cr := newCpioReader(reader)
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return newConversionError(format, ErrCorrupt, err)
+		}
+
+		switch header.mode & 0xF000 {
+		case 0x8000:
+			if err = callback(&ContainerFile{Name: header.name, Size: header.size, Date: header.date, Reader: cr}); err != nil {
+				return err
+			}
+		case 0xA000:
+			if err = callback(&ContainerFile{Name: header.name, Size: header.size, Date: header.date, Symlink: true, LinkTarget: header.linkname}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// containerExtractAR calls the callback for all members of the ar archive
+func containerExtractAR(ctx context.Context, reader io.Reader, callback func(file *ContainerFile) error) (err error) {
+	ar, err := newARReader(reader)
+	if err != nil {
+		return newConversionError(FormatAR, ErrCorrupt, err)
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := ar.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return newConversionError(FormatAR, ErrCorrupt, err)
+		}
+
+		if err = callback(&ContainerFile{Name: header.name, Size: header.size, Date: header.date, Reader: ar, compressed: header.size}); err != nil {
+			return err
+		}
+	}
+}
+
+// containerExtractDEB calls the callback for all regular files and links of data.tar in the Debian package
+func containerExtractDEB(ctx context.Context, file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	data, err := debDataReader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return newConversionError(FormatDEB, ErrCorrupt, err)
+	}
+
+	// Meta packages have an empty data.tar
+	if err = containerExtractTAR(ctx, data, callback); err == ErrUnsupportedFormat {
+		return nil
+	}
+	return err
+}
+
+// containerExtractRPM calls the callback for all regular files and symbolic links of the cpio payload of the RPM package
+func containerExtractRPM(ctx context.Context, file io.ReaderAt, size int64, callback func(file *ContainerFile) error) (err error) {
+	offset, err := rpmReadPayloadOffset(file, size)
+	if err == ErrUnsupportedVersion {
+		return &ConversionError{Format: FormatRPM, Kind: ErrUnsupportedVersion}
+	} else if err != nil {
+		return newConversionError(FormatRPM, ErrCorrupt, err)
+	}
+
+	payload, err := decompressPayload(io.NewSectionReader(file, offset, size-offset))
+	if err != nil {
+		return newConversionError(FormatRPM, ErrCorrupt, err)
+	}
+
+	return containerExtractCPIO(ctx, payload, FormatRPM, callback)
+}
+
+// containerExtractTAR calls the callback for all regular files and links of the TAR archive. If the first header is invalid, it is not a TAR file.
+func containerExtractTAR(ctx context.Context, reader io.Reader, callback func(file *ContainerFile) error) (err error) {
+	tr := tar.NewReader(reader)
+
+	for n := 0; ; n++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF && n > 0 {
+			return nil
+		} else if err != nil && n == 0 {
+			return ErrUnsupportedFormat
+		} else if err != nil {
+			return newConversionError(FormatTAR, ErrCorrupt, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if err = callback(&ContainerFile{Name: hdr.Name, Size: hdr.Size, Date: hdr.ModTime, Reader: tr}); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			if err = callback(&ContainerFile{Name: hdr.Name, Date: hdr.ModTime, Symlink: hdr.Typeflag == tar.TypeSymlink, Hardlink: hdr.Typeflag == tar.TypeLink, LinkTarget: hdr.Linkname}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// containerMaxLinkSize is the max size of the target of a symbolic link that is stored as the data of the link
+const containerMaxLinkSize = 4096
+
+// containerUnnamed replaces names that are empty after normalizing, for example "/" or "../"
+const containerUnnamed = "unnamed"
+
+// containerSafeName normalizes the name of a file in a container to a relative path that stays within the directory the container is extracted to.
+// Backslashes are converted to slashes. Drive letters, leading slashes, "." elements and ".." elements that would leave the directory are removed.
+// If nothing is left, containerUnnamed is returned.
+func containerSafeName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	if containerHasDrive(name) {
+		name = name[2:]
+	}
+
+	var elements []string
+	for _, element := range strings.Split(name, "/") {
+		switch element {
+		case "", ".":
+		case "..":
+			if len(elements) > 0 {
+				elements = elements[:len(elements)-1]
+			}
+		default:
+			elements = append(elements, element)
+		}
+	}
+
+	if len(elements) == 0 {
+		return containerUnnamed
+	}
+
+	return strings.Join(elements, "/")
+}
+
+// containerHasDrive checks if the path starts with a Windows drive letter like "C:"
+func containerHasDrive(path string) bool {
+	return len(path) >= 2 && path[1] == ':' && (path[0] >= 'A' && path[0] <= 'Z' || path[0] >= 'a' && path[0] <= 'z')
+}
+
+// containerLink prepares a link for the callback. Most formats store the target of a symbolic link as its data, which is read here.
+// The reader of a link returns no data. The name of the file must be normalized already.
+func containerLink(format Format, file *ContainerFile) {
+	if !file.Symlink && !file.Hardlink {
+		return
+	}
+
+	if file.Hardlink {
+		file.LinkTarget = containerSafeName(file.LinkTarget)
+	} else if file.LinkTarget == "" && file.Reader != nil {
+		target, err := ioutil.ReadAll(io.LimitReader(file.Reader, containerMaxLinkSize))
+		if err != nil {
+			file.Err = newConversionError(format, ErrCorrupt, err)
+		}
+		file.LinkTarget = string(target)
+	}
+
+	if file.Symlink {
+		file.UnsafeLink = containerUnsafeLink(file.Name, file.LinkTarget)
+	}
+
+	file.Reader = nil
+	if file.Err == nil {
+		file.Reader = bytes.NewReader(nil)
+	}
+}
+
+// containerUnsafeLink checks if the target of a symbolic link is absolute or points outside of the directory the container is extracted to.
+// Name is the normalized name of the link, relative targets start in its directory.
+func containerUnsafeLink(name, target string) bool {
+	target = strings.Replace(target, "\\", "/", -1)
+	if strings.HasPrefix(target, "/") || containerHasDrive(target) {
+		return true
+	}
+
+	depth := strings.Count(name, "/")
+	for _, element := range strings.Split(target, "/") {
+		switch element {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
+
+// containerFileReader returns read errors of a file in a container as *ConversionError
+type containerFileReader struct {
+	format Format
+	reader io.Reader
+}
+
+func (r *containerFileReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = newConversionError(r.format, ErrCorrupt, err)
+	}
+	return n, err
+}
+
+// DecompressReader returns a reader that decompresses the input on the fly. It supports: GZ, BZ2, XZ, ZSTD, LZ4, LZIP, LZMA, Z (Unix compress) and zlib.
+// The format is detected via the signature. If it is none of the supported ones, ErrUnsupportedFormat is returned. Brotli and raw deflate are not supported, they have no signature.
+func DecompressReader(reader io.Reader) (decompressed io.Reader, format Format, err error) {
+	return DecompressReaderContext(context.Background(), reader)
+}
+
+// DecompressReaderContext is the same as DecompressReader, but the returned reader stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes. Decompression bombs are detected using the limits of the context (see WithBombLimits).
+func DecompressReaderContext(ctx context.Context, reader io.Reader) (decompressed io.Reader, format Format, err error) {
+	defer recoverPanic(FormatUnknown, &err)
+
+	input := &bombCountReader{reader: &contextReader{ctx: ctx, reader: reader}}
+	buffered := bufio.NewReader(input)
+	header, _ := buffered.Peek(13)
+
+	if format, _ = decompressDetect(header); format == FormatUnknown {
+		if err = ctx.Err(); err != nil {
+			return nil, FormatUnknown, err
+		}
+		return nil, FormatUnknown, ErrUnsupportedFormat
+	}
+
+	if decompressed, err = newDecompressor(format, buffered); err != nil {
+		return nil, format, newConversionError(format, ErrCorrupt, err)
+	}
+
+	tracker := &bombTracker{limits: bombLimitsFromContext(ctx), input: func() int64 { return input.count }}
+
+	return &containerFileReader{format: format, reader: decompressReader(ctx, tracker.reader("", 0, decompressed))}, format, nil
+}
@@ -0,0 +1,392 @@
+/*
+File Name:  Detect.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Content-based file format detection. Many formats share the same signature (DOCX, XLSX, PPTX, ODT, EPUB are all ZIP files; DOC, XLS, PPT and MSG are all OLE2 files).
+The IsFileX functions only check the signature. DetectFormat looks into the container to resolve these collisions.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/IntelligenceX/fileconversion/odf"
+	"github.com/IntelligenceX/fileconversion/ole2"
+)
+
+// Format identifies a file format
+type Format string
+
+// List of detected formats
+const (
+	FormatUnknown Format = ""
+	FormatZIP     Format = "zip"
+	FormatDOCX    Format = "docx"
+	FormatXLSX    Format = "xlsx"
+	FormatPPTX    Format = "pptx"
+	FormatODT     Format = "odt"
+	FormatODS     Format = "ods"
+	FormatODP     Format = "odp"
+	FormatEPUB    Format = "epub"
+	FormatOLE2    Format = "ole2"
+	FormatDOC     Format = "doc"
+	FormatXLS     Format = "xls"
+	FormatPPT     Format = "ppt"
+	FormatMSG     Format = "msg"
+	FormatPDF     Format = "pdf"
+	FormatRTF     Format = "rtf"
+	FormatMOBI    Format = "mobi"
+	FormatHTML    Format = "html"
+	FormatRAR     Format = "rar"
+	Format7Z      Format = "7z"
+	FormatTAR     Format = "tar"
+	FormatGZ      Format = "gz"
+	FormatBZ2     Format = "bz2"
+	FormatXZ      Format = "xz"
+	FormatZSTD    Format = "zst"
+	FormatLZ4     Format = "lz4"
+	FormatLZIP    Format = "lz"
+	FormatLZMA    Format = "lzma"    // LZMA alone, the format of .lzma files
+	FormatZ       Format = "z"       // Unix compress
+	FormatZlib    Format = "zlib"    // zlib stream as specified in RFC 1950
+	FormatBrotli  Format = "br"      // Not returned by DetectFormat, since Brotli has no signature
+	FormatDeflate Format = "deflate" // Raw deflate stream. Not returned by DetectFormat, since it has no signature.
+	FormatISO     Format = "iso"     // ISO 9660 disk image, including UDF bridge images
+	FormatUDF     Format = "udf"     // UDF disk image without ISO 9660 file system
+	FormatCAB     Format = "cab"     // Microsoft Cabinet
+	FormatCPIO    Format = "cpio"
+	FormatAR      Format = "ar"
+	FormatDEB     Format = "deb" // Debian package
+	FormatRPM     Format = "rpm"
+	FormatJPEG    Format = "jpeg" // Pictures are not returned by DetectFormat, only by Carve
+	FormatPNG     Format = "png"
+	FormatGIF     Format = "gif"
+	FormatBMP     Format = "bmp"
+)
+
+// Confidence values returned by DetectFormat, in percent
+const (
+	ConfidenceNone      = 0   // Format could not be detected
+	ConfidenceLow       = 25  // Only a weak heuristic matched, for example HTML sniffing
+	ConfidenceSignature = 50  // The signature matched, which may be shared with other formats
+	ConfidenceStructure = 75  // The internal structure matched, for example typical file names in a ZIP
+	ConfidenceDeclared  = 100 // The format is declared by the file itself, for example via [Content_Types].xml, mimetype or OLE2 stream names
+)
+
+// detectHeaderSize is the amount of bytes read from the start of the file for signature checks
+const detectHeaderSize = 512
+
+// odfMimeTypes maps the OpenDocument mimetype without the prefix application/vnd.oasis.opendocument. to the format
+var odfMimeTypes = map[string]Format{
+	"text":         FormatODT,
+	"spreadsheet":  FormatODS,
+	"presentation": FormatODP,
+}
+
+// detectMaxContentTypes is the max size of [Content_Types].xml and mimetype files that are read. This protects against decompression bombs.
+const detectMaxContentTypes = 1 * 1024 * 1024
+
+// ooxmlContentTypes maps the content type of the main part of an Office Open XML file to the format
+var ooxmlContentTypes = map[string]Format{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml":   FormatDOCX,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.template.main+xml":   FormatDOCX,
+	"application/vnd.ms-word.document.macroenabled.main+xml":                             FormatDOCX,
+	"application/vnd.ms-word.template.macroenabledtemplate.main+xml":                     FormatDOCX,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml":         FormatXLSX,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.template.main+xml":      FormatXLSX,
+	"application/vnd.ms-excel.sheet.macroenabled.main+xml":                               FormatXLSX,
+	"application/vnd.ms-excel.template.macroenabled.main+xml":                            FormatXLSX,
+	"application/vnd.ms-excel.addin.macroenabled.main+xml":                               FormatXLSX,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation.main+xml": FormatPPTX,
+	"application/vnd.openxmlformats-officedocument.presentationml.slideshow.main+xml":    FormatPPTX,
+	"application/vnd.openxmlformats-officedocument.presentationml.template.main+xml":     FormatPPTX,
+	"application/vnd.ms-powerpoint.presentation.macroenabled.main+xml":                   FormatPPTX,
+	"application/vnd.ms-powerpoint.slideshow.macroenabled.main+xml":                      FormatPPTX,
+	"application/vnd.ms-powerpoint.template.macroenabled.main+xml":                       FormatPPTX,
+}
+
+// zipMainParts maps typical file names to the format. It is only used if the format is not declared via [Content_Types].xml or mimetype.
+var zipMainParts = map[string]Format{
+	"word/document.xml":      FormatDOCX,
+	"xl/workbook.xml":        FormatXLSX,
+	"ppt/presentation.xml":   FormatPPTX,
+	"META-INF/container.xml": FormatEPUB,
+}
+
+// DetectFormat detects the format of the file based on its content.
+// Size is the full size of the input file. Confidence is in percent, see the Confidence constants.
+// Unlike the IsFileX functions it resolves signature collisions by inspecting ZIP and OLE2 containers.
+func DetectFormat(file io.ReaderAt, size int64) (format Format, confidence int) {
+	header := make([]byte, detectHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+
+	switch {
+	case IsFileZIP(header):
+		return detectZIPFormat(file, size)
+	case isFileOLE2(header):
+		return detectOLE2Format(file, size)
+	case IsFilePDF(header):
+		return FormatPDF, ConfidenceSignature
+	case IsFileRTF(header):
+		return FormatRTF, ConfidenceSignature
+	case IsFileMOBI(header):
+		return FormatMOBI, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07}): // "Rar!" 1A 07
+		return FormatRAR, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}): // "7z" BC AF 27 1C
+		return Format7Z, ConfidenceSignature
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return FormatTAR, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte("MSCF\x00\x00\x00\x00")):
+		return FormatCAB, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte("070701")) || bytes.HasPrefix(header, []byte("070702")) || bytes.HasPrefix(header, []byte("070707")):
+		return FormatCPIO, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte(arMagic)):
+		// Debian packages start with the member debian-binary
+		if bytes.HasPrefix(header[len(arMagic):], []byte("debian-binary")) {
+			return FormatDEB, ConfidenceStructure
+		}
+		return FormatAR, ConfidenceSignature
+	case bytes.HasPrefix(header, []byte{0xED, 0xAB, 0xEE, 0xDB}):
+		return FormatRPM, ConfidenceSignature
+	}
+
+	// Disk images start with unused system sectors, the volume descriptors are at sector 16
+	if format = isoDetect(file); format != FormatUnknown {
+		return format, ConfidenceSignature
+	}
+
+	if format, confidence = decompressDetect(header); format != FormatUnknown {
+		return format, confidence
+	}
+
+	if strings.HasPrefix(http.DetectContentType(header), "text/html") {
+		return FormatHTML, ConfidenceLow
+	}
+
+	return FormatUnknown, ConfidenceNone
+}
+
+// detectZIPFormat detects ZIP based formats: DOCX, XLSX, PPTX, ODT, ODS, ODP, EPUB
+func detectZIPFormat(file io.ReaderAt, size int64) (format Format, confidence int) {
+	// OpenDocument files declare their type in the mimetype file. Templates have the suffix -template.
+	if f, err := odf.NewReader(file, size); err == nil {
+		if format, ok := odfMimeTypes[strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(f.MimeType), odf.MimeTypePfx), "-template")]; ok {
+			return format, ConfidenceDeclared
+		}
+	}
+
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		return FormatZIP, ConfidenceSignature
+	}
+
+	var structureFormat Format
+
+	for _, f := range r.File {
+		switch f.Name {
+		case "mimetype":
+			// EPUB uses the same mechanism as OpenDocument
+			if data, err := zipReadFileLimit(f, detectMaxContentTypes); err == nil && strings.TrimSpace(string(data)) == "application/epub+zip" {
+				return FormatEPUB, ConfidenceDeclared
+			}
+		case "[Content_Types].xml":
+			if data, err := zipReadFileLimit(f, detectMaxContentTypes); err == nil {
+				if format = ooxmlParseContentTypes(data); format != FormatUnknown {
+					return format, ConfidenceDeclared
+				}
+			}
+		default:
+			if format, ok := zipMainParts[f.Name]; ok && structureFormat == FormatUnknown {
+				structureFormat = format
+			}
+		}
+	}
+
+	if structureFormat != FormatUnknown {
+		return structureFormat, ConfidenceStructure
+	}
+
+	// It is a valid ZIP file, but none of the known ZIP based formats.
+	return FormatZIP, ConfidenceStructure
+}
+
+// ooxmlParseContentTypes returns the format declared in [Content_Types].xml
+func ooxmlParseContentTypes(data []byte) (format Format) {
+	var types struct {
+		Override []struct {
+			PartName    string `xml:"PartName,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		} `xml:"Override"`
+		Default []struct {
+			Extension   string `xml:"Extension,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		} `xml:"Default"`
+	}
+
+	if err := xml.Unmarshal(data, &types); err != nil {
+		return FormatUnknown
+	}
+
+	for _, override := range types.Override {
+		if format, ok := ooxmlContentTypes[strings.ToLower(override.ContentType)]; ok {
+			return format
+		}
+	}
+
+	// Some generators declare the main part only via a default extension.
+	for _, def := range types.Default {
+		if format, ok := ooxmlContentTypes[strings.ToLower(def.ContentType)]; ok {
+			return format
+		}
+	}
+
+	return FormatUnknown
+}
+
+// zipReadFileLimit reads a file from a ZIP archive. It fails if the file is larger than the limit.
+func zipReadFileLimit(f *zip.File, limit int64) (data []byte, err error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, io.ErrShortBuffer
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(io.LimitReader(rc, limit))
+}
+
+// detectOLE2Format detects OLE2 based formats via the stream names: DOC, XLS, PPT, MSG
+func detectOLE2Format(file io.ReaderAt, size int64) (format Format, confidence int) {
+	defer func() {
+		// The OLE2 parser may panic on invalid files. The signature is still valid.
+		if recover() != nil {
+			format, confidence = FormatOLE2, ConfidenceSignature
+		}
+	}()
+
+	ole, err := ole2.Open(io.NewSectionReader(file, 0, size), "")
+	if err != nil {
+		return FormatOLE2, ConfidenceSignature
+	}
+
+	dir, err := ole.ListDir()
+	if err != nil || len(dir) == 0 {
+		return FormatOLE2, ConfidenceSignature
+	}
+
+	// Only streams directly in the root storage are relevant. Embedded objects (for example an Excel sheet in a Word document) have their own storages.
+	names := ole2RootNames(dir)
+
+	isMSG := false
+	for name := range names {
+		if strings.HasPrefix(name, "__substg1.0_") || name == "__properties_version1.0" {
+			isMSG = true
+		}
+	}
+
+	switch {
+	case isMSG:
+		return FormatMSG, ConfidenceDeclared
+	case names["WordDocument"]:
+		return FormatDOC, ConfidenceDeclared
+	case names["PowerPoint Document"]:
+		return FormatPPT, ConfidenceDeclared
+	case names["Workbook"] || names["Book"]:
+		return FormatXLS, ConfidenceDeclared
+	}
+
+	return FormatOLE2, ConfidenceStructure
+}
+
+// ole2IsEncryptedPackage checks if the file is an Office Open XML file encrypted with a password. They are stored as EncryptedPackage stream in an OLE2 container.
+func ole2IsEncryptedPackage(file io.ReaderAt, size int64) (encrypted bool) {
+	defer func() {
+		if recover() != nil {
+			encrypted = false
+		}
+	}()
+
+	header := make([]byte, 8)
+	if n, _ := file.ReadAt(header, 0); !isFileOLE2(header[:n]) {
+		return false
+	}
+
+	ole, err := ole2.Open(io.NewSectionReader(file, 0, size), "")
+	if err != nil {
+		return false
+	}
+
+	dir, err := ole.ListDir()
+	if err != nil || len(dir) == 0 {
+		return false
+	}
+
+	names := ole2RootNames(dir)
+
+	return names["EncryptedPackage"] && names["EncryptionInfo"]
+}
+
+// ole2RootNames returns the names of all entries in the root storage. See ole2RootEntries.
+func ole2RootNames(dir []*ole2.File) (names map[string]bool) {
+	names = make(map[string]bool)
+	for name := range ole2RootEntries(dir) {
+		names[name] = true
+	}
+
+	return names
+}
+
+// ole2RootEntries returns all entries in the root storage by name. The directory is a red-black tree of siblings below the root entry.
+// If the tree is invalid, all entries in the directory are returned.
+func ole2RootEntries(dir []*ole2.File) (entries map[string]*ole2.File) {
+	const noStream = 0xFFFFFFFF
+
+	entries = make(map[string]*ole2.File)
+	visited := make(map[uint32]bool)
+
+	var walk func(id uint32)
+	walk = func(id uint32) {
+		if id == noStream || id >= uint32(len(dir)) || visited[id] {
+			return
+		}
+		visited[id] = true
+
+		entries[dir[id].Name()] = dir[id]
+
+		walk(dir[id].Left)
+		walk(dir[id].Right)
+	}
+
+	if dir[0].Type == ole2.ROOT {
+		walk(dir[0].Child)
+	}
+
+	if len(entries) == 0 {
+		for _, file := range dir {
+			if _, exists := entries[file.Name()]; !exists {
+				entries[file.Name()] = file
+			}
+		}
+	}
+
+	return entries
+}
+
+// isFileOLE2 checks if the data indicates an OLE2 file (Compound File Binary Format)
+// Signature D0 CF 11 E0 A1 B1 1A E1
+func isFileOLE2(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+}
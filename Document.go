@@ -0,0 +1,221 @@
+/*
+File Name:  Document.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Structured document model. Instead of plain text, the converters can return the structure of the document: pages, slides, sheets and sections,
+which contain headings, paragraphs, list items and tables. It can be serialized to JSON for indexing.
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// BlockType is the type of a block of a document
+type BlockType string
+
+// Block types. Pages, slides, sheets and sections are containers at the top level of the document. All other blocks are content.
+const (
+	BlockSection   BlockType = "section"
+	BlockPage      BlockType = "page"
+	BlockSlide     BlockType = "slide"
+	BlockSheet     BlockType = "sheet"
+	BlockHeading   BlockType = "heading"
+	BlockParagraph BlockType = "paragraph"
+	BlockListItem  BlockType = "list item"
+	BlockTable     BlockType = "table"
+)
+
+// Document is the structure of a converted document
+type Document struct {
+	Format    Format  `json:"format"`
+	Blocks    []Block `json:"blocks"`              // Pages, slides, sheets or sections
+	Truncated bool    `json:"truncated,omitempty"` // Indicates that the text was truncated because the limit was reached
+}
+
+// Block is a single block of a document. Which fields are set depends on the type.
+type Block struct {
+	Type   BlockType  `json:"type"`
+	Title  string     `json:"title,omitempty"`  // Name of a sheet, or the title of a slide
+	Number int        `json:"number,omitempty"` // Number of a page, slide, sheet or section, starting at 1
+	Level  int        `json:"level,omitempty"`  // Level of a heading (1 is the top level), or nesting level of a list item (starting at 1)
+	Text   string     `json:"text,omitempty"`   // Text of headings, paragraphs and list items
+	Rows   [][]string `json:"rows,omitempty"`   // Cells of a table, row by row
+	Blocks []Block    `json:"blocks,omitempty"` // Content of pages, slides, sheets and sections
+}
+
+// WriteJSON writes the document as JSON to the writer
+func (document *Document) WriteJSON(writer io.Writer) error {
+	return json.NewEncoder(writer).Encode(document)
+}
+
+// ConvertDocument detects the format of the input and extracts the structure of the document using the default registry.
+// Size is the full size of the input file. Options.Limit limits the total bytes of text in the document. Truncation is indicated via Document.Truncated.
+// The document contains everything extracted before an error occurred.
+func ConvertDocument(ctx context.Context, input io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	return DefaultRegistry.ConvertDocument(ctx, input, size, options)
+}
+
+// builtinDocumentConverters are the functions for all formats that support the document model
+var builtinDocumentConverters = map[Format]func(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error){
+	FormatDOCX: DOCX2Document,
+	FormatXLSX: XLSX2Document,
+	FormatPPTX: PPTX2Document,
+	FormatODS:  ODS2Document,
+	FormatXLS:  XLS2Document,
+	FormatPDF:  PDF2Document,
+}
+
+// documentBuilder builds a document and enforces the limit of the text
+type documentBuilder struct {
+	document  *Document
+	container *Block // current page, slide, sheet or section
+	limit     int64  // remaining bytes of text, negative for unlimited
+}
+
+// newDocumentBuilder creates a new document builder. Options.Limit is the max amount of bytes of text, 0 means unlimited.
+func newDocumentBuilder(format Format, options Options) *documentBuilder {
+	limit := options.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return &documentBuilder{document: &Document{Format: format}, limit: limit}
+}
+
+// open starts a new container at the top level of the document
+func (builder *documentBuilder) open(blockType BlockType, title string, number int) {
+	builder.document.Blocks = append(builder.document.Blocks, Block{Type: blockType, Title: title, Number: number})
+	builder.container = &builder.document.Blocks[len(builder.document.Blocks)-1]
+}
+
+// add adds the block to the current container. If there is none, a section is started.
+// Once the limit is reached the text is truncated and ErrLimitReached is returned.
+func (builder *documentBuilder) add(block Block) (err error) {
+	if builder.container == nil {
+		builder.open(BlockSection, "", 1)
+	}
+
+	block.Text, err = builder.limitText(block.Text)
+	builder.container.Blocks = append(builder.container.Blocks, block)
+
+	return err
+}
+
+// table starts a new table in the current container. Rows are added via row.
+func (builder *documentBuilder) table() {
+	builder.add(Block{Type: BlockTable})
+}
+
+// row adds a row to the last table. Trailing empty cells are removed and empty rows are skipped.
+// Once the limit is reached the remaining cells are dropped and ErrLimitReached is returned.
+func (builder *documentBuilder) row(cells []string) (err error) {
+	for len(cells) > 0 && cells[len(cells)-1] == "" {
+		cells = cells[:len(cells)-1]
+	}
+	if len(cells) == 0 {
+		return nil
+	}
+
+	if builder.container == nil || len(builder.container.Blocks) == 0 || builder.container.Blocks[len(builder.container.Blocks)-1].Type != BlockTable {
+		builder.table()
+	}
+	table := &builder.container.Blocks[len(builder.container.Blocks)-1]
+
+	for n := range cells {
+		if cells[n], err = builder.limitText(cells[n]); err != nil {
+			cells = cells[:n+1]
+			break
+		}
+	}
+
+	table.Rows = append(table.Rows, cells)
+
+	return err
+}
+
+// limitText charges the text to the limit. If it exceeds the limit, it is truncated at a rune boundary and ErrLimitReached is returned.
+func (builder *documentBuilder) limitText(text string) (limited string, err error) {
+	if builder.limit < 0 {
+		return text, nil
+	}
+
+	if int64(len(text)) > builder.limit {
+		text = string(truncateUTF8([]byte(text), builder.limit))
+		builder.document.Truncated = true
+		err = ErrLimitReached
+	}
+	builder.limit -= int64(len(text))
+
+	return text, err
+}
+
+// result returns the document. ErrLimitReached is not an error, it is indicated via Document.Truncated.
+func (builder *documentBuilder) result(err error) (*Document, error) {
+	if err == ErrLimitReached {
+		err = nil
+	}
+
+	return builder.document, err
+}
+
+// xmlReadTable reads the rows of a table element <tbl> until its end, and adds them to the builder. This is used for DOCX and PPTX, which both use tbl, tr and tc elements.
+// The paragraph function returns the text of a paragraph element <p>. All paragraphs of a cell are joined, including the ones of nested tables.
+func xmlReadTable(decoder *xml.Decoder, builder *documentBuilder, paragraph func(decoder *xml.Decoder, se *xml.StartElement) string) (err error) {
+	builder.table()
+
+	var row []string
+	nested := 0
+
+	for {
+		t, errToken := decoder.Token()
+		if errToken != nil {
+			return nil
+		}
+
+		switch token := t.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "tbl":
+				nested++
+			case "tr":
+				if nested == 0 {
+					row = nil
+				}
+			case "tc":
+				if nested == 0 {
+					row = append(row, "")
+				}
+			case "p":
+				if text := strings.TrimSpace(paragraph(decoder, &token)); text != "" && len(row) > 0 {
+					cell := &row[len(row)-1]
+					if *cell != "" {
+						*cell += " "
+					}
+					*cell += cleanCell(text)
+				}
+			}
+
+		case xml.EndElement:
+			switch token.Name.Local {
+			case "tbl":
+				if nested == 0 {
+					return nil
+				}
+				nested--
+			case "tr":
+				if nested == 0 {
+					if err = builder.row(row); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
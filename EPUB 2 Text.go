@@ -1,70 +1,141 @@
-/*
-File Name:  EPUB 2 Text.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-EPUB files are ZIP based and contain the content as HTML files.
-
-Tested but did not work:
-* https://github.com/n3integration/epub could not read 2 sample files. Also no NewReader function available.
-
-This one was tested and works:
-* https://github.com/taylorskalyo/goreader/tree/master/epub
-
-Sample files via https://github.com/IDPF/epub3-samples/releases.
-*/
-
-package fileconversion
-
-import (
-	"io"
-
-	"github.com/taylorskalyo/goreader/epub"
-)
-
-// EPUB2Text converts an EPUB ebook to text
-func EPUB2Text(file io.ReaderAt, size int64, limit int64) (string, error) {
-	text := ""
-
-	rc, err := epub.NewReader(file, size)
-	if err != nil {
-		return "", nil
-	}
-
-	// The rootfile (content.opf) lists all of the contents of an epub file.
-	// There may be multiple rootfiles, although typically there is only one.
-	book := rc.Rootfiles[0]
-
-	// Print book title.
-	title := "Title: " + book.Title + "\n\n"
-	limit -= int64(len(title))
-	if limit <= 0 {
-		return title, nil
-	}
-
-	// List the IDs of files in the book's spine.
-	for _, item := range book.Spine.Itemrefs {
-		// item.ID was observed to be in one book: cover,titlepage,brief-toc,xpreface_001,xintroduction_001,xepigraph_001,xchapter_001
-		reader2, err := item.Open()
-		if err != nil {
-			continue
-		}
-
-		itemText, _ := HTML2Text(reader2)
-
-		// check max length
-		if limit <= int64(len(itemText)) {
-			itemText = itemText[:limit]
-			return title + text, nil
-		}
-
-		text += itemText
-		limit -= int64(len(itemText))
-	}
-
-	if text == "" {
-		return "", nil
-	}
-
-	return title + text, nil
-}
+/*
+File Name:  EPUB 2 Text.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+EPUB files are ZIP based and contain the content as HTML files.
+
+Tested but did not work:
+* https://github.com/n3integration/epub could not read 2 sample files. Also no NewReader function available.
+
+This one was tested and works:
+* https://github.com/taylorskalyo/goreader/tree/master/epub
+
+Sample files via https://github.com/IDPF/epub3-samples/releases.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/IntelligenceX/fileconversion/html2text"
+	"github.com/taylorskalyo/goreader/epub"
+)
+
+// EPUB2Text converts an EPUB ebook to text
+func EPUB2Text(file io.ReaderAt, size int64, limit int64) (string, error) {
+	var buffer bytes.Buffer
+
+	if _, err := EPUB2TextWriter(file, size, &buffer, limit); err != nil && err != ErrLimitReached {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// EPUB2TextWriter converts an EPUB ebook to text and writes it to the writer. It returns bytes written.
+// Size is the full size of the input file. Limit is the max amount of bytes (not characters) to write out.
+// The chapters are converted one by one. Conversion stops once the limit is reached and ErrLimitReached is returned.
+func EPUB2TextWriter(file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	return EPUB2TextContext(context.Background(), file, size, writer, limit)
+}
+
+// EPUB2TextContext is the same as EPUB2TextWriter, but stops once the context is cancelled and returns its error.
+func EPUB2TextContext(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	return epubWriteText(ctx, file, size, writer, limit, OutputText)
+}
+
+// epubWriteText converts the chapters to the output format and writes them to the writer. See EPUB2TextWriter.
+func epubWriteText(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, limit int64, output OutputFormat) (written int64, err error) {
+	defer recoverPanic(FormatEPUB, &err)
+
+	rc, err := epub.NewReader(&contextReaderAt{ctx: ctx, reader: file}, size)
+	if err != nil {
+		return 0, newConversionError(FormatEPUB, ErrCorrupt, err)
+	}
+
+	// The rootfile (content.opf) lists all of the contents of an epub file.
+	// There may be multiple rootfiles, although typically there is only one.
+	if len(rc.Rootfiles) == 0 {
+		return 0, &ConversionError{Format: FormatEPUB, Kind: ErrCorrupt, Err: errors.New("no rootfile")}
+	}
+	book := rc.Rootfiles[0]
+
+	// The title is only written if there is any text in the book.
+	title := "Title: " + book.Title + "\n\n"
+	if output == OutputMarkdown {
+		title = "# " + markdownLine(book.Title) + "\n\n"
+	}
+
+	// List the IDs of files in the book's spine.
+	for _, item := range book.Spine.Itemrefs {
+		// item.ID was observed to be in one book: cover,titlepage,brief-toc,xpreface_001,xintroduction_001,xepigraph_001,xchapter_001
+		if err = ctx.Err(); err != nil {
+			return written, err
+		}
+
+		reader2, err := item.Open()
+		if err != nil {
+			continue
+		}
+
+		itemText, _ := html2TextContext(ctx, reader2, html2text.Options{Markdown: output == OutputMarkdown})
+		reader2.Close()
+
+		if itemText == "" {
+			continue
+		} else if output == OutputMarkdown {
+			// Chapters are separate blocks.
+			itemText += "\n\n"
+		}
+
+		if title != "" {
+			if err = writeOutputLimit(writer, []byte(title), &written, &limit); err != nil {
+				return written, err
+			}
+			title = ""
+		}
+
+		if err = writeOutputLimit(writer, []byte(itemText), &written, &limit); err != nil {
+			return written, err
+		}
+	}
+
+	return written, ctx.Err()
+}
+
+// epubMetadata extracts the metadata of the first rootfile (content.opf)
+func epubMetadata(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(FormatEPUB, &err)
+
+	rc, err := epub.NewReader(file, size)
+	if err != nil {
+		return metadata, newConversionError(FormatEPUB, ErrCorrupt, err)
+	} else if len(rc.Rootfiles) == 0 {
+		return metadata, &ConversionError{Format: FormatEPUB, Kind: ErrCorrupt, Err: errors.New("no rootfile")}
+	}
+	book := rc.Rootfiles[0]
+
+	metadata.Title = strings.TrimSpace(book.Title)
+	metadata.Authors = metadataList(book.Creator, ";")
+	metadata.Subject = strings.TrimSpace(book.Subject)
+
+	// EPUB 2 dates have an optional event attribute. Dates without one are the publication date.
+	for _, event := range book.Event {
+		switch event.Name {
+		case "modification":
+			metadata.Modified = metadataDate(event.Date)
+		default:
+			if metadata.Created.IsZero() {
+				metadata.Created = metadataDate(event.Date)
+			}
+		}
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,299 @@
+/*
+File Name:  Embedded.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Discovery of archives embedded in other files: self-extracting archives (ZIP, RAR, 7Z or CAB appended to an executable), archives appended to images
+and other polyglots, and archives followed by other data. The file is searched for the signatures of the archives, each match is validated.
+ZIP archives are found via the end of central directory record, which has the offset and size of the central directory. From them the start is calculated.
+Signatures within an archive that was found are ignored, archives inside of archives are left to the extraction of the outer one.
+*/
+
+package fileconversion
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/saracen/go7z/headers"
+)
+
+// EmbeddedArchive is an archive found in a file, see ContainerFindEmbedded
+type EmbeddedArchive struct {
+	Format Format // ZIP, RAR, 7Z, TAR or CAB
+	Offset int64  // Offset of the archive in the file
+	Size   int64  // Size of the archive. If the end is not stored in the archive, it is the rest of the file.
+	base   int64  // Offset that the archive is extracted from. ZIP archives of self-extracting executables may store offsets relative to the start of the file.
+}
+
+// scanSignature is a signature that the file is searched for. Offset is the position of the signature in the file that starts with it.
+type scanSignature struct {
+	format    Format
+	signature []byte
+	offset    int64
+}
+
+// embeddedSignatures are the signatures of the archives
+var embeddedSignatures = []scanSignature{
+	{FormatZIP, []byte("PK\x05\x06"), 0}, // end of central directory record
+	{FormatRAR, []byte("Rar!\x1A\x07"), 0},
+	{Format7Z, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, 0},
+	{FormatTAR, []byte("ustar"), 257},
+	{FormatCAB, []byte("MSCF\x00\x00\x00\x00"), 0},
+}
+
+// scanChunkSize is the size of the chunks that the file is searched in. The chunks overlap by the size of the longest signature.
+const scanChunkSize = 1 << 20
+
+// scanMaxSignature is the size of the longest signature
+const scanMaxSignature = 8
+
+// scanMaxCandidates is the max count of signature matches. Data full of signatures would otherwise result in unbounded memory and work.
+const scanMaxCandidates = 1 << 20
+
+// scanMaxValidations is the max count of candidates that are validated. Each validation may parse the rest of the file.
+const scanMaxValidations = 1 << 16
+
+// ContainerFindEmbedded searches the file for embedded archives: ZIP, RAR, 7Z, TAR and CAB. It finds archives at any offset, for example
+// self-extracting archives and archives appended to images. An archive at offset 0 is returned as well. Each match is validated via the headers of the archive.
+// Archives inside of archives that are found are not returned. At most 1048576 signature matches are searched and 65536 of them validated,
+// if there are more the archives found so far are returned together with ErrLimitReached.
+func ContainerFindEmbedded(file io.ReaderAt, size int64) (archives []EmbeddedArchive, err error) {
+	return ContainerFindEmbeddedContext(context.Background(), file, size)
+}
+
+// ContainerFindEmbeddedContext is the same as ContainerFindEmbedded, but stops once the context is cancelled and returns its error
+func ContainerFindEmbeddedContext(ctx context.Context, file io.ReaderAt, size int64) (archives []EmbeddedArchive, err error) {
+	candidates, limitErr := scanSignatures(ctx, file, size, embeddedSignatures)
+	if limitErr != nil && limitErr != ErrLimitReached {
+		return nil, limitErr
+	}
+
+	// Validate the candidates in order. Candidates within an archive are skipped.
+	end := int64(0)
+	validations := 0
+
+	for _, archive := range candidates {
+		if archive.Offset < end {
+			continue
+		} else if err = ctx.Err(); err != nil {
+			return nil, err
+		} else if validations++; validations > scanMaxValidations {
+			return archives, ErrLimitReached
+		}
+
+		if archive.Size = embeddedValidate(archive, file, size); archive.Size > 0 {
+			archives = append(archives, archive)
+			end = archive.Offset + archive.Size
+		}
+	}
+
+	return archives, limitErr
+}
+
+// ContainerExtractEmbedded extracts the files of all archives that ContainerFindEmbedded finds in the file. The callback gets the archive, which has the offset in the file.
+// The files are the same as returned by ContainerExtractReader. If the callback returns an error, the extraction stops and the error is returned. SkipAll stops it without error.
+func ContainerExtractEmbedded(file io.ReaderAt, size int64, callback func(archive EmbeddedArchive, file *ContainerFile) error) (err error) {
+	return ContainerExtractEmbeddedContext(context.Background(), file, size, callback)
+}
+
+// ContainerExtractEmbeddedContext is the same as ContainerExtractEmbedded, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes, see ContainerExtractReaderContext.
+// If ContainerFindEmbedded reaches its limits, the archives found so far are extracted and ErrLimitReached is returned.
+func ContainerExtractEmbeddedContext(ctx context.Context, file io.ReaderAt, size int64, callback func(archive EmbeddedArchive, file *ContainerFile) error) (err error) {
+	archives, limitErr := ContainerFindEmbeddedContext(ctx, file, size)
+	if limitErr != nil && limitErr != ErrLimitReached {
+		return limitErr
+	}
+
+	for _, archive := range archives {
+		skipAll := false
+		archiveSize := archive.Offset + archive.Size - archive.base
+
+		err = ContainerExtractReaderContext(ctx, io.NewSectionReader(file, archive.base, archiveSize), archiveSize, func(containerFile *ContainerFile) error {
+			err := callback(archive, containerFile)
+			skipAll = err == SkipAll
+			return err
+		})
+		if err != nil || skipAll {
+			return err
+		}
+	}
+
+	return limitErr
+}
+
+// scanSignatures searches the file for the signatures and returns the candidates sorted by offset. They are not validated yet.
+// The start of ZIP archives is calculated from the end of central directory record.
+// After scanMaxCandidates matches the search stops, the candidates found so far are returned with ErrLimitReached.
+func scanSignatures(ctx context.Context, file io.ReaderAt, size int64, signatures []scanSignature) (candidates []EmbeddedArchive, err error) {
+	buffer := make([]byte, scanChunkSize+scanMaxSignature-1)
+	matches := 0
+
+	for chunk := int64(0); chunk < size; chunk += scanChunkSize {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, err := file.ReadAt(buffer, chunk)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		data := buffer[:n]
+
+		for _, signature := range signatures {
+			for index := 0; ; index++ {
+				found := bytes.Index(data[index:], signature.signature)
+				if found < 0 || index+found >= scanChunkSize {
+					break
+				}
+				index += found
+				offset := chunk + int64(index) - signature.offset
+
+				if matches++; matches > scanMaxCandidates {
+					sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Offset < candidates[j].Offset })
+					return candidates, ErrLimitReached
+				}
+
+				if signature.format == FormatZIP {
+					if archive, ok := embeddedZIP(file, size, offset); ok {
+						candidates = append(candidates, archive)
+					}
+				} else if offset >= 0 {
+					candidates = append(candidates, EmbeddedArchive{Format: signature.format, Offset: offset, base: offset})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Offset < candidates[j].Offset })
+	return candidates, nil
+}
+
+// embeddedZIP returns the ZIP archive of the end of central directory record at the offset. The start of the archive is calculated from the offset and size of the central directory.
+// The offsets of the files are relative to the start of the archive, self-extracting executables may store them relative to the start of the file.
+// The first file is usually at the start of the archive, so its offset indicates where the archive starts.
+func embeddedZIP(file io.ReaderAt, size, offset int64) (archive EmbeddedArchive, ok bool) {
+	record := make([]byte, 22)
+	if _, err := file.ReadAt(record, offset); err != nil {
+		return archive, false
+	}
+
+	end := offset + 22 + int64(binary.LittleEndian.Uint16(record[20:]))
+	directorySize := int64(binary.LittleEndian.Uint32(record[12:]))
+	directoryOffset := int64(binary.LittleEndian.Uint32(record[16:]))
+	directoryStart := offset - directorySize
+
+	// The ZIP64 end of central directory record and its locator are in front of the record
+	if offset >= 56+20 {
+		record64 := make([]byte, 56+20)
+		if _, err := file.ReadAt(record64, offset-56-20); err == nil && binary.LittleEndian.Uint32(record64) == zipSignatureEnd64 && binary.LittleEndian.Uint32(record64[56:]) == zipSignatureLocator {
+			directorySize = int64(binary.LittleEndian.Uint64(record64[40:]))
+			directoryOffset = int64(binary.LittleEndian.Uint64(record64[48:]))
+			directoryStart = offset - 56 - 20 - directorySize
+		}
+	}
+
+	base := directoryStart - directoryOffset
+	if end > size || directorySize < 0 || directoryStart < 0 || base < 0 || base > directoryStart {
+		return archive, false
+	}
+
+	start := base
+	header := make([]byte, 46)
+	if _, err := file.ReadAt(header, directoryStart); err == nil && directorySize >= 46 && binary.LittleEndian.Uint32(header) == zipSignatureCentral {
+		if first := int64(binary.LittleEndian.Uint32(header[42:])); first != 0xFFFFFFFF && base+first < directoryStart {
+			start = base + first
+		}
+	}
+
+	return EmbeddedArchive{Format: FormatZIP, Offset: start, Size: end - start, base: base}, true
+}
+
+// embeddedValidate checks if the archive is valid and returns its size. If it is not valid, 0 is returned.
+func embeddedValidate(archive EmbeddedArchive, file io.ReaderAt, size int64) (archiveSize int64) {
+	remaining := size - archive.Offset
+	section := io.NewSectionReader(file, archive.Offset, remaining)
+
+	switch archive.Format {
+	case FormatZIP:
+		if _, err := zip.NewReader(io.NewSectionReader(file, archive.base, archive.Offset+archive.Size-archive.base), archive.Offset+archive.Size-archive.base); err == nil {
+			return archive.Size
+		}
+
+	case FormatRAR:
+		// The first block is the archive header, or the encryption header in RAR 5. Its checksum is verified, the other headers are only parsed.
+		header := make([]byte, 8+4+3+16)
+		if _, err := section.ReadAt(header, 0); err != nil {
+			return 0
+		}
+
+		if header[6] == 0 {
+			headerSize := int(binary.LittleEndian.Uint16(header[7+5:]))
+			block := make([]byte, headerSize)
+			if _, err := section.ReadAt(block, 7); err != nil || headerSize < 7 || header[7+2] != 0x73 || uint16(crc32.ChecksumIEEE(block[2:])) != binary.LittleEndian.Uint16(header[7:]) {
+				return 0
+			}
+		} else {
+			headerSize, n := rarVint(header[12:])
+			if n == 0 || headerSize == 0 || headerSize > rarMaxHeaderSize {
+				return 0
+			}
+			block := make([]byte, uint64(n)+headerSize)
+			if _, err := section.ReadAt(block, 12); err != nil || crc32.ChecksumIEEE(block) != binary.LittleEndian.Uint32(header[8:]) {
+				return 0
+			} else if blockType, _ := rarVint(block[n:]); blockType != 1 && blockType != 4 {
+				return 0
+			}
+		}
+
+		if rar, err := rarReadHeaders(section, remaining); err == nil {
+			return rar.size
+		}
+
+	case Format7Z:
+		// The start header has the offset and size of the header at the end of the archive
+		signature, err := headers.ReadSignatureHeader(section)
+		if err != nil || signature.StartHeader.NextHeaderOffset < 0 {
+			return 0
+		}
+		if archiveSize = headers.SignatureHeaderSize + signature.StartHeader.NextHeaderOffset + signature.StartHeader.NextHeaderSize; archiveSize <= remaining {
+			return archiveSize
+		}
+
+	case FormatTAR:
+		// The end of the archive is marked by 2 empty blocks
+		reader := tar.NewReader(section)
+		if _, err := reader.Next(); err != nil {
+			return 0
+		}
+		for {
+			if _, err := reader.Next(); err == io.EOF {
+				archiveSize, _ = section.Seek(0, io.SeekCurrent)
+				return archiveSize
+			} else if err != nil {
+				return 0
+			}
+		}
+
+	case FormatCAB:
+		// The header has the size of the cabinet
+		if _, err := cabReadArchive(section, remaining); err != nil {
+			return 0
+		}
+		header := make([]byte, 12)
+		if _, err := section.ReadAt(header, 0); err == nil {
+			if archiveSize = int64(binary.LittleEndian.Uint32(header[8:])); archiveSize <= remaining {
+				return archiveSize
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,108 @@
+/*
+File Name:  Errors.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Errors returned by the converters. Use errors.Is to check for the category, and errors.As with *ConversionError to get the format and the underlying error.
+Context errors (cancellation, deadline) and errors returned by the output writer are returned as they are.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// Categories of errors returned by the converters
+var (
+	ErrUnsupportedFormat  = errors.New("unsupported format")         // The format is not detected or no converter is registered for it
+	ErrCorrupt            = errors.New("file is corrupt")            // The file is invalid, truncated or could not be parsed
+	ErrEncrypted          = errors.New("file is encrypted")          // The file or its content is encrypted
+	ErrPasswordRequired   = errors.New("password required")          // The file is encrypted with a password that is not known. It also matches ErrEncrypted.
+	ErrUnsupportedVersion = errors.New("unsupported format version") // The file uses an old or unusual version of the format that is not supported
+	ErrLimitReached       = errors.New("output limit reached")       // The output was truncated. Convert does not return it as error, but indicates it via Result.Truncated.
+	ErrParserPanic        = errors.New("parser panic")               // The parser panicked, which indicates a bug triggered by an invalid file. Use errors.As with *PanicError for details.
+	ErrBudgetExceeded     = errors.New("budget exceeded")            // A limit of the Budget was exceeded. Use errors.As with *BudgetError for details.
+	ErrDecompressionBomb  = errors.New("decompression bomb")         // A compressed file or archive exceeds the limits of BombLimits. Use errors.As with *BombError for details.
+)
+
+// ConversionError is a failure of a converter. Kind is one of the error categories above.
+type ConversionError struct {
+	Format Format // Format of the file
+	Kind   error  // Category, for example ErrCorrupt
+	Err    error  // Underlying error, if any
+}
+
+func (e *ConversionError) Error() string {
+	text := e.Kind.Error()
+	if e.Format != FormatUnknown {
+		text = string(e.Format) + ": " + text
+	}
+	if e.Err != nil {
+		text += ": " + e.Err.Error()
+	}
+
+	return text
+}
+
+// Is makes errors.Is match the category. Files that require a password are also encrypted.
+func (e *ConversionError) Is(target error) bool {
+	return target == e.Kind || (e.Kind == ErrPasswordRequired && target == ErrEncrypted)
+}
+
+// Unwrap returns the underlying error
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+// newConversionError creates a typed error for the format. Errors that are already typed and context errors are returned as they are.
+// If the budget is exceeded or a decompression bomb is detected, the kind is always ErrBudgetExceeded or ErrDecompressionBomb.
+// Err may be nil if the category is sufficient.
+func newConversionError(format Format, kind error, err error) error {
+	var typed *ConversionError
+
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrLimitReached):
+		return err
+	case errors.As(err, &typed):
+		return err
+	case errors.Is(err, ErrBudgetExceeded):
+		kind = ErrBudgetExceeded
+	case errors.Is(err, ErrDecompressionBomb):
+		kind = ErrDecompressionBomb
+	}
+
+	return &ConversionError{Format: format, Kind: kind, Err: err}
+}
+
+// zipOpenError returns the typed error for a ZIP based file that could not be opened.
+// Office Open XML files encrypted with a password are not ZIP files, but OLE2 files.
+func zipOpenError(format Format, file io.ReaderAt, size int64, err error) error {
+	if ole2IsEncryptedPackage(file, size) {
+		return newConversionError(format, ErrPasswordRequired, err)
+	}
+
+	return newConversionError(format, ErrCorrupt, err)
+}
+
+// odfIsEncrypted checks if the content of an OpenDocument file is encrypted. The manifest lists the encryption parameters of each encrypted file.
+func odfIsEncrypted(file io.ReaderAt, size int64) bool {
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		return false
+	}
+
+	for _, f := range r.File {
+		if f.Name == "META-INF/manifest.xml" {
+			data, err := zipReadFileLimit(f, detectMaxContentTypes)
+			return err == nil && bytes.Contains(data, []byte("encryption-data"))
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,59 @@
+/*
+File Name:  GZIP.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+GZ files may consist of multiple concatenated members, each with its own header. They are decompressed as one and all headers are collected.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+)
+
+// gzipMembersReader decompresses all members of a GZ file and collects their headers.
+// Data after the last member that is not a valid header is ignored, the same as the gzip tool does.
+type gzipMembersReader struct {
+	source  *bufio.Reader
+	reader  *gzip.Reader
+	headers []gzip.Header
+}
+
+// newGzipMembersReader reads the header of the first member
+func newGzipMembersReader(reader io.Reader) (members *gzipMembersReader, err error) {
+	// The source must not be read beyond the end of a member, which is guaranteed by an io.ByteReader
+	source := bufio.NewReader(reader)
+
+	gr, err := gzip.NewReader(source)
+	if err != nil {
+		return nil, err
+	}
+	gr.Multistream(false)
+
+	return &gzipMembersReader{source: source, reader: gr, headers: []gzip.Header{gr.Header}}, nil
+}
+
+func (r *gzipMembersReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = r.reader.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		// Continue with the next member, if any
+		if errReset := r.reader.Reset(r.source); errReset == io.EOF || errReset == gzip.ErrHeader {
+			return n, io.EOF
+		} else if errReset != nil {
+			return n, errReset
+		}
+		r.reader.Multistream(false)
+		r.headers = append(r.headers, r.reader.Header)
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
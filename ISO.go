@@ -0,0 +1,914 @@
+/*
+File Name:  ISO.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Parser for ISO 9660 and UDF disk images. ISO 9660 images use the Rock Ridge extensions if present, which store Unix names, permissions and symbolic links.
+Otherwise the Joliet directory tree is used if present.
+UDF is supported for images with physical and sparable partitions (UDF 1.02 to 2.01), which covers most DVDs and UDF bridge images.
+Files are stored uncompressed, the readers return the data directly from the image.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// isoSectorSize is the size of a sector. The volume descriptors start at sector 16.
+const isoSectorSize = 2048
+
+// isoMaxDepth is the max depth of directories. ISO 9660 limits it to 8, but Rock Ridge and UDF allow deeper trees.
+const isoMaxDepth = 64
+
+// isoMaxDirectorySize is the max size of a directory that is read
+const isoMaxDirectorySize = 16 << 20
+
+var errISOHeader = errors.New("invalid disk image")
+
+// isoFile is a file or directory of an ISO 9660 or UDF image
+type isoFile struct {
+	name       string
+	size       int64
+	date       time.Time
+	directory  bool
+	symlink    bool
+	linkTarget string      // Target of the symbolic link
+	mode       os.FileMode // Only set for Rock Ridge and UDF
+	extents    []isoExtent
+}
+
+// isoExtent is a part of the file data. Unrecorded extents of UDF files are read as zeros.
+type isoExtent struct {
+	offset   int64
+	length   int64
+	recorded bool
+}
+
+// reader returns the data of the file
+func (f *isoFile) reader(file io.ReaderAt) io.Reader {
+	readers := make([]io.Reader, 0, len(f.extents))
+	for _, extent := range f.extents {
+		if extent.recorded {
+			readers = append(readers, io.NewSectionReader(file, extent.offset, extent.length))
+		} else {
+			readers = append(readers, io.LimitReader(zeroReader{}, extent.length))
+		}
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// zeroReader returns zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	for n = range p {
+		p[n] = 0
+	}
+	return len(p), nil
+}
+
+// isoDetect detects ISO 9660 and UDF images via the volume recognition sequence. UDF bridge images are ISO 9660.
+func isoDetect(file io.ReaderAt) (format Format) {
+	identifier := make([]byte, 5)
+
+	for sector := int64(16); sector < 32; sector++ {
+		if _, err := file.ReadAt(identifier, sector*isoSectorSize+1); err != nil {
+			return FormatUnknown
+		}
+
+		switch string(identifier) {
+		case "CD001":
+			return FormatISO
+		case "NSR02", "NSR03":
+			return FormatUDF
+		case "BEA01", "BOOT2", "CDW02":
+		default:
+			return FormatUnknown
+		}
+	}
+
+	return FormatUnknown
+}
+
+// isoReadFiles reads all files and directories of the image. UDF is preferred, since ISO 9660 names of UDF bridge images are often limited to 8.3.
+func isoReadFiles(file io.ReaderAt, size int64) (files []isoFile, format Format, err error) {
+	if files, err = udfReadFiles(file, size); err == nil {
+		return files, FormatUDF, nil
+	} else if isoDetect(file) == FormatUDF {
+		return nil, FormatUDF, err
+	}
+
+	files, err = iso9660ReadFiles(file, size)
+	return files, FormatISO, err
+}
+
+// ---- ISO 9660 ----
+
+// iso9660Reader reads the directory tree of an ISO 9660 image
+type iso9660Reader struct {
+	file      io.ReaderAt
+	size      int64
+	blockSize int64
+	joliet    bool
+	visited   map[int64]bool // directories already read, to prevent loops
+	files     []isoFile
+}
+
+// iso9660ReadFiles reads the directory tree of the primary volume descriptor if it has Rock Ridge entries, otherwise of the Joliet one if present
+func iso9660ReadFiles(file io.ReaderAt, size int64) (files []isoFile, err error) {
+	var primary, joliet []byte
+
+	for sector := int64(16); sector < 16+64; sector++ {
+		descriptor := make([]byte, isoSectorSize)
+		if _, err = file.ReadAt(descriptor, sector*isoSectorSize); err != nil {
+			return nil, err
+		} else if string(descriptor[1:6]) != "CD001" || descriptor[0] == 255 {
+			break
+		}
+
+		switch descriptor[0] {
+		case 1:
+			if primary == nil {
+				primary = descriptor
+			}
+		case 2:
+			// Joliet is a supplementary volume descriptor with the escape sequence of UCS-2 level 1, 2 or 3
+			if escape := descriptor[88:91]; joliet == nil && escape[0] == '%' && escape[1] == '/' && (escape[2] == '@' || escape[2] == 'C' || escape[2] == 'E') {
+				joliet = descriptor
+			}
+		}
+	}
+
+	descriptor, useJoliet := primary, joliet != nil && (primary == nil || !iso9660HasRockRidge(file, primary))
+	if useJoliet {
+		descriptor = joliet
+	}
+	if descriptor == nil {
+		return nil, errISOHeader
+	}
+
+	r := &iso9660Reader{file: file, size: size, blockSize: int64(binary.LittleEndian.Uint16(descriptor[128:])), joliet: useJoliet, visited: make(map[int64]bool)}
+	if r.blockSize != 512 && r.blockSize != 1024 && r.blockSize != 2048 {
+		r.blockSize = isoSectorSize
+	}
+
+	// The root directory record
+	root := descriptor[156 : 156+34]
+	if err = r.readDirectory(int64(binary.LittleEndian.Uint32(root[2:])), int64(binary.LittleEndian.Uint32(root[10:])), "", 0); err != nil && len(r.files) == 0 {
+		return nil, err
+	}
+
+	return r.files, nil
+}
+
+// iso9660HasRockRidge checks if the first record (".") of the root directory starts the System Use Sharing Protocol with the SP entry
+func iso9660HasRockRidge(file io.ReaderAt, descriptor []byte) bool {
+	blockSize := int64(binary.LittleEndian.Uint16(descriptor[128:]))
+	if blockSize != 512 && blockSize != 1024 && blockSize != 2048 {
+		blockSize = isoSectorSize
+	}
+
+	record := make([]byte, 41)
+	if _, err := file.ReadAt(record, int64(binary.LittleEndian.Uint32(descriptor[156+2:]))*blockSize); err != nil {
+		return false
+	}
+	return record[32] == 1 && string(record[34:36]) == "SP" && record[38] == 0xBE && record[39] == 0xEF
+}
+
+// readDirectory reads the directory records and recursively the subdirectories
+func (r *iso9660Reader) readDirectory(extent, length int64, path string, depth int) (err error) {
+	offset := extent * r.blockSize
+	if depth > isoMaxDepth || r.visited[offset] || length > isoMaxDirectorySize || offset+length > r.size {
+		return errISOHeader
+	}
+	r.visited[offset] = true
+
+	data := make([]byte, length)
+	if _, err = r.file.ReadAt(data, offset); err != nil {
+		return err
+	}
+
+	var subdirectories []isoFile
+	var multiExtent *isoFile
+
+	for position := 0; position < len(data); {
+		recordLength := int(data[position])
+		if recordLength == 0 {
+			// Records do not cross sectors, the rest of the sector is padding
+			position = (position/isoSectorSize + 1) * isoSectorSize
+			continue
+		} else if recordLength < 34 || position+recordLength > len(data) {
+			return errISOHeader
+		}
+		record := data[position : position+recordLength]
+		position += recordLength
+
+		nameLength := int(record[32])
+		if 33+nameLength > len(record) {
+			return errISOHeader
+		}
+		identifier := record[33 : 33+nameLength]
+		flags := record[25]
+
+		if nameLength == 1 && (identifier[0] == 0 || identifier[0] == 1) {
+			// current and parent directory
+			continue
+		} else if flags&0x04 != 0 {
+			// associated file, for example the resource fork of a Mac file
+			continue
+		}
+
+		f := isoFile{name: iso9660Name(identifier, r.joliet), directory: flags&0x02 != 0, date: iso9660Date(record[18:25])}
+		extent := isoExtent{offset: int64(binary.LittleEndian.Uint32(record[2:])) * r.blockSize, length: int64(binary.LittleEndian.Uint32(record[10:])), recorded: true}
+
+		if !r.joliet {
+			systemUse := record[33+nameLength:]
+			if nameLength%2 == 0 && len(systemUse) > 0 {
+				// padding byte
+				systemUse = systemUse[1:]
+			}
+			if r.rockRidge(systemUse, &f, &extent) {
+				// relocated directory, it is listed at its original location
+				continue
+			}
+		}
+
+		// Files larger than 4 GB consist of multiple records. All but the last one have the multi-extent flag set.
+		if multiExtent != nil && multiExtent.name == f.name {
+			multiExtent.extents = append(multiExtent.extents, extent)
+			multiExtent.size += extent.length
+			if flags&0x80 != 0 {
+				continue
+			}
+			f = *multiExtent
+		} else {
+			f.extents = []isoExtent{extent}
+			f.size = extent.length
+		}
+		multiExtent = nil
+		if flags&0x80 != 0 && !f.directory {
+			multiExtent = &f
+			continue
+		}
+
+		if path != "" {
+			f.name = path + "/" + f.name
+		}
+		if f.directory || f.symlink {
+			f.size = 0
+		}
+		if f.mode == 0 && f.directory {
+			// Without Rock Ridge there are no permissions, the image is read-only
+			f.mode = os.ModeDir | 0555
+		} else if f.mode == 0 {
+			f.mode = 0444
+		}
+
+		r.files = append(r.files, f)
+		if f.directory {
+			subdirectories = append(subdirectories, f)
+		}
+	}
+
+	for _, directory := range subdirectories {
+		if err = r.readDirectory(directory.extents[0].offset/r.blockSize, directory.extents[0].length, directory.name, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rockRidge parses the System Use Sharing Protocol entries of a directory record. It updates the name, mode, date and link status.
+// Relocated directories return true. Child links point to the actual location of a relocated directory.
+func (r *iso9660Reader) rockRidge(systemUse []byte, f *isoFile, extent *isoExtent) (relocated bool) {
+	var name []byte
+	hasName := false
+	linkContinued := false
+
+	for continuations := 0; len(systemUse) >= 4; {
+		length := int(systemUse[2])
+		if length < 4 || length > len(systemUse) {
+			break
+		}
+		entry := systemUse[:length]
+		systemUse = systemUse[length:]
+
+		switch string(entry[:2]) {
+		case "NM":
+			// Flags: continue (0x01), current directory (0x02), parent directory (0x04)
+			if length >= 5 && entry[4]&0x06 == 0 {
+				name = append(name, entry[5:]...)
+				hasName = true
+			}
+		case "PX":
+			if length >= 12 {
+				f.mode = unixFileMode(binary.LittleEndian.Uint32(entry[4:]))
+			}
+		case "SL":
+			f.symlink = true
+			f.linkTarget, linkContinued = rockRidgeSymlink(entry, f.linkTarget, linkContinued)
+		case "TF":
+			f.date = rockRidgeModified(entry, f.date)
+		case "RE":
+			relocated = true
+		case "CL":
+			if length >= 12 {
+				f.directory = true
+				extent.offset = int64(binary.LittleEndian.Uint32(entry[4:])) * r.blockSize
+				extent.length = r.directoryLength(extent.offset)
+			}
+		case "CE":
+			// The entries continue in another block
+			if length >= 28 && continuations < 16 && len(systemUse) < 4 {
+				offset := int64(binary.LittleEndian.Uint32(entry[4:]))*r.blockSize + int64(binary.LittleEndian.Uint32(entry[12:]))
+				continuation := make([]byte, binary.LittleEndian.Uint32(entry[20:])&0xFFFF)
+				if _, err := r.file.ReadAt(continuation, offset); err == nil {
+					systemUse = continuation
+					continuations++
+				}
+			}
+		case "ST":
+			systemUse = nil
+		}
+	}
+
+	if hasName && len(name) > 0 {
+		f.name = strings.Replace(string(name), "/", "_", -1)
+	}
+	if f.symlink {
+		f.mode |= os.ModeSymlink
+	}
+
+	return relocated
+}
+
+// rockRidgeSymlink appends the components of an SL entry to the target of the symbolic link. Components are split into multiple entries if continued is set.
+// Each component has flags (1), length (1) and the content. Flags: continue (0x01), current directory (0x02), parent directory (0x04) and root (0x08).
+func rockRidgeSymlink(entry []byte, target string, continued bool) (string, bool) {
+	if len(entry) < 5 {
+		return target, continued
+	}
+
+	for components := entry[5:]; len(components) >= 2 && 2+int(components[1]) <= len(components); components = components[2+int(components[1]):] {
+		flags := components[0]
+		component := string(components[2 : 2+int(components[1])])
+		switch {
+		case flags&0x02 != 0:
+			component = "."
+		case flags&0x04 != 0:
+			component = ".."
+		case flags&0x08 != 0:
+			component = "/"
+		}
+
+		if !continued && target != "" && !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+		target += component
+		continued = flags&0x01 != 0
+	}
+
+	return target, continued
+}
+
+// directoryLength returns the length of a directory, which is stored in its first record (".")
+func (r *iso9660Reader) directoryLength(offset int64) int64 {
+	record := make([]byte, 34)
+	if _, err := r.file.ReadAt(record, offset); err != nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint32(record[10:]))
+}
+
+// rockRidgeModified returns the modification date of a Rock Ridge TF entry. The flags specify which dates are stored and if the long format is used.
+func rockRidgeModified(entry []byte, date time.Time) time.Time {
+	if len(entry) < 5 {
+		return date
+	}
+	flags := entry[4]
+	size := 7
+	if flags&0x80 != 0 {
+		size = 17
+	}
+
+	// The creation date comes first, if present
+	offset := 5
+	if flags&0x01 != 0 {
+		offset += size
+	}
+	if flags&0x02 == 0 || offset+size > len(entry) {
+		return date
+	}
+
+	if size == 7 {
+		return iso9660Date(entry[offset : offset+7])
+	}
+	return iso9660LongDate(entry[offset : offset+17])
+}
+
+// iso9660Name decodes the name of a directory record. The version number ";1" and a trailing dot of names without extension are removed.
+func iso9660Name(identifier []byte, joliet bool) (name string) {
+	if joliet {
+		characters := make([]uint16, len(identifier)/2)
+		for n := range characters {
+			characters[n] = binary.BigEndian.Uint16(identifier[n*2:])
+		}
+		name = string(utf16.Decode(characters))
+	} else {
+		name = string(identifier)
+	}
+
+	if index := strings.LastIndexByte(name, ';'); index > 0 {
+		name = name[:index]
+	}
+	if len(name) > 1 && strings.HasSuffix(name, ".") {
+		name = name[:len(name)-1]
+	}
+
+	return strings.Replace(name, "/", "_", -1)
+}
+
+// iso9660Date decodes the 7 byte date of a directory record: years since 1900, month, day, hour, minute, second and the offset from GMT in 15 minute intervals
+func iso9660Date(data []byte) (date time.Time) {
+	if data[0] == 0 && data[1] == 0 {
+		return date
+	}
+	zone := time.FixedZone("", int(int8(data[6]))*15*60)
+
+	return time.Date(1900+int(data[0]), time.Month(data[1]), int(data[2]), int(data[3]), int(data[4]), int(data[5]), 0, zone)
+}
+
+// iso9660LongDate decodes the 17 byte date of volume descriptors and Rock Ridge: "YYYYMMDDHHMMSSCC" as digits and the offset from GMT
+func iso9660LongDate(data []byte) (date time.Time) {
+	digits := func(text []byte) (value int) {
+		for _, c := range text {
+			value = value*10 + int(c-'0')
+		}
+		return value
+	}
+	if data[0] < '0' || data[0] > '9' || digits(data[0:4]) == 0 {
+		return date
+	}
+	zone := time.FixedZone("", int(int8(data[16]))*15*60)
+
+	return time.Date(digits(data[0:4]), time.Month(digits(data[4:6])), digits(data[6:8]), digits(data[8:10]), digits(data[10:12]), digits(data[12:14]), digits(data[14:16])*10000000, zone)
+}
+
+// ---- UDF ----
+
+// Tag identifiers of UDF descriptors
+const (
+	udfTagAnchor             = 2
+	udfTagPartition          = 5
+	udfTagLogicalVolume      = 6
+	udfTagTerminating        = 8
+	udfTagFileSet            = 256
+	udfTagFileIdentifier     = 257
+	udfTagFileEntry          = 261
+	udfTagExtendedFileEntry  = 266
+	udfFileTypeDirectory     = 4
+	udfFileTypeFile          = 5
+	udfFileTypeSymlink       = 12
+	udfMaxPartitionMaps      = 16
+	udfMaxAllocationExtents  = 1 << 16
+	udfVolumeDescriptorLimit = 256
+)
+
+// udfReader reads the directory tree of a UDF image
+type udfReader struct {
+	file       io.ReaderAt
+	size       int64
+	blockSize  int64
+	partitions []int64 // start sector of the partitions, by partition reference number
+	visited    map[int64]bool
+	files      []isoFile
+}
+
+// udfReadFiles reads the directory tree of the UDF file system
+func udfReadFiles(file io.ReaderAt, size int64) (files []isoFile, err error) {
+	if isoDetect(file) == FormatUnknown {
+		return nil, errISOHeader
+	}
+
+	r := &udfReader{file: file, size: size, visited: make(map[int64]bool)}
+
+	// The anchor volume descriptor pointer is at sector 256. Hard disk images may use 512 byte sectors.
+	var anchor []byte
+	for _, blockSize := range []int64{2048, 512, 4096} {
+		if data, err := r.readTag(256*blockSize, blockSize, udfTagAnchor); err == nil {
+			r.blockSize, anchor = blockSize, data
+			break
+		}
+	}
+	if anchor == nil {
+		return nil, errISOHeader
+	}
+
+	// Main volume descriptor sequence
+	sequenceLength := int64(binary.LittleEndian.Uint32(anchor[16:]))
+	sequenceLocation := int64(binary.LittleEndian.Uint32(anchor[20:]))
+
+	partitionStarts := make(map[uint16]int64)
+	var logicalVolume []byte
+
+	for n := int64(0); n < sequenceLength/r.blockSize && n < udfVolumeDescriptorLimit; n++ {
+		descriptor := make([]byte, r.blockSize)
+		if _, err = file.ReadAt(descriptor, (sequenceLocation+n)*r.blockSize); err != nil {
+			return nil, err
+		}
+
+		tag := binary.LittleEndian.Uint16(descriptor)
+		if tag == udfTagTerminating {
+			break
+		} else if tag == udfTagPartition {
+			partitionStarts[binary.LittleEndian.Uint16(descriptor[22:])] = int64(binary.LittleEndian.Uint32(descriptor[188:]))
+		} else if tag == udfTagLogicalVolume && logicalVolume == nil {
+			logicalVolume = descriptor
+		}
+	}
+	if logicalVolume == nil || len(logicalVolume) < 440 {
+		return nil, errISOHeader
+	}
+
+	// Partition maps: type 1 is a physical partition. Type 2 is only supported for sparable partitions, which are read like physical ones.
+	mapCount := int(binary.LittleEndian.Uint32(logicalVolume[268:]))
+	maps := logicalVolume[440:]
+	for n := 0; n < mapCount && n < udfMaxPartitionMaps; n++ {
+		if len(maps) < 2 || int(maps[1]) > len(maps) || maps[1] < 6 {
+			return nil, errISOHeader
+		}
+		partitionMap := maps[:maps[1]]
+		maps = maps[maps[1]:]
+
+		var partitionNumber uint16
+		switch {
+		case partitionMap[0] == 1:
+			partitionNumber = binary.LittleEndian.Uint16(partitionMap[4:])
+		case partitionMap[0] == 2 && len(partitionMap) >= 40 && bytes.HasPrefix(partitionMap[5:], []byte("*UDF Sparable Partition")):
+			partitionNumber = binary.LittleEndian.Uint16(partitionMap[38:])
+		default:
+			// Virtual (CD-R) and metadata partitions (UDF 2.50) are not supported
+			return nil, ErrUnsupportedVersion
+		}
+
+		start, ok := partitionStarts[partitionNumber]
+		if !ok {
+			return nil, errISOHeader
+		}
+		r.partitions = append(r.partitions, start)
+	}
+
+	if logicalBlockSize := int64(binary.LittleEndian.Uint32(logicalVolume[212:])); logicalBlockSize != r.blockSize {
+		return nil, ErrUnsupportedVersion
+	}
+
+	// The file set descriptor contains the root directory
+	fileSetBlock, fileSetPartition := udfLongAD(logicalVolume[248:])
+	fileSetOffset, err := r.offset(fileSetBlock, fileSetPartition)
+	if err != nil {
+		return nil, err
+	}
+	fileSet, err := r.readTag(fileSetOffset, r.blockSize, udfTagFileSet)
+	if err != nil {
+		return nil, err
+	}
+
+	rootBlock, rootPartition := udfLongAD(fileSet[400:])
+	if err = r.readDirectory(rootBlock, rootPartition, "", 0); err != nil && len(r.files) == 0 {
+		return nil, err
+	}
+
+	return r.files, nil
+}
+
+// readTag reads a descriptor and checks its tag identifier and location
+func (r *udfReader) readTag(offset, length int64, identifier uint16) (data []byte, err error) {
+	data = make([]byte, length)
+	if _, err = r.file.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	// The tag checksum is the sum of bytes 0-3 and 5-15
+	var checksum byte
+	for n := 0; n < 16; n++ {
+		if n != 4 {
+			checksum += data[n]
+		}
+	}
+	if binary.LittleEndian.Uint16(data) != identifier || checksum != data[4] {
+		return nil, errISOHeader
+	}
+
+	return data, nil
+}
+
+// offset returns the offset in the image of a block in a partition
+func (r *udfReader) offset(block uint32, partition uint16) (offset int64, err error) {
+	if int(partition) >= len(r.partitions) {
+		return 0, errISOHeader
+	}
+
+	offset = (r.partitions[partition] + int64(block)) * r.blockSize
+	if offset >= r.size {
+		return 0, errISOHeader
+	}
+
+	return offset, nil
+}
+
+// readFileEntry reads a (extended) file entry and returns the file without name
+func (r *udfReader) readFileEntry(block uint32, partition uint16) (f isoFile, fileType byte, err error) {
+	offset, err := r.offset(block, partition)
+	if err != nil {
+		return f, 0, err
+	}
+
+	entry, err := r.readTag(offset, r.blockSize, udfTagFileEntry)
+	if err != nil {
+		if entry, err = r.readTag(offset, r.blockSize, udfTagExtendedFileEntry); err != nil {
+			return f, 0, err
+		}
+	}
+
+	// The extended file entry has additional fields before the extended attributes
+	modified, attributes := 84, 168
+	if binary.LittleEndian.Uint16(entry) == udfTagExtendedFileEntry {
+		modified, attributes = 92, 208
+	}
+
+	fileType = entry[27]
+	icbFlags := binary.LittleEndian.Uint16(entry[34:])
+	permissions := binary.LittleEndian.Uint32(entry[44:])
+
+	f.size = int64(binary.LittleEndian.Uint64(entry[56:]))
+	f.date = udfTimestamp(entry[modified : modified+12])
+	f.mode = udfFileMode(permissions)
+	f.directory = fileType == udfFileTypeDirectory
+	f.symlink = fileType == udfFileTypeSymlink
+	if f.directory {
+		f.mode |= os.ModeDir
+	} else if f.symlink {
+		f.mode |= os.ModeSymlink
+	}
+
+	extendedLength := int(binary.LittleEndian.Uint32(entry[attributes:]))
+	descriptorsLength := int(binary.LittleEndian.Uint32(entry[attributes+4:]))
+	start := attributes + 8 + extendedLength
+	if extendedLength < 0 || descriptorsLength < 0 || start+descriptorsLength > len(entry) || f.size < 0 {
+		return f, 0, errISOHeader
+	}
+	descriptors := entry[start : start+descriptorsLength]
+
+	// Allocation descriptors: short (0) and long (1). The data of small files may be embedded in the entry (3).
+	remaining := f.size
+	switch icbFlags & 0x07 {
+	case 0, 1:
+		descriptorSize := 8
+		if icbFlags&0x07 == 1 {
+			descriptorSize = 16
+		}
+
+		for ; len(descriptors) >= descriptorSize && remaining > 0 && len(f.extents) < udfMaxAllocationExtents; descriptors = descriptors[descriptorSize:] {
+			length := int64(binary.LittleEndian.Uint32(descriptors) & 0x3FFFFFFF)
+			extentType := binary.LittleEndian.Uint32(descriptors) >> 30
+			if length == 0 {
+				break
+			} else if extentType == 3 {
+				// Continuation of the allocation descriptors in another block, which is only needed for heavily fragmented files
+				return f, 0, ErrUnsupportedVersion
+			}
+
+			extentBlock, extentPartition := binary.LittleEndian.Uint32(descriptors[4:]), partition
+			if descriptorSize == 16 {
+				extentBlock, extentPartition = udfLongAD(descriptors)
+			}
+
+			if length > remaining {
+				length = remaining
+			}
+			remaining -= length
+
+			extent := isoExtent{length: length, recorded: extentType == 0}
+			if extent.recorded {
+				if extent.offset, err = r.offset(extentBlock, extentPartition); err != nil {
+					return f, 0, err
+				}
+			}
+			f.extents = append(f.extents, extent)
+		}
+
+	case 3:
+		if int64(len(descriptors)) < f.size {
+			return f, 0, errISOHeader
+		}
+		f.extents = []isoExtent{{offset: offset + int64(start), length: f.size, recorded: true}}
+		remaining = 0
+
+	default:
+		return f, 0, ErrUnsupportedVersion
+	}
+
+	if remaining > 0 {
+		// The allocation descriptors are shorter than the file
+		f.size -= remaining
+	}
+
+	return f, fileType, nil
+}
+
+// readDirectory reads the file identifier descriptors of the directory and recursively the subdirectories
+func (r *udfReader) readDirectory(block uint32, partition uint16, path string, depth int) (err error) {
+	offset, err := r.offset(block, partition)
+	if err != nil {
+		return err
+	} else if depth > isoMaxDepth || r.visited[offset] {
+		return errISOHeader
+	}
+	r.visited[offset] = true
+
+	directory, _, err := r.readFileEntry(block, partition)
+	if err != nil {
+		return err
+	} else if directory.size > isoMaxDirectorySize {
+		return errISOHeader
+	}
+
+	data, err := ioutil.ReadAll(directory.reader(r.file))
+	if err != nil {
+		return err
+	}
+
+	type subdirectory struct {
+		block     uint32
+		partition uint16
+		name      string
+	}
+	var subdirectories []subdirectory
+
+	for len(data) >= 38 {
+		if binary.LittleEndian.Uint16(data) != udfTagFileIdentifier {
+			return errISOHeader
+		}
+
+		characteristics := data[18]
+		identifierLength := int(data[19])
+		implementationLength := int(binary.LittleEndian.Uint16(data[36:]))
+		length := (38 + implementationLength + identifierLength + 3) &^ 3
+		if 38+implementationLength+identifierLength > len(data) {
+			return errISOHeader
+		}
+		identifier := data[38+implementationLength : 38+implementationLength+identifierLength]
+		entryBlock, entryPartition := udfLongAD(data[20:])
+
+		if length > len(data) {
+			length = len(data)
+		}
+		data = data[length:]
+
+		// Deleted (0x04) and parent (0x08) entries are skipped
+		if characteristics&0x0C != 0 || identifierLength == 0 {
+			continue
+		}
+
+		f, fileType, err := r.readFileEntry(entryBlock, entryPartition)
+		if err != nil {
+			continue
+		} else if fileType != udfFileTypeDirectory && fileType != udfFileTypeFile && fileType != udfFileTypeSymlink {
+			continue
+		}
+
+		f.name = strings.Replace(udfName(identifier), "/", "_", -1)
+		if path != "" {
+			f.name = path + "/" + f.name
+		}
+		if f.symlink && f.size <= containerMaxLinkSize {
+			if data, err := ioutil.ReadAll(f.reader(r.file)); err == nil {
+				f.linkTarget = udfSymlinkTarget(data)
+			}
+		}
+		if f.directory {
+			f.size = 0
+			subdirectories = append(subdirectories, subdirectory{block: entryBlock, partition: entryPartition, name: f.name})
+		}
+		r.files = append(r.files, f)
+	}
+
+	for _, subdirectory := range subdirectories {
+		if err = r.readDirectory(subdirectory.block, subdirectory.partition, subdirectory.name, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// udfSymlinkTarget decodes the path components that are the data of a symbolic link: type (1), length (1), version (2) and the identifier.
+// Types: root (1 and 2), parent directory (3), current directory (4) and name (5).
+func udfSymlinkTarget(data []byte) (target string) {
+	for len(data) >= 4 && 4+int(data[1]) <= len(data) {
+		componentType, identifier := data[0], data[4:4+int(data[1])]
+		data = data[4+int(data[1]):]
+
+		var component string
+		switch componentType {
+		case 1, 2:
+			target = "/"
+			continue
+		case 3:
+			component = ".."
+		case 4:
+			component = "."
+		case 5:
+			component = udfName(identifier)
+		default:
+			continue
+		}
+
+		if target != "" && !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+		target += component
+	}
+
+	return target
+}
+
+// udfLongAD decodes the location of a long allocation descriptor: length (4), block (4), partition reference (2) and implementation use (6)
+func udfLongAD(data []byte) (block uint32, partition uint16) {
+	return binary.LittleEndian.Uint32(data[4:]), binary.LittleEndian.Uint16(data[8:])
+}
+
+// udfName decodes a file identifier. The first byte is the compression ID: 8 for 8-bit and 16 for UCS-2 big endian characters.
+func udfName(identifier []byte) string {
+	if len(identifier) == 0 {
+		return ""
+	}
+
+	switch identifier[0] {
+	case 16, 255:
+		characters := make([]uint16, (len(identifier)-1)/2)
+		for n := range characters {
+			characters[n] = binary.BigEndian.Uint16(identifier[1+n*2:])
+		}
+		return string(utf16.Decode(characters))
+
+	default:
+		// Latin-1
+		characters := make([]rune, len(identifier)-1)
+		for n, c := range identifier[1:] {
+			characters[n] = rune(c)
+		}
+		return string(characters)
+	}
+}
+
+// udfTimestamp decodes a UDF timestamp: type and time zone (2), year (2), month, day, hour, minute, second, centiseconds, hundreds of microseconds and microseconds
+func udfTimestamp(data []byte) (date time.Time) {
+	year := int(binary.LittleEndian.Uint16(data[2:]))
+	if year == 0 {
+		return date
+	}
+
+	// The time zone is the offset in minutes as signed 12 bit value, -2047 if not specified
+	typeAndZone := binary.LittleEndian.Uint16(data)
+	offset := int(typeAndZone & 0x0FFF)
+	if offset >= 0x0800 {
+		offset -= 0x1000
+	}
+	zone := time.UTC
+	if offset != -2047 && typeAndZone>>12 == 1 {
+		zone = time.FixedZone("", offset*60)
+	}
+
+	nanoseconds := (int(data[9])*10000 + int(data[10])*100 + int(data[11])) * 1000
+	return time.Date(year, time.Month(data[4]), int(data[5]), int(data[6]), int(data[7]), int(data[8]), nanoseconds, zone)
+}
+
+// udfFileMode converts UDF permissions. They consist of 5 bits for other, group and owner each: execute, write, read, change attributes, delete.
+func udfFileMode(permissions uint32) (mode os.FileMode) {
+	for n, shift := range []uint{10, 5, 0} {
+		bits := permissions >> shift
+		if bits&0x04 != 0 {
+			mode |= 0400 >> (uint(n) * 3)
+		}
+		if bits&0x02 != 0 {
+			mode |= 0200 >> (uint(n) * 3)
+		}
+		if bits&0x01 != 0 {
+			mode |= 0100 >> (uint(n) * 3)
+		}
+	}
+
+	return mode
+}
@@ -0,0 +1,225 @@
+/*
+File Name:  LZW.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Decoder for files compressed with the Unix compress tool (.Z). The package compress/lzw cannot be used: compress uses up to 16 bits per code,
+a clear code that is only valid in block mode, and pads the codes to the end of a group of 8 codes whenever the code size changes.
+*/
+
+package fileconversion
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Constants of the .Z format
+const (
+	lzwHeaderSize = 3
+	lzwInitBits   = 9
+	lzwMaxBits    = 16
+	lzwClear      = 256
+	lzwBlockMode  = 0x80
+	lzwBitsMask   = 0x1F
+)
+
+var errLZWCorrupt = errors.New("invalid .Z data")
+
+// lzwReader decompresses a .Z stream
+type lzwReader struct {
+	reader    io.ByteReader
+	blockMode bool
+	maxBits   uint
+	bits      uint // current code size
+	maxCode   int  // once freeEntry exceeds it, the code size is increased
+	freeEntry int  // next free entry of the table
+
+	bitBuffer uint32
+	bitCount  uint
+	groupBits uint // bits read since the code size changed
+	oldCode   int
+	finalChar byte
+	prefix    []uint16
+	suffix    []byte
+	stack     []byte // decoded string
+	output    []byte // decoded bytes that were not returned yet
+	err       error
+}
+
+// newLZWReader returns a reader that decompresses the .Z stream. The header is checked.
+func newLZWReader(reader io.Reader) (decompressed io.Reader, err error) {
+	buffered := bufio.NewReader(reader)
+
+	header := make([]byte, lzwHeaderSize)
+	if _, err = io.ReadFull(buffered, header); err != nil {
+		return nil, err
+	} else if header[0] != 0x1F || header[1] != 0x9D {
+		return nil, errLZWCorrupt
+	}
+
+	maxBits := uint(header[2] & lzwBitsMask)
+	if maxBits < lzwInitBits || maxBits > lzwMaxBits {
+		return nil, errLZWCorrupt
+	}
+
+	r := &lzwReader{
+		reader:    buffered,
+		blockMode: header[2]&lzwBlockMode != 0,
+		maxBits:   maxBits,
+		bits:      lzwInitBits,
+		maxCode:   1<<lzwInitBits - 1,
+		freeEntry: 256,
+		oldCode:   -1,
+		prefix:    make([]uint16, 1<<maxBits),
+		suffix:    make([]byte, 1<<maxBits),
+		stack:     make([]byte, 0, 1<<maxBits),
+	}
+	if r.blockMode {
+		r.freeEntry = lzwClear + 1
+	}
+	for n := 0; n < 256; n++ {
+		r.suffix[n] = byte(n)
+	}
+
+	return r, nil
+}
+
+func (r *lzwReader) Read(p []byte) (n int, err error) {
+	for len(r.output) == 0 && r.err == nil {
+		r.decode()
+	}
+
+	n = copy(p, r.output)
+	r.output = r.output[n:]
+	if len(r.output) == 0 && r.err != nil {
+		return n, r.err
+	}
+
+	return n, nil
+}
+
+// decode decodes the next code. The output is stored in r.output, errors in r.err.
+func (r *lzwReader) decode() {
+	if r.freeEntry > r.maxCode {
+		// The code size increases. The remaining codes of the group are padding.
+		if r.err = r.skipGroup(); r.err != nil {
+			return
+		}
+		r.bits++
+		if r.bits == r.maxBits {
+			r.maxCode = 1 << r.maxBits
+		} else {
+			r.maxCode = 1<<r.bits - 1
+		}
+	}
+
+	code, err := r.readCode()
+	if err != nil {
+		r.err = err
+		return
+	}
+
+	if r.oldCode == -1 {
+		// The first code is a literal
+		if code >= 256 {
+			r.err = errLZWCorrupt
+			return
+		}
+		r.oldCode = code
+		r.finalChar = byte(code)
+		r.output = append(r.stack[:0], r.finalChar)
+		return
+	}
+
+	if code == lzwClear && r.blockMode {
+		// Reset the table and the code size
+		if r.err = r.skipGroup(); r.err != nil {
+			return
+		}
+		r.freeEntry = lzwClear
+		r.bits = lzwInitBits
+		r.maxCode = 1<<lzwInitBits - 1
+		return
+	}
+
+	inCode := code
+	stack := r.stack[:0]
+
+	if code >= r.freeEntry {
+		// The code is defined by this step: the previous string followed by its first character
+		if code > r.freeEntry {
+			r.err = errLZWCorrupt
+			return
+		}
+		stack = append(stack, r.finalChar)
+		code = r.oldCode
+	}
+
+	for code >= 256 {
+		if len(stack) >= cap(r.stack) {
+			r.err = errLZWCorrupt
+			return
+		}
+		stack = append(stack, r.suffix[code])
+		code = int(r.prefix[code])
+	}
+	r.finalChar = r.suffix[code]
+	stack = append(stack, r.finalChar)
+
+	// The string was decoded in reverse order
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	r.stack = stack
+	r.output = stack
+
+	if r.freeEntry < 1<<r.maxBits {
+		r.prefix[r.freeEntry] = uint16(r.oldCode)
+		r.suffix[r.freeEntry] = r.finalChar
+		r.freeEntry++
+	}
+	r.oldCode = inCode
+}
+
+// readCode reads the next code. At the end of the input io.EOF is returned, an incomplete code is ignored.
+func (r *lzwReader) readCode() (code int, err error) {
+	for r.bitCount < r.bits {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		r.bitBuffer |= uint32(b) << r.bitCount
+		r.bitCount += 8
+	}
+
+	code = int(r.bitBuffer & (1<<r.bits - 1))
+	r.bitBuffer >>= r.bits
+	r.bitCount -= r.bits
+	r.groupBits += r.bits
+
+	return code, nil
+}
+
+// skipGroup skips the rest of the current group of 8 codes. Codes are written in groups, which are padded when the code size changes.
+func (r *lzwReader) skipGroup() (err error) {
+	groupSize := r.bits * 8
+	skip := (groupSize - r.groupBits%groupSize) % groupSize
+	r.groupBits = 0
+
+	for ; skip > 0; skip-- {
+		if r.bitCount == 0 {
+			b, err := r.reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			r.bitBuffer = uint32(b)
+			r.bitCount = 8
+		}
+		r.bitBuffer >>= 1
+		r.bitCount--
+	}
+
+	return nil
+}
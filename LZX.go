@@ -0,0 +1,525 @@
+/*
+File Name:  LZX.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Decoder for LZX compressed folders of CAB files. The data of a folder is decompressed in frames of 32 KB, one frame per CFDATA block.
+Huffman codes are read MSB first from 16-bit little endian words. After each frame the input is aligned to 16 bits.
+*/
+
+package fileconversion
+
+import (
+	"errors"
+	"io"
+)
+
+// Constants of the LZX format
+const (
+	lzxMinWindowBits  = 15
+	lzxMaxWindowBits  = 21
+	lzxFrameSize      = 32768
+	lzxNumChars       = 256
+	lzxPrimaryLengths = 7
+	lzxLengthSymbols  = 249
+	lzxMinMatch       = 2
+	lzxPretreeSymbols = 20
+	lzxAlignedSymbols = 8
+	lzxMaxCodeLength  = 16
+	lzxMaxMainSymbols = lzxNumChars + 50*8
+
+	lzxBlockVerbatim     = 1
+	lzxBlockAligned      = 2
+	lzxBlockUncompressed = 3
+
+	lzxInvalidSymbol = 0xFFFF
+)
+
+var errLZXCorrupt = errors.New("invalid LZX data")
+
+// lzxPositionSlots is the number of position slots for window sizes of 2^15 to 2^21 bytes
+var lzxPositionSlots = []int{30, 32, 34, 36, 38, 42, 50}
+
+// lzxExtraBits and lzxPositionBase define the offsets of the position slots
+var lzxExtraBits, lzxPositionBase = func() (extraBits [50]uint, positionBase [50]uint32) {
+	bits := uint(0)
+	for n := 0; n < 50; n += 2 {
+		extraBits[n], extraBits[n+1] = bits, bits
+		if n != 0 && bits < 17 {
+			bits++
+		}
+	}
+	base := uint32(0)
+	for n := range positionBase {
+		positionBase[n] = base
+		base += 1 << extraBits[n]
+	}
+	return extraBits, positionBase
+}()
+
+// lzxDecoder decompresses the LZX stream of a CAB folder. The window and the Huffman code lengths are kept across frames.
+type lzxDecoder struct {
+	reader  io.ByteReader
+	pending []byte // bytes that were read ahead while aligning the input for an uncompressed block
+
+	bitBuffer uint64 // bits are stored starting at the most significant bit
+	bitCount  uint
+	overrun   int // zero bytes returned after the end of the input
+
+	window     []byte
+	windowMask int64
+	slots      int
+	position   int64 // bytes decoded
+	output     int64 // bytes returned as frames
+
+	headerRead     bool
+	intelSize      int32 // file size for the translation of x86 CALL instructions (E8), 0 if not used
+	blockType      int
+	blockLength    int64
+	blockRemaining int64
+	r              [3]uint32 // repeated offsets
+
+	mainLengths    [lzxMaxMainSymbols]byte
+	lengthLengths  [lzxLengthSymbols]byte
+	alignedLengths [lzxAlignedSymbols]byte
+	pretreeTable   []uint16
+	mainTable      []uint16
+	lengthTable    []uint16
+	alignedTable   []uint16
+}
+
+// newLZXDecoder creates a decoder for the window size 2^windowBits
+func newLZXDecoder(reader io.ByteReader, windowBits uint) (decoder *lzxDecoder, err error) {
+	if windowBits < lzxMinWindowBits || windowBits > lzxMaxWindowBits {
+		return nil, errLZXCorrupt
+	}
+
+	return &lzxDecoder{
+		reader:     reader,
+		window:     make([]byte, 1<<windowBits),
+		windowMask: 1<<windowBits - 1,
+		slots:      lzxPositionSlots[windowBits-lzxMinWindowBits],
+		r:          [3]uint32{1, 1, 1},
+	}, nil
+}
+
+// readByte reads the next byte of the input. After the end of the input zeros are returned, since the last frame may end within a 16-bit word.
+func (d *lzxDecoder) readByte() (b byte, err error) {
+	if len(d.pending) > 0 {
+		b, d.pending = d.pending[0], d.pending[1:]
+		return b, nil
+	}
+
+	b, err = d.reader.ReadByte()
+	if err == io.EOF {
+		if d.overrun++; d.overrun > 8 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, nil
+	}
+	return b, err
+}
+
+// ensureBits makes sure that at least count bits are in the buffer
+func (d *lzxDecoder) ensureBits(count uint) (err error) {
+	for d.bitCount < count {
+		low, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		high, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		d.bitBuffer |= uint64(high)<<56>>d.bitCount | uint64(low)<<48>>d.bitCount
+		d.bitCount += 16
+	}
+	return nil
+}
+
+// readBits reads up to 32 bits
+func (d *lzxDecoder) readBits(count uint) (value uint32, err error) {
+	if count == 0 {
+		return 0, nil
+	} else if err = d.ensureBits(count); err != nil {
+		return 0, err
+	}
+
+	value = uint32(d.bitBuffer >> (64 - count))
+	d.bitBuffer <<= count
+	d.bitCount -= count
+	return value, nil
+}
+
+// readSymbol decodes the next symbol using the table created by lzxBuildTable
+func (d *lzxDecoder) readSymbol(table []uint16, lengths []byte) (symbol int, err error) {
+	if err = d.ensureBits(lzxMaxCodeLength); err != nil {
+		return 0, err
+	}
+
+	symbol = int(table[d.bitBuffer>>(64-lzxMaxCodeLength)])
+	if symbol == lzxInvalidSymbol {
+		return 0, errLZXCorrupt
+	}
+	d.bitBuffer <<= lengths[symbol]
+	d.bitCount -= uint(lengths[symbol])
+	return symbol, nil
+}
+
+// alignBytes discards the bits of the current 16-bit word before the raw data of an uncompressed block. If the input is already aligned, 16 bits are discarded.
+func (d *lzxDecoder) alignBytes() (err error) {
+	if err = d.ensureBits(16); err != nil {
+		return err
+	}
+
+	if d.bitCount > 16 {
+		// The last word that was read belongs to the raw data
+		d.bitBuffer <<= d.bitCount - 16
+		word := d.bitBuffer >> 48
+		d.pending = append([]byte{byte(word), byte(word >> 8)}, d.pending...)
+	}
+	d.bitBuffer, d.bitCount = 0, 0
+	return nil
+}
+
+// lzxBuildTable creates the lookup table for the canonical Huffman code. The table is indexed by the next 16 bits of the input.
+func lzxBuildTable(table []uint16, lengths []byte) (result []uint16, err error) {
+	if table == nil {
+		table = make([]uint16, 1<<lzxMaxCodeLength)
+	}
+	for n := range table {
+		table[n] = lzxInvalidSymbol
+	}
+
+	code := 0
+	for length := 1; length <= lzxMaxCodeLength; length++ {
+		for symbol, symbolLength := range lengths {
+			if int(symbolLength) != length {
+				continue
+			}
+
+			fill := 1 << uint(lzxMaxCodeLength-length)
+			start := code * fill
+			if start+fill > len(table) {
+				// over-subscribed
+				return table, errLZXCorrupt
+			}
+			for n := start; n < start+fill; n++ {
+				table[n] = uint16(symbol)
+			}
+			code++
+		}
+		code <<= 1
+	}
+
+	return table, nil
+}
+
+// readLengths reads code lengths encoded with the pretree. They are stored as difference to the lengths of the previous block.
+func (d *lzxDecoder) readLengths(lengths []byte) (err error) {
+	var pretreeLengths [lzxPretreeSymbols]byte
+	for n := range pretreeLengths {
+		value, err := d.readBits(4)
+		if err != nil {
+			return err
+		}
+		pretreeLengths[n] = byte(value)
+	}
+	if d.pretreeTable, err = lzxBuildTable(d.pretreeTable, pretreeLengths[:]); err != nil {
+		return err
+	}
+	pretree := d.pretreeTable
+
+	for n := 0; n < len(lengths); {
+		symbol, err := d.readSymbol(pretree, pretreeLengths[:])
+		if err != nil {
+			return err
+		}
+
+		var run uint32
+		var length byte
+		switch symbol {
+		case 17, 18:
+			// run of zeros
+			if symbol == 17 {
+				run, err = d.readBits(4)
+				run += 4
+			} else {
+				run, err = d.readBits(5)
+				run += 20
+			}
+		case 19:
+			// run of the same length
+			if run, err = d.readBits(1); err != nil {
+				return err
+			}
+			run += 4
+			if symbol, err = d.readSymbol(pretree, pretreeLengths[:]); err != nil {
+				return err
+			} else if symbol > 16 {
+				return errLZXCorrupt
+			}
+			length = byte((int(lengths[n]) - symbol + 17) % 17)
+		default:
+			run = 1
+			length = byte((int(lengths[n]) - symbol + 17) % 17)
+		}
+		if err != nil {
+			return err
+		}
+
+		for ; run > 0 && n < len(lengths); run-- {
+			lengths[n] = length
+			n++
+		}
+	}
+
+	return nil
+}
+
+// readBlockHeader reads the type and size of the next block and its Huffman codes
+func (d *lzxDecoder) readBlockHeader() (err error) {
+	if d.blockType == lzxBlockUncompressed && d.blockLength&1 != 0 {
+		// Uncompressed blocks of odd size are padded
+		if _, err = d.readByte(); err != nil {
+			return err
+		}
+	}
+
+	blockType, err := d.readBits(3)
+	if err != nil {
+		return err
+	}
+	length, err := d.readBits(24)
+	if err != nil {
+		return err
+	} else if length == 0 {
+		return errLZXCorrupt
+	}
+	d.blockType, d.blockLength, d.blockRemaining = int(blockType), int64(length), int64(length)
+
+	switch d.blockType {
+	case lzxBlockAligned, lzxBlockVerbatim:
+		if d.blockType == lzxBlockAligned {
+			for n := range d.alignedLengths {
+				value, err := d.readBits(3)
+				if err != nil {
+					return err
+				}
+				d.alignedLengths[n] = byte(value)
+			}
+			if d.alignedTable, err = lzxBuildTable(d.alignedTable, d.alignedLengths[:]); err != nil {
+				return err
+			}
+		}
+
+		mainSymbols := lzxNumChars + d.slots*8
+		if err = d.readLengths(d.mainLengths[:lzxNumChars]); err != nil {
+			return err
+		} else if err = d.readLengths(d.mainLengths[lzxNumChars:mainSymbols]); err != nil {
+			return err
+		} else if d.mainTable, err = lzxBuildTable(d.mainTable, d.mainLengths[:mainSymbols]); err != nil {
+			return err
+		} else if err = d.readLengths(d.lengthLengths[:]); err != nil {
+			return err
+		} else if d.lengthTable, err = lzxBuildTable(d.lengthTable, d.lengthLengths[:]); err != nil {
+			return err
+		}
+
+	case lzxBlockUncompressed:
+		// The repeated offsets follow as 32-bit values after aligning the input
+		if err = d.alignBytes(); err != nil {
+			return err
+		}
+		for n := range d.r {
+			var value [4]byte
+			for m := range value {
+				if value[m], err = d.readByte(); err != nil {
+					return err
+				}
+			}
+			d.r[n] = uint32(value[0]) | uint32(value[1])<<8 | uint32(value[2])<<16 | uint32(value[3])<<24
+		}
+
+	default:
+		return errLZXCorrupt
+	}
+
+	return nil
+}
+
+// decodeFrame decodes the next frame of the given size, which is at most 32 KB.
+func (d *lzxDecoder) decodeFrame(size int) (frame []byte, err error) {
+	if size <= 0 || size > lzxFrameSize {
+		return nil, errLZXCorrupt
+	}
+
+	if !d.headerRead {
+		// The stream starts with the file size for the E8 translation, if used
+		d.headerRead = true
+		intel, err := d.readBits(1)
+		if err != nil {
+			return nil, err
+		} else if intel != 0 {
+			high, err := d.readBits(16)
+			if err != nil {
+				return nil, err
+			}
+			low, err := d.readBits(16)
+			if err != nil {
+				return nil, err
+			}
+			d.intelSize = int32(high<<16 | low)
+		}
+	}
+
+	// A match at the end of the previous frame may have decoded bytes of this frame already
+	frameEnd := d.output + int64(size)
+
+	for d.position < frameEnd {
+		if d.blockRemaining == 0 {
+			if err = d.readBlockHeader(); err != nil {
+				return nil, err
+			}
+		}
+
+		if d.blockType == lzxBlockUncompressed {
+			run := d.blockRemaining
+			if run > frameEnd-d.position {
+				run = frameEnd - d.position
+			}
+			for ; run > 0; run-- {
+				b, err := d.readByte()
+				if err != nil {
+					return nil, err
+				}
+				d.window[d.position&d.windowMask] = b
+				d.position++
+				d.blockRemaining--
+			}
+			continue
+		}
+
+		for d.blockRemaining > 0 && d.position < frameEnd {
+			if err = d.decodeSymbol(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Align the input to 16 bits
+	d.bitBuffer <<= d.bitCount & 15
+	d.bitCount -= d.bitCount & 15
+
+	frame = make([]byte, size)
+	for n := range frame {
+		frame[n] = d.window[(d.output+int64(n))&d.windowMask]
+	}
+	if d.intelSize != 0 && d.output < lzxFrameSize*lzxFrameSize {
+		lzxTranslateE8(frame, d.output, d.intelSize)
+	}
+	d.output = frameEnd
+
+	return frame, nil
+}
+
+// decodeSymbol decodes a literal or a match of a verbatim or aligned block
+func (d *lzxDecoder) decodeSymbol() (err error) {
+	symbol, err := d.readSymbol(d.mainTable, d.mainLengths[:])
+	if err != nil {
+		return err
+	}
+
+	if symbol < lzxNumChars {
+		d.window[d.position&d.windowMask] = byte(symbol)
+		d.position++
+		d.blockRemaining--
+		return nil
+	}
+
+	symbol -= lzxNumChars
+	length := symbol & 7
+	if length == lzxPrimaryLengths {
+		extra, err := d.readSymbol(d.lengthTable, d.lengthLengths[:])
+		if err != nil {
+			return err
+		}
+		length += extra
+	}
+	length += lzxMinMatch
+
+	var offset uint32
+	switch slot := symbol >> 3; slot {
+	case 0:
+		offset = d.r[0]
+	case 1:
+		offset = d.r[1]
+		d.r[1] = d.r[0]
+	case 2:
+		offset = d.r[2]
+		d.r[2] = d.r[0]
+	default:
+		extra := lzxExtraBits[slot]
+		offset = lzxPositionBase[slot] - 2
+
+		if d.blockType == lzxBlockAligned && extra >= 3 {
+			// The lowest 3 bits are encoded with the aligned offset tree
+			verbatim, err := d.readBits(extra - 3)
+			if err != nil {
+				return err
+			}
+			aligned, err := d.readSymbol(d.alignedTable, d.alignedLengths[:])
+			if err != nil {
+				return err
+			}
+			offset += verbatim<<3 + uint32(aligned)
+		} else if extra > 0 {
+			verbatim, err := d.readBits(extra)
+			if err != nil {
+				return err
+			}
+			offset += verbatim
+		} else {
+			offset = 1
+		}
+
+		d.r[2], d.r[1] = d.r[1], d.r[0]
+	}
+	d.r[0] = offset
+
+	if offset == 0 || int64(offset) > d.position || int64(offset) > d.windowMask+1 || int64(length) > d.blockRemaining {
+		return errLZXCorrupt
+	}
+
+	for n := 0; n < length; n++ {
+		d.window[d.position&d.windowMask] = d.window[(d.position-int64(offset))&d.windowMask]
+		d.position++
+	}
+	d.blockRemaining -= int64(length)
+
+	return nil
+}
+
+// lzxTranslateE8 reverts the translation of the targets of x86 CALL instructions (E8) from relative to absolute offsets. The last 10 bytes of a frame are not translated.
+func lzxTranslateE8(frame []byte, offset int64, fileSize int32) {
+	position := int32(offset)
+
+	for n := 0; n < len(frame)-10; {
+		if frame[n] != 0xE8 {
+			n++
+			position++
+			continue
+		}
+
+		absolute := int32(uint32(frame[n+1]) | uint32(frame[n+2])<<8 | uint32(frame[n+3])<<16 | uint32(frame[n+4])<<24)
+		if absolute >= -position && absolute < fileSize {
+			relative := absolute - position
+			if absolute < 0 {
+				relative = absolute + fileSize
+			}
+			frame[n+1], frame[n+2], frame[n+3], frame[n+4] = byte(relative), byte(relative>>8), byte(relative>>16), byte(relative>>24)
+		}
+		n += 5
+		position += 5
+	}
+}
@@ -0,0 +1,525 @@
+/*
+File Name:  Listing.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Listing of the files in containers with their metadata. Only the headers are read, the files are not decompressed.
+*/
+
+package fileconversion
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ContainerListing is the list of files in a container, returned by ContainerListFiles
+type ContainerListing struct {
+	Format  Format
+	Comment string // Archive comment
+	Files   []ContainerEntry
+}
+
+// ContainerEntry is a file or directory in a container
+type ContainerEntry struct {
+	Name           string
+	Size           int64       // Uncompressed size, -1 if unknown
+	CompressedSize int64       // Compressed size, -1 if unknown. 7Z archives compress multiple files together (solid), their compressed size is unknown.
+	CRC32          uint32      // Checksum of the uncompressed data, if HasCRC is set
+	HasCRC         bool        // The container stores a checksum for the file
+	Method         string      // Compression method, for example "Deflate". Empty if unknown or not applicable.
+	Encrypted      bool        // The file is encrypted
+	Directory      bool        // It is a directory
+	Symlink        bool        // It is a symbolic link (or a junction on Windows)
+	Mode           os.FileMode // Permissions and the type of the file, if stored in the container
+	Date           time.Time   // Modification date
+	Comment        string      // File comment, only supported by ZIP and TAR (PAX header)
+	HostOS         string      // Operating system that created the file, for example "Unix". Empty if unknown.
+	NameEncoding   string      // Detected encoding of the name if the container does not specify it, see ContainerFile.NameEncoding
+}
+
+// ContainerListFiles lists the files of supported containers: ZIP, RAR, 7Z, TAR, CAB, cpio, ar, DEB, RPM, ISO 9660 and UDF disk images. Size is the full size of the input file.
+// Only the headers are read, the files are not decompressed. Directories are included.
+// If the input is none of the supported containers, ErrUnsupportedFormat is returned. Invalid archives return a *ConversionError.
+// Archives with encrypted headers (RAR, 7Z) return ErrPasswordRequired, unless some files are listed before the encrypted headers.
+func ContainerListFiles(file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	return ContainerListFilesContext(context.Background(), file, size)
+}
+
+// ContainerListFilesContext is the same as ContainerListFiles, but stops once the context is cancelled and returns its error.
+// Panics of the parsers are returned as ErrParserPanic.
+func ContainerListFilesContext(ctx context.Context, file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	defer recoverPanic(FormatUnknown, &err)
+
+	file = &contextReaderAt{ctx: ctx, reader: file}
+
+	if r, errZIP := zip.NewReader(file, size); errZIP == nil {
+		listing = listZIP(r)
+	} else {
+		var format Format
+		switch format, _ = DetectFormat(file, size); format {
+		case FormatZIP:
+			err = newConversionError(FormatZIP, ErrCorrupt, errZIP)
+		case FormatRAR:
+			listing, err = listRAR(file, size)
+		case Format7Z:
+			listing, err = list7Z(file, size)
+		case FormatISO, FormatUDF:
+			listing, err = listISO(file, size)
+		case FormatCAB:
+			listing, err = listCAB(file, size)
+		case FormatCPIO:
+			listing, err = listCPIO(ctx, io.NewSectionReader(file, 0, size), FormatCPIO)
+		case FormatAR:
+			listing, err = listAR(ctx, io.NewSectionReader(file, 0, size))
+		case FormatDEB:
+			listing, err = listDEB(ctx, file, size)
+		case FormatRPM:
+			listing, err = listRPM(ctx, file, size)
+		default:
+			// Old TAR files do not have a signature. They are only detected via a valid header.
+			listing, err = listTAR(ctx, io.NewSectionReader(file, 0, size))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, err
+	}
+
+	return listing, nil
+}
+
+// zipMethods are the names of the compression methods of ZIP files
+var zipMethods = map[uint16]string{
+	zip.Store:      "Store",
+	1:              "Shrink",
+	6:              "Implode",
+	zip.Deflate:    "Deflate",
+	9:              "Deflate64",
+	zipMethodBZIP2: "BZip2",
+	14:             "LZMA",
+	93:             "Zstandard",
+	95:             "XZ",
+	96:             "JPEG",
+	97:             "WavPack",
+	98:             "PPMd",
+}
+
+// zipHostOS are the names of the operating systems in the "version made by" field of ZIP files
+var zipHostOS = []string{"MS-DOS", "Amiga", "OpenVMS", "Unix", "VM/CMS", "Atari ST", "OS/2", "Macintosh", "Z-System", "CP/M", "Windows NTFS", "MVS", "VSE", "Acorn RISC OS", "VFAT", "MVS", "BeOS", "Tandem", "OS/400", "OS X"}
+
+// listZIP lists the files of the ZIP archive
+func listZIP(r *zip.Reader) (listing *ContainerListing) {
+	listing = &ContainerListing{Format: FormatZIP, Comment: r.Comment}
+
+	names, encodings := zipNames(r)
+
+	for n, f := range r.File {
+		entry := ContainerEntry{
+			Name:           names[n],
+			NameEncoding:   encodings[n],
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			CRC32:          f.CRC32,
+			HasCRC:         true,
+			Encrypted:      f.Flags&0x1 != 0,
+			Mode:           f.Mode(),
+			Date:           f.Modified,
+			Comment:        f.Comment,
+		}
+		entry.Directory = entry.Mode.IsDir()
+		entry.Symlink = entry.Mode&os.ModeSymlink != 0
+
+		method := f.Method
+		if f.Method == zipMethodAES {
+			// AE-2 does not store the CRC, the authentication code is used instead
+			if version, _, actualMethod, ok := zipAESExtra(f.Extra); ok {
+				method = actualMethod
+				entry.HasCRC = version == 1
+			}
+			entry.Encrypted = true
+		}
+		if name, ok := zipMethods[method]; ok {
+			entry.Method = name
+		} else {
+			entry.Method = strconv.Itoa(int(method))
+		}
+
+		if hostOS := int(f.CreatorVersion >> 8); hostOS < len(zipHostOS) {
+			entry.HostOS = zipHostOS[hostOS]
+		}
+
+		listing.Files = append(listing.Files, entry)
+	}
+
+	return listing
+}
+
+// listRAR lists the files of the RAR archive
+func listRAR(file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	archive, err := rarReadHeaders(file, size)
+	if err != nil && len(archive.files) == 0 {
+		return nil, newConversionError(FormatRAR, ErrCorrupt, err)
+	} else if archive.encryptedHeaders && len(archive.files) == 0 {
+		return nil, &ConversionError{Format: FormatRAR, Kind: ErrPasswordRequired}
+	}
+
+	listing = &ContainerListing{Format: FormatRAR, Comment: archive.comment}
+
+	for _, header := range archive.files {
+		listing.Files = append(listing.Files, ContainerEntry{
+			Name:           header.name,
+			Size:           header.size,
+			CompressedSize: header.packedSize,
+			CRC32:          header.crc,
+			HasCRC:         header.hasCRC,
+			Method:         header.method,
+			Encrypted:      header.encrypted,
+			Directory:      header.directory,
+			Symlink:        header.symlink,
+			Mode:           header.mode,
+			Date:           header.date,
+			HostOS:         header.hostOS,
+		})
+	}
+
+	return listing, nil
+}
+
+// list7Z lists the files of the 7Z archive. Files with data are stored in folders, each folder contains one or more streams in the order of the files.
+func list7Z(file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	header, err := sevenZipReadHeader(file, size)
+	if err == ErrPasswordRequired {
+		return nil, &ConversionError{Format: Format7Z, Kind: ErrPasswordRequired}
+	} else if err != nil {
+		return nil, newConversionError(Format7Z, ErrCorrupt, err)
+	}
+
+	// The streams of all folders
+	type stream struct {
+		size, compressedSize int64
+		crc                  uint32
+		hasCRC               bool
+		method               string
+		encrypted            bool
+	}
+	var streams []stream
+
+	if info := header.MainStreamsInfo; info != nil && info.UnpackInfo != nil {
+		var sizes []uint64
+		var digests []uint32
+		if info.SubStreamsInfo != nil {
+			sizes = info.SubStreamsInfo.UnpackSizes
+			digests = info.SubStreamsInfo.Digests
+		}
+		packIndex := 0
+
+		for n, folder := range info.UnpackInfo.Folders {
+			method, encrypted := sevenZipMethod(folder)
+
+			compressedSize := int64(0)
+			packedStreams := len(folder.PackedIndices)
+			if packedStreams == 0 {
+				packedStreams = 1
+			}
+			for ; packedStreams > 0; packedStreams-- {
+				if info.PackInfo != nil && packIndex < len(info.PackInfo.PackSizes) {
+					compressedSize += int64(info.PackInfo.PackSizes[packIndex])
+				}
+				packIndex++
+			}
+
+			count := 1
+			if info.SubStreamsInfo != nil && n < len(info.SubStreamsInfo.NumUnpackStreamsInFolders) {
+				count = info.SubStreamsInfo.NumUnpackStreamsInFolders[n]
+			}
+
+			for m := 0; m < count; m++ {
+				s := stream{size: int64(folder.UnpackSize()), compressedSize: -1, method: method, encrypted: encrypted}
+				if info.SubStreamsInfo != nil && len(sizes) > 0 {
+					s.size = int64(sizes[0])
+					sizes = sizes[1:]
+				}
+				if count == 1 {
+					s.compressedSize = compressedSize
+				}
+
+				// The checksum of a folder with a single stream is stored in the folder
+				if count == 1 && folder.UnpackCRC != 0 {
+					s.crc, s.hasCRC = folder.UnpackCRC, true
+				} else if len(digests) > 0 {
+					s.crc, s.hasCRC = digests[0], true
+					digests = digests[1:]
+				}
+
+				streams = append(streams, s)
+			}
+		}
+	}
+
+	listing = &ContainerListing{Format: Format7Z}
+
+	for _, fileInfo := range header.FilesInfo {
+		entry := ContainerEntry{Name: fileInfo.Name, Date: fileInfo.ModifiedAt, HostOS: "Windows"}
+
+		if fileInfo.IsEmptyStream {
+			entry.Directory = !fileInfo.IsEmptyFile || fileInfo.Attrib&0x10 != 0
+		} else if len(streams) > 0 {
+			s := streams[0]
+			streams = streams[1:]
+			entry.Size, entry.CompressedSize = s.size, s.compressedSize
+			entry.CRC32, entry.HasCRC = s.crc, s.hasCRC
+			entry.Method, entry.Encrypted = s.method, s.encrypted
+		}
+
+		// 7-Zip stores the Unix mode in the high 16 bits of the attributes, indicated by 0x8000
+		if fileInfo.Attrib&0x8000 != 0 {
+			entry.HostOS = "Unix"
+			entry.Mode = unixFileMode(fileInfo.Attrib >> 16)
+		} else {
+			entry.Mode = msdosFileMode(fileInfo.Attrib, entry.Directory)
+		}
+		entry.Symlink = entry.Mode&os.ModeSymlink != 0
+
+		listing.Files = append(listing.Files, entry)
+	}
+
+	return listing, nil
+}
+
+// listISO lists the files and directories of the ISO 9660 or UDF image
+func listISO(file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	files, format, err := isoReadFiles(file, size)
+	if err == ErrUnsupportedVersion {
+		return nil, &ConversionError{Format: format, Kind: ErrUnsupportedVersion}
+	} else if err != nil {
+		return nil, newConversionError(format, ErrCorrupt, err)
+	}
+
+	listing = &ContainerListing{Format: format}
+	for _, f := range files {
+		listing.Files = append(listing.Files, ContainerEntry{
+			Name:           f.name,
+			Size:           f.size,
+			CompressedSize: f.size,
+			Method:         "Store",
+			Directory:      f.directory,
+			Symlink:        f.symlink,
+			Mode:           f.mode,
+			Date:           f.date,
+		})
+	}
+
+	return listing, nil
+}
+
+// listCAB lists the files of the CAB file. The compressed size of files is unknown, since a folder is compressed as one stream.
+func listCAB(file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	archive, err := cabReadArchive(file, size)
+	if err != nil {
+		return nil, newConversionError(FormatCAB, ErrCorrupt, err)
+	}
+
+	listing = &ContainerListing{Format: FormatCAB}
+	for _, f := range archive.files {
+		entry := ContainerEntry{
+			Name:           f.name,
+			Size:           f.size,
+			CompressedSize: -1,
+			Mode:           msdosFileMode(uint32(f.attributes), false),
+			Date:           f.date,
+		}
+		if int(f.folder) < len(archive.folders) {
+			entry.Method = cabMethods[archive.folders[f.folder].compression&cabCompressionMask]
+		}
+
+		listing.Files = append(listing.Files, entry)
+	}
+
+	return listing, nil
+}
+
+// listCPIO lists the files of the cpio archive. Format is used for the listing and errors, since RPM packages contain cpio archives.
+func listCPIO(ctx context.Context, reader io.Reader, format Format) (listing *ContainerListing, err error) {
+	cr := newCpioReader(reader)
+	listing = &ContainerListing{Format: format}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		header, err := cr.Next()
+		if err == io.EOF {
+			return listing, nil
+		} else if err != nil {
+			return nil, newConversionError(format, ErrCorrupt, err)
+		}
+
+		mode := unixFileMode(header.mode)
+		listing.Files = append(listing.Files, ContainerEntry{
+			Name:           header.name,
+			Size:           header.size,
+			CompressedSize: -1,
+			Mode:           mode,
+			Date:           header.date,
+			Directory:      mode.IsDir(),
+			Symlink:        mode&os.ModeSymlink != 0,
+		})
+	}
+}
+
+// listAR lists the members of the ar archive
+func listAR(ctx context.Context, reader io.Reader) (listing *ContainerListing, err error) {
+	ar, err := newARReader(reader)
+	if err != nil {
+		return nil, newConversionError(FormatAR, ErrCorrupt, err)
+	}
+	listing = &ContainerListing{Format: FormatAR}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		header, err := ar.Next()
+		if err == io.EOF {
+			return listing, nil
+		} else if err != nil {
+			return nil, newConversionError(FormatAR, ErrCorrupt, err)
+		}
+
+		listing.Files = append(listing.Files, ContainerEntry{
+			Name:           header.name,
+			Size:           header.size,
+			CompressedSize: header.size,
+			Method:         "Store",
+			Mode:           unixFileMode(header.mode),
+			Date:           header.date,
+		})
+	}
+}
+
+// listDEB lists the files of data.tar in the Debian package. It is decompressed, but only the headers are read.
+func listDEB(ctx context.Context, file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	data, err := debDataReader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return nil, newConversionError(FormatDEB, ErrCorrupt, err)
+	}
+
+	// Meta packages have an empty data.tar
+	if listing, err = listTAR(ctx, data); err == ErrUnsupportedFormat {
+		listing, err = &ContainerListing{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	listing.Format = FormatDEB
+	return listing, nil
+}
+
+// listRPM lists the files of the cpio payload of the RPM package
+func listRPM(ctx context.Context, file io.ReaderAt, size int64) (listing *ContainerListing, err error) {
+	offset, err := rpmReadPayloadOffset(file, size)
+	if err == ErrUnsupportedVersion {
+		return nil, &ConversionError{Format: FormatRPM, Kind: ErrUnsupportedVersion}
+	} else if err != nil {
+		return nil, newConversionError(FormatRPM, ErrCorrupt, err)
+	}
+
+	payload, err := decompressPayload(io.NewSectionReader(file, offset, size-offset))
+	if err != nil {
+		return nil, newConversionError(FormatRPM, ErrCorrupt, err)
+	}
+
+	return listCPIO(ctx, payload, FormatRPM)
+}
+
+// listTAR lists the files of the TAR archive. If the first header is invalid, it is not a TAR file.
+func listTAR(ctx context.Context, reader io.Reader) (listing *ContainerListing, err error) {
+	tr := tar.NewReader(reader)
+	listing = &ContainerListing{Format: FormatTAR}
+
+	for n := 0; ; n++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Next skips the data of the previous file without decompressing anything
+		hdr, err := tr.Next()
+		if err == io.EOF && n > 0 {
+			return listing, nil
+		} else if err != nil && n == 0 {
+			return nil, ErrUnsupportedFormat
+		} else if err != nil {
+			return nil, newConversionError(FormatTAR, ErrCorrupt, err)
+		}
+
+		entry := ContainerEntry{
+			Name:           hdr.Name,
+			Size:           hdr.Size,
+			CompressedSize: hdr.Size,
+			Mode:           hdr.FileInfo().Mode(),
+			Date:           hdr.ModTime,
+			Comment:        hdr.PAXRecords["comment"],
+			Directory:      hdr.Typeflag == tar.TypeDir,
+			Symlink:        hdr.Typeflag == tar.TypeSymlink,
+		}
+
+		listing.Files = append(listing.Files, entry)
+	}
+}
+
+// dosDateTime converts an MS-DOS date and time as used by ZIP and RAR. The high 16 bits are the date.
+func dosDateTime(value uint32) time.Time {
+	return time.Date(int(value>>25)+1980, time.Month(value>>21&0x0F), int(value>>16&0x1F), int(value>>11&0x1F), int(value>>5&0x3F), int(value&0x1F)*2, 0, time.UTC)
+}
+
+// msdosFileMode converts MS-DOS file attributes. Only the read-only and directory attributes are used.
+func msdosFileMode(attributes uint32, directory bool) (mode os.FileMode) {
+	if directory || attributes&0x10 != 0 {
+		return os.ModeDir | 0777
+	} else if attributes&0x01 != 0 {
+		return 0444
+	}
+
+	return 0666
+}
+
+// unixFileMode converts a Unix st_mode value
+func unixFileMode(value uint32) (mode os.FileMode) {
+	mode = os.FileMode(value & 0777)
+
+	switch value & 0xF000 {
+	case 0x4000:
+		mode |= os.ModeDir
+	case 0xA000:
+		mode |= os.ModeSymlink
+	case 0x2000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0x6000:
+		mode |= os.ModeDevice
+	case 0x1000:
+		mode |= os.ModeNamedPipe
+	case 0xC000:
+		mode |= os.ModeSocket
+	}
+	if value&0x800 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if value&0x400 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if value&0x200 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
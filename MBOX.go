@@ -1,11 +1,11 @@
-/*
-File Name:  MBOX.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-Support for email files in the MBOX format.
-*/
-
-package fileconversion
-
-// Check out https://github.com/blabber/mbox ????
+/*
+File Name:  MBOX.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Support for email files in the MBOX format.
+*/
+
+package fileconversion
+
+// Check out https://github.com/blabber/mbox ????
@@ -1,415 +1,709 @@
-/*
-File Name:  MOBI 2 Text.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-Mobi files use HTML tags.
-
-Did not work:
-* https://github.com/766b/mobi is only a writer and does not have a useful reader
-* https://github.com/peterbn/mobi a fork of above one.
-
-Works:
-* https://github.com/neofight/mobi code basically works, just an in-memory open function had to be forked.
-
-*/
-
-package fileconversion
-
-import (
-	"bytes"
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-	"strconv"
-	"strings"
-	"unicode/utf8"
-
-	html "github.com/levigross/exp-html"
-	"github.com/neofight/mobi/convert"
-	"github.com/neofight/mobi/headers"
-)
-
-// Mobi2Text converts a MOBI ebook to text
-func Mobi2Text(file io.ReadSeeker) (string, error) {
-
-	book, _ := mobiOpen(file)
-	markupText, _ := book.Markup()
-
-	text, _ := HTML2Text(strings.NewReader(markupText))
-
-	return text, nil
-}
-
-// below code is forked from https://github.com/neofight/mobi MOBIFile.go
-
-type mobiBook struct {
-	file          io.ReadSeeker
-	pdbHeader     *headers.PDB
-	palmDOCHeader *headers.PalmDOC
-	mobiHeader    *headers.MOBI
-	exthHeader    *headers.EXTH
-}
-
-func mobiOpen(file io.ReadSeeker) (*mobiBook, error) {
-
-	var book mobiBook
-
-	var err error
-
-	book.file = file
-	book.pdbHeader, err = headers.ReadPDB(book.file)
-
-	if err != nil {
-		return nil, fmt.Errorf("unable to read PDB header: %v", err)
-	}
-
-	book.palmDOCHeader, err = headers.ReadPalmDOC(book.file)
-
-	if err != nil {
-		return nil, fmt.Errorf("unable to read PalmDOC header: %v", err)
-	}
-
-	book.mobiHeader, err = headers.ReadMOBI(book.file)
-
-	if err != nil {
-		return nil, fmt.Errorf("unable to read MOBI header: %v", err)
-	}
-
-	if book.mobiHeader.EXTHHeaderPresent {
-
-		book.exthHeader, err = headers.ReadEXTH(book.file)
-
-		if err != nil {
-			return nil, fmt.Errorf("unable to read EXTH header: %v", err)
-		}
-	}
-
-	return &book, nil
-}
-
-func (mobiFile mobiBook) Cover() ([]byte, error) {
-
-	for _, r := range mobiFile.exthHeader.Records {
-
-		if r.RecordType == 201 {
-			coverIndex := mobiFile.mobiHeader.FirstImageIndex + convert.FromUint32(r.RecordData)
-
-			record := mobiFile.pdbHeader.Records[coverIndex]
-			nextRecord := mobiFile.pdbHeader.Records[coverIndex+1]
-
-			coverOffset := record.RecordDataOffset
-			coverSize := nextRecord.RecordDataOffset - coverOffset
-
-			_, err := mobiFile.file.Seek(int64(coverOffset), 0)
-
-			if err != nil {
-				return nil, fmt.Errorf("unable to find cover: %v", err)
-			}
-
-			cover := make([]byte, coverSize)
-
-			err = binary.Read(mobiFile.file, binary.BigEndian, &cover)
-
-			if err != nil {
-				return nil, fmt.Errorf("unable to read cover: %v", err)
-			}
-
-			return cover, nil
-		}
-	}
-
-	return nil, nil
-}
-
-func (mobiFile mobiBook) Markup() (string, error) {
-
-	startIndex := mobiFile.mobiHeader.FirstContentIndex
-	endIndex := mobiFile.mobiHeader.FirstNonBookIndex - 1
-
-	if endIndex > len(mobiFile.pdbHeader.Records)-2 {
-		endIndex = len(mobiFile.pdbHeader.Records) - 2
-	}
-
-	if endIndex < 0 || startIndex < 0 || startIndex >= len(mobiFile.pdbHeader.Records) {
-		return "", fmt.Errorf("Invalid header")
-	}
-
-	text := make([]byte, 0)
-
-	for index := startIndex; index <= endIndex; index++ {
-
-		record := mobiFile.pdbHeader.Records[index]
-		nextRecord := mobiFile.pdbHeader.Records[index+1]
-
-		recordOffset := record.RecordDataOffset
-		recordSize := nextRecord.RecordDataOffset - recordOffset
-
-		_, err := mobiFile.file.Seek(int64(recordOffset), 0)
-
-		if err != nil {
-			return "", fmt.Errorf("unable to find text: %v", err)
-		}
-
-		recordData := make([]byte, recordSize)
-
-		err = binary.Read(mobiFile.file, binary.BigEndian, &recordData)
-
-		if err != nil {
-			return "", fmt.Errorf("unable to read text: %v", err)
-		}
-
-		recordText := fromLZ77(recordData)
-
-		text = append(text, recordText...)
-	}
-
-	text = text[:mobiFile.palmDOCHeader.TextLength]
-
-	if !utf8.Valid(text) {
-		return "", errors.New("unable to decompress text")
-	}
-
-	return string(text), nil
-}
-
-func (mobiFile mobiBook) Text() (string, error) {
-
-	markup, err := mobiFile.Markup()
-
-	if err != nil {
-		return "", fmt.Errorf("unable to read markup: %v", err)
-	}
-
-	pos, err := getTOCPosition(markup)
-
-	if err != nil {
-		return "", fmt.Errorf("unable to locate TOC: %v", err)
-	}
-
-	bookmarks, err := parseTOC(markup[pos:])
-
-	text := make([]string, 0)
-
-	for i := range bookmarks {
-
-		start := bookmarks[i]
-		var end int
-
-		if i < len(bookmarks)-1 {
-			end = bookmarks[i+1]
-		} else {
-			end = pos
-		}
-
-		paragraphs, err := parseChapter(markup[start:end])
-
-		if err != nil {
-			return "", fmt.Errorf("unable to parse chapter: %v", err)
-		}
-
-		text = append(text, paragraphs...)
-	}
-
-	return strings.Join(text, "\n\n"), nil
-}
-
-func getTOCPosition(markup string) (int, error) {
-
-	htmlReader := strings.NewReader(markup)
-
-	tokenizer := html.NewTokenizer(htmlReader)
-
-	for {
-		tokenType := tokenizer.Next()
-
-		switch {
-		case tokenType == html.ErrorToken:
-			return 0, fmt.Errorf("unable to find reference element")
-		case tokenType == html.SelfClosingTagToken:
-			token := tokenizer.Token()
-
-			if token.Data == "reference" {
-				filepos, err := attr(token, "filepos")
-
-				if err != nil {
-					return 0, errors.New("filepos attribute missing")
-				}
-
-				pos, err := strconv.Atoi(filepos)
-
-				if err != nil {
-					return 0, errors.New("filepos attribute invalid")
-				}
-
-				return pos, nil
-			}
-		}
-	}
-}
-
-func parseTOC(markup string) ([]int, error) {
-
-	toc := make([]int, 0)
-
-	htmlReader := strings.NewReader(markup)
-
-	tokenizer := html.NewTokenizer(htmlReader)
-
-	for {
-		tokenType := tokenizer.Next()
-
-		switch {
-		case tokenType == html.ErrorToken:
-			return toc[1:], nil
-		case tokenType == html.StartTagToken:
-			token := tokenizer.Token()
-
-			if token.Data == "a" {
-				filepos, err := attr(token, "filepos")
-
-				if err != nil {
-					continue
-				}
-
-				pos, err := strconv.Atoi(filepos)
-
-				if err != nil {
-					return nil, errors.New("filepos attribute invalid")
-				}
-
-				toc = append(toc, pos)
-			}
-		}
-	}
-}
-
-func parseChapter(markup string) ([]string, error) {
-
-	paragraphs := make([]string, 0)
-
-	htmlReader := strings.NewReader(markup)
-
-	tokenizer := html.NewTokenizer(htmlReader)
-
-	for {
-		tokenType := tokenizer.Next()
-
-		switch {
-		case tokenType == html.ErrorToken:
-			return paragraphs, nil
-		case tokenType == html.TextToken:
-			token := tokenizer.Token()
-
-			if len(strings.TrimSpace(token.Data)) > 0 {
-				paragraphs = append(paragraphs, strings.TrimSpace(token.Data))
-			}
-		}
-	}
-}
-
-func attr(t html.Token, name string) (string, error) {
-	for _, a := range t.Attr {
-		if a.Key == name {
-			return a.Val, nil
-		}
-	}
-
-	return "", fmt.Errorf("attribute %v not found", name)
-}
-
-// fromLZ77 is forked from conversion.go because of index out of range panic
-func fromLZ77(text []byte) []byte {
-
-	var reader = bytes.NewReader(text)
-
-	var buffer [4096]byte
-	var pos int
-
-	for {
-		if pos == 4096 {
-			break
-		}
-
-		c, err := reader.ReadByte()
-
-		if err == io.EOF {
-			break
-		}
-
-		switch {
-
-		// 0x00: "1 literal" copy that byte unmodified to the decompressed stream.
-		case c == 0x00:
-			buffer[pos] = c
-			pos++
-
-		// 0x09 to 0x7f: "1 literal" copy that byte unmodified to the decompressed stream.
-		case c >= 0x09 && c <= 0x7f:
-			buffer[pos] = c
-			pos++
-
-		// 0x01 to 0x08: "literals": the byte is interpreted as a count from 1 to 8, and that many literals are copied
-		// unmodified from the compressed stream to the decompressed stream.
-		case c >= 0x01 && c <= 0x08:
-			length := int(c)
-			for i := 0; i < length; i++ {
-				c, err = reader.ReadByte()
-				buffer[pos] = c
-				pos++
-			}
-
-		// 0x80 to 0xbf: "length, distance" pair: the 2 leftmost bits of this byte ('10') are discarded, and the
-		// following 6 bits are combined with the 8 bits of the next byte to make a 14 bit "distance, length" item.
-		// Those 14 bits are broken into 11 bits of distance backwards from the current location in the uncompressed
-		// text, and 3 bits of length to copy from that point (copying n+3 bytes, 3 to 10 bytes).
-		case c >= 0x80 && c <= 0xbf:
-			c2, _ := reader.ReadByte()
-
-			distance := (int(c&0x3F)<<8 | int(c2)) >> 3
-			length := int(c2&0x07) + 3
-
-			start := pos - distance
-
-			for i := 0; i < length; i++ {
-				// check if index is in range
-				if start+i >= len(buffer) || start+i < 0 {
-					return buffer[:pos]
-				}
-
-				c = buffer[start+i]
-				buffer[pos] = c
-				pos++
-			}
-
-		// 0xc0 to 0xff: "byte pair": this byte is decoded into 2 characters: a space character, and a letter formed
-		// from this byte XORed with 0x80.
-		case c >= 0xc0:
-			buffer[pos] = ' '
-			pos++
-			buffer[pos] = c ^ 0x80
-			pos++
-		}
-	}
-
-	return buffer[:pos]
-}
-
-// IsFileMOBI checks if the data indicates a MOBI file
-func IsFileMOBI(data []byte) bool {
-	// Mobi files have a header and there is the signature "BOOKMOBI" or "TEXtREAd".
-	// There are many more more potential signatures https://sno.phy.queensu.ca/~phil/exiftool/TagNames/Palm.html
-
-	// Fork from code here http://will.tip.dhappy.org/lib/calibre/dedrm/mobidedrm.py
-	// if self.header[0x3C:0x3C+8] != 'BOOKMOBI' and self.header[0x3C:0x3C+8] != 'TEXtREAd':
-	//   raise DrmException(u"Invalid file format")
-
-	if len(data) < 0x3C+8 {
-		return false
-	}
-
-	signature := data[0x3C : 0x3C+8]
-
-	return bytes.Equal(signature, []byte("BOOKMOBI")) || bytes.Equal(signature, []byte("TEXtREAd"))
-}
+/*
+File Name:  MOBI 2 Text.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Mobi files use HTML tags.
+
+Did not work:
+* https://github.com/766b/mobi is only a writer and does not have a useful reader
+* https://github.com/peterbn/mobi a fork of above one.
+
+Works:
+* https://github.com/neofight/mobi code basically works, just an in-memory open function had to be forked.
+
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	html "github.com/levigross/exp-html"
+	"github.com/neofight/mobi/convert"
+	"github.com/neofight/mobi/headers"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Mobi2Text converts a MOBI ebook to text
+func Mobi2Text(file io.ReadSeeker) (text string, err error) {
+	defer recoverPanic(FormatMOBI, &err)
+
+	book, err := mobiOpen(file)
+	if err != nil {
+		return "", err
+	}
+
+	markupText, err := book.Markup()
+	if err != nil {
+		return "", err
+	}
+
+	return HTML2Text(strings.NewReader(markupText))
+}
+
+// mobiMarkdown converts a MOBI ebook to Markdown. The book is loaded into memory.
+func mobiMarkdown(ctx context.Context, file io.ReadSeeker) (markdown string, err error) {
+	defer recoverPanic(FormatMOBI, &err)
+
+	book, err := mobiOpen(&contextReadSeeker{ctx: ctx, reader: file})
+	if err != nil {
+		return "", err
+	}
+
+	markupText, err := book.Markup()
+	if err != nil {
+		return "", err
+	}
+
+	return HTML2MarkdownContext(ctx, strings.NewReader(markupText))
+}
+
+// Mobi2TextWriter converts a MOBI ebook to text and writes it to the writer. It returns bytes written.
+// Limit is the max amount of bytes (not characters) to write out.
+// Unlike Mobi2Text it does not load the book into memory. The text records are decompressed and the HTML is tokenized as stream.
+// Block level tags are converted to new-lines. Conversion stops once the limit is reached and ErrLimitReached is returned.
+func Mobi2TextWriter(file io.ReadSeeker, writer io.Writer, limit int64) (written int64, err error) {
+	return Mobi2TextContext(context.Background(), file, writer, limit)
+}
+
+// Mobi2TextContext is the same as Mobi2TextWriter, but stops once the context is cancelled and returns its error.
+func Mobi2TextContext(ctx context.Context, file io.ReadSeeker, writer io.Writer, limit int64) (written int64, err error) {
+	defer recoverPanic(FormatMOBI, &err)
+
+	book, err := mobiOpen(&contextReadSeeker{ctx: ctx, reader: file})
+	if err != nil {
+		return 0, err
+	}
+
+	return book.WriteText(writer, limit)
+}
+
+// WriteText writes the text of the book to the writer. See Mobi2TextWriter.
+func (mobiFile mobiBook) WriteText(writer io.Writer, limit int64) (written int64, err error) {
+
+	markup, err := mobiFile.MarkupReader()
+	if err != nil {
+		return 0, err
+	}
+
+	tokenizer := html.NewTokenizer(markup)
+
+	separator := "" // pending separator before the next text
+	skipDepth := 0  // inside <head>, <script> or <style>
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch tokenType {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return written, nil
+			}
+			return written, newConversionError(FormatMOBI, ErrCorrupt, tokenizer.Err())
+
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+
+			switch tag {
+			case "head", "script", "style":
+				if tokenType == html.StartTagToken {
+					skipDepth++
+				} else if tokenType == html.EndTagToken && skipDepth > 0 {
+					skipDepth--
+				}
+			}
+
+			if brk := mobiBlockTags[tag]; len(brk) > len(separator) {
+				separator = brk
+			}
+
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+
+			raw := string(tokenizer.Text())
+			text := strings.Join(strings.Fields(raw), " ")
+
+			if text == "" {
+				if raw != "" && separator == "" {
+					separator = " "
+				}
+				continue
+			}
+
+			if separator == "" && strings.TrimLeftFunc(raw, unicode.IsSpace) != raw {
+				separator = " "
+			}
+			if written == 0 {
+				separator = ""
+			}
+
+			if err = writeOutputLimit(writer, []byte(strings.ToValidUTF8(separator+text, "\uFFFD")), &written, &limit); err != nil {
+				return written, err
+			}
+
+			separator = ""
+			if strings.TrimRightFunc(raw, unicode.IsSpace) != raw {
+				separator = " "
+			}
+		}
+	}
+}
+
+// mobiBlockTags are the HTML tags that separate text blocks, with the separator to use
+var mobiBlockTags = map[string]string{
+	"p": "\n\n", "div": "\n\n", "blockquote": "\n\n", "mbp:pagebreak": "\n\n", "table": "\n\n",
+	"h1": "\n\n", "h2": "\n\n", "h3": "\n\n", "h4": "\n\n", "h5": "\n\n", "h6": "\n\n",
+	"br": "\n", "li": "\n", "tr": "\n", "dt": "\n", "dd": "\n",
+}
+
+// below code is forked from https://github.com/neofight/mobi MOBIFile.go
+
+type mobiBook struct {
+	file          io.ReadSeeker
+	pdbHeader     *headers.PDB
+	palmDOCHeader *headers.PalmDOC
+	mobiHeader    *headers.MOBI
+	exthHeader    *headers.EXTH
+}
+
+func mobiOpen(file io.ReadSeeker) (*mobiBook, error) {
+
+	book, err := mobiReadHeaders(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// The EXTH header follows the MOBI header, so this check must happen afterwards.
+	if err = book.checkRecord0(); err != nil {
+		return nil, err
+	}
+
+	return book, nil
+}
+
+// mobiReadHeaders reads the PDB, PalmDOC, MOBI and EXTH headers. The text is not checked, they can be read even if the book is encrypted.
+func mobiReadHeaders(file io.ReadSeeker) (*mobiBook, error) {
+
+	var book mobiBook
+
+	var err error
+
+	book.file = file
+	book.pdbHeader, err = headers.ReadPDB(book.file)
+
+	if err != nil {
+		return nil, newConversionError(FormatMOBI, ErrCorrupt, fmt.Errorf("unable to read PDB header: %w", err))
+	}
+
+	book.palmDOCHeader, err = headers.ReadPalmDOC(book.file)
+
+	if err != nil {
+		return nil, newConversionError(FormatMOBI, ErrCorrupt, fmt.Errorf("unable to read PalmDOC header: %w", err))
+	}
+
+	book.mobiHeader, err = headers.ReadMOBI(book.file)
+
+	if err != nil {
+		return nil, newConversionError(FormatMOBI, ErrCorrupt, fmt.Errorf("unable to read MOBI header: %w", err))
+	}
+
+	if book.mobiHeader.EXTHHeaderPresent {
+
+		book.exthHeader, err = headers.ReadEXTH(book.file)
+
+		if err != nil {
+			return nil, newConversionError(FormatMOBI, ErrCorrupt, fmt.Errorf("unable to read EXTH header: %w", err))
+		}
+	}
+
+	return &book, nil
+}
+
+// EXTH record types used for the metadata
+const (
+	mobiEXTHAuthor         = 100
+	mobiEXTHSubject        = 105
+	mobiEXTHPublishingDate = 106
+	mobiEXTHContributor    = 108
+	mobiEXTHUpdatedTitle   = 503
+	mobiMaxFullNameLength  = 4096
+)
+
+// mobiMetadata extracts the metadata of the EXTH header. The title is taken from the full name in record 0 if the EXTH header does not contain it.
+// The metadata of encrypted books can be read.
+func mobiMetadata(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(FormatMOBI, &err)
+
+	book, err := mobiReadHeaders(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return metadata, err
+	}
+
+	var subjects []string
+
+	if book.exthHeader != nil {
+		for _, record := range book.exthHeader.Records {
+			text := strings.TrimSpace(book.decodeText(record.RecordData))
+			if text == "" {
+				continue
+			}
+
+			switch record.RecordType {
+			case mobiEXTHAuthor:
+				metadata.Authors = append(metadata.Authors, text)
+			case mobiEXTHSubject:
+				subjects = append(subjects, text)
+			case mobiEXTHPublishingDate:
+				metadata.Created = metadataDate(text)
+			case mobiEXTHContributor:
+				// The contributor is the software that created the book, for example "calibre (3.39.1) [https://calibre-ebook.com]".
+				metadata.Creator = text
+			case mobiEXTHUpdatedTitle:
+				metadata.Title = text
+			}
+		}
+	}
+
+	metadata.Subject = strings.Join(subjects, "; ")
+
+	if metadata.Title == "" {
+		metadata.Title = strings.TrimSpace(book.fullName())
+	}
+
+	return metadata, nil
+}
+
+// fullName returns the full name of the book stored in record 0. If it cannot be read, an empty string is returned.
+func (mobiFile mobiBook) fullName() string {
+	length := mobiFile.mobiHeader.FullNameLength
+	if len(mobiFile.pdbHeader.Records) == 0 || length == 0 || length > mobiMaxFullNameLength {
+		return ""
+	}
+
+	if _, err := mobiFile.file.Seek(int64(mobiFile.pdbHeader.Records[0].RecordDataOffset)+int64(mobiFile.mobiHeader.FullNameOffset), 0); err != nil {
+		return ""
+	}
+
+	name := make([]byte, length)
+	if _, err := io.ReadFull(mobiFile.file, name); err != nil {
+		return ""
+	}
+
+	return mobiFile.decodeText(name)
+}
+
+// decodeText decodes the text using the encoding of the MOBI header. 65001 is UTF-8, older books use Windows-1252.
+func (mobiFile mobiBook) decodeText(data []byte) string {
+	if mobiFile.mobiHeader.TextEncoding != 65001 || !utf8.Valid(data) {
+		if decoded, err := charmap.Windows1252.NewDecoder().Bytes(data); err == nil {
+			return string(decoded)
+		}
+	}
+
+	return strings.ToValidUTF8(string(data), "\uFFFD")
+}
+
+// checkRecord0 checks the compression and encryption of the text in the PalmDOC header at the start of record 0
+func (mobiFile mobiBook) checkRecord0() error {
+	if len(mobiFile.pdbHeader.Records) == 0 {
+		return &ConversionError{Format: FormatMOBI, Kind: ErrCorrupt, Err: errors.New("no records")}
+	}
+
+	if _, err := mobiFile.file.Seek(int64(mobiFile.pdbHeader.Records[0].RecordDataOffset), 0); err != nil {
+		return newConversionError(FormatMOBI, ErrCorrupt, err)
+	}
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(mobiFile.file, header); err != nil {
+		return newConversionError(FormatMOBI, ErrCorrupt, err)
+	}
+
+	// Compression 1 = none, 2 = PalmDOC (LZ77), 17480 = HUFF/CDIC
+	if compression := binary.BigEndian.Uint16(header[0:2]); compression == 17480 {
+		return &ConversionError{Format: FormatMOBI, Kind: ErrUnsupportedVersion, Err: errors.New("HUFF/CDIC compression is not supported")}
+	}
+
+	// Encryption 0 = none, 1 = old Mobipocket, 2 = Mobipocket (DRM)
+	if encryption := binary.BigEndian.Uint16(header[12:14]); encryption != 0 {
+		return &ConversionError{Format: FormatMOBI, Kind: ErrEncrypted, Err: fmt.Errorf("encryption type %d", encryption)}
+	}
+
+	return nil
+}
+
+func (mobiFile mobiBook) Cover() ([]byte, error) {
+
+	for _, r := range mobiFile.exthHeader.Records {
+
+		if r.RecordType == 201 {
+			coverIndex := mobiFile.mobiHeader.FirstImageIndex + convert.FromUint32(r.RecordData)
+
+			record := mobiFile.pdbHeader.Records[coverIndex]
+			nextRecord := mobiFile.pdbHeader.Records[coverIndex+1]
+
+			coverOffset := record.RecordDataOffset
+			coverSize := nextRecord.RecordDataOffset - coverOffset
+
+			_, err := mobiFile.file.Seek(int64(coverOffset), 0)
+
+			if err != nil {
+				return nil, fmt.Errorf("unable to find cover: %v", err)
+			}
+
+			cover := make([]byte, coverSize)
+
+			err = binary.Read(mobiFile.file, binary.BigEndian, &cover)
+
+			if err != nil {
+				return nil, fmt.Errorf("unable to read cover: %v", err)
+			}
+
+			return cover, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (mobiFile mobiBook) Markup() (string, error) {
+
+	reader, err := mobiFile.MarkupReader()
+	if err != nil {
+		return "", err
+	}
+
+	text, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", newConversionError(FormatMOBI, ErrCorrupt, err)
+	}
+
+	if !utf8.Valid(text) {
+		// Older books use Windows-1252 instead of UTF-8.
+		if text, err = charmap.Windows1252.NewDecoder().Bytes(text); err != nil {
+			return "", newConversionError(FormatMOBI, ErrCorrupt, err)
+		}
+	}
+
+	return string(text), nil
+}
+
+// MarkupReader returns a reader that decompresses the text records on the fly
+func (mobiFile mobiBook) MarkupReader() (io.Reader, error) {
+
+	startIndex := mobiFile.mobiHeader.FirstContentIndex
+	endIndex := mobiFile.mobiHeader.FirstNonBookIndex - 1
+
+	if endIndex > len(mobiFile.pdbHeader.Records)-2 {
+		endIndex = len(mobiFile.pdbHeader.Records) - 2
+	}
+
+	if endIndex < 0 || startIndex < 0 || startIndex >= len(mobiFile.pdbHeader.Records) {
+		return nil, &ConversionError{Format: FormatMOBI, Kind: ErrCorrupt, Err: errors.New("invalid text record indexes")}
+	}
+
+	return &mobiMarkupReader{book: mobiFile, index: startIndex, endIndex: endIndex, remaining: int64(mobiFile.palmDOCHeader.TextLength)}, nil
+}
+
+// mobiMarkupReader reads the text records one by one. The output is cut at the text length indicated in the PalmDOC header.
+type mobiMarkupReader struct {
+	book      mobiBook
+	index     int
+	endIndex  int
+	remaining int64
+	buffer    []byte
+}
+
+func (reader *mobiMarkupReader) Read(p []byte) (n int, err error) {
+	for len(reader.buffer) == 0 {
+		if reader.index > reader.endIndex || reader.remaining <= 0 {
+			return 0, io.EOF
+		}
+
+		record := reader.book.pdbHeader.Records[reader.index]
+		nextRecord := reader.book.pdbHeader.Records[reader.index+1]
+		reader.index++
+
+		recordOffset := record.RecordDataOffset
+		recordSize := nextRecord.RecordDataOffset - recordOffset
+
+		_, err := reader.book.file.Seek(int64(recordOffset), 0)
+
+		if err != nil {
+			return 0, fmt.Errorf("unable to find text: %w", err)
+		}
+
+		recordData := make([]byte, recordSize)
+
+		err = binary.Read(reader.book.file, binary.BigEndian, &recordData)
+
+		if err != nil {
+			return 0, fmt.Errorf("unable to read text: %w", err)
+		}
+
+		reader.buffer = fromLZ77(recordData)
+
+		if int64(len(reader.buffer)) > reader.remaining {
+			reader.buffer = reader.buffer[:reader.remaining]
+		}
+		reader.remaining -= int64(len(reader.buffer))
+	}
+
+	n = copy(p, reader.buffer)
+	reader.buffer = reader.buffer[n:]
+
+	return n, nil
+}
+
+func (mobiFile mobiBook) Text() (string, error) {
+
+	markup, err := mobiFile.Markup()
+
+	if err != nil {
+		return "", fmt.Errorf("unable to read markup: %v", err)
+	}
+
+	pos, err := getTOCPosition(markup)
+
+	if err != nil {
+		return "", fmt.Errorf("unable to locate TOC: %v", err)
+	}
+
+	bookmarks, err := parseTOC(markup[pos:])
+
+	text := make([]string, 0)
+
+	for i := range bookmarks {
+
+		start := bookmarks[i]
+		var end int
+
+		if i < len(bookmarks)-1 {
+			end = bookmarks[i+1]
+		} else {
+			end = pos
+		}
+
+		paragraphs, err := parseChapter(markup[start:end])
+
+		if err != nil {
+			return "", fmt.Errorf("unable to parse chapter: %v", err)
+		}
+
+		text = append(text, paragraphs...)
+	}
+
+	return strings.Join(text, "\n\n"), nil
+}
+
+func getTOCPosition(markup string) (int, error) {
+
+	htmlReader := strings.NewReader(markup)
+
+	tokenizer := html.NewTokenizer(htmlReader)
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch {
+		case tokenType == html.ErrorToken:
+			return 0, fmt.Errorf("unable to find reference element")
+		case tokenType == html.SelfClosingTagToken:
+			token := tokenizer.Token()
+
+			if token.Data == "reference" {
+				filepos, err := attr(token, "filepos")
+
+				if err != nil {
+					return 0, errors.New("filepos attribute missing")
+				}
+
+				pos, err := strconv.Atoi(filepos)
+
+				if err != nil {
+					return 0, errors.New("filepos attribute invalid")
+				}
+
+				return pos, nil
+			}
+		}
+	}
+}
+
+func parseTOC(markup string) ([]int, error) {
+
+	toc := make([]int, 0)
+
+	htmlReader := strings.NewReader(markup)
+
+	tokenizer := html.NewTokenizer(htmlReader)
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch {
+		case tokenType == html.ErrorToken:
+			return toc[1:], nil
+		case tokenType == html.StartTagToken:
+			token := tokenizer.Token()
+
+			if token.Data == "a" {
+				filepos, err := attr(token, "filepos")
+
+				if err != nil {
+					continue
+				}
+
+				pos, err := strconv.Atoi(filepos)
+
+				if err != nil {
+					return nil, errors.New("filepos attribute invalid")
+				}
+
+				toc = append(toc, pos)
+			}
+		}
+	}
+}
+
+func parseChapter(markup string) ([]string, error) {
+
+	paragraphs := make([]string, 0)
+
+	htmlReader := strings.NewReader(markup)
+
+	tokenizer := html.NewTokenizer(htmlReader)
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch {
+		case tokenType == html.ErrorToken:
+			return paragraphs, nil
+		case tokenType == html.TextToken:
+			token := tokenizer.Token()
+
+			if len(strings.TrimSpace(token.Data)) > 0 {
+				paragraphs = append(paragraphs, strings.TrimSpace(token.Data))
+			}
+		}
+	}
+}
+
+func attr(t html.Token, name string) (string, error) {
+	for _, a := range t.Attr {
+		if a.Key == name {
+			return a.Val, nil
+		}
+	}
+
+	return "", fmt.Errorf("attribute %v not found", name)
+}
+
+// fromLZ77 is forked from conversion.go because of index out of range panic
+func fromLZ77(text []byte) []byte {
+
+	var reader = bytes.NewReader(text)
+
+	var buffer [4096]byte
+	var pos int
+
+	for {
+		if pos == 4096 {
+			break
+		}
+
+		c, err := reader.ReadByte()
+
+		if err == io.EOF {
+			break
+		}
+
+		switch {
+
+		// 0x00: "1 literal" copy that byte unmodified to the decompressed stream.
+		case c == 0x00:
+			buffer[pos] = c
+			pos++
+
+		// 0x09 to 0x7f: "1 literal" copy that byte unmodified to the decompressed stream.
+		case c >= 0x09 && c <= 0x7f:
+			buffer[pos] = c
+			pos++
+
+		// 0x01 to 0x08: "literals": the byte is interpreted as a count from 1 to 8, and that many literals are copied
+		// unmodified from the compressed stream to the decompressed stream.
+		case c >= 0x01 && c <= 0x08:
+			length := int(c)
+			for i := 0; i < length; i++ {
+				c, err = reader.ReadByte()
+				buffer[pos] = c
+				pos++
+			}
+
+		// 0x80 to 0xbf: "length, distance" pair: the 2 leftmost bits of this byte ('10') are discarded, and the
+		// following 6 bits are combined with the 8 bits of the next byte to make a 14 bit "distance, length" item.
+		// Those 14 bits are broken into 11 bits of distance backwards from the current location in the uncompressed
+		// text, and 3 bits of length to copy from that point (copying n+3 bytes, 3 to 10 bytes).
+		case c >= 0x80 && c <= 0xbf:
+			c2, _ := reader.ReadByte()
+
+			distance := (int(c&0x3F)<<8 | int(c2)) >> 3
+			length := int(c2&0x07) + 3
+
+			start := pos - distance
+
+			for i := 0; i < length; i++ {
+				// check if index is in range
+				if start+i >= len(buffer) || start+i < 0 {
+					return buffer[:pos]
+				}
+
+				c = buffer[start+i]
+				buffer[pos] = c
+				pos++
+			}
+
+		// 0xc0 to 0xff: "byte pair": this byte is decoded into 2 characters: a space character, and a letter formed
+		// from this byte XORed with 0x80.
+		case c >= 0xc0:
+			buffer[pos] = ' '
+			pos++
+			buffer[pos] = c ^ 0x80
+			pos++
+		}
+	}
+
+	return buffer[:pos]
+}
+
+// IsFileMOBI checks if the data indicates a MOBI file
+func IsFileMOBI(data []byte) bool {
+	// Mobi files have a header and there is the signature "BOOKMOBI" or "TEXtREAd".
+	// There are many more more potential signatures https://sno.phy.queensu.ca/~phil/exiftool/TagNames/Palm.html
+
+	// Fork from code here http://will.tip.dhappy.org/lib/calibre/dedrm/mobidedrm.py
+	// if self.header[0x3C:0x3C+8] != 'BOOKMOBI' and self.header[0x3C:0x3C+8] != 'TEXtREAd':
+	//   raise DrmException(u"Invalid file format")
+
+	if len(data) < 0x3C+8 {
+		return false
+	}
+
+	signature := data[0x3C : 0x3C+8]
+
+	return bytes.Equal(signature, []byte("BOOKMOBI")) || bytes.Equal(signature, []byte("TEXtREAd"))
+}
@@ -0,0 +1,178 @@
+/*
+File Name:  Markdown.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Markdown output. Documents with a document model (DOCX, PPTX, XLS, XLSX, ODS, PDF) are rendered from it, HTML based formats via html2text.
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/IntelligenceX/fileconversion/html2text"
+)
+
+// OutputFormat is the format of the text written by Convert
+type OutputFormat string
+
+// Output formats
+const (
+	OutputText     OutputFormat = ""         // Plain text
+	OutputMarkdown OutputFormat = "markdown" // Markdown. Formats without structure information (DOC, ODT, RTF) are written as plain text.
+)
+
+// WriteMarkdown writes the document as Markdown to the writer. It returns bytes written.
+// Sheets start with their name as heading and contain a table. Slides, pages and sections are separated by a horizontal rule.
+func (document *Document) WriteMarkdown(writer io.Writer) (written int64, err error) {
+	for _, container := range document.Blocks {
+		var output strings.Builder
+		var previous BlockType
+
+		if container.Type == BlockSheet {
+			output.WriteString("# " + markdownLine(container.Title))
+			previous = BlockHeading
+		}
+
+		for _, block := range container.Blocks {
+			text := markdownBlock(block)
+			if text == "" {
+				continue
+			}
+
+			// List items are written without empty line between them.
+			if previous == BlockListItem && block.Type == BlockListItem {
+				output.WriteString("\n")
+			} else if previous != "" {
+				output.WriteString("\n\n")
+			}
+
+			output.WriteString(text)
+			previous = block.Type
+		}
+
+		// Empty slides, pages and sections are skipped.
+		if output.Len() == 0 {
+			continue
+		}
+
+		separator := ""
+		if written > 0 {
+			separator = "\n\n"
+			if container.Type != BlockSheet {
+				separator += "---\n\n"
+			}
+		}
+
+		writtenOut, err := io.WriteString(writer, separator+output.String())
+		written += int64(writtenOut)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if written > 0 {
+		writtenOut, err := io.WriteString(writer, "\n")
+		written += int64(writtenOut)
+		return written, err
+	}
+
+	return written, nil
+}
+
+// markdownBlock returns the content block as Markdown
+func markdownBlock(block Block) string {
+	switch block.Type {
+	case BlockHeading:
+		level := block.Level
+		if level < 1 {
+			level = 1
+		} else if level > 6 {
+			level = 6
+		}
+		return strings.Repeat("#", level) + " " + markdownLine(block.Text)
+
+	case BlockListItem:
+		indent := ""
+		if block.Level > 1 {
+			indent = strings.Repeat("    ", block.Level-1)
+		}
+		return indent + "- " + markdownLine(block.Text)
+
+	case BlockTable:
+		return markdownTable(block.Rows)
+	}
+
+	return block.Text
+}
+
+// markdownTable returns the table as Markdown. The first row is used as header. Rows are padded to the same number of columns.
+func markdownTable(rows [][]string) string {
+	if len(rows) == 0 {
+		return ""
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	var output strings.Builder
+
+	for n, row := range rows {
+		if n > 0 {
+			output.WriteString("\n")
+		}
+
+		for m := 0; m < columns; m++ {
+			output.WriteString("| ")
+			if m < len(row) && row[m] != "" {
+				output.WriteString(strings.Replace(markdownLine(row[m]), "|", "\\|", -1) + " ")
+			}
+		}
+		output.WriteString("|")
+
+		if n == 0 {
+			output.WriteString("\n" + strings.Repeat("| --- ", columns) + "|")
+		}
+	}
+
+	return output.String()
+}
+
+// markdownLine returns the text as single line
+func markdownLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// HTML2Markdown converts the HTML to Markdown
+func HTML2Markdown(reader io.Reader) (markdown string, err error) {
+	return HTML2MarkdownContext(context.Background(), reader)
+}
+
+// HTML2MarkdownContext is the same as HTML2Markdown, but stops reading the HTML once the context is cancelled and returns its error.
+func HTML2MarkdownContext(ctx context.Context, reader io.Reader) (markdown string, err error) {
+	return html2TextContext(ctx, reader, html2text.Options{Markdown: true})
+}
+
+// markdownDocument converts the file via the document model and writes it as Markdown.
+// If the document was truncated because of the limit, ErrLimitReached is returned.
+func markdownDocument(ctx context.Context, convert func(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error), file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	document, err := convert(ctx, file, size, options)
+	if document != nil {
+		var errWrite error
+		if written, errWrite = document.WriteMarkdown(writer); errWrite != nil {
+			return written, errWrite
+		}
+	}
+	if err == nil && document != nil && document.Truncated {
+		err = ErrLimitReached
+	}
+
+	return written, err
+}
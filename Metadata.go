@@ -0,0 +1,489 @@
+/*
+File Name:  Metadata.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Metadata of documents: title, authors, subject, keywords, the application that created it and the dates.
+Sources are the PDF Info dictionary and XMP, docProps/core.xml and app.xml of Office Open XML, meta.xml of OpenDocument,
+the SummaryInformation stream of OLE2 files, the OPF package of EPUB and the EXTH header of MOBI.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/IntelligenceX/fileconversion/odf"
+	"github.com/IntelligenceX/fileconversion/ole2"
+)
+
+// DocumentMetadata contains the metadata of a document. Fields that are not available are empty.
+type DocumentMetadata struct {
+	Title    string
+	Authors  []string
+	Subject  string
+	Keywords []string
+	Creator  string    // Application that created the document
+	Created  time.Time // Creation date
+	Modified time.Time // Last modification date
+	Printed  time.Time // Last print date
+}
+
+// metadataMaxSize is the max size of metadata files and streams that are read. This protects against decompression bombs.
+const metadataMaxSize = 4 * 1024 * 1024
+
+// Metadata detects the format of the input and extracts the metadata using the default registry. Size is the full size of the input file.
+// If the format does not support metadata, ErrUnsupportedFormat is returned. Documents without metadata return empty fields and no error.
+func Metadata(input io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	return DefaultRegistry.Metadata(input, size)
+}
+
+// builtinMetadata are the functions for all formats that support metadata
+var builtinMetadata = map[Format]func(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error){
+	FormatDOCX: metadataOfFormat(FormatDOCX, ooxmlMetadata),
+	FormatXLSX: metadataOfFormat(FormatXLSX, ooxmlMetadata),
+	FormatPPTX: metadataOfFormat(FormatPPTX, ooxmlMetadata),
+	FormatODT:  metadataOfFormat(FormatODT, odfMetadata),
+	FormatODS:  metadataOfFormat(FormatODS, odfMetadata),
+	FormatODP:  metadataOfFormat(FormatODP, odfMetadata),
+	FormatDOC:  metadataOfFormat(FormatDOC, ole2Metadata),
+	FormatPPT:  metadataOfFormat(FormatPPT, ole2Metadata),
+	FormatMSG:  metadataOfFormat(FormatMSG, ole2Metadata),
+	FormatOLE2: metadataOfFormat(FormatOLE2, ole2Metadata),
+	FormatXLS:  xlsMetadata,
+	FormatPDF:  pdfMetadata,
+	FormatEPUB: epubMetadata,
+	FormatMOBI: mobiMetadata,
+}
+
+// metadataOfFormat returns a metadata function for a specific format, for functions that handle a family of formats
+func metadataOfFormat(format Format, extract func(format Format, file io.ReaderAt, size int64) (DocumentMetadata, error)) func(file io.ReaderAt, size int64) (DocumentMetadata, error) {
+	return func(file io.ReaderAt, size int64) (DocumentMetadata, error) {
+		return extract(format, file, size)
+	}
+}
+
+// merge fills all empty fields with the ones from the other metadata
+func (metadata *DocumentMetadata) merge(other DocumentMetadata) {
+	if metadata.Title == "" {
+		metadata.Title = other.Title
+	}
+	if len(metadata.Authors) == 0 {
+		metadata.Authors = other.Authors
+	}
+	if metadata.Subject == "" {
+		metadata.Subject = other.Subject
+	}
+	if len(metadata.Keywords) == 0 {
+		metadata.Keywords = other.Keywords
+	}
+	if metadata.Creator == "" {
+		metadata.Creator = other.Creator
+	}
+	if metadata.Created.IsZero() {
+		metadata.Created = other.Created
+	}
+	if metadata.Modified.IsZero() {
+		metadata.Modified = other.Modified
+	}
+	if metadata.Printed.IsZero() {
+		metadata.Printed = other.Printed
+	}
+}
+
+// metadataList splits a list of authors or keywords at the separators. Empty entries are removed.
+func metadataList(text string, separators string) (list []string) {
+	for _, entry := range strings.FieldsFunc(text, func(r rune) bool { return strings.ContainsRune(separators, r) }) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// metadataDate parses a date in the W3C format used by XMP, OOXML, ODF and OPF. The time zone and the time are optional.
+// If the date is invalid, a zero time is returned.
+func metadataDate(text string) (date time.Time) {
+	text = strings.TrimSpace(text)
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006"} {
+		if date, err := time.Parse(layout, text); err == nil {
+			return date
+		}
+	}
+
+	return time.Time{}
+}
+
+// Namespaces of XMP properties
+const (
+	xmpNamespaceDC  = "http://purl.org/dc/elements/1.1/"
+	xmpNamespaceXMP = "http://ns.adobe.com/xap/1.0/"
+	xmpNamespacePDF = "http://ns.adobe.com/pdf/1.3/"
+)
+
+// xmpMetadata extracts the metadata of an XMP packet. Properties may be elements, or attributes of rdf:Description.
+// Lists and alternatives (rdf:Seq, rdf:Bag, rdf:Alt) are read from their rdf:li elements. Invalid XML stops parsing.
+func xmpMetadata(data []byte) (metadata DocumentMetadata) {
+	properties := map[string][]string{
+		xmpNamespaceDC + " title":        nil,
+		xmpNamespaceDC + " creator":      nil,
+		xmpNamespaceDC + " description":  nil,
+		xmpNamespaceDC + " subject":      nil,
+		xmpNamespacePDF + " Keywords":    nil,
+		xmpNamespacePDF + " Producer":    nil,
+		xmpNamespaceXMP + " CreatorTool": nil,
+		xmpNamespaceXMP + " CreateDate":  nil,
+		xmpNamespaceXMP + " ModifyDate":  nil,
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	property := "" // current property element
+
+	for {
+		t, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch token := t.(type) {
+		case xml.StartElement:
+			for _, attribute := range token.Attr {
+				key := attribute.Name.Space + " " + attribute.Name.Local
+				if values, ok := properties[key]; ok && strings.TrimSpace(attribute.Value) != "" {
+					properties[key] = append(values, strings.TrimSpace(attribute.Value))
+				}
+			}
+
+			key := token.Name.Space + " " + token.Name.Local
+			if _, ok := properties[key]; ok && property == "" {
+				property = key
+			}
+
+		case xml.CharData:
+			if text := strings.TrimSpace(string(token)); property != "" && text != "" {
+				properties[property] = append(properties[property], text)
+			}
+
+		case xml.EndElement:
+			if token.Name.Space+" "+token.Name.Local == property {
+				property = ""
+			}
+		}
+	}
+
+	first := func(key string) string {
+		if values := properties[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	// dc:description corresponds to the subject of the PDF Info dictionary, and dc:subject to the keywords.
+	metadata.Title = first(xmpNamespaceDC + " title")
+	metadata.Authors = properties[xmpNamespaceDC+" creator"]
+	metadata.Subject = first(xmpNamespaceDC + " description")
+	if metadata.Keywords = properties[xmpNamespaceDC+" subject"]; len(metadata.Keywords) == 0 {
+		metadata.Keywords = metadataList(first(xmpNamespacePDF+" Keywords"), ";,")
+	}
+	if metadata.Creator = first(xmpNamespaceXMP + " CreatorTool"); metadata.Creator == "" {
+		metadata.Creator = first(xmpNamespacePDF + " Producer")
+	}
+	metadata.Created = metadataDate(first(xmpNamespaceXMP + " CreateDate"))
+	metadata.Modified = metadataDate(first(xmpNamespaceXMP + " ModifyDate"))
+
+	return metadata
+}
+
+// ooxmlCoreProperties is docProps/core.xml of Office Open XML files
+type ooxmlCoreProperties struct {
+	Title       string `xml:"title"`
+	Subject     string `xml:"subject"`
+	Creator     string `xml:"creator"`
+	Keywords    string `xml:"keywords"`
+	Created     string `xml:"created"`
+	Modified    string `xml:"modified"`
+	LastPrinted string `xml:"lastPrinted"`
+}
+
+// ooxmlAppProperties is docProps/app.xml of Office Open XML files
+type ooxmlAppProperties struct {
+	Application string `xml:"Application"`
+}
+
+// ooxmlMetadata extracts the metadata of DOCX, XLSX and PPTX files
+func ooxmlMetadata(format Format, file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(format, &err)
+
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		return metadata, zipOpenError(format, file, size, err)
+	}
+
+	for _, f := range r.File {
+		switch f.Name {
+		case "docProps/core.xml":
+			var core ooxmlCoreProperties
+			if data, err := zipReadFileLimit(f, metadataMaxSize); err != nil {
+				return metadata, newConversionError(format, ErrCorrupt, err)
+			} else if err = xml.Unmarshal(data, &core); err != nil {
+				return metadata, newConversionError(format, ErrCorrupt, err)
+			}
+
+			metadata.Title = strings.TrimSpace(core.Title)
+			metadata.Subject = strings.TrimSpace(core.Subject)
+			metadata.Authors = metadataList(core.Creator, ";")
+			metadata.Keywords = metadataList(core.Keywords, ";,")
+			metadata.Created = metadataDate(core.Created)
+			metadata.Modified = metadataDate(core.Modified)
+			metadata.Printed = metadataDate(core.LastPrinted)
+
+		case "docProps/app.xml":
+			var app ooxmlAppProperties
+			if data, err := zipReadFileLimit(f, metadataMaxSize); err != nil {
+				return metadata, newConversionError(format, ErrCorrupt, err)
+			} else if err = xml.Unmarshal(data, &app); err != nil {
+				return metadata, newConversionError(format, ErrCorrupt, err)
+			}
+
+			metadata.Creator = strings.TrimSpace(app.Application)
+		}
+	}
+
+	return metadata, nil
+}
+
+// odfMetadata extracts the metadata of ODT and ODS files from meta.xml
+func odfMetadata(format Format, file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(format, &err)
+
+	r, err := zip.NewReader(file, size)
+	if err != nil {
+		return metadata, newConversionError(format, ErrCorrupt, err)
+	}
+
+	for _, f := range r.File {
+		if f.Name != "meta.xml" {
+			continue
+		}
+
+		var document odf.DocumentMeta
+		if data, err := zipReadFileLimit(f, metadataMaxSize); err != nil {
+			return metadata, newConversionError(format, ErrCorrupt, err)
+		} else if err = xml.Unmarshal(data, &document); err != nil {
+			return metadata, newConversionError(format, ErrCorrupt, err)
+		}
+		meta := document.Meta
+
+		metadata.Title = strings.TrimSpace(meta.Title)
+		metadata.Subject = strings.TrimSpace(meta.Subject)
+		metadata.Creator = strings.TrimSpace(meta.Generator)
+
+		// The initial creator is the author. dc:creator is the one who modified the document last.
+		metadata.Authors = metadataList(string(meta.InitialCreator), ";")
+		if len(metadata.Authors) == 0 {
+			metadata.Authors = metadataList(meta.DcCreator, ";")
+		}
+
+		for _, keyword := range meta.Keywords {
+			metadata.Keywords = append(metadata.Keywords, metadataList(keyword, ";,")...)
+		}
+
+		metadata.Created = metadataDate(string(meta.CreationDate))
+		metadata.Modified = metadataDate(meta.DcDate)
+		metadata.Printed = metadataDate(string(meta.PrintDate))
+		break
+	}
+
+	return metadata, nil
+}
+
+// Property IDs and types of the SummaryInformation property set, see [MS-OLEPS]
+const (
+	ole2PIDCodepage    = 1
+	ole2PIDTitle       = 2
+	ole2PIDSubject     = 3
+	ole2PIDAuthor      = 4
+	ole2PIDKeywords    = 5
+	ole2PIDLastPrinted = 11
+	ole2PIDCreated     = 12
+	ole2PIDLastSaved   = 13
+	ole2PIDAppName     = 18
+
+	ole2TypeI2       = 0x02
+	ole2TypeLPSTR    = 0x1E
+	ole2TypeLPWSTR   = 0x1F
+	ole2TypeFILETIME = 0x40
+)
+
+// ole2Metadata extracts the metadata of OLE2 files (DOC, XLS, PPT, MSG) from the SummaryInformation stream
+func ole2Metadata(format Format, file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(format, &err)
+
+	ole, err := ole2.Open(io.NewSectionReader(file, 0, size), "")
+	if err != nil {
+		return metadata, newConversionError(format, ErrCorrupt, err)
+	}
+
+	dir, err := ole.ListDir()
+	if err != nil {
+		return metadata, newConversionError(format, ErrCorrupt, err)
+	} else if len(dir) == 0 {
+		return metadata, &ConversionError{Format: format, Kind: ErrCorrupt, Err: errors.New("empty directory")}
+	}
+
+	entry := ole2RootEntries(dir)["\x05SummaryInformation"]
+	if entry == nil || entry.Type != ole2.USERSTREAM {
+		return metadata, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(ole.OpenFile(entry, dir[0]), metadataMaxSize))
+	if err != nil {
+		return metadata, newConversionError(format, ErrCorrupt, err)
+	}
+
+	return ole2SummaryInformation(data), nil
+}
+
+// ole2SummaryInformation parses the first property set of the SummaryInformation stream. Invalid properties are ignored.
+func ole2SummaryInformation(data []byte) (metadata DocumentMetadata) {
+	// Header: byte order, version, system identifier, CLSID, number of property sets, then FMTID and offset of each property set.
+	if len(data) < 48 || binary.LittleEndian.Uint16(data[0:2]) != 0xFFFE || binary.LittleEndian.Uint32(data[24:28]) == 0 {
+		return metadata
+	}
+
+	offset := int64(binary.LittleEndian.Uint32(data[44:48]))
+	if offset+8 > int64(len(data)) {
+		return metadata
+	}
+	set := data[offset:]
+
+	// The codepage is needed for all strings, so the properties are read first.
+	type property struct {
+		id    uint32
+		value []byte
+	}
+	var properties []property
+	codepage := 1252
+
+	count := int64(binary.LittleEndian.Uint32(set[4:8]))
+	for n := int64(0); n < count && 8+n*8+8 <= int64(len(set)); n++ {
+		id := binary.LittleEndian.Uint32(set[8+n*8:])
+		position := int64(binary.LittleEndian.Uint32(set[8+n*8+4:]))
+		if position+4 > int64(len(set)) {
+			continue
+		}
+		value := set[position:]
+
+		if id == ole2PIDCodepage && binary.LittleEndian.Uint16(value) == ole2TypeI2 && len(value) >= 6 {
+			codepage = int(binary.LittleEndian.Uint16(value[4:6]))
+		}
+		properties = append(properties, property{id: id, value: value})
+	}
+
+	for _, property := range properties {
+		switch property.id {
+		case ole2PIDTitle:
+			metadata.Title = ole2PropertyString(property.value, codepage)
+		case ole2PIDSubject:
+			metadata.Subject = ole2PropertyString(property.value, codepage)
+		case ole2PIDAuthor:
+			metadata.Authors = metadataList(ole2PropertyString(property.value, codepage), ";")
+		case ole2PIDKeywords:
+			metadata.Keywords = metadataList(ole2PropertyString(property.value, codepage), ";,")
+		case ole2PIDAppName:
+			metadata.Creator = ole2PropertyString(property.value, codepage)
+		case ole2PIDLastPrinted:
+			metadata.Printed = ole2PropertyTime(property.value)
+		case ole2PIDCreated:
+			metadata.Created = ole2PropertyTime(property.value)
+		case ole2PIDLastSaved:
+			metadata.Modified = ole2PropertyTime(property.value)
+		}
+	}
+
+	return metadata
+}
+
+// ole2PropertyString returns the value of a string property. 8-bit strings are decoded using the codepage.
+func ole2PropertyString(value []byte, codepage int) (text string) {
+	if len(value) < 8 {
+		return ""
+	}
+	length := int64(binary.LittleEndian.Uint32(value[4:8]))
+
+	switch binary.LittleEndian.Uint16(value[0:2]) {
+	case ole2TypeLPSTR:
+		if length > int64(len(value)-8) {
+			length = int64(len(value) - 8)
+		}
+		data := value[8 : 8+length]
+
+		switch codepage {
+		case 1200: // UTF-16 little endian
+			text = ole2DecodeUTF16(data)
+		case 65001: // UTF-8
+			text = string(data)
+		default:
+			if charMap := charmaps[strconv.Itoa(codepage)]; charMap != nil {
+				decoded, _ := charMap.NewDecoder().Bytes(data)
+				text = string(decoded)
+			} else {
+				text = string(data)
+			}
+		}
+
+	case ole2TypeLPWSTR:
+		// The length is in characters.
+		if length > int64(len(value)-8)/2 {
+			length = int64(len(value)-8) / 2
+		}
+		text = ole2DecodeUTF16(value[8 : 8+length*2])
+	}
+
+	text = strings.ToValidUTF8(text, "\uFFFD")
+	return strings.TrimSpace(strings.TrimRight(text, "\x00"))
+}
+
+// ole2DecodeUTF16 decodes UTF-16 little endian text
+func ole2DecodeUTF16(data []byte) string {
+	chars := make([]uint16, len(data)/2)
+	for n := range chars {
+		chars[n] = binary.LittleEndian.Uint16(data[n*2:])
+	}
+
+	return string(utf16.Decode(chars))
+}
+
+// ole2PropertyTime returns the value of a FILETIME property. A value of 0 means not set and returns a zero time.
+func ole2PropertyTime(value []byte) (date time.Time) {
+	if len(value) < 12 || binary.LittleEndian.Uint16(value[0:2]) != ole2TypeFILETIME {
+		return date
+	}
+
+	return filetimeToTime(binary.LittleEndian.Uint64(value[4:12]))
+}
+
+// filetimeToTime converts a Windows FILETIME. Values before 1970 return a zero time.
+func filetimeToTime(filetime uint64) (date time.Time) {
+	// FILETIME is the number of 100-nanosecond intervals since January 1, 1601 UTC.
+	const epochDifference = 116444736000000000
+
+	if filetime <= epochDifference {
+		return date
+	}
+	intervals := filetime - epochDifference
+
+	return time.Unix(int64(intervals/10000000), int64(intervals%10000000)*100).UTC()
+}
@@ -1,92 +1,165 @@
-/*
-File Name:  ODS 2 Text.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-Code for parsing Open Document Spreadsheet files. ZIP-compressed XML-based file format.
-*/
-
-package fileconversion
-
-import (
-	"io"
-
-	"github.com/IntelligenceX/fileconversion/odf/ods"
-)
-
-// ODS2Text extracts text of an OpenDocument Spreadsheet
-// Size is the full size of the input file.
-func ODS2Text(file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
-
-	var doc ods.Doc
-
-	f, err := ods.NewReader(file, size)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	if err := f.ParseContent(&doc); err != nil {
-		return 0, err
-	}
-
-	for n, sheet := range doc.Table {
-		rows := sheet.Strings()
-		if err = writeOutput(writer, []byte(xlGenerateSheetTitle(sheet.Name, n, int(len(rows)))), &written, &limit); err != nil || limit == 0 {
-			return written, err
-		}
-
-		for _, row := range rows {
-
-			rowText := ""
-
-			// go through all columns
-			for m, text := range row {
-				if text != "" {
-					text = cleanCell(text)
-
-					if m > 0 {
-						rowText += ", "
-					}
-					rowText += text
-				}
-			}
-
-			rowText += "\n"
-
-			if err = writeOutput(writer, []byte(rowText), &written, &limit); err != nil || limit == 0 {
-				return written, err
-			}
-		}
-	}
-
-	return written, nil
-}
-
-// ODS2Cells converts an ODS file to individual cells
-// Size is the full size of the input file.
-func ODS2Cells(file io.ReaderAt, size int64) (cells []string, err error) {
-
-	var doc ods.Doc
-
-	f, err := ods.NewReader(file, size)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	if err := f.ParseContent(&doc); err != nil {
-		return nil, err
-	}
-
-	for _, sheet := range doc.Table {
-		for _, row := range sheet.Strings() {
-			for _, text := range row {
-				if text != "" {
-					text = cleanCell(text)
-					cells = append(cells, text)
-				}
-			}
-		}
-	}
-
-	return
-}
+/*
+File Name:  ODS 2 Text.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Code for parsing Open Document Spreadsheet files. ZIP-compressed XML-based file format.
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"io"
+
+	"github.com/IntelligenceX/fileconversion/odf/ods"
+)
+
+// ODS2Text extracts text of an OpenDocument Spreadsheet
+// Size is the full size of the input file.
+func ODS2Text(file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	return ODS2TextContext(context.Background(), file, size, writer, limit)
+}
+
+// ODS2TextContext is the same as ODS2Text, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed content and cells.
+func ODS2TextContext(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	defer recoverPanic(FormatODS, &err)
+
+	doc, err := odsParse(ctx, file, size)
+	if err != nil {
+		return 0, err
+	}
+	budget := BudgetFromContext(ctx)
+
+	for n, sheet := range doc.Table {
+		rows, err := sheet.StringsBudget(budget)
+		if err != nil {
+			return written, newConversionError(FormatODS, ErrBudgetExceeded, err)
+		}
+
+		if err = writeOutput(writer, []byte(xlGenerateSheetTitle(sheet.Name, n, int(len(rows)))), &written, &limit); err != nil || limit == 0 {
+			return written, err
+		}
+
+		for r, row := range rows {
+			if r%contextCheckInterval == 0 {
+				if err = ctx.Err(); err != nil {
+					return written, err
+				}
+			}
+
+			rowText := ""
+
+			// go through all columns
+			for m, text := range row {
+				if text != "" {
+					text = cleanCell(text)
+
+					if m > 0 {
+						rowText += ", "
+					}
+					rowText += text
+				}
+			}
+
+			rowText += "\n"
+
+			if err = writeOutput(writer, []byte(rowText), &written, &limit); err != nil || limit == 0 {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// ODS2Document extracts the structure of an OpenDocument Spreadsheet. Each sheet contains a single table.
+// Size is the full size of the input file. The budget of the context is charged for the decompressed content and cells.
+func ODS2Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	defer recoverPanic(FormatODS, &err)
+
+	builder := newDocumentBuilder(FormatODS, options)
+
+	doc, err := odsParse(ctx, file, size)
+	if err != nil {
+		return builder.result(err)
+	}
+	budget := BudgetFromContext(ctx)
+
+	for n, sheet := range doc.Table {
+		rows, err := sheet.StringsBudget(budget)
+		if err != nil {
+			return builder.result(newConversionError(FormatODS, ErrBudgetExceeded, err))
+		}
+
+		builder.open(BlockSheet, sheet.Name, n+1)
+		builder.table()
+
+		for r, row := range rows {
+			if r%contextCheckInterval == 0 {
+				if err = ctx.Err(); err != nil {
+					return builder.result(err)
+				}
+			}
+
+			cells := make([]string, len(row))
+			for m, text := range row {
+				cells[m] = cleanCell(text)
+			}
+
+			if err = builder.row(cells); err != nil {
+				return builder.result(err)
+			}
+		}
+	}
+
+	return builder.result(nil)
+}
+
+// odsParse opens the file and parses the content. The budget of the context is charged for the decompressed content.
+func odsParse(ctx context.Context, file io.ReaderAt, size int64) (doc ods.Doc, err error) {
+	f, err := ods.NewReader(&contextReaderAt{ctx: ctx, reader: file}, size)
+	if err != nil {
+		return doc, newConversionError(FormatODS, ErrCorrupt, err)
+	}
+	defer f.Close()
+	if odfIsEncrypted(file, size) {
+		return doc, &ConversionError{Format: FormatODS, Kind: ErrPasswordRequired}
+	}
+	if err := f.ParseContentBudget(&doc, BudgetFromContext(ctx)); err != nil {
+		return doc, newConversionError(FormatODS, ErrCorrupt, err)
+	}
+
+	return doc, nil
+}
+
+// ODS2Cells converts an ODS file to individual cells
+// Size is the full size of the input file.
+func ODS2Cells(file io.ReaderAt, size int64) (cells []string, err error) {
+	defer recoverPanic(FormatODS, &err)
+
+	var doc ods.Doc
+
+	f, err := ods.NewReader(file, size)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.ParseContent(&doc); err != nil {
+		return nil, err
+	}
+
+	for _, sheet := range doc.Table {
+		for _, row := range sheet.Strings() {
+			for _, text := range row {
+				if text != "" {
+					text = cleanCell(text)
+					cells = append(cells, text)
+				}
+			}
+		}
+	}
+
+	return
+}
@@ -1,148 +1,333 @@
-/*
-File Name:  PDF 2 Text.go
-Copyright:  2018 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-This code uses the commercial library UniDoc https://unidoc.io/ to extract text from PDFs.
-*/
-
-package fileconversion
-
-import (
-	"io"
-	"strconv"
-	"strings"
-	"time"
-
-	"github.com/unidoc/unipdf/core"
-	"github.com/unidoc/unipdf/extractor"
-	pdf "github.com/unidoc/unipdf/model"
-
-	"github.com/unidoc/unipdf/common/license"
-)
-
-// InitPDFLicense initializes the PDF license
-func InitPDFLicense(key, name string) {
-	// load the unidoc license (v3)
-	license.SetLicenseKey(key, name)
-}
-
-// PDFListContentStreams writes all text streams in a PDF to the writer
-// It returns the number of characters attempted written (excluding "Page N" and new-lines) and an error, if any. It can be used to determine whether any text was extracted.
-// The parameter size is the max amount of bytes (not characters) to write out.
-func PDFListContentStreams(f io.ReadSeeker, w io.Writer, size int64) (written int64, err error) {
-
-	pdfReader, err := pdf.NewPdfReader(f)
-	if err != nil {
-		return 0, err
-	}
-
-	isEncrypted, err := pdfReader.IsEncrypted()
-	if err != nil {
-		return 0, err
-	}
-
-	if isEncrypted {
-		_, err = pdfReader.Decrypt([]byte(""))
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	numPages, err := pdfReader.GetNumPages()
-	if err != nil {
-		return 0, err
-	}
-
-	for i := 0; i < numPages && size > 0; i++ {
-		pageNum := i + 1
-
-		page, err := pdfReader.GetPage(pageNum)
-		if err != nil {
-			return written, err
-		}
-
-		ex, err := extractor.New(page)
-		if err != nil {
-			return written, err
-		}
-
-		txt, err := ex.ExtractText()
-		if err != nil {
-			return written, err
-		}
-
-		// use the extracted text
-		txtNL := ""
-		if written > 0 {
-			txtNL += "\n\n"
-		}
-
-		textB := []byte(txtNL + "---- Page " + strconv.Itoa(pageNum) + " ----\n")
-
-		// empty page? skip if so.
-		txt = strings.TrimSpace(txt)
-		if len(txt) == 0 {
-			continue
-		}
-
-		textB = append(textB, []byte(txt)...)
-		if int64(len(textB)) > size {
-			textB = textB[:size]
-		}
-
-		if _, err = w.Write(textB); err != nil {
-			return written, err
-		}
-
-		size -= int64(len(textB))
-		written += int64(len(txt))
-	}
-
-	return written, nil
-}
-
-// PDFGetCreationDate tries to get the creation date
-func PDFGetCreationDate(f io.ReadSeeker) (date time.Time, valid bool) {
-	// Below code is forked from https://github.com/unidoc/unidoc-examples/blob/master/pdf/metadata/pdf_metadata_get_docinfo.go
-	pdfReader, err := pdf.NewPdfReader(f)
-	if err != nil {
-		return date, false
-	}
-
-	trailerDict, err := pdfReader.GetTrailer()
-	if err != nil || trailerDict == nil {
-		return date, false
-	}
-
-	var infoDict *core.PdfObjectDictionary
-
-	infoObj := trailerDict.Get("Info")
-	switch t := infoObj.(type) {
-	case *core.PdfObjectReference:
-		infoRef := t
-		infoObj, err = pdfReader.GetIndirectObjectByNumber(int(infoRef.ObjectNumber))
-		infoObj = core.TraceToDirectObject(infoObj)
-		if err != nil {
-			return date, false
-		}
-		infoDict, _ = infoObj.(*core.PdfObjectDictionary)
-	case *core.PdfObjectDictionary:
-		infoDict = t
-	}
-
-	if infoDict == nil {
-		return date, false
-	}
-
-	if str, has := infoDict.Get("CreationDate").(*core.PdfObjectString); has {
-		creationDateA := strings.TrimPrefix(str.String(), "D:")
-
-		time1, err := time.Parse("20060102150405-07'00'", creationDateA)
-		if err == nil {
-			return time1.UTC(), true
-		}
-	}
-
-	return date, false
-}
+/*
+File Name:  PDF 2 Text.go
+Copyright:  2018 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+This code uses the commercial library UniDoc https://unidoc.io/ to extract text from PDFs.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unidoc/unipdf/core"
+	"github.com/unidoc/unipdf/extractor"
+	pdf "github.com/unidoc/unipdf/model"
+
+	"github.com/unidoc/unipdf/common/license"
+)
+
+// InitPDFLicense initializes the PDF license
+func InitPDFLicense(key, name string) {
+	// load the unidoc license (v3)
+	license.SetLicenseKey(key, name)
+}
+
+// PDFListContentStreams writes all text streams in a PDF to the writer
+// It returns the number of characters attempted written (excluding "Page N" and new-lines) and an error, if any. It can be used to determine whether any text was extracted.
+// The parameter size is the max amount of bytes (not characters) to write out.
+func PDFListContentStreams(f io.ReadSeeker, w io.Writer, size int64) (written int64, err error) {
+	return PDFListContentStreamsContext(context.Background(), f, w, size)
+}
+
+// PDFListContentStreamsContext is the same as PDFListContentStreams, but stops once the context is cancelled and returns its error.
+// The context is checked for every page.
+func PDFListContentStreamsContext(ctx context.Context, f io.ReadSeeker, w io.Writer, size int64) (written int64, err error) {
+	defer recoverPanic(FormatPDF, &err)
+
+	pdfReader, numPages, err := pdfOpen(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < numPages && size > 0; i++ {
+		if err = ctx.Err(); err != nil {
+			return written, err
+		}
+
+		pageNum := i + 1
+
+		txt, err := pdfPageText(pdfReader, pageNum)
+		if err != nil {
+			return written, err
+		}
+
+		// use the extracted text
+		txtNL := ""
+		if written > 0 {
+			txtNL += "\n\n"
+		}
+
+		textB := []byte(txtNL + "---- Page " + strconv.Itoa(pageNum) + " ----\n")
+
+		// empty page? skip if so.
+		txt = strings.TrimSpace(txt)
+		if len(txt) == 0 {
+			continue
+		}
+
+		textB = append(textB, []byte(txt)...)
+		if int64(len(textB)) > size {
+			textB = textB[:size]
+		}
+
+		if _, err = w.Write(textB); err != nil {
+			return written, err
+		}
+
+		size -= int64(len(textB))
+		written += int64(len(txt))
+	}
+
+	return written, nil
+}
+
+// PDF2Document extracts the structure of a PDF file. Each page contains its paragraphs, which are separated by empty lines in the extracted text.
+// Size is the full size of the input file. The context is checked for every page.
+func PDF2Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	defer recoverPanic(FormatPDF, &err)
+
+	builder := newDocumentBuilder(FormatPDF, options)
+
+	pdfReader, numPages, err := pdfOpen(ctx, io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return builder.result(err)
+	}
+
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		if err = ctx.Err(); err != nil {
+			return builder.result(err)
+		}
+
+		txt, err := pdfPageText(pdfReader, pageNum)
+		if err != nil {
+			return builder.result(err)
+		}
+
+		builder.open(BlockPage, "", pageNum)
+
+		for _, paragraph := range strings.Split(strings.Replace(txt, "\r\n", "\n", -1), "\n\n") {
+			if paragraph = strings.TrimSpace(paragraph); paragraph == "" {
+				continue
+			}
+
+			if err = builder.add(Block{Type: BlockParagraph, Text: paragraph}); err != nil {
+				return builder.result(err)
+			}
+		}
+	}
+
+	return builder.result(nil)
+}
+
+// pdfOpen opens the PDF file and returns the number of pages. Encrypted files are decrypted if they use an empty user password.
+func pdfOpen(ctx context.Context, f io.ReadSeeker) (pdfReader *pdf.PdfReader, numPages int, err error) {
+	pdfReader, err = pdf.NewPdfReader(&contextReadSeeker{ctx: ctx, reader: f})
+	if err != nil {
+		return nil, 0, newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return nil, 0, newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	if isEncrypted {
+		// Many PDFs are encrypted only to set permissions. They use an empty user password.
+		authenticated, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return nil, 0, newConversionError(FormatPDF, ErrEncrypted, err)
+		} else if !authenticated {
+			return nil, 0, &ConversionError{Format: FormatPDF, Kind: ErrPasswordRequired}
+		}
+	}
+
+	numPages, err = pdfReader.GetNumPages()
+	if err != nil {
+		return nil, 0, newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	return pdfReader, numPages, nil
+}
+
+// pdfPageText extracts the text of the page. The page number starts at 1.
+func pdfPageText(pdfReader *pdf.PdfReader, pageNum int) (text string, err error) {
+	page, err := pdfReader.GetPage(pageNum)
+	if err != nil {
+		return "", newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	ex, err := extractor.New(page)
+	if err != nil {
+		return "", newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	text, err = ex.ExtractText()
+	if err != nil {
+		return "", newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	return text, nil
+}
+
+// PDFGetCreationDate tries to get the creation date
+func PDFGetCreationDate(f io.ReadSeeker) (date time.Time, valid bool) {
+	defer func() {
+		if recover() != nil {
+			date, valid = time.Time{}, false
+		}
+	}()
+
+	// Below code is forked from https://github.com/unidoc/unidoc-examples/blob/master/pdf/metadata/pdf_metadata_get_docinfo.go
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return date, false
+	}
+
+	trailerDict, err := pdfReader.GetTrailer()
+	if err != nil || trailerDict == nil {
+		return date, false
+	}
+
+	var infoDict *core.PdfObjectDictionary
+
+	infoObj := trailerDict.Get("Info")
+	switch t := infoObj.(type) {
+	case *core.PdfObjectReference:
+		infoRef := t
+		infoObj, err = pdfReader.GetIndirectObjectByNumber(int(infoRef.ObjectNumber))
+		infoObj = core.TraceToDirectObject(infoObj)
+		if err != nil {
+			return date, false
+		}
+		infoDict, _ = infoObj.(*core.PdfObjectDictionary)
+	case *core.PdfObjectDictionary:
+		infoDict = t
+	}
+
+	if infoDict == nil {
+		return date, false
+	}
+
+	if str, has := infoDict.Get("CreationDate").(*core.PdfObjectString); has {
+		creationDateA := strings.TrimPrefix(str.String(), "D:")
+
+		time1, err := time.Parse("20060102150405-07'00'", creationDateA)
+		if err == nil {
+			return time1.UTC(), true
+		}
+	}
+
+	return date, false
+}
+
+// pdfMetadata extracts the metadata of the Info dictionary. Fields that are not set there are taken from the XMP metadata of the catalog.
+func pdfMetadata(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(FormatPDF, &err)
+
+	pdfReader, _, err := pdfOpen(context.Background(), io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return metadata, err
+	}
+
+	trailerDict, err := pdfReader.GetTrailer()
+	if err != nil || trailerDict == nil {
+		return metadata, newConversionError(FormatPDF, ErrCorrupt, err)
+	}
+
+	if infoDict, ok := pdfResolve(pdfReader, trailerDict.Get("Info")).(*core.PdfObjectDictionary); ok {
+		metadata.Title = pdfInfoString(pdfReader, infoDict, "Title")
+		metadata.Authors = metadataList(pdfInfoString(pdfReader, infoDict, "Author"), ";")
+		metadata.Subject = pdfInfoString(pdfReader, infoDict, "Subject")
+		metadata.Keywords = metadataList(pdfInfoString(pdfReader, infoDict, "Keywords"), ";,")
+		metadata.Created = pdfDate(pdfInfoString(pdfReader, infoDict, "CreationDate"))
+		metadata.Modified = pdfDate(pdfInfoString(pdfReader, infoDict, "ModDate"))
+
+		// Creator is the application that created the original document, Producer the one that converted it to PDF.
+		if metadata.Creator = pdfInfoString(pdfReader, infoDict, "Creator"); metadata.Creator == "" {
+			metadata.Creator = pdfInfoString(pdfReader, infoDict, "Producer")
+		}
+	}
+
+	if catalog, ok := pdfResolve(pdfReader, trailerDict.Get("Root")).(*core.PdfObjectDictionary); ok {
+		if stream, ok := pdfResolve(pdfReader, catalog.Get("Metadata")).(*core.PdfObjectStream); ok {
+			if data, err := core.DecodeStream(stream); err == nil {
+				metadata.merge(xmpMetadata(data))
+			}
+		}
+	}
+
+	return metadata, nil
+}
+
+// pdfResolve returns the direct object. References are loaded via the reader.
+func pdfResolve(pdfReader *pdf.PdfReader, object core.PdfObject) core.PdfObject {
+	if reference, ok := object.(*core.PdfObjectReference); ok {
+		indirect, err := pdfReader.GetIndirectObjectByNumber(int(reference.ObjectNumber))
+		if err != nil {
+			return nil
+		}
+		object = indirect
+	}
+
+	return core.TraceToDirectObject(object)
+}
+
+// pdfInfoString returns the text of the string in the Info dictionary
+func pdfInfoString(pdfReader *pdf.PdfReader, infoDict *core.PdfObjectDictionary, key core.PdfObjectName) string {
+	if str, ok := pdfResolve(pdfReader, infoDict.Get(key)).(*core.PdfObjectString); ok {
+		return strings.TrimSpace(strings.TrimRight(str.Decoded(), "\x00"))
+	}
+
+	return ""
+}
+
+// pdfDate parses a PDF date in the format D:YYYYMMDDHHmmSSOHH'mm'. All parts after the year are optional. If the date is invalid, a zero time is returned.
+func pdfDate(text string) (date time.Time) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), "D:")
+
+	digits := 0
+	for digits < len(text) && digits < 14 && text[digits] >= '0' && text[digits] <= '9' {
+		digits++
+	}
+	if digits < 4 || digits%2 != 0 {
+		return date
+	}
+
+	date, err := time.Parse("20060102150405"[:digits], text[:digits])
+	if err != nil {
+		return time.Time{}
+	}
+
+	// The time zone is Z, or the offset to UTC in hours and minutes. Without it, the time is treated as UTC.
+	zone := strings.Replace(text[digits:], "'", "", -1)
+	if len(zone) >= 3 && (zone[0] == '+' || zone[0] == '-') {
+		hours, errHours := strconv.Atoi(zone[1:3])
+		minutes := 0
+		if len(zone) >= 5 {
+			minutes, _ = strconv.Atoi(zone[3:5])
+		}
+
+		if errHours == nil {
+			offset := hours*3600 + minutes*60
+			if zone[0] == '-' {
+				offset = -offset
+			}
+			date = time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), 0, time.FixedZone("", offset))
+		}
+	}
+
+	return date
+}
+
+// IsFilePDF checks if the data indicates a PDF file
+// PDF has a signature of 25 50 44 46 2D, or in string "%PDF-"
+func IsFilePDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x25, 0x50, 0x44, 0x46, 0x2D})
+}
@@ -1,115 +1,368 @@
-/*
-File Name:  PPTX 2 Text.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-This code is a fork from https://github.com/mr-tim/rol-o-decks/blob/master/indexer/indexer.go.
-*/
-
-package fileconversion
-
-import (
-	"archive/zip"
-	"bytes"
-	"io"
-	"sort"
-	"strconv"
-	"strings"
-
-	"gopkg.in/xmlpath.v2"
-)
-
-// PPTXDocument is a PPTX document loaded into memory
-type PPTXDocument struct {
-	Slides []PPTXSlide
-}
-
-// PPTXSlide is a single PPTX slide
-type PPTXSlide struct {
-	SlideNumber int
-	//ThumbnailBase64 string
-	TextContent string
-}
-
-// SlideNumberSorter is used for sorting
-type SlideNumberSorter []PPTXSlide
-
-func (a SlideNumberSorter) Len() int           { return len(a) }
-func (a SlideNumberSorter) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a SlideNumberSorter) Less(i, j int) bool { return a[i].SlideNumber < a[j].SlideNumber }
-
-// PPTX2Text extracts text of a PowerPoint document
-// Size is the full size of the input file.
-func PPTX2Text(file io.ReaderAt, size int64) (string, error) {
-
-	r, err := zip.NewReader(file, size)
-	if err != nil {
-		return "", err
-	}
-
-	doc := parsePPTXDocument(r)
-
-	return doc.AsText(), nil
-}
-
-// IsFilePPTX checks if the data indicates a PPTX file
-// PPTX has a signature of 50 4B 03 04
-// Warning: This collides with ZIP, DOCX and other zip-based files.
-func IsFilePPTX(data []byte) bool {
-	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04})
-}
-
-func extractSlideContent(f *zip.File) string {
-	p := xmlpath.MustCompile("//t")
-	zr, _ := f.Open()
-	defer zr.Close()
-	root, _ := xmlpath.Parse(zr)
-	i := p.Iter(root)
-	content := make([]string, 0)
-	for i.Next() {
-		n := i.Node()
-		content = append(content, n.String())
-	}
-	textContent := strings.Join(content, "\n")
-	return textContent
-}
-
-func parsePPTXDocument(r *zip.Reader) (doc PPTXDocument) {
-
-	for _, f := range r.File {
-		if strings.HasPrefix(f.Name, "ppt/slides/") && !strings.HasPrefix(f.Name, "ppt/slides/_rels") {
-			slideNumberStr := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(f.Name), "ppt/slides/slide"), ".xml")
-			slideNumber, _ := strconv.Atoi(slideNumberStr)
-
-			// grab the text content
-			doc.Slides = append(doc.Slides, PPTXSlide{
-				SlideNumber: slideNumber,
-				TextContent: extractSlideContent(f),
-				//ThumbnailBase64: generateThumbnail(fileToIndex, slideNumber),
-			})
-		}
-	}
-
-	sort.Sort(SlideNumberSorter(doc.Slides))
-
-	return doc
-}
-
-// AsText returns the text on all slides
-func (doc PPTXDocument) AsText() (text string) {
-
-	for n, slide := range doc.Slides {
-		if slide.TextContent == "" { // skip empty slides
-			continue
-		}
-
-		if n > 0 && text != "" {
-			text += "\n\n"
-		}
-
-		text += "Slide " + strconv.Itoa(n+1) + ":\n"
-		text += slide.TextContent
-	}
-
-	return text
-}
+/*
+File Name:  PPTX 2 Text.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+This code is a fork from https://github.com/mr-tim/rol-o-decks/blob/master/indexer/indexer.go.
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PPTXDocument is a PPTX document loaded into memory
+type PPTXDocument struct {
+	Slides []PPTXSlide
+}
+
+// PPTXSlide is a single PPTX slide
+type PPTXSlide struct {
+	SlideNumber int
+	//ThumbnailBase64 string
+	TextContent string
+}
+
+// SlideNumberSorter is used for sorting
+type SlideNumberSorter []PPTXSlide
+
+func (a SlideNumberSorter) Len() int           { return len(a) }
+func (a SlideNumberSorter) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a SlideNumberSorter) Less(i, j int) bool { return a[i].SlideNumber < a[j].SlideNumber }
+
+// PPTX2Text extracts text of a PowerPoint document
+// Size is the full size of the input file.
+func PPTX2Text(file io.ReaderAt, size int64) (string, error) {
+	var buffer bytes.Buffer
+
+	if _, err := PPTX2TextWriter(file, size, &buffer, math.MaxInt64); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// PPTX2TextWriter extracts text of a PowerPoint document and writes it to the writer. It returns bytes written.
+// Size is the full size of the input file. Limit is the max amount of bytes (not characters) to write out.
+// Slides are parsed one by one as stream. Parsing stops once the limit is reached and ErrLimitReached is returned.
+func PPTX2TextWriter(file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	return PPTX2TextContext(context.Background(), file, size, writer, limit)
+}
+
+// PPTX2TextContext is the same as PPTX2TextWriter, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed XML.
+func PPTX2TextContext(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, limit int64) (written int64, err error) {
+	defer recoverPanic(FormatPPTX, &err)
+
+	r, err := zip.NewReader(&contextReaderAt{ctx: ctx, reader: file}, size)
+	if err != nil {
+		return 0, zipOpenError(FormatPPTX, file, size, err)
+	}
+
+	for n, slide := range pptxSlideFiles(r) {
+		if err = ctx.Err(); err != nil {
+			return written, err
+		}
+
+		// The header is only written once the slide has text. Empty slides are skipped.
+		header := "Slide " + strconv.Itoa(n+1) + ":\n"
+		if written > 0 {
+			header = "\n\n" + header
+		}
+
+		if err = pptxWriteSlide(slide, BudgetFromContext(ctx), header, writer, &written, &limit); err != nil {
+			return written, err
+		}
+	}
+
+	// A cancelled context ends the last slide early.
+	return written, ctx.Err()
+}
+
+// PPTX2Document extracts the structure of a PowerPoint document. Each slide contains its headings, paragraphs, list items and tables.
+// Text of title placeholders is returned as heading, and used as title of the slide. Text of body placeholders and bulleted text is returned as list items.
+// Size is the full size of the input file. The budget of the context is charged for the decompressed XML.
+func PPTX2Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	defer recoverPanic(FormatPPTX, &err)
+
+	builder := newDocumentBuilder(FormatPPTX, options)
+
+	r, err := zip.NewReader(&contextReaderAt{ctx: ctx, reader: file}, size)
+	if err != nil {
+		return builder.result(zipOpenError(FormatPPTX, file, size, err))
+	}
+
+	for n, slide := range pptxSlideFiles(r) {
+		if err = ctx.Err(); err != nil {
+			return builder.result(err)
+		}
+
+		builder.open(BlockSlide, "", n+1)
+
+		if err = pptxReadSlide(slide, BudgetFromContext(ctx), builder); err != nil {
+			return builder.result(err)
+		}
+	}
+
+	// A cancelled context ends the last slide early.
+	return builder.result(ctx.Err())
+}
+
+// IsFilePPTX checks if the data indicates a PPTX file
+// PPTX has a signature of 50 4B 03 04
+// Warning: This collides with ZIP, DOCX and other zip-based files.
+func IsFilePPTX(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04})
+}
+
+// pptxSlideFiles returns the slide files sorted by slide number
+func pptxSlideFiles(r *zip.Reader) (slides []*zip.File) {
+	var numbers []int
+
+	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, "ppt/slides/") && !strings.HasPrefix(f.Name, "ppt/slides/_rels") && strings.HasSuffix(f.Name, ".xml") {
+			slideNumberStr := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(f.Name), "ppt/slides/slide"), ".xml")
+			slideNumber, _ := strconv.Atoi(slideNumberStr)
+
+			slides = append(slides, f)
+			numbers = append(numbers, slideNumber)
+		}
+	}
+
+	sort.Stable(pptxSlideSorter{slides, numbers})
+
+	return slides
+}
+
+type pptxSlideSorter struct {
+	slides  []*zip.File
+	numbers []int
+}
+
+func (a pptxSlideSorter) Len() int           { return len(a.slides) }
+func (a pptxSlideSorter) Less(i, j int) bool { return a.numbers[i] < a.numbers[j] }
+func (a pptxSlideSorter) Swap(i, j int) {
+	a.slides[i], a.slides[j] = a.slides[j], a.slides[i]
+	a.numbers[i], a.numbers[j] = a.numbers[j], a.numbers[i]
+}
+
+// pptxWriteSlide writes the text of all <t> elements of the slide, separated by new-lines. The header is written before the first text.
+// Invalid XML ends the slide without error. The decompressed XML is charged to the budget.
+func pptxWriteSlide(f *zip.File, budget *Budget, header string, writer io.Writer, written *int64, limit *int64) (err error) {
+	zr, err := f.Open()
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+
+	budgetZR := &budgetReader{budget: budget, reader: zr}
+	decoder := xml.NewDecoder(budgetZR)
+	count := 0
+
+	for {
+		t, errToken := decoder.Token()
+		if budgetZR.err != nil {
+			return newConversionError(FormatPPTX, ErrBudgetExceeded, budgetZR.err)
+		} else if errToken != nil {
+			return nil
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "t" {
+			continue
+		}
+
+		text := pptxElementText(decoder)
+		count++
+
+		// A single empty text element does not count as content.
+		if count == 1 && text == "" {
+			continue
+		}
+
+		if header != "" {
+			if err = writeOutputLimit(writer, []byte(header), written, limit); err != nil {
+				return err
+			}
+			header = ""
+		}
+
+		if count > 1 {
+			text = "\n" + text
+		}
+
+		if err = writeOutputLimit(writer, []byte(text), written, limit); err != nil {
+			return err
+		}
+	}
+}
+
+// pptxReadSlide adds the paragraphs and tables of the slide to the builder. Invalid XML ends the slide without error. The decompressed XML is charged to the budget.
+func pptxReadSlide(f *zip.File, budget *Budget, builder *documentBuilder) (err error) {
+	zr, err := f.Open()
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+
+	budgetZR := &budgetReader{budget: budget, reader: zr}
+	decoder := xml.NewDecoder(budgetZR)
+
+	// Type of the placeholder of the current shape. Placeholders without type are content placeholders "obj".
+	placeholder := ""
+
+	for {
+		t, errToken := decoder.Token()
+		if budgetZR.err != nil {
+			return newConversionError(FormatPPTX, ErrBudgetExceeded, budgetZR.err)
+		} else if errToken != nil {
+			return nil
+		}
+
+		switch token := t.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "sp":
+				placeholder = ""
+			case "ph":
+				placeholder = "obj"
+				for _, attr := range token.Attr {
+					if attr.Name.Local == "type" {
+						placeholder = attr.Value
+					}
+				}
+			case "tbl":
+				if err = xmlReadTable(decoder, builder, pptxParagraphText); err != nil {
+					return err
+				}
+			case "p":
+				block := pptxParagraph(decoder, placeholder)
+				if block.Text == "" {
+					continue
+				}
+
+				if block.Type == BlockHeading && builder.container.Title == "" {
+					builder.container.Title = block.Text
+				}
+
+				if err = builder.add(block); err != nil {
+					return err
+				}
+			}
+
+		case xml.EndElement:
+			if token.Name.Local == "sp" {
+				placeholder = ""
+			}
+		}
+	}
+}
+
+// pptxParagraph reads the paragraph <a:p> and returns it as block. The placeholder is the type of the placeholder that contains it, if any.
+func pptxParagraph(decoder *xml.Decoder, placeholder string) (block Block) {
+	block.Type = BlockParagraph
+
+	level := 0
+	bullet := placeholder == "body" || placeholder == "obj"
+
+	for depth := 1; depth > 0; {
+		t, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch token := t.(type) {
+		case xml.StartElement:
+			depth++
+
+			switch token.Name.Local {
+			case "pPr":
+				for _, attr := range token.Attr {
+					if attr.Name.Local == "lvl" {
+						level, _ = strconv.Atoi(attr.Value)
+					}
+				}
+			case "buChar", "buAutoNum", "buBlip":
+				bullet = true
+			case "buNone":
+				bullet = false
+			case "br":
+				block.Text += "\n"
+			case "t":
+				block.Text += pptxElementText(decoder)
+				depth--
+			}
+
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	block.Text = strings.TrimSpace(block.Text)
+
+	switch {
+	case placeholder == "title" || placeholder == "ctrTitle":
+		block.Type, block.Level = BlockHeading, 1
+	case bullet:
+		if level < 0 || level > 8 {
+			level = 0
+		}
+		block.Type, block.Level = BlockListItem, level+1
+	}
+
+	return block
+}
+
+// pptxParagraphText returns the text of a paragraph in a table
+func pptxParagraphText(decoder *xml.Decoder, se *xml.StartElement) string {
+	return pptxParagraph(decoder, "").Text
+}
+
+// pptxElementText returns all character data until the end of the current element
+func pptxElementText(decoder *xml.Decoder) (text string) {
+	for depth := 1; depth > 0; {
+		t, err := decoder.Token()
+		if err != nil {
+			return text
+		}
+
+		switch token := t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			text += string(token)
+		}
+	}
+
+	return text
+}
+
+// AsText returns the text on all slides
+func (doc PPTXDocument) AsText() (text string) {
+
+	for n, slide := range doc.Slides {
+		if slide.TextContent == "" { // skip empty slides
+			continue
+		}
+
+		if n > 0 && text != "" {
+			text += "\n\n"
+		}
+
+		text += "Slide " + strconv.Itoa(n+1) + ":\n"
+		text += slide.TextContent
+	}
+
+	return text
+}
@@ -0,0 +1,76 @@
+/*
+File Name:  Panic.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+The parsers are fed untrusted files and some of the forked code indexes slices without bounds checks.
+All converters recover from panics and return ErrParserPanic instead, so a single bad file does not crash the process.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/debug"
+)
+
+// panicStackSize is the max size of the stack excerpt stored in PanicError
+const panicStackSize = 4096
+
+// PanicError contains the details of a recovered panic. It is the underlying error of a ConversionError with the kind ErrParserPanic.
+type PanicError struct {
+	Value interface{} // Value passed to panic
+	Stack string      // Excerpt of the stack trace, starting at the function that panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v", e.Value)
+}
+
+// recoverPanic recovers a panic and stores it as ErrParserPanic in err. It must be called directly via defer.
+func recoverPanic(format Format, err *error) {
+	if value := recover(); value != nil {
+		*err = newPanicError(format, value)
+	}
+}
+
+// newPanicError creates the error for a recovered panic. It must be called by the deferred function, so the stack still contains the panicking function.
+func newPanicError(format Format, value interface{}) error {
+	return &ConversionError{Format: format, Kind: ErrParserPanic, Err: &PanicError{Value: value, Stack: panicStack(debug.Stack())}}
+}
+
+// panicStack returns the relevant part of the stack trace. The frames of the recovery and the runtime are skipped.
+func panicStack(stack []byte) string {
+	// Each frame has 2 lines: the function and its source line. The frame "panic(...)" is followed by the panicking function.
+	if start := bytes.Index(stack, []byte("\npanic(")); start >= 0 {
+		stack = panicSkipFrame(stack[start+1:])
+
+		// Runtime errors like index out of range have additional runtime frames.
+		for bytes.HasPrefix(stack, []byte("runtime.")) {
+			stack = panicSkipFrame(stack)
+		}
+	}
+
+	if len(stack) > panicStackSize {
+		stack = stack[:panicStackSize]
+		if end := bytes.LastIndexByte(stack, '\n'); end > 0 {
+			stack = stack[:end+1]
+		}
+	}
+
+	return string(stack)
+}
+
+// panicSkipFrame removes the first frame from the stack trace
+func panicSkipFrame(stack []byte) []byte {
+	for n := 0; n < 2; n++ {
+		end := bytes.IndexByte(stack, '\n')
+		if end < 0 {
+			return nil
+		}
+		stack = stack[end+1:]
+	}
+
+	return stack
+}
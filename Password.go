@@ -0,0 +1,89 @@
+/*
+File Name:  Password.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Candidate passwords for encrypted archives. The container functions try them in order for encrypted ZIP (ZipCrypto and WinZip AES), RAR and 7Z files.
+The password that worked is reported in ContainerFile.Password. Files that none of them decrypts are passed to the callback with ErrPasswordRequired.
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+type passwordsContextKey struct{}
+
+// WithPasswords returns a context with candidate passwords for encrypted archives. They are used by the container functions.
+func WithPasswords(ctx context.Context, passwords []string) context.Context {
+	return context.WithValue(ctx, passwordsContextKey{}, passwords)
+}
+
+// passwordsFromContext returns the candidate passwords of the context
+func passwordsFromContext(ctx context.Context) []string {
+	passwords, _ := ctx.Value(passwordsContextKey{}).([]string)
+	return passwords
+}
+
+// passwordVerify reads the decrypted file fully and checks if it is valid. Wrong passwords produce garbage, which the decompressors reject or which fails the checksum at the end of the file.
+// Stored files are only rejected by the checksum, therefore the start of the file is not enough. Compressed is the compressed size of the file, 0 if unknown.
+// The bytes are counted against the bomb limits of the context. Decompressors that panic on the garbage of a wrong password are treated as invalid.
+func passwordVerify(ctx context.Context, reader io.Reader, compressed int64) (valid bool) {
+	defer func() {
+		if recover() != nil {
+			valid = false
+		}
+	}()
+
+	bomb := newBombTracker(ctx, compressed).reader("", compressed, &contextReader{ctx: ctx, reader: reader})
+	_, err := io.Copy(ioutil.Discard, bomb)
+	return err == nil
+}
+
+// passwordFirst returns the passwords with the one that worked last moved to the front. Archives usually use the same password for all files.
+func passwordFirst(passwords []string, last string) []string {
+	for n, password := range passwords {
+		if password == last && n > 0 {
+			ordered := append([]string{last}, passwords[:n]...)
+			return append(ordered, passwords[n+1:]...)
+		}
+	}
+
+	return passwords
+}
+
+// pbkdf2SHA1 derives a key from the password as specified in RFC 2898 using HMAC-SHA1
+func pbkdf2SHA1(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha1.New, password)
+	key := make([]byte, 0, keyLength+sha1.Size)
+	var block, u []byte
+	var counter [4]byte
+
+	for n := uint32(1); len(key) < keyLength; n++ {
+		binary.BigEndian.PutUint32(counter[:], n)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		block = append(block[:0], u...)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range block {
+				block[x] ^= u[x]
+			}
+		}
+
+		key = append(key, block...)
+	}
+
+	return key[:keyLength]
+}
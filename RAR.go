@@ -0,0 +1,535 @@
+/*
+File Name:  RAR.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Parser for the headers of RAR archives (versions 1.5 to 4 and 5). The rardecode package does not report which files are encrypted,
+which is required to try the candidate passwords and to list encrypted files when none of them works. It also does not report CRC, method and comments.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// rarMaxHeaderSize is the max size of a single header. RAR 5 limits headers to 2 MB.
+const rarMaxHeaderSize = 2 << 20
+
+// rarMaxCommentSize is the max size of an archive comment that is read
+const rarMaxCommentSize = 64 << 10
+
+var errRARHeader = errors.New("invalid RAR header")
+
+// rarArchive contains the headers of a RAR archive
+type rarArchive struct {
+	files            []rarFileHeader
+	encryptedHeaders bool   // If the headers are encrypted, only the files before are listed
+	comment          string // Archive comment, only if stored uncompressed
+	start            int64  // Offset of the first block after the signature
+	end              int64  // Offset of the end of archive block, or the size if there is none. The end is not known if the headers are encrypted.
+	size             int64  // Size of the archive including the end of archive block, or the size of the file
+	volume           int    // Number of the volume starting at 0, or -1 if unknown
+	nextVolume       bool   // The archive continues in the next volume
+}
+
+// addFile adds the file header. Files that are split across volumes have a header in each volume, they are stored as one file.
+// The checksum of the last part is the one of the whole file.
+func (archive *rarArchive) addFile(header rarFileHeader, continued bool) {
+	if last := len(archive.files) - 1; continued && last >= 0 && archive.files[last].name == header.name {
+		archive.files[last].packedSize += header.packedSize
+		archive.files[last].crc, archive.files[last].hasCRC = header.crc, header.hasCRC
+		return
+	}
+
+	archive.files = append(archive.files, header)
+}
+
+// rarFileHeader is a file header of a RAR archive
+type rarFileHeader struct {
+	name       string
+	directory  bool
+	symlink    bool
+	hardlink   bool
+	linkTarget string // Only stored in the header by RAR 5, older versions store the target of symbolic links as data
+	encrypted  bool
+	packedSize int64
+	size       int64 // -1 if unknown
+	crc        uint32
+	hasCRC     bool
+	method     string
+	hostOS     string
+	mode       os.FileMode
+	date       time.Time
+}
+
+// rarMethods are the names of the compression methods 0 to 5
+var rarMethods = []string{"Store", "Fastest", "Fast", "Normal", "Good", "Best"}
+
+// rarReadHeaders reads the headers of the RAR archive. The file headers are in the same order as returned by rardecode.
+// On error, the headers read so far are returned.
+func rarReadHeaders(file io.ReaderAt, size int64) (archive rarArchive, err error) {
+	signature := make([]byte, 8)
+	if _, err = file.ReadAt(signature, 0); err != nil {
+		return archive, err
+	}
+	archive.end, archive.size, archive.volume = size, size, -1
+
+	if bytes.Equal(signature, []byte("Rar!\x1A\x07\x01\x00")) {
+		archive.start = 8
+		err = rar5ReadHeaders(file, size, &archive)
+	} else if bytes.HasPrefix(signature, []byte("Rar!\x1A\x07\x00")) {
+		archive.start = 7
+		err = rar4ReadHeaders(file, size, &archive)
+	} else {
+		err = errRARHeader
+	}
+
+	return archive, err
+}
+
+// rar4ReadHeaders reads the headers of a RAR 1.5 to 4 archive
+func rar4ReadHeaders(file io.ReaderAt, size int64, archive *rarArchive) (err error) {
+	// Each block starts with CRC (2), type (1), flags (2) and the header size (2). Blocks with the flag 0x8000 are followed by data, its size is stored after the header fields.
+	header := make([]byte, 11)
+
+	for offset := int64(7); offset+7 <= size; {
+		// A short read at the end of the file must not leave bytes of the previous block in the buffer
+		n, err := file.ReadAt(header, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for i := n; i < len(header); i++ {
+			header[i] = 0
+		}
+
+		blockType := header[2]
+		flags := binary.LittleEndian.Uint16(header[3:])
+		headerSize := int64(binary.LittleEndian.Uint16(header[5:]))
+		if headerSize < 7 {
+			return errRARHeader
+		}
+
+		dataSize := int64(0)
+		if flags&0x8000 != 0 {
+			if headerSize < 11 || n < 11 {
+				return errRARHeader
+			}
+			dataSize = int64(binary.LittleEndian.Uint32(header[7:]))
+		}
+
+		switch blockType {
+		case 0x73: // archive header
+			if flags&0x0080 != 0 {
+				archive.encryptedHeaders = true
+				return nil
+			} else if flags&0x0100 != 0 {
+				// first volume, set since RAR 3
+				archive.volume = 0
+			}
+
+		case 0x74, 0x7A: // file header, service header
+			data := make([]byte, headerSize)
+			if _, err = file.ReadAt(data, offset); err != nil {
+				return err
+			}
+
+			fileHeader, err := rar4FileHeader(data, flags)
+			if err != nil {
+				return err
+			}
+			dataSize = fileHeader.packedSize
+
+			if blockType == 0x74 {
+				archive.addFile(fileHeader, flags&0x0001 != 0)
+			} else if fileHeader.name == "CMT" && fileHeader.method == rarMethods[0] {
+				archive.comment = rarReadComment(file, offset+headerSize, dataSize)
+			}
+
+		case 0x7B: // end of archive
+			archive.end, archive.size = offset, offset+headerSize+dataSize
+			archive.nextVolume = flags&0x0001 != 0
+
+			// The volume number follows the optional data CRC
+			data := make([]byte, headerSize)
+			if _, err = file.ReadAt(data, offset); err == nil && flags&0x0008 != 0 {
+				if position := 7 + 4*int64(flags>>1&1); position+2 <= headerSize {
+					archive.volume = int(binary.LittleEndian.Uint16(data[position:]))
+				}
+			}
+			return nil
+		}
+
+		// The next block must be after this one. Data beyond the end of the file means the archive is truncated, the remaining headers are missing.
+		next := offset + headerSize + dataSize
+		if dataSize < 0 || next <= offset || next > size {
+			break
+		}
+		offset = next
+	}
+
+	return nil
+}
+
+// rar4FileHeader parses a file header of a RAR 1.5 to 4 archive. Service headers use the same structure.
+func rar4FileHeader(data []byte, flags uint16) (header rarFileHeader, err error) {
+	// The fields after the block header: packed size (4), size (4), host OS (1), CRC (4), time (4), version (1), method (1), name size (2), attributes (4)
+	nameOffset := 32
+	if len(data) < nameOffset {
+		return header, errRARHeader
+	}
+
+	header.packedSize = int64(binary.LittleEndian.Uint32(data[7:]))
+	header.size = int64(binary.LittleEndian.Uint32(data[11:]))
+	if flags&0x0100 != 0 {
+		// 64-bit sizes
+		if len(data) < 40 {
+			return header, errRARHeader
+		}
+		header.packedSize |= int64(binary.LittleEndian.Uint32(data[32:])) << 32
+		header.size |= int64(binary.LittleEndian.Uint32(data[36:])) << 32
+		nameOffset += 8
+		// A high word of 0x80000000 or more results in a negative size
+		if header.packedSize < 0 || header.size < 0 {
+			return header, errRARHeader
+		}
+	} else if header.size == 0xFFFFFFFF {
+		header.size = -1
+	}
+
+	nameSize := int(binary.LittleEndian.Uint16(data[26:]))
+	if nameOffset+nameSize > len(data) {
+		return header, errRARHeader
+	}
+	name := data[nameOffset : nameOffset+nameSize]
+	if flags&0x0200 != 0 {
+		header.name = rarDecodeName(name)
+	} else {
+		header.name = string(name)
+	}
+	header.name = strings.Replace(header.name, "\\", "/", -1)
+
+	hostOS := data[15]
+	attributes := binary.LittleEndian.Uint32(data[28:])
+
+	header.crc = binary.LittleEndian.Uint32(data[16:])
+	header.hasCRC = true
+	header.date = dosDateTime(binary.LittleEndian.Uint32(data[20:]))
+	if method := int(data[25]) - 0x30; method >= 0 && method < len(rarMethods) {
+		header.method = rarMethods[method]
+	}
+	header.directory = flags&0x00E0 == 0x00E0
+	header.encrypted = flags&0x0004 != 0
+
+	switch hostOS {
+	case 0, 1, 2: // MS-DOS, OS/2, Windows
+		header.mode = msdosFileMode(attributes, header.directory)
+	case 3, 5: // Unix, BeOS
+		header.mode = unixFileMode(attributes)
+	}
+	header.symlink = header.mode&os.ModeSymlink != 0
+	if hostOS < 6 {
+		header.hostOS = []string{"MS-DOS", "OS/2", "Windows", "Unix", "Mac OS", "BeOS"}[hostOS]
+	}
+
+	return header, nil
+}
+
+// rarDecodeName decodes a unicode name of a RAR 1.5 to 4 archive. The ASCII name is followed by a zero byte and the unicode characters, encoded relative to the ASCII name.
+func rarDecodeName(data []byte) string {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		// UTF-8 name
+		return string(data)
+	}
+
+	name := data[:end]
+	encoded := data[end+1:]
+	if len(encoded) < 2 {
+		return string(name)
+	}
+
+	highByte := uint16(encoded[0]) << 8
+	flags := encoded[1]
+	flagBits := 8
+	encoded = encoded[2:]
+	var characters []uint16
+
+	for len(characters) < len(name) && len(encoded) > 0 {
+		if flagBits == 0 {
+			flags = encoded[0]
+			flagBits = 8
+			if encoded = encoded[1:]; len(encoded) == 0 {
+				break
+			}
+		}
+
+		switch flags >> 6 {
+		case 0:
+			characters = append(characters, uint16(encoded[0]))
+			encoded = encoded[1:]
+		case 1:
+			characters = append(characters, uint16(encoded[0])|highByte)
+			encoded = encoded[1:]
+		case 2:
+			if len(encoded) < 2 {
+				encoded = nil
+				break
+			}
+			characters = append(characters, binary.LittleEndian.Uint16(encoded))
+			encoded = encoded[2:]
+		case 3:
+			// A run of characters of the ASCII name, optionally with a correction
+			length := int(encoded[0]&0x7F) + 2
+			correction := encoded[0]&0x80 != 0
+			encoded = encoded[1:]
+
+			run := name[len(characters):]
+			if length < len(run) {
+				run = run[:length]
+			}
+
+			if correction {
+				if len(encoded) == 0 {
+					break
+				}
+				for _, c := range run {
+					characters = append(characters, uint16(c+encoded[0])|highByte)
+				}
+				encoded = encoded[1:]
+			} else {
+				for _, c := range run {
+					characters = append(characters, uint16(c))
+				}
+			}
+		}
+
+		flags <<= 2
+		flagBits -= 2
+	}
+
+	return string(utf16.Decode(characters))
+}
+
+// rar5ReadHeaders reads the headers of a RAR 5 archive
+func rar5ReadHeaders(file io.ReaderAt, size int64, archive *rarArchive) (err error) {
+	// Each block starts with CRC (4) and the header size. The size, type and all other numbers are variable length integers.
+	start := make([]byte, 4+3)
+
+	for offset := int64(8); offset+5 <= size; {
+		if _, err = file.ReadAt(start, offset); err != nil && err != io.EOF {
+			return err
+		}
+
+		headerSize, n := rarVint(start[4:])
+		if n == 0 || headerSize == 0 || headerSize > rarMaxHeaderSize {
+			return errRARHeader
+		}
+
+		header := make([]byte, headerSize)
+		if _, err = file.ReadAt(header, offset+4+int64(n)); err != nil {
+			return err
+		}
+		dataOffset := offset + 4 + int64(n) + int64(headerSize)
+
+		fields := &rarFields{data: header}
+		blockType := fields.vint()
+		flags := fields.vint()
+		extraSize, dataSize := uint64(0), uint64(0)
+		if flags&0x0001 != 0 {
+			extraSize = fields.vint()
+		}
+		if flags&0x0002 != 0 {
+			dataSize = fields.vint()
+		}
+		if fields.invalid || extraSize > headerSize || dataSize > uint64(size) {
+			return errRARHeader
+		}
+		blockOffset := offset
+		offset = dataOffset + int64(dataSize)
+
+		switch blockType {
+		case 1: // main archive header, the volume number is stored in all but the first volume
+			archiveFlags := fields.vint()
+			archive.volume = 0
+			if archiveFlags&0x0002 != 0 {
+				if number := fields.vint(); number < 1<<30 {
+					archive.volume = int(number)
+				}
+			}
+
+		case 2, 3: // file header, service header
+			fileHeader, err := rar5FileHeader(fields, header[headerSize-extraSize:])
+			if err != nil {
+				return err
+			}
+			fileHeader.packedSize = int64(dataSize)
+
+			if blockType == 2 {
+				archive.addFile(fileHeader, flags&0x0008 != 0)
+			} else if fileHeader.name == "CMT" && fileHeader.method == rarMethods[0] && !fileHeader.encrypted {
+				archive.comment = rarReadComment(file, dataOffset, int64(dataSize))
+			}
+
+		case 4: // encryption header, all following headers are encrypted
+			archive.encryptedHeaders = true
+			return nil
+
+		case 5: // end of archive
+			archive.end, archive.size = blockOffset, offset
+			archive.nextVolume = fields.vint()&0x0001 != 0
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// rar5FileHeader parses a file header of a RAR 5 archive. Service headers use the same structure. The extra area contains additional records.
+func rar5FileHeader(fields *rarFields, extra []byte) (header rarFileHeader, err error) {
+	fileFlags := fields.vint()
+	header.size = int64(fields.vint())
+	attributes := fields.vint()
+	if fileFlags&0x0002 != 0 {
+		header.date = time.Unix(int64(fields.uint32()), 0).UTC()
+	}
+	if fileFlags&0x0004 != 0 {
+		header.crc = fields.uint32()
+		header.hasCRC = true
+	}
+	compression := fields.vint()
+	hostOS := fields.vint()
+	header.name = string(fields.bytes(int(fields.vint())))
+	if fields.invalid {
+		return header, errRARHeader
+	}
+
+	if fileFlags&0x0008 != 0 {
+		header.size = -1
+	}
+	header.directory = fileFlags&0x0001 != 0
+	if method := (compression >> 7) & 7; method < uint64(len(rarMethods)) {
+		header.method = rarMethods[method]
+	}
+
+	switch hostOS {
+	case 0:
+		header.hostOS = "Windows"
+		header.mode = msdosFileMode(uint32(attributes), header.directory)
+	case 1:
+		header.hostOS = "Unix"
+		header.mode = unixFileMode(uint32(attributes))
+	}
+
+	// Records: encryption (1), file time (3) and redirection (5) for links
+	records := &rarFields{data: extra}
+	for len(records.data) > 0 && !records.invalid {
+		record := &rarFields{data: records.bytes(int(records.vint()))}
+
+		switch record.vint() {
+		case 1:
+			header.encrypted = true
+		case 3:
+			// The modification time in the header takes precedence
+			if timeFlags := record.vint(); timeFlags&0x0002 == 0 || !header.date.IsZero() {
+				break
+			} else if timeFlags&0x0001 != 0 {
+				header.date = time.Unix(int64(record.uint32()), 0).UTC()
+			} else {
+				header.date = filetimeToTime(record.uint64())
+			}
+		case 5:
+			// Unix symlink, Windows symlink, junction and hard link, followed by flags and the target
+			redirection := record.vint()
+			record.vint()
+			target := string(record.bytes(int(record.vint())))
+			if redirection >= 1 && redirection <= 3 {
+				header.mode |= os.ModeSymlink
+				header.linkTarget = target
+			} else if redirection == 4 {
+				header.hardlink = true
+				header.linkTarget = target
+			}
+		}
+	}
+	header.symlink = header.mode&os.ModeSymlink != 0
+
+	return header, nil
+}
+
+// rarReadComment reads an archive comment stored uncompressed
+func rarReadComment(file io.ReaderAt, offset, size int64) string {
+	if size <= 0 || size > rarMaxCommentSize {
+		return ""
+	}
+
+	comment := make([]byte, size)
+	if _, err := file.ReadAt(comment, offset); err != nil {
+		return ""
+	}
+
+	return string(bytes.TrimRight(comment, "\x00"))
+}
+
+// rarVint decodes a variable length integer as used by RAR 5. It returns the number of bytes used, 0 if invalid.
+func rarVint(data []byte) (value uint64, n int) {
+	for shift := uint(0); n < len(data) && shift < 64; shift += 7 {
+		b := data[n]
+		n++
+		value |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return value, n
+		}
+	}
+
+	return 0, 0
+}
+
+// rarFields reads the fields of a RAR 5 header. Once the data is exhausted, invalid is set and zero values are returned.
+type rarFields struct {
+	data    []byte
+	invalid bool
+}
+
+func (fields *rarFields) vint() uint64 {
+	value, n := rarVint(fields.data)
+	if n == 0 {
+		fields.invalid = true
+		return 0
+	}
+	fields.data = fields.data[n:]
+	return value
+}
+
+func (fields *rarFields) uint32() uint32 {
+	if data := fields.bytes(4); data != nil {
+		return binary.LittleEndian.Uint32(data)
+	}
+	return 0
+}
+
+func (fields *rarFields) uint64() uint64 {
+	if data := fields.bytes(8); data != nil {
+		return binary.LittleEndian.Uint64(data)
+	}
+	return 0
+}
+
+// bytes returns the next n bytes. If there are not enough, nil is returned.
+func (fields *rarFields) bytes(n int) []byte {
+	if n < 0 || n > len(fields.data) {
+		fields.invalid = true
+		fields.data = nil
+		return nil
+	}
+	data := fields.data[:n]
+	fields.data = fields.data[n:]
+	return data
+}
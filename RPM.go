@@ -0,0 +1,104 @@
+/*
+File Name:  RPM.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Parser for RPM packages. The package starts with the lead, followed by the signature header and the main header. The payload is a compressed cpio archive.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// RPM structures
+const (
+	rpmLeadSize        = 96
+	rpmHeaderSize      = 16 // header structure, followed by the index entries (16 bytes each) and the data
+	rpmMaxIndexEntries = 1 << 16
+	rpmMaxDataSize     = 256 << 20
+)
+
+// Tags of the main header
+const (
+	rpmTagPayloadFormat = 1124 // "cpio", or "drpm" for delta RPMs
+)
+
+var errRPMHeader = errors.New("invalid RPM header")
+
+// rpmReadPayloadOffset reads the lead, the signature and the main header and returns the offset of the payload
+func rpmReadPayloadOffset(file io.ReaderAt, size int64) (offset int64, err error) {
+	lead := make([]byte, rpmLeadSize)
+	if _, err = file.ReadAt(lead, 0); err != nil {
+		return 0, err
+	} else if !bytes.HasPrefix(lead, []byte{0xED, 0xAB, 0xEE, 0xDB}) {
+		return 0, errRPMHeader
+	}
+
+	// The signature header is padded to 8 bytes
+	offset = rpmLeadSize
+	length, _, err := rpmReadHeader(file, offset, size)
+	if err != nil {
+		return 0, err
+	}
+	offset += (length + 7) &^ 7
+
+	length, tags, err := rpmReadHeader(file, offset, size)
+	if err != nil {
+		return 0, err
+	}
+	offset += length
+
+	if format, ok := tags[rpmTagPayloadFormat]; ok && format != "cpio" {
+		return 0, ErrUnsupportedVersion
+	} else if offset > size {
+		return 0, errRPMHeader
+	}
+
+	return offset, nil
+}
+
+// rpmReadHeader reads a header structure at the offset and returns its length and the string tags. Size is the size of the file, the header must fit into it.
+func rpmReadHeader(file io.ReaderAt, offset, size int64) (length int64, tags map[uint32]string, err error) {
+	header := make([]byte, rpmHeaderSize)
+	if _, err = file.ReadAt(header, offset); err != nil {
+		return 0, nil, err
+	} else if !bytes.HasPrefix(header, []byte{0x8E, 0xAD, 0xE8, 0x01}) {
+		return 0, nil, errRPMHeader
+	}
+
+	entries := int64(binary.BigEndian.Uint32(header[8:]))
+	dataSize := int64(binary.BigEndian.Uint32(header[12:]))
+	if entries > rpmMaxIndexEntries || dataSize > rpmMaxDataSize || offset+rpmHeaderSize+entries*16+dataSize > size {
+		return 0, nil, errRPMHeader
+	}
+
+	index := make([]byte, entries*16)
+	data := make([]byte, dataSize)
+	if _, err = file.ReadAt(index, offset+rpmHeaderSize); err != nil {
+		return 0, nil, err
+	} else if _, err = file.ReadAt(data, offset+rpmHeaderSize+int64(len(index))); err != nil {
+		return 0, nil, err
+	}
+
+	// Index entries: tag, type, offset and count. Type 6 is a null-terminated string.
+	tags = make(map[uint32]string)
+	for n := 0; n < len(index); n += 16 {
+		tag := binary.BigEndian.Uint32(index[n:])
+		valueType := binary.BigEndian.Uint32(index[n+4:])
+		valueOffset := int64(binary.BigEndian.Uint32(index[n+8:]))
+
+		if valueType == 6 && valueOffset < dataSize {
+			value := data[valueOffset:]
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				tags[tag] = string(value[:end])
+			}
+		}
+	}
+
+	return rpmHeaderSize + int64(len(index)) + dataSize, tags, nil
+}
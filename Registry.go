@@ -0,0 +1,317 @@
+/*
+File Name:  Registry.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Registry of converters used by Convert. All built-in converters are registered by default.
+Custom converters can be registered for new formats, or to override built-in ones (for example to use a different PDF library).
+*/
+
+package fileconversion
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Converter converts a file to text
+type Converter interface {
+	// Detect returns the confidence in percent that the file is in the format handled by this converter. See the Confidence constants.
+	Detect(file io.ReaderAt, size int64) (confidence int)
+
+	// Convert extracts the text of the file and writes it to the writer. Size is the full size of the input file.
+	// The writer passed by the registry enforces the output limit of the options and returns an error once it is reached.
+	Convert(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error)
+}
+
+// MetadataConverter is an optional interface for converters that can extract metadata. Documents without metadata return empty fields and no error.
+type MetadataConverter interface {
+	Metadata(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error)
+}
+
+// DocumentConverter is an optional interface for converters that can extract the structure of the document.
+// Options.Limit limits the total bytes of text in the document.
+type DocumentConverter interface {
+	Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error)
+}
+
+// Registry holds the converters for each format
+type Registry struct {
+	mu         sync.RWMutex
+	converters map[Format]Converter
+	formats    []Format // in order of registration
+}
+
+// DefaultRegistry is used by Convert and contains all built-in converters
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates a new registry with all built-in converters registered
+func NewRegistry() (registry *Registry) {
+	registry = &Registry{converters: make(map[Format]Converter)}
+
+	for _, format := range []Format{FormatDOC, FormatDOCX, FormatXLS, FormatXLSX, FormatODS, FormatODT, FormatODP, FormatPPTX, FormatPDF, FormatEPUB, FormatMOBI, FormatHTML, FormatRTF} {
+		registry.Register(format, newBuiltinConverter(format))
+	}
+
+	return registry
+}
+
+// Register registers the converter for the format. An existing converter for the same format, including a built-in one, is replaced.
+func (registry *Registry) Register(format Format, converter Converter) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, exists := registry.converters[format]; !exists {
+		registry.formats = append(registry.formats, format)
+	}
+	registry.converters[format] = converter
+}
+
+// Unregister removes the converter for the format. If it replaced a built-in converter, the built-in one is restored.
+// Unregistering a built-in converter removes it.
+func (registry *Registry) Unregister(format Format) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	converter, exists := registry.converters[format]
+	if !exists {
+		return
+	} else if _, isBuiltin := converter.(*builtinConverter); !isBuiltin && builtinConverters[format] != nil {
+		registry.converters[format] = newBuiltinConverter(format)
+		return
+	}
+	delete(registry.converters, format)
+
+	for n, existing := range registry.formats {
+		if existing == format {
+			registry.formats = append(registry.formats[:n], registry.formats[n+1:]...)
+			break
+		}
+	}
+}
+
+// Converter returns the converter for the format, or nil if none is registered
+func (registry *Registry) Converter(format Format) Converter {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	return registry.converters[format]
+}
+
+// Formats returns all formats with a registered converter
+func (registry *Registry) Formats() (formats []Format) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	return append(formats, registry.formats...)
+}
+
+// Detect detects the format of the file. The built-in detection is used first, then all custom converters are asked.
+// A custom converter wins if it returns a higher confidence.
+func (registry *Registry) Detect(file io.ReaderAt, size int64) (format Format, confidence int) {
+	format, confidence = DetectFormat(file, size)
+
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	for _, customFormat := range registry.formats {
+		converter := registry.converters[customFormat]
+		if _, isBuiltin := converter.(*builtinConverter); isBuiltin {
+			// Built-in converters use DetectFormat, no need to run it again.
+			continue
+		}
+
+		if customConfidence := safeDetect(converter, file, size); customConfidence > confidence {
+			format, confidence = customFormat, customConfidence
+		}
+	}
+
+	return format, confidence
+}
+
+// Convert detects the format of the input and extracts the text to the writer using the registered converter.
+// See the package level function Convert for details.
+func (registry *Registry) Convert(ctx context.Context, input io.ReaderAt, size int64, writer io.Writer, options Options) (result Result) {
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	var converter Converter
+	if result.Format, converter, result.Err = registry.lookup(input, size, options); result.Err != nil {
+		return result
+	}
+
+	if options.Budget != nil {
+		ctx = WithBudget(ctx, options.Budget)
+	}
+
+	lw := newLimitWriter(ctx, writer, options.Limit)
+
+	_, err := safeConvert(ctx, result.Format, converter, input, size, lw, options)
+
+	result.Written = lw.written
+	result.Truncated = lw.truncated || errors.Is(err, ErrLimitReached)
+
+	if errors.Is(err, ErrLimitReached) || (err != nil && lw.truncated) {
+		// The converter stopped because of the limit. This is not an error.
+		err = nil
+	} else if err != nil && ctx.Err() != nil {
+		// Some parsers do not keep the original read error, make sure the cancellation is reported.
+		err = ctx.Err()
+	}
+	result.Err = err
+
+	return result
+}
+
+// ConvertDocument detects the format of the input and extracts the structure of the document using the registered converter.
+// The converter must implement DocumentConverter, otherwise ErrUnsupportedFormat is returned. See the package level function ConvertDocument for details.
+func (registry *Registry) ConvertDocument(ctx context.Context, input io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	format, converter, err := registry.lookup(input, size, options)
+	if err != nil {
+		return nil, err
+	}
+
+	documentConverter, ok := converter.(DocumentConverter)
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+
+	if options.Budget != nil {
+		ctx = WithBudget(ctx, options.Budget)
+	}
+
+	document, err = safeDocument(ctx, format, documentConverter, input, size, options)
+
+	if document != nil && document.Format == FormatUnknown {
+		document.Format = format
+	}
+	if err != nil && ctx.Err() != nil {
+		// Some parsers do not keep the original read error, make sure the cancellation is reported.
+		err = ctx.Err()
+	}
+
+	return document, err
+}
+
+// Metadata detects the format of the input and extracts the metadata using the registered converter.
+// The converter must implement MetadataConverter, otherwise ErrUnsupportedFormat is returned.
+// Formats without a converter use the built-in metadata extraction if available, for example PPT and MSG.
+func (registry *Registry) Metadata(input io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	format, converter, err := registry.lookup(input, size, Options{})
+	if err == ErrUnsupportedFormat && builtinMetadata[format] != nil {
+		converter, err = &builtinConverter{format: format, metadata: builtinMetadata[format]}, nil
+	}
+	if err != nil {
+		return metadata, err
+	}
+
+	metadataConverter, ok := converter.(MetadataConverter)
+	if !ok {
+		return metadata, ErrUnsupportedFormat
+	}
+
+	return safeMetadata(format, metadataConverter, input, size)
+}
+
+// lookup returns the format of the input and its converter. If the options specify a format, the detection is skipped.
+func (registry *Registry) lookup(input io.ReaderAt, size int64, options Options) (format Format, converter Converter, err error) {
+	format = options.Format
+	if format == FormatUnknown {
+		format, _ = registry.Detect(input, size)
+	}
+
+	if converter = registry.Converter(format); converter == nil {
+		if format == FormatOLE2 && ole2IsEncryptedPackage(input, size) {
+			return format, nil, &ConversionError{Format: format, Kind: ErrPasswordRequired}
+		}
+		return format, nil, ErrUnsupportedFormat
+	}
+
+	return format, converter, nil
+}
+
+// Register registers the converter for the format in the default registry. An existing converter for the same format is replaced.
+func Register(format Format, converter Converter) {
+	DefaultRegistry.Register(format, converter)
+}
+
+// safeConvert calls the converter and returns a panic as ErrParserPanic
+func safeConvert(ctx context.Context, format Format, converter Converter, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	defer recoverPanic(format, &err)
+
+	return converter.Convert(ctx, file, size, writer, options)
+}
+
+// safeDocument calls the document converter and returns a panic as ErrParserPanic
+func safeDocument(ctx context.Context, format Format, converter DocumentConverter, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	defer recoverPanic(format, &err)
+
+	return converter.Document(ctx, file, size, options)
+}
+
+// safeMetadata calls the metadata converter and returns a panic as ErrParserPanic
+func safeMetadata(format Format, converter MetadataConverter, file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(format, &err)
+
+	return converter.Metadata(file, size)
+}
+
+// safeDetect calls the detection of the converter. A panic is treated as no match.
+func safeDetect(converter Converter, file io.ReaderAt, size int64) (confidence int) {
+	defer func() {
+		if recover() != nil {
+			confidence = ConfidenceNone
+		}
+	}()
+
+	return converter.Detect(file, size)
+}
+
+// builtinConverter wraps the built-in conversion functions
+type builtinConverter struct {
+	format   Format
+	convert  func(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error)
+	document func(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) // nil if the format does not support the document model
+	metadata func(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error)                                // nil if the format does not support metadata
+}
+
+// newBuiltinConverter returns the built-in converter for the format
+func newBuiltinConverter(format Format) *builtinConverter {
+	return &builtinConverter{format: format, convert: builtinConverters[format], document: builtinDocumentConverters[format], metadata: builtinMetadata[format]}
+}
+
+func (converter *builtinConverter) Detect(file io.ReaderAt, size int64) (confidence int) {
+	if format, confidence := DetectFormat(file, size); format == converter.format {
+		return confidence
+	}
+
+	return ConfidenceNone
+}
+
+func (converter *builtinConverter) Convert(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer, options Options) (written int64, err error) {
+	return converter.convert(ctx, file, size, writer, options)
+}
+
+func (converter *builtinConverter) Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	if converter.document == nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	return converter.document(ctx, file, size, options)
+}
+
+func (converter *builtinConverter) Metadata(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	if converter.metadata == nil {
+		return metadata, ErrUnsupportedFormat
+	}
+
+	return converter.metadata(file, size)
+}
@@ -0,0 +1,310 @@
+/*
+File Name:  Volumes.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+Extraction of archives that are split into multiple files: multi-volume RAR (.part1.rar or .rar, .r00), 7Z and other archives split into pieces (.7z.001, .zip.001) and split ZIP (.z01, .zip).
+The volumes are joined to a single file, which is extracted like any other container. Pieces are simply joined together.
+Each RAR volume starts with the signature, which is removed from the following volumes. Their archive headers are kept, and so are the file headers that are repeated for each part of a file.
+The end of archive block is removed from all but the last volume. The volume numbers in the RAR headers must be in sequence.
+Split 7Z archives store their size in the signature header, the joined pieces must not be shorter.
+Split ZIP archives store offsets relative to the volume, a new central directory with the offsets in the joined file is appended.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContainerVolume is a volume of a multi-volume or split archive
+type ContainerVolume struct {
+	Reader io.ReaderAt
+	Size   int64
+}
+
+// ContainerExtractVolumes extracts files from archives that are split into multiple volumes: multi-volume RAR, split 7Z and split ZIP.
+// The volumes must be in order, starting with the first one. Use ContainerVolumeNames to find and order the volumes via their names.
+// Files that span multiple volumes are extracted as one. A single volume is extracted like ContainerExtractReader does, with all its supported containers.
+// Missing volumes result in a *ConversionError. RAR archives with encrypted headers are only supported as single volume.
+func ContainerExtractVolumes(volumes []ContainerVolume, callback func(file *ContainerFile) error) (err error) {
+	return ContainerExtractVolumesContext(context.Background(), volumes, callback)
+}
+
+// ContainerExtractVolumesContext is the same as ContainerExtractVolumes, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for the decompressed bytes, see ContainerExtractReaderContext.
+func ContainerExtractVolumesContext(ctx context.Context, volumes []ContainerVolume, callback func(file *ContainerFile) error) (err error) {
+	if len(volumes) == 0 {
+		return ErrUnsupportedFormat
+	}
+
+	file, size, err := containerJoinVolumes(volumes)
+	if err != nil {
+		return err
+	}
+
+	return ContainerExtractReaderContext(ctx, file, size, callback)
+}
+
+// ContainerExtractVolumeFiles extracts the archive that the file belongs to. Path is any volume of the archive, the other volumes are searched in the same directory.
+// See ContainerVolumeNames for the supported names. Files that are not part of a multi-volume archive are extracted on their own. Gaps in the volume names result in a *ConversionError.
+func ContainerExtractVolumeFiles(path string, callback func(file *ContainerFile) error) (err error) {
+	return ContainerExtractVolumeFilesContext(context.Background(), path, callback)
+}
+
+// ContainerExtractVolumeFilesContext is the same as ContainerExtractVolumeFiles, but stops once the context is cancelled and returns its error.
+func ContainerExtractVolumeFilesContext(ctx context.Context, path string, callback func(file *ContainerFile) error) (err error) {
+	directory, name := filepath.Split(path)
+
+	infos, err := ioutil.ReadDir(filepath.Clean(directory))
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+
+	volumeNames := ContainerVolumeNames(name, names)
+	if len(volumeNames) == 0 {
+		volumeNames = []string{name}
+	} else if missing := volumeMissing(volumeNames); missing > 0 {
+		return &ConversionError{Kind: ErrCorrupt, Err: errors.New("volume " + strconv.Itoa(missing) + " is missing")}
+	}
+
+	var volumes []ContainerVolume
+	for _, volumeName := range volumeNames {
+		file, err := os.Open(filepath.Join(directory, volumeName))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, ContainerVolume{Reader: file, Size: info.Size()})
+	}
+
+	return ContainerExtractVolumesContext(ctx, volumes, callback)
+}
+
+// volumePatterns are the names of volumes. The first group is the name of the archive, the second one the number of the volume.
+// Volumes of RAR 3 and newer are named .part1.rar, .part2.rar. Older versions use .rar, .r00 to .r99, .s00 and so on.
+// Split ZIP archives use .z01, .z02 and .zip for the last volume. Other archives are split into pieces named .001, .002.
+var volumePatterns = []struct {
+	pattern *regexp.Regexp
+	set     string // identifies the volume set together with the name of the archive
+}{
+	{regexp.MustCompile(`(?i)^(.+)\.part(\d+)\.rar$`), ".part.rar"},
+	{regexp.MustCompile(`(?i)^(.+)\.(rar|[r-y]\d\d)$`), ".rar"},
+	{regexp.MustCompile(`(?i)^(.+)\.(zip|z\d\d)$`), ".zip"},
+	{regexp.MustCompile(`^(.+)\.(\d{3,})$`), ".001"},
+}
+
+// ContainerVolumeNames returns the names of all volumes of the archive in order. Name is any volume of the archive, names are the files in the same directory.
+// Supported are multi-volume RAR (.part1.rar or .rar, .r00), split ZIP (.z01, .zip) and archives split into pieces (.7z.001, .zip.001).
+// Names are compared case-insensitive. If the name is not part of a multi-volume archive, nil is returned.
+func ContainerVolumeNames(name string, names []string) (volumes []string) {
+	set, _, ok := volumeNumber(name)
+	if !ok {
+		return nil
+	}
+
+	numbers := make(map[string]int)
+	for _, candidate := range append(append([]string(nil), names...), name) {
+		if candidateSet, number, ok := volumeNumber(candidate); ok && candidateSet == set {
+			if _, exists := numbers[candidate]; !exists {
+				volumes = append(volumes, candidate)
+			}
+			numbers[candidate] = number
+		}
+	}
+	if len(volumes) < 2 {
+		return nil
+	}
+
+	sort.SliceStable(volumes, func(i, j int) bool { return numbers[volumes[i]] < numbers[volumes[j]] })
+	return volumes
+}
+
+// volumeNumber returns the volume set and the position of the volume in it
+func volumeNumber(name string) (set string, number int, ok bool) {
+	for _, volumePattern := range volumePatterns {
+		match := volumePattern.pattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+
+		suffix := strings.ToLower(match[2])
+		switch {
+		case suffix == "rar":
+			number = 0
+		case suffix == "zip":
+			number = 1 << 30 // The last volume
+		case volumePattern.set == ".rar":
+			// .r00 is the second volume
+			number = int(suffix[0]-'r')*100 + int(suffix[1]-'0')*10 + int(suffix[2]-'0') + 1
+		case volumePattern.set == ".zip":
+			number, _ = strconv.Atoi(suffix[1:])
+		default:
+			if number, _ = strconv.Atoi(suffix); number > 1<<29 {
+				return "", 0, false
+			}
+		}
+
+		return strings.ToLower(match[1]) + volumePattern.set, number, true
+	}
+
+	return "", 0, false
+}
+
+// volumeMissing returns the position of the first missing volume starting at 1, or 0 if none is missing. The volume names must be in order as returned by ContainerVolumeNames.
+func volumeMissing(names []string) (missing int) {
+	for n, name := range names {
+		set, number, _ := volumeNumber(name)
+
+		expected := n + 1
+		switch {
+		case strings.HasSuffix(set, ".part.rar"):
+		case strings.HasSuffix(set, ".rar"):
+			// Volumes of old RAR archives start with .rar as 0
+			expected = n
+		case number == 1<<30 && n == len(names)-1:
+			// .zip is the last volume of split ZIP archives
+			continue
+		}
+
+		if number != expected {
+			return n + 1
+		}
+	}
+
+	return 0
+}
+
+// containerJoinVolumes joins the volumes to a single file
+func containerJoinVolumes(volumes []ContainerVolume) (file io.ReaderAt, size int64, err error) {
+	if len(volumes) == 1 {
+		return volumes[0].Reader, volumes[0].Size, nil
+	}
+
+	joined := &volumeReader{}
+	header := make([]byte, 8)
+	volumes[0].Reader.ReadAt(header, 0)
+
+	if bytes.HasPrefix(header, []byte("Rar!\x1A\x07")) {
+		// The file headers are repeated in each volume for the parts of the file. rardecode merges the parts.
+		for n, volume := range volumes {
+			archive, err := rarReadHeaders(volume.Reader, volume.Size)
+			if err != nil {
+				return nil, 0, newConversionError(FormatRAR, ErrCorrupt, err)
+			} else if archive.encryptedHeaders {
+				return nil, 0, newConversionError(FormatRAR, ErrUnsupportedVersion, errors.New("multi-volume archives with encrypted headers are not supported"))
+			} else if archive.volume >= 0 && archive.volume != n {
+				return nil, 0, &ConversionError{Format: FormatRAR, Kind: ErrCorrupt, Err: errors.New("volume " + strconv.Itoa(n+1) + " is missing")}
+			} else if n == len(volumes)-1 && archive.nextVolume {
+				return nil, 0, &ConversionError{Format: FormatRAR, Kind: ErrCorrupt, Err: errors.New("volume " + strconv.Itoa(n+2) + " is missing")}
+			}
+
+			start, end := int64(0), archive.end
+			if n > 0 {
+				start = archive.start
+			}
+			if n == len(volumes)-1 {
+				end = volume.Size
+			}
+			joined.add(volume.Reader, start, end-start)
+		}
+
+		return joined, joined.size, nil
+	}
+
+	starts := make([]int64, len(volumes))
+	for n, volume := range volumes {
+		starts[n] = joined.size
+		joined.add(volume.Reader, 0, volume.Size)
+	}
+
+	if bytes.HasPrefix(header, []byte("7z\xBC\xAF\x27\x1C")) {
+		// Pieces of a split 7Z archive have no headers, but the size of the archive is known
+		if archiveSize, err := sevenZipSize(joined, joined.size); err == nil && archiveSize > joined.size {
+			return nil, 0, &ConversionError{Format: Format7Z, Kind: ErrCorrupt, Err: errors.New("volumes are missing")}
+		}
+	} else if bytes.HasPrefix(header, []byte("PK\x07\x08")) || IsFileZIP(header) {
+		directory, err := zipSplitDirectory(joined, starts, joined.size)
+		if err != nil {
+			return nil, 0, newConversionError(FormatZIP, ErrCorrupt, err)
+		} else if directory != nil {
+			joined.add(bytes.NewReader(directory), 0, int64(len(directory)))
+		}
+	}
+
+	return joined, joined.size, nil
+}
+
+// volumeReader is a ReaderAt of parts of multiple files joined together
+type volumeReader struct {
+	parts []volumePart
+	size  int64
+}
+
+// volumePart is a part of a file at the offset of the joined file
+type volumePart struct {
+	reader io.ReaderAt
+	start  int64 // offset in the file
+	size   int64
+	offset int64 // offset in the joined file
+}
+
+func (r *volumeReader) add(reader io.ReaderAt, start, size int64) {
+	if size > 0 {
+		r.parts = append(r.parts, volumePart{reader: reader, start: start, size: size, offset: r.size})
+		r.size += size
+	}
+}
+
+func (r *volumeReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	// first part that ends after the offset
+	index := sort.Search(len(r.parts), func(i int) bool { return r.parts[i].offset+r.parts[i].size > off })
+
+	for ; n < len(p) && index < len(r.parts); index++ {
+		part := r.parts[index]
+		partOffset := off + int64(n) - part.offset
+		length := int64(len(p) - n)
+		if length > part.size-partOffset {
+			length = part.size - partOffset
+		}
+
+		read, err := part.reader.ReadAt(p[n:n+int(length)], part.start+partOffset)
+		n += read
+		if read < int(length) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -1,135 +1,274 @@
-/*
-File Name:  XLS 2 Text.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-
-The code originally used https://github.com/extrame/xls, which revealed multiple bugs that crashed for certain Excel files.
-Now it forks the xls package and the underlying ole2 package. This fork also fixes excessive memory usage issues.
-*/
-
-package fileconversion
-
-import (
-	"bytes"
-	"fmt"
-	"io"
-	"strings"
-
-	"github.com/IntelligenceX/fileconversion/xls"
-)
-
-// XLS2Text extracts text from an Excel sheet. It returns bytes written.
-// The parameter size is the max amount of bytes (not characters) to write out.
-// The whole Excel file is required even for partial text extraction. This function returns no error with 0 bytes written in case of corrupted or invalid file.
-func XLS2Text(reader io.ReadSeeker, writer io.Writer, size int64) (written int64, err error) {
-
-	xlFile, err := xls.OpenReader(reader, "utf-8")
-	if err != nil || xlFile == nil {
-		return 0, err
-	}
-
-	for n := 0; n < xlFile.NumSheets(); n++ {
-		if sheet1 := xlFile.GetSheet(n); sheet1 != nil {
-			if err = writeOutput(writer, []byte(xlGenerateSheetTitle(sheet1.Name, n, int(sheet1.MaxRow))), &written, &size); err != nil || size == 0 {
-				return written, err
-			}
-
-			for m := 0; m <= int(sheet1.MaxRow); m++ {
-				row1 := sheet1.Row(m)
-				if row1 == nil {
-					continue
-				}
-
-				rowText := ""
-
-				// go through all columns
-				for c := row1.FirstCol(); c < row1.LastCol(); c++ {
-					if text := row1.Col(c); text != "" {
-						text = cleanCell(text)
-
-						if c > row1.FirstCol() {
-							rowText += ", "
-						}
-						rowText += text
-					}
-				}
-
-				rowText += "\n"
-
-				if err = writeOutput(writer, []byte(rowText), &written, &size); err != nil || size == 0 {
-					return written, err
-				}
-			}
-		}
-	}
-
-	return written, nil
-}
-
-// cleanCell returns a cleaned cell text without new-lines
-func cleanCell(text string) string {
-	text = strings.ReplaceAll(text, "\n", " ")
-	text = strings.ReplaceAll(text, "\r", "")
-	text = strings.TrimSpace(text)
-
-	return text
-}
-
-func xlGenerateSheetTitle(name string, number, rows int) (title string) {
-	if number > 0 {
-		title += "\n"
-	}
-
-	title += fmt.Sprintf("Sheet \"%s\" (%d rows):\n", name, rows)
-
-	return title
-}
-
-func writeOutput(writer io.Writer, output []byte, alreadyWritten *int64, size *int64) (err error) {
-
-	if int64(len(output)) > *size {
-		output = output[:*size]
-	}
-
-	*size -= int64(len(output))
-
-	writtenOut, err := writer.Write(output)
-	*alreadyWritten += int64(writtenOut)
-
-	return err
-}
-
-// IsFileXLS checks if the data indicates a XLS file
-// XLS has a signature of D0 CF 11 E0 A1 B1 1A E1
-func IsFileXLS(data []byte) bool {
-	return bytes.HasPrefix(data, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
-}
-
-// XLS2Cells converts an XLS file to individual cells
-func XLS2Cells(reader io.ReadSeeker) (cells []string, err error) {
-
-	xlFile, err := xls.OpenReader(reader, "utf-8")
-	if err != nil || xlFile == nil {
-		return nil, err
-	}
-
-	for n := 0; n < xlFile.NumSheets(); n++ {
-		if sheet1 := xlFile.GetSheet(n); sheet1 != nil {
-			for m := 0; m <= int(sheet1.MaxRow); m++ {
-				row1 := sheet1.Row(m)
-				if row1 == nil {
-					continue
-				}
-
-				for c := row1.FirstCol(); c < row1.LastCol(); c++ {
-					if text := row1.Col(c); text != "" {
-						text = cleanCell(text)
-						cells = append(cells, text)
-					}
-				}
-			}
-		}
-	}
-
-	return
-}
+/*
+File Name:  XLS 2 Text.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+
+The code originally used https://github.com/extrame/xls, which revealed multiple bugs that crashed for certain Excel files.
+Now it forks the xls package and the underlying ole2 package. This fork also fixes excessive memory usage issues.
+*/
+
+package fileconversion
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/IntelligenceX/fileconversion/xls"
+)
+
+// XLS2Text extracts text from an Excel sheet. It returns bytes written.
+// The parameter size is the max amount of bytes (not characters) to write out.
+// The whole Excel file is required even for partial text extraction. Invalid and encrypted files return a *ConversionError.
+func XLS2Text(reader io.ReadSeeker, writer io.Writer, size int64) (written int64, err error) {
+	return XLS2TextContext(context.Background(), reader, writer, size)
+}
+
+// XLS2TextContext is the same as XLS2Text, but stops once the context is cancelled and returns its error.
+// The budget of the context is charged for allocations and cells.
+func XLS2TextContext(ctx context.Context, reader io.ReadSeeker, writer io.Writer, size int64) (written int64, err error) {
+	defer recoverPanic(FormatXLS, &err)
+
+	xlFile, err := xlsOpen(ctx, reader)
+	if err != nil {
+		return 0, err
+	}
+
+	for n := 0; n < xlFile.NumSheets(); n++ {
+		sheet1, err := xlsSheet(ctx, xlFile, n)
+		if err != nil {
+			return written, err
+		}
+
+		if sheet1 != nil {
+			if err = writeOutput(writer, []byte(xlGenerateSheetTitle(sheet1.Name, n, int(sheet1.MaxRow))), &written, &size); err != nil || size == 0 {
+				return written, err
+			}
+
+			for m := 0; m <= int(sheet1.MaxRow); m++ {
+				row1 := sheet1.Row(m)
+				if row1 == nil {
+					continue
+				}
+
+				rowText := ""
+
+				// go through all columns
+				for c := row1.FirstCol(); c < row1.LastCol(); c++ {
+					if text := row1.Col(c); text != "" {
+						text = cleanCell(text)
+
+						if c > row1.FirstCol() {
+							rowText += ", "
+						}
+						rowText += text
+					}
+				}
+
+				rowText += "\n"
+
+				if err = writeOutput(writer, []byte(rowText), &written, &size); err != nil || size == 0 {
+					return written, err
+				}
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// XLS2Document extracts the structure of an Excel file. Each sheet contains a single table.
+// Size is the full size of the input file. The budget of the context is charged for allocations and cells.
+func XLS2Document(ctx context.Context, file io.ReaderAt, size int64, options Options) (document *Document, err error) {
+	defer recoverPanic(FormatXLS, &err)
+
+	builder := newDocumentBuilder(FormatXLS, options)
+
+	xlFile, err := xlsOpen(ctx, io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return builder.result(err)
+	}
+
+	for n := 0; n < xlFile.NumSheets(); n++ {
+		sheet1, err := xlsSheet(ctx, xlFile, n)
+		if err != nil {
+			return builder.result(err)
+		} else if sheet1 == nil {
+			continue
+		}
+
+		builder.open(BlockSheet, sheet1.Name, n+1)
+		builder.table()
+
+		for m := 0; m <= int(sheet1.MaxRow); m++ {
+			row1 := sheet1.Row(m)
+			if row1 == nil {
+				continue
+			}
+
+			// The first columns are kept empty, so that the cells are aligned with the ones of other rows.
+			cells := make([]string, row1.LastCol())
+			for c := row1.FirstCol(); c < row1.LastCol(); c++ {
+				cells[c] = cleanCell(row1.Col(c))
+			}
+
+			if err = builder.row(cells); err != nil {
+				return builder.result(err)
+			}
+		}
+	}
+
+	return builder.result(nil)
+}
+
+// xlsOpen opens the Excel file. The budget of the context is charged. Invalid and encrypted files return a *ConversionError.
+func xlsOpen(ctx context.Context, reader io.ReadSeeker) (xlFile *xls.WorkBook, err error) {
+	xlFile, err = xls.OpenReaderBudget(ctx, reader, "utf-8", BudgetFromContext(ctx))
+	if err != nil {
+		return nil, newConversionError(FormatXLS, ErrCorrupt, err)
+	} else if xlFile == nil {
+		return nil, &ConversionError{Format: FormatXLS, Kind: ErrCorrupt, Err: errors.New("workbook stream not found")}
+	} else if xlFile.Encrypted {
+		return nil, &ConversionError{Format: FormatXLS, Kind: ErrEncrypted}
+	}
+
+	return xlFile, nil
+}
+
+// xlsSheet parses the sheet. Parsing of the sheet stops if the context is cancelled or the budget is exceeded, which is returned as error.
+func xlsSheet(ctx context.Context, xlFile *xls.WorkBook, n int) (sheet *xls.WorkSheet, err error) {
+	sheet = xlFile.GetSheet(n)
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	} else if err = xlFile.Err(); err != nil {
+		return nil, newConversionError(FormatXLS, ErrBudgetExceeded, err)
+	}
+
+	return sheet, nil
+}
+
+// xlsMetadata extracts the metadata from the SummaryInformation stream. If it does not contain an author, the user name of the workbook is used.
+func xlsMetadata(file io.ReaderAt, size int64) (metadata DocumentMetadata, err error) {
+	defer recoverPanic(FormatXLS, &err)
+
+	if metadata, err = ole2Metadata(FormatXLS, file, size); err != nil || len(metadata.Authors) > 0 {
+		return metadata, err
+	}
+
+	// The workbook stream of encrypted files is not parsed. The metadata of the SummaryInformation stream is still returned.
+	if xlFile, err := xlsOpen(context.Background(), io.NewSectionReader(file, 0, size)); err == nil && xlFile.Author != "" {
+		metadata.Authors = []string{xlFile.Author}
+	}
+
+	return metadata, nil
+}
+
+// cleanCell returns a cleaned cell text without new-lines
+func cleanCell(text string) string {
+	text = strings.ReplaceAll(text, "\n", " ")
+	text = strings.ReplaceAll(text, "\r", "")
+	text = strings.TrimSpace(text)
+
+	return text
+}
+
+func xlGenerateSheetTitle(name string, number, rows int) (title string) {
+	if number > 0 {
+		title += "\n"
+	}
+
+	title += fmt.Sprintf("Sheet \"%s\" (%d rows):\n", name, rows)
+
+	return title
+}
+
+// writeOutput writes the output and decreases the remaining size. If the output exceeds the size, it is cut at a rune boundary and the size is set to 0.
+func writeOutput(writer io.Writer, output []byte, alreadyWritten *int64, size *int64) (err error) {
+	if err = writeOutputLimit(writer, output, alreadyWritten, size); err == ErrLimitReached {
+		err = nil
+	}
+
+	return err
+}
+
+// writeOutputLimit is the same as writeOutput, but returns ErrLimitReached if the output was truncated
+func writeOutputLimit(writer io.Writer, output []byte, alreadyWritten *int64, size *int64) (err error) {
+	truncated := false
+
+	if int64(len(output)) > *size {
+		output = truncateUTF8(output, *size)
+		truncated = true
+	}
+
+	*size -= int64(len(output))
+
+	writtenOut, err := writer.Write(output)
+	*alreadyWritten += int64(writtenOut)
+
+	if truncated {
+		// The remaining bytes may be less than a full rune. Nothing more can be written.
+		*size = 0
+
+		if err == nil {
+			err = ErrLimitReached
+		}
+	}
+
+	return err
+}
+
+// truncateUTF8 cuts the data to max n bytes without splitting a UTF-8 sequence. Invalid UTF-8 is cut at n.
+func truncateUTF8(data []byte, n int64) []byte {
+	if int64(len(data)) <= n {
+		return data
+	}
+
+	for cut := n; cut >= 0 && cut > n-utf8.UTFMax; cut-- {
+		if utf8.RuneStart(data[cut]) {
+			return data[:cut]
+		}
+	}
+
+	return data[:n]
+}
+
+// IsFileXLS checks if the data indicates a XLS file
+// XLS has a signature of D0 CF 11 E0 A1 B1 1A E1
+func IsFileXLS(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+}
+
+// XLS2Cells converts an XLS file to individual cells
+func XLS2Cells(reader io.ReadSeeker) (cells []string, err error) {
+	defer recoverPanic(FormatXLS, &err)
+
+	xlFile, err := xls.OpenReader(reader, "utf-8")
+	if err != nil || xlFile == nil {
+		return nil, err
+	}
+
+	for n := 0; n < xlFile.NumSheets(); n++ {
+		if sheet1 := xlFile.GetSheet(n); sheet1 != nil {
+			for m := 0; m <= int(sheet1.MaxRow); m++ {
+				row1 := sheet1.Row(m)
+				if row1 == nil {
+					continue
+				}
+
+				for c := row1.FirstCol(); c < row1.LastCol(); c++ {
+					if text := row1.Col(c); text != "" {
+						text = cleanCell(text)
+						cells = append(cells, text)
+					}
+				}
+			}
+		}
+	}
+
+	return
+}
@@ -1,16 +1,506 @@
-/*
-File Name:  ZIP.go
-Copyright:  2019 Kleissner Investments s.r.o.
-Author:     Peter Kleissner
-*/
-
-package fileconversion
-
-import "bytes"
-
-// IsFileZIP checks if the data indicates a ZIP file.
-// Many file formats like DOCX, XLSX, PPTX and APK are actual ZIP files.
-// Signature 50 4B 03 04
-func IsFileZIP(data []byte) bool {
-	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04})
-}
+/*
+File Name:  ZIP.go
+Copyright:  2019 Kleissner Investments s.r.o.
+Author:     Peter Kleissner
+*/
+
+package fileconversion
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"unicode/utf8"
+)
+
+// IsFileZIP checks if the data indicates a ZIP file.
+// Many file formats like DOCX, XLSX, PPTX and APK are actual ZIP files.
+// Signature 50 4B 03 04
+func IsFileZIP(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04})
+}
+
+// zipOpenEncrypted tries the passwords for an encrypted file of the ZIP archive. File is the archive. It returns a reader of the decrypted and decompressed data and the password that worked.
+// If none of the passwords works, ErrPasswordRequired is returned.
+func zipOpenEncrypted(ctx context.Context, f *zip.File, file io.ReaderAt, passwords []string) (reader io.ReadCloser, password string, err error) {
+	if f.Flags&0x40 != 0 {
+		return nil, "", newConversionError(FormatZIP, ErrUnsupportedVersion, errors.New("strong encryption is not supported"))
+	}
+
+	for _, password = range passwords {
+		// The check value stored in the file header rejects most wrong passwords. The remaining ones are detected by the checksum or authentication code of the whole file.
+		if reader, err = zipDecrypt(f, file, password); err != nil {
+			return nil, "", err
+		} else if reader == nil {
+			continue
+		}
+
+		valid := passwordVerify(ctx, reader, int64(f.CompressedSize64))
+		reader.Close()
+
+		if valid {
+			reader, err = zipDecrypt(f, file, password)
+			return reader, password, err
+		}
+	}
+
+	return nil, "", &ConversionError{Format: FormatZIP, Kind: ErrPasswordRequired}
+}
+
+// zipDecrypt returns a reader of the decrypted and decompressed data. If the check value of the password does not match, nil is returned.
+// It supports ZipCrypto and WinZip AES with the compression methods store, deflate and bzip2.
+func zipDecrypt(f *zip.File, file io.ReaderAt, password string) (reader io.ReadCloser, err error) {
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, newConversionError(FormatZIP, ErrCorrupt, err)
+	}
+	size := int64(f.CompressedSize64)
+
+	encrypted := &zipEncryptedReader{crc: crc32.NewIEEE(), expected: f.CRC32, checkCRC: true}
+	method := f.Method
+	var decrypted io.Reader
+
+	if f.Method == zipMethodAES {
+		// WinZip AES stores the actual compression method in an extra field. The data starts with the salt and the password verification value, and ends with the authentication code.
+		version, strength, actualMethod, ok := zipAESExtra(f.Extra)
+		if !ok || strength < 1 || strength > 3 {
+			return nil, newConversionError(FormatZIP, ErrUnsupportedVersion, errors.New("invalid AES extra field"))
+		}
+		method = actualMethod
+		saltSize, keySize := int64(4+4*strength), 8+8*strength
+
+		if size < saltSize+2+zipAESAuthSize {
+			return nil, newConversionError(FormatZIP, ErrCorrupt, io.ErrUnexpectedEOF)
+		}
+
+		header := make([]byte, saltSize+2)
+		encrypted.authCode = make([]byte, zipAESAuthSize)
+		if _, err = file.ReadAt(header, offset); err == nil {
+			_, err = file.ReadAt(encrypted.authCode, offset+size-zipAESAuthSize)
+		}
+		if err != nil {
+			return nil, newConversionError(FormatZIP, ErrCorrupt, err)
+		}
+
+		keys := pbkdf2SHA1([]byte(password), header[:saltSize], 1000, 2*keySize+2)
+		if !bytes.Equal(keys[2*keySize:], header[saltSize:]) {
+			return nil, nil
+		}
+
+		block, err := aes.NewCipher(keys[:keySize])
+		if err != nil {
+			return nil, err
+		}
+		encrypted.mac = hmac.New(sha1.New, keys[keySize:2*keySize])
+		// AE-2 does not store the CRC, the authentication code is used instead.
+		encrypted.checkCRC = version == 1
+
+		data := io.NewSectionReader(file, offset+saltSize+2, size-saltSize-2-zipAESAuthSize)
+		decrypted = &cipher.StreamReader{S: &zipAESStream{block: block, position: aes.BlockSize}, R: io.TeeReader(data, encrypted.mac)}
+	} else {
+		// ZipCrypto prepends a 12 byte header. Its last byte is the check value, which is part of the CRC or the modification time if the CRC is stored after the data.
+		if size < zipCryptoHeaderSize {
+			return nil, newConversionError(FormatZIP, ErrCorrupt, io.ErrUnexpectedEOF)
+		}
+
+		header := make([]byte, zipCryptoHeaderSize)
+		if _, err = file.ReadAt(header, offset); err != nil {
+			return nil, newConversionError(FormatZIP, ErrCorrupt, err)
+		}
+
+		keys := newZipCryptoKeys(password)
+		keys.decrypt(header)
+
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&0x8 != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		if header[zipCryptoHeaderSize-1] != check {
+			return nil, nil
+		}
+
+		decrypted = &zipCryptoReader{keys: keys, reader: io.NewSectionReader(file, offset+zipCryptoHeaderSize, size-zipCryptoHeaderSize)}
+	}
+
+	switch method {
+	case zip.Store:
+		encrypted.reader = decrypted
+	case zip.Deflate:
+		decompressor := flate.NewReader(decrypted)
+		encrypted.reader, encrypted.closer = decompressor, decompressor
+	case zipMethodBZIP2:
+		encrypted.reader = bzip2.NewReader(decrypted)
+	default:
+		return nil, newConversionError(FormatZIP, ErrUnsupportedVersion, zip.ErrAlgorithm)
+	}
+
+	return encrypted, nil
+}
+
+// ZIP compression methods that are not defined in archive/zip
+const (
+	zipMethodBZIP2 = 12
+	zipMethodAES   = 99 // WinZip AES encryption, the actual method is stored in the extra field
+)
+
+const (
+	zipCryptoHeaderSize = 12     // size of the encryption header of ZipCrypto
+	zipAESAuthSize      = 10     // size of the authentication code of WinZip AES
+	zipExtraAES         = 0x9901 // ID of the WinZip AES extra field
+	zipExtraUnicodePath = 0x7075 // ID of the Info-ZIP Unicode Path extra field
+	zipFlagUTF8         = 0x0800 // The name and comment are UTF-8
+)
+
+// Signatures, extra field and limits of the central directory and its end records
+const (
+	zipSignatureEnd     = 0x06054B50
+	zipSignatureEnd64   = 0x06064B50
+	zipSignatureLocator = 0x07064B50
+	zipSignatureCentral = 0x02014B50
+	zipExtraZIP64       = 0x0001     // ID of the ZIP64 extra field with the 64-bit sizes, offset and disk number
+	zipMaxEndSearch     = 22 + 65535 // The record is followed by the comment
+)
+
+// zipSplitDirectory returns a central directory for a split ZIP archive, which is appended to the volumes. File is the volumes joined together, starts are the offsets of the volumes.
+// The offsets of split archives are relative to the volume that contains the header. The new directory has the offsets in the joined file and only refers to disk 0.
+// If the archive is not split, nil is returned.
+func zipSplitDirectory(file io.ReaderAt, starts []int64, size int64) (directory []byte, err error) {
+	// The end of central directory record is in the last volume, followed by the comment
+	tailStart := starts[len(starts)-1]
+	if size-tailStart > zipMaxEndSearch {
+		tailStart = size - zipMaxEndSearch
+	}
+	tail := make([]byte, size-tailStart)
+	if _, err = file.ReadAt(tail, tailStart); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	end := -1
+	for n := len(tail) - 22; n >= 0; n-- {
+		if binary.LittleEndian.Uint32(tail[n:]) == zipSignatureEnd && n+22+int(binary.LittleEndian.Uint16(tail[n+20:])) == len(tail) {
+			end = n
+			break
+		}
+	}
+	if end < 0 || binary.LittleEndian.Uint16(tail[end+4:]) == 0 {
+		return nil, nil
+	}
+
+	// Disk number (2), disk of the directory (2), entries on this disk (2), entries (2), size (4), offset (4), comment size (2)
+	record := tail[end:]
+	directoryDisk := uint64(binary.LittleEndian.Uint16(record[6:]))
+	directorySize := uint64(binary.LittleEndian.Uint32(record[12:]))
+	directoryOffset := uint64(binary.LittleEndian.Uint32(record[16:]))
+	comment := record[22:]
+
+	if end >= 20 && binary.LittleEndian.Uint32(tail[end-20:]) == zipSignatureLocator {
+		// The ZIP64 locator has the disk (4) and offset (8) of the ZIP64 end of central directory record, which has the 64-bit fields
+		locator := tail[end-20:]
+		disk, offset := uint64(binary.LittleEndian.Uint32(locator[4:])), binary.LittleEndian.Uint64(locator[8:])
+		if disk >= uint64(len(starts)) {
+			return nil, errors.New("invalid ZIP64 locator")
+		}
+
+		record64 := make([]byte, 56)
+		if _, err = file.ReadAt(record64, starts[disk]+int64(offset)); err != nil || binary.LittleEndian.Uint32(record64) != zipSignatureEnd64 {
+			return nil, errors.New("invalid ZIP64 end of central directory")
+		}
+		directoryDisk = uint64(binary.LittleEndian.Uint32(record64[20:]))
+		directorySize = binary.LittleEndian.Uint64(record64[40:])
+		directoryOffset = binary.LittleEndian.Uint64(record64[48:])
+	}
+
+	if directoryDisk >= uint64(len(starts)) || directorySize > uint64(size) || directoryOffset > uint64(size) {
+		return nil, errors.New("invalid end of central directory")
+	}
+	original := make([]byte, directorySize)
+	if _, err = file.ReadAt(original, starts[directoryDisk]+int64(directoryOffset)); err != nil {
+		return nil, err
+	}
+
+	// Rewrite the entries. Values that do not fit into the 32-bit fields are stored in the ZIP64 extra field.
+	var buffer bytes.Buffer
+	var entries uint64
+	for len(original) >= 46 && binary.LittleEndian.Uint32(original) == zipSignatureCentral {
+		nameSize := int(binary.LittleEndian.Uint16(original[28:]))
+		extraSize := int(binary.LittleEndian.Uint16(original[30:]))
+		commentSize := int(binary.LittleEndian.Uint16(original[32:]))
+		if len(original) < 46+nameSize+extraSize+commentSize {
+			return nil, errors.New("invalid central directory")
+		}
+		header := append([]byte(nil), original[:46]...)
+		name := original[46 : 46+nameSize]
+		extra := original[46+nameSize : 46+nameSize+extraSize]
+		fileComment := original[46+nameSize+extraSize : 46+nameSize+extraSize+commentSize]
+		original = original[46+nameSize+extraSize+commentSize:]
+
+		// The ZIP64 extra field only has the values whose 32-bit field is 0xFFFFFFFF (0xFFFF for the disk), in this order
+		values := []uint64{uint64(binary.LittleEndian.Uint32(header[24:])), uint64(binary.LittleEndian.Uint32(header[20:])), uint64(binary.LittleEndian.Uint32(header[42:])), uint64(binary.LittleEndian.Uint16(header[34:]))}
+		var otherExtra []byte
+		for len(extra) >= 4 {
+			id := binary.LittleEndian.Uint16(extra)
+			fieldSize := int(binary.LittleEndian.Uint16(extra[2:]))
+			if len(extra) < 4+fieldSize {
+				break
+			}
+
+			if field := extra[4 : 4+fieldSize]; id == zipExtraZIP64 {
+				for n := range values {
+					if n < 3 && values[n] == 0xFFFFFFFF && len(field) >= 8 {
+						values[n], field = binary.LittleEndian.Uint64(field), field[8:]
+					} else if n == 3 && values[n] == 0xFFFF && len(field) >= 4 {
+						values[n] = uint64(binary.LittleEndian.Uint32(field))
+					}
+				}
+			} else {
+				otherExtra = append(otherExtra, extra[:4+fieldSize]...)
+			}
+			extra = extra[4+fieldSize:]
+		}
+
+		if values[3] >= uint64(len(starts)) {
+			return nil, errors.New("invalid disk number")
+		}
+		values[2] += uint64(starts[values[3]])
+
+		var zip64 []byte
+		for n, offset := range []int{24, 20, 42} {
+			if values[n] >= 0xFFFFFFFF {
+				binary.LittleEndian.PutUint32(header[offset:], 0xFFFFFFFF)
+				value := make([]byte, 8)
+				binary.LittleEndian.PutUint64(value, values[n])
+				zip64 = append(zip64, value...)
+			} else {
+				binary.LittleEndian.PutUint32(header[offset:], uint32(values[n]))
+			}
+		}
+		binary.LittleEndian.PutUint16(header[34:], 0)
+
+		newExtra := otherExtra
+		if len(zip64) > 0 {
+			newExtra = append([]byte{zipExtraZIP64, 0, byte(len(zip64)), 0}, append(zip64, otherExtra...)...)
+		}
+		if len(newExtra) > 0xFFFF {
+			return nil, errors.New("invalid extra field")
+		}
+		binary.LittleEndian.PutUint16(header[30:], uint16(len(newExtra)))
+
+		buffer.Write(header)
+		buffer.Write(name)
+		buffer.Write(newExtra)
+		buffer.Write(fileComment)
+		entries++
+	}
+
+	// The directory is appended to the joined volumes
+	directorySize, directoryOffset = uint64(buffer.Len()), uint64(size)
+	if entries >= 0xFFFF || directorySize >= 0xFFFFFFFF || directoryOffset >= 0xFFFFFFFF {
+		record64 := make([]byte, 56)
+		binary.LittleEndian.PutUint32(record64, zipSignatureEnd64)
+		binary.LittleEndian.PutUint64(record64[4:], 56-12)
+		binary.LittleEndian.PutUint16(record64[12:], 45)
+		binary.LittleEndian.PutUint16(record64[14:], 45)
+		binary.LittleEndian.PutUint64(record64[24:], entries)
+		binary.LittleEndian.PutUint64(record64[32:], entries)
+		binary.LittleEndian.PutUint64(record64[40:], directorySize)
+		binary.LittleEndian.PutUint64(record64[48:], directoryOffset)
+
+		locator := make([]byte, 20)
+		binary.LittleEndian.PutUint32(locator, zipSignatureLocator)
+		binary.LittleEndian.PutUint64(locator[8:], directoryOffset+directorySize)
+		binary.LittleEndian.PutUint32(locator[16:], 1)
+
+		buffer.Write(record64)
+		buffer.Write(locator)
+		entries, directorySize, directoryOffset = 0xFFFF, 0xFFFFFFFF, 0xFFFFFFFF
+	}
+
+	record = make([]byte, 22)
+	binary.LittleEndian.PutUint32(record, zipSignatureEnd)
+	binary.LittleEndian.PutUint16(record[8:], uint16(entries))
+	binary.LittleEndian.PutUint16(record[10:], uint16(entries))
+	binary.LittleEndian.PutUint32(record[12:], uint32(directorySize))
+	binary.LittleEndian.PutUint32(record[16:], uint32(directoryOffset))
+	binary.LittleEndian.PutUint16(record[20:], uint16(len(comment)))
+	buffer.Write(record)
+	buffer.Write(comment)
+
+	return buffer.Bytes(), nil
+}
+
+// zipNames returns the decoded names of the files. The Info-ZIP Unicode Path extra field takes precedence, otherwise names are UTF-8 if the flag is set or they are ASCII.
+// Otherwise the encoding is detected from all other non-ASCII names of the archive, which is returned for them.
+func zipNames(r *zip.Reader) (names, encodings []string) {
+	names = make([]string, len(r.File))
+	encodings = make([]string, len(r.File))
+
+	var legacy []int
+	var legacyNames []string
+	for n, f := range r.File {
+		names[n] = f.Name
+		// Tools that cannot store the name in the header often replace the characters by "?", which is ASCII. The Unicode Path field is checked first.
+		if name, ok := zipUnicodePath(f.Extra, f.Name); ok {
+			names[n] = name
+			continue
+		} else if f.Flags&zipFlagUTF8 != 0 || nameIsASCII(f.Name) {
+			continue
+		}
+		legacy = append(legacy, n)
+		legacyNames = append(legacyNames, f.Name)
+	}
+
+	if len(legacy) > 0 {
+		decoded, encoding := decodeNames(legacyNames)
+		for m, n := range legacy {
+			names[n], encodings[n] = decoded[m], encoding
+		}
+	}
+
+	return names, encodings
+}
+
+// zipUnicodePath returns the UTF-8 name of the Info-ZIP Unicode Path extra field: version (1), CRC-32 of the name in the header (4) and the name.
+// It is only valid if the checksum matches, otherwise the name was changed by a tool that did not update the field.
+func zipUnicodePath(extra []byte, name string) (unicodeName string, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+
+		if field := extra[4 : 4+size]; id == zipExtraUnicodePath && size > 5 && field[0] == 1 && binary.LittleEndian.Uint32(field[1:]) == crc32.ChecksumIEEE([]byte(name)) && utf8.Valid(field[5:]) {
+			return string(field[5:]), true
+		}
+		extra = extra[4+size:]
+	}
+
+	return "", false
+}
+
+// zipAESExtra parses the WinZip AES extra field. Strength 1, 2 and 3 are AES-128, AES-192 and AES-256.
+func zipAESExtra(extra []byte) (version, strength int, method uint16, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+
+		if field := extra[4 : 4+size]; id == zipExtraAES && size >= 7 {
+			return int(binary.LittleEndian.Uint16(field)), int(field[4]), binary.LittleEndian.Uint16(field[5:]), true
+		}
+		extra = extra[4+size:]
+	}
+
+	return 0, 0, 0, false
+}
+
+// zipEncryptedReader returns the decompressed data of an encrypted file and verifies the CRC and the authentication code at the end
+type zipEncryptedReader struct {
+	reader   io.Reader
+	closer   io.Closer // decompressor, if any
+	crc      hash.Hash32
+	expected uint32
+	checkCRC bool
+	mac      hash.Hash // HMAC of the encrypted data, only for WinZip AES
+	authCode []byte
+}
+
+func (r *zipEncryptedReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.crc.Write(p[:n])
+
+	if err == io.EOF {
+		if r.checkCRC && r.crc.Sum32() != r.expected {
+			err = zip.ErrChecksum
+		} else if r.mac != nil && !hmac.Equal(r.mac.Sum(nil)[:zipAESAuthSize], r.authCode) {
+			err = zip.ErrChecksum
+		}
+	}
+
+	return n, err
+}
+
+func (r *zipEncryptedReader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// zipAESStream is AES in counter mode as used by WinZip. Unlike cipher.NewCTR the counter is little endian and starts at 1.
+type zipAESStream struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keystream [aes.BlockSize]byte
+	position  int // position in the keystream, aes.BlockSize if the next block is required
+}
+
+func (s *zipAESStream) XORKeyStream(dst, src []byte) {
+	for n := range src {
+		if s.position == aes.BlockSize {
+			for i := range s.counter {
+				s.counter[i]++
+				if s.counter[i] != 0 {
+					break
+				}
+			}
+			s.block.Encrypt(s.keystream[:], s.counter[:])
+			s.position = 0
+		}
+
+		dst[n] = src[n] ^ s.keystream[s.position]
+		s.position++
+	}
+}
+
+// zipCryptoKeys are the keys of the traditional PKWARE encryption (ZipCrypto)
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) (keys *zipCryptoKeys) {
+	keys = &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for n := 0; n < len(password); n++ {
+		keys.update(password[n])
+	}
+
+	return keys
+}
+
+func (keys *zipCryptoKeys) update(b byte) {
+	keys[0] = crc32.IEEETable[byte(keys[0])^b] ^ (keys[0] >> 8)
+	keys[1] = (keys[1]+keys[0]&0xFF)*134775813 + 1
+	keys[2] = crc32.IEEETable[byte(keys[2])^byte(keys[1]>>24)] ^ (keys[2] >> 8)
+}
+
+// decrypt decrypts the data in place
+func (keys *zipCryptoKeys) decrypt(data []byte) {
+	for n := range data {
+		temp := keys[2] | 2
+		data[n] ^= byte((temp * (temp ^ 1)) >> 8)
+		keys.update(data[n])
+	}
+}
+
+// zipCryptoReader decrypts data encrypted with ZipCrypto
+type zipCryptoReader struct {
+	keys   *zipCryptoKeys
+	reader io.Reader
+}
+
+func (r *zipCryptoReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.keys.decrypt(p[:n])
+	return n, err
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -18,6 +19,7 @@ type Options struct {
 	PrettyTables        bool                 // Turns on pretty ASCII rendering for table elements.
 	PrettyTablesOptions *PrettyTablesOptions // Configures pretty ASCII rendering for table elements.
 	OmitLinks           bool                 // Turns on omitting links
+	Markdown            bool                 // Turns on Markdown rendering of headings, lists, emphasis, links, tables and code blocks
 }
 
 // PrettyTablesOptions overrides tablewriter behaviors
@@ -77,9 +79,12 @@ func FromHTMLNode(doc *html.Node, o ...Options) (string, error) {
 		return "", err
 	}
 
-	text := strings.TrimSpace(newlineRe.ReplaceAllString(
-		strings.Replace(ctx.buf.String(), "\n ", "\n", -1), "\n\n"),
-	)
+	text := ctx.buf.String()
+	if !options.Markdown {
+		// Markdown uses leading spaces for nested lists.
+		text = strings.Replace(text, "\n ", "\n", -1)
+	}
+	text = strings.TrimSpace(newlineRe.ReplaceAllString(text, "\n\n"))
 	return text, nil
 }
 
@@ -125,6 +130,9 @@ type textifyTraverseContext struct {
 	lineLength      int
 	isPre           bool
 	isVirtualBQ     bool // virtual blockquote
+	listLevel       int  // nesting level of lists, used for Markdown
+	listOrdered     bool // current list is ordered, used for Markdown
+	listIndex       int  // number of the current list item, used for Markdown
 }
 
 // tableTraverseContext holds table ASCII-form related context.
@@ -147,6 +155,12 @@ func (tableCtx *tableTraverseContext) init() {
 func (ctx *textifyTraverseContext) handleElement(node *html.Node) error {
 	ctx.justClosedDiv = false
 
+	if ctx.options.Markdown {
+		if handled, err := ctx.handleMarkdownElement(node); handled {
+			return err
+		}
+	}
+
 	switch node.DataAtom {
 	case atom.Br:
 		return ctx.emit("\n")
@@ -321,9 +335,195 @@ func (ctx *textifyTraverseContext) paragraphHandler(node *html.Node) error {
 	return ctx.emit("\n\n")
 }
 
-// handleTableElement is only to be invoked when options.PrettyTables is active.
+// handleMarkdownElement renders the elements that are different in Markdown. It returns false for all other elements.
+func (ctx *textifyTraverseContext) handleMarkdownElement(node *html.Node) (handled bool, err error) {
+	switch node.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		str, err := ctx.renderChildren(node)
+		if err != nil || str == "" {
+			return true, err
+		}
+
+		level := int(node.Data[1] - '0')
+		return true, ctx.emit("\n\n" + strings.Repeat("#", level) + " " + strings.Join(strings.Fields(str), " ") + "\n\n")
+
+	case atom.Ul, atom.Ol:
+		if ctx.listLevel == 0 {
+			if err := ctx.emit("\n\n"); err != nil {
+				return true, err
+			}
+		}
+
+		listOrdered, listIndex := ctx.listOrdered, ctx.listIndex
+		ctx.listLevel++
+		ctx.listOrdered, ctx.listIndex = node.DataAtom == atom.Ol, 0
+
+		err := ctx.traverseChildren(node)
+
+		ctx.listLevel--
+		ctx.listOrdered, ctx.listIndex = listOrdered, listIndex
+
+		if err == nil && ctx.listLevel == 0 {
+			err = ctx.emit("\n\n")
+		}
+		return true, err
+
+	case atom.Li:
+		ctx.listIndex++
+		marker := "- "
+		if ctx.listOrdered {
+			marker = strconv.Itoa(ctx.listIndex) + ". "
+		}
+
+		indent := ""
+		if ctx.listLevel > 1 {
+			indent = strings.Repeat("    ", ctx.listLevel-1)
+		}
+
+		// Each item starts on a new line, without empty lines between the items.
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return true, err
+			}
+		}
+		if err := ctx.emit(indent + marker); err != nil {
+			return true, err
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return true, err
+		}
+		if ctx.lineLength > 0 {
+			return true, ctx.emit("\n")
+		}
+		return true, nil
+
+	case atom.B, atom.Strong, atom.I, atom.Em:
+		str, err := ctx.renderChildren(node)
+		if err != nil || str == "" {
+			return true, err
+		}
+
+		marker := "**"
+		if node.DataAtom == atom.I || node.DataAtom == atom.Em {
+			marker = "_"
+		}
+		return true, ctx.emit(marker + str + marker)
+
+	case atom.A:
+		var str string
+
+		// If image is the only child, take its alt text as the link text.
+		if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
+			str = getAttrVal(img, "alt")
+		} else if str, err = ctx.renderChildren(node); err != nil {
+			return true, err
+		}
+
+		href := strings.TrimSpace(getAttrVal(node, "href"))
+		switch {
+		case href == "" || ctx.options.OmitLinks:
+			return true, ctx.emit(str)
+		case str == "" || str == href || str == ctx.normalizeHrefLink(href):
+			return true, ctx.emit("<" + href + ">")
+		}
+
+		href = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(href)
+		return true, ctx.emit("[" + strings.Join(strings.Fields(str), " ") + "](" + href + ")")
+
+	case atom.Table, atom.Tfoot, atom.Th, atom.Tr, atom.Td:
+		return true, ctx.handleTableElement(node)
+
+	case atom.Pre:
+		subCtx := textifyTraverseContext{isPre: true, endsWithSpace: true}
+		if err := subCtx.traverseChildren(node); err != nil {
+			return true, err
+		}
+
+		str := strings.Trim(subCtx.buf.String(), "\n")
+		if str == "" {
+			return true, nil
+		}
+		return true, ctx.emit("\n\n```\n" + str + "\n```\n\n")
+
+	case atom.Code:
+		if ctx.isPre {
+			return true, ctx.traverseChildren(node)
+		}
+
+		subCtx := textifyTraverseContext{isPre: true, endsWithSpace: true}
+		if err := subCtx.traverseChildren(node); err != nil {
+			return true, err
+		}
+
+		str := strings.TrimSpace(subCtx.buf.String())
+		if str == "" {
+			return true, nil
+		}
+		return true, ctx.emit("`" + str + "`")
+
+	case atom.Hr:
+		return true, ctx.emit("\n\n---\n\n")
+	}
+
+	return false, nil
+}
+
+// renderChildren renders the children of the node with the same options and returns the trimmed text
+func (ctx *textifyTraverseContext) renderChildren(node *html.Node) (string, error) {
+	subCtx := textifyTraverseContext{options: ctx.options, endsWithSpace: true}
+	if err := subCtx.traverseChildren(node); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(subCtx.buf.String()), nil
+}
+
+// markdownTable renders the table as Markdown. If there is no header, the first row is used.
+func markdownTable(header []string, body [][]string, footer []string) string {
+	var rows [][]string
+	for _, row := range append(body, footer) {
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+
+	if len(header) == 0 {
+		if len(rows) == 0 {
+			return ""
+		}
+		header, rows = rows[0], rows[1:]
+	}
+
+	columns := len(header)
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	writeRow := func(row []string) {
+		for n := 0; n < columns; n++ {
+			buf.WriteString("| ")
+			if n < len(row) && strings.TrimSpace(row[n]) != "" {
+				buf.WriteString(strings.Replace(strings.Join(strings.Fields(row[n]), " "), "|", "\\|", -1) + " ")
+			}
+		}
+		buf.WriteString("|\n")
+	}
+
+	writeRow(header)
+	buf.WriteString(strings.Repeat("| --- ", columns) + "|\n")
+	for _, row := range rows {
+		writeRow(row)
+	}
+
+	return buf.String()
+}
+
+// handleTableElement is only to be invoked when options.PrettyTables or options.Markdown is active.
 func (ctx *textifyTraverseContext) handleTableElement(node *html.Node) error {
-	if !ctx.options.PrettyTables {
+	if !ctx.options.PrettyTables && !ctx.options.Markdown {
 		panic("handleTableElement invoked when PrettyTables not active")
 	}
 
@@ -341,6 +541,14 @@ func (ctx *textifyTraverseContext) handleTableElement(node *html.Node) error {
 			return err
 		}
 
+		if ctx.options.Markdown {
+			if err := ctx.emit(markdownTable(ctx.tableCtx.header, ctx.tableCtx.body, ctx.tableCtx.footer)); err != nil {
+				return err
+			}
+
+			return ctx.emit("\n\n")
+		}
+
 		buf := &bytes.Buffer{}
 		table := tablewriter.NewWriter(buf)
 		if ctx.options.PrettyTablesOptions != nil {
@@ -1028,3 +1028,47 @@ func Example() {
 	// |  FOOTER 1   |  FOOTER 2   |
 	// +-------------+-------------+
 }
+
+func TestMarkdown(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<h1>Test</h1><h3>Sub <i>heading</i></h3>",
+			"# Test\n\n### Sub _heading_",
+		},
+		{
+			"<p>Some <b>bold</b> text</p>",
+			"Some **bold** text",
+		},
+		{
+			`<a href="http://example.com/">Example</a> <a href="http://example.com/">http://example.com/</a>`,
+			"[Example](http://example.com/) <http://example.com/>",
+		},
+		{
+			"<ul><li>One</li><li>Two<ol><li>A</li><li>B</li></ol></li></ul>",
+			"- One\n- Two\n    1. A\n    2. B",
+		},
+		{
+			"<table><tr><th>Name</th><th>Value</th></tr><tr><td>a|b</td><td>1</td></tr></table>",
+			"| Name | Value |\n| --- | --- |\n| a\\|b | 1 |",
+		},
+		{
+			"<table><tr><td>1</td><td>2</td></tr><tr><td>3</td></tr></table>",
+			"| 1 | 2 |\n| --- | --- |\n| 3 | |",
+		},
+		{
+			"<p>Run <code>go test</code></p><pre>func main() {\n\treturn\n}</pre>",
+			"Run `go test`\n\n```\nfunc main() {\n\treturn\n}\n```",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{Markdown: true}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
@@ -17,14 +17,19 @@ type DocumentMeta struct {
 }
 
 type Meta struct {
-	Title string `xml:"title"`
-
-	InitialCreator Time `xml:"initial-creator"`
-	CreationDate   Time `xml:"creation-date"`
-
-	DcCreator string `xml:"dc creator"`
-	DcDate    string `xml:"dc date"`
-	DcLang    string `xml:"dc language"`
+	Title       string   `xml:"title"`
+	Subject     string   `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Description string   `xml:"http://purl.org/dc/elements/1.1/ description"`
+	Keywords    []string `xml:"keyword"`
+
+	InitialCreator Time   `xml:"initial-creator"`
+	CreationDate   Time   `xml:"creation-date"`
+	PrintedBy      string `xml:"printed-by"`
+	PrintDate      Time   `xml:"print-date"`
+
+	DcCreator string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	DcDate    string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	DcLang    string `xml:"http://purl.org/dc/elements/1.1/ language"`
 
 	EditingCycles   int    `xml:"editing-cycles"`
 	EditingDuration string `xml:"editing-duration"`
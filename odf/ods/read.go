@@ -31,24 +31,9 @@ type Row struct {
 	Cell []Cell `xml:",any"` // use ",any" to match table-cell and covered-table-cell
 }
 
-func (r *Row) IsEmpty() bool {
-	for _, c := range r.Cell {
-		if !c.IsEmpty() {
-			return false
-		}
-	}
-	return true
-}
-
-// Return the contents of a row as a slice of strings. Cells that are
-// covered by other cells will appear as empty strings.
-func (r *Row) Strings(b *bytes.Buffer) (row []string) {
+// trim removes trailing empty cells
+func (r *Row) trim() {
 	n := len(r.Cell)
-	if n == 0 {
-		return
-	}
-
-	// remove trailing empty cells
 	for i := n - 1; i >= 0; i-- {
 		if !r.Cell[i].IsEmpty() {
 			break
@@ -56,19 +41,40 @@ func (r *Row) Strings(b *bytes.Buffer) (row []string) {
 		n--
 	}
 	r.Cell = r.Cell[:n]
+}
 
-	n = 0
-	// calculate the real number of cells (including repeated)
+// width calculates the real number of cells (including repeated)
+func (r *Row) width() (n int) {
 	for _, c := range r.Cell {
 		switch {
-		case c.RepeatedCols != 0:
+		case c.RepeatedCols > 1:
 			n += c.RepeatedCols
 		default:
 			n++
 		}
 	}
+	return
+}
+
+func (r *Row) IsEmpty() bool {
+	for _, c := range r.Cell {
+		if !c.IsEmpty() {
+			return false
+		}
+	}
+	return true
+}
 
-	row = make([]string, n)
+// Return the contents of a row as a slice of strings. Cells that are
+// covered by other cells will appear as empty strings.
+func (r *Row) Strings(b *bytes.Buffer) (row []string) {
+	if len(r.Cell) == 0 {
+		return
+	}
+
+	r.trim()
+
+	row = make([]string, r.width())
 	w := 0
 	for _, c := range r.Cell {
 		cs := ""
@@ -191,6 +197,13 @@ func (t *Table) Height() int {
 	return len(t.Row)
 }
 func (t *Table) Strings() (s [][]string) {
+	s, _ = t.StringsBudget(nil)
+	return
+}
+
+// StringsBudget is the same as Strings, but charges all cells (including repeated) to the budget before they are allocated.
+// It stops and returns the error of the budget once it is exceeded.
+func (t *Table) StringsBudget(budget Budget) (s [][]string, err error) {
 	var b bytes.Buffer
 
 	n := len(t.Row)
@@ -209,12 +222,19 @@ func (t *Table) Strings() (s [][]string) {
 
 	n = 0
 	// calculate the real number of rows (including repeated rows)
-	for _, r := range t.Row {
-		switch {
-		case r.RepeatedRows != 0:
-			n += r.RepeatedRows
-		default:
-			n++
+	for i := range t.Row {
+		r := &t.Row[i]
+		repeated := 1
+		if r.RepeatedRows > 1 {
+			repeated = r.RepeatedRows
+		}
+		n += repeated
+
+		if budget != nil {
+			r.trim()
+			if err = budget.AddCells(int64(r.width()) * int64(repeated)); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -268,13 +288,45 @@ func newFile(f *odf.File) (*File, error) {
 // the returned Doc will contain the data of the rows and cells
 // of the table(s) contained in the ODS file.
 func (f *File) ParseContent(doc *Doc) (err error) {
+	return f.ParseContentBudget(doc, nil)
+}
+
+// ParseContentBudget is the same as ParseContent, but charges the decompressed size of content.xml to the budget.
+func (f *File) ParseContentBudget(doc *Doc, budget Budget) (err error) {
 	content, err := f.Open("content.xml")
 	if err != nil {
 		return
 	}
 	defer content.Close()
 
-	d := xml.NewDecoder(content)
+	var reader io.Reader = content
+	if budget != nil {
+		reader = &budgetReader{budget: budget, reader: content}
+	}
+
+	d := xml.NewDecoder(reader)
 	err = d.Decode(doc)
 	return
 }
+
+// Budget limits the resources used while parsing. It is charged for the decompressed content and for all cells.
+type Budget interface {
+	AddCells(count int64) error
+	AddDecompressed(size int64) error
+}
+
+// budgetReader charges all bytes read to the budget
+type budgetReader struct {
+	budget Budget
+	reader io.Reader
+}
+
+func (r *budgetReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		if errBudget := r.budget.AddDecompressed(int64(n)); errBudget != nil {
+			return n, errBudget
+		}
+	}
+	return n, err
+}
@@ -10,6 +10,9 @@ import (
 
 const (
 	MimeTypePfx = "application/vnd.oasis.opendocument."
+
+	// maxMimeTypeSize is the max size of the mimetype file. It protects against decompression bombs.
+	maxMimeTypeSize = 1024
 )
 
 type File struct {
@@ -51,8 +54,11 @@ func newFile(z *zip.Reader, closer io.Closer) (*File, error) {
 		return nil, err
 	}
 
-	b, err := ioutil.ReadAll(mf)
+	b, err := ioutil.ReadAll(io.LimitReader(mf, maxMimeTypeSize+1))
 	mf.Close()
+	if err == nil && len(b) > maxMimeTypeSize {
+		err = errors.New("odf: mimetype too large")
+	}
 	if err != nil {
 		if closer != nil {
 			closer.Close()
@@ -136,12 +136,12 @@ func (o *Ole) readSSAT() error {
 }
 
 func (o *Ole) stream_read(sid int32, size uint32) *StreamReader {
-	return &StreamReader{o.SecID, sid, o.reader, sid, 0, o.Lsector, int64(size), 0, sector_pos}
+	return &StreamReader{o.SecID, sid, o.reader, sid, 0, o.Lsector, int64(size), 0, sector_pos, 0}
 }
 
 func (o *Ole) short_stream_read(sid int32, size uint32, startSecId int32) *StreamReader {
-	ssatReader := &StreamReader{o.SecID, startSecId, o.reader, sid, 0, o.Lsector, int64(uint32(len(o.SSecID)) * o.Lssector), 0, sector_pos}
-	return &StreamReader{o.SSecID, sid, ssatReader, sid, 0, o.Lssector, int64(size), 0, short_sector_pos}
+	ssatReader := &StreamReader{o.SecID, startSecId, o.reader, sid, 0, o.Lsector, int64(uint32(len(o.SSecID)) * o.Lssector), 0, sector_pos, 0}
+	return &StreamReader{o.SSecID, sid, ssatReader, sid, 0, o.Lssector, int64(size), 0, short_sector_pos, 0}
 }
 
 func (o *Ole) sector_read(sid int32) (Sector, error) {
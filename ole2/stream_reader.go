@@ -19,6 +19,7 @@ type StreamReader struct {
 	size           int64
 	offset         int64
 	sectorPos      func(int32, uint32) int32
+	sectors        int // number of sectors followed in the chain, used to detect loops
 }
 
 // Read reads data from the stream into p
@@ -35,12 +36,15 @@ func (r *StreamReader) Read(p []byte) (n int, err error) {
 		} else {
 			readed += uint32(n)
 			r.offsetInSector = 0
-			if r.offsetOfSector >= int32(len(r.sat)) {
+			if r.offsetOfSector < 0 || r.offsetOfSector >= int32(len(r.sat)) {
 				//log.Fatal(`
 				//THIS SHOULD NOT HAPPEN, IF YOUR PROGRAM BREAK,
 				//COMMENT THIS LINE TO CONTINUE AND MAIL ME XLS FILE
 				//TO TEST, THANKS`)
 				return int(readed), io.EOF
+			} else if r.sectors++; r.sectors > len(r.sat) {
+				// the sector chain has a loop
+				return int(readed), io.ErrUnexpectedEOF
 			} else {
 				r.offsetOfSector = r.sat[r.offsetOfSector]
 			}
@@ -70,6 +74,7 @@ func (r *StreamReader) Seek(offset int64, whence int) (offsetResult int64, err e
 		r.offsetOfSector = r.start
 		r.offsetInSector = 0
 		r.offset = offset
+		r.sectors = 0
 	} else {
 		r.offset += offset
 	}
@@ -79,6 +84,11 @@ func (r *StreamReader) Seek(offset int64, whence int) (offsetResult int64, err e
 	}
 
 	for offset >= int64(r.sizeSector-r.offsetInSector) {
+		if r.sectors++; r.offsetOfSector < 0 || r.offsetOfSector >= int32(len(r.sat)) || r.sectors > len(r.sat) {
+			// invalid sector chain
+			err = io.ErrUnexpectedEOF
+			goto return_res
+		}
 		r.offsetOfSector = r.sat[r.offsetOfSector]
 		offset -= int64(r.sizeSector - r.offsetInSector)
 		r.offsetInSector = 0
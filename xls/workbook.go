@@ -2,9 +2,11 @@ package xls
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"os"
+	"strings"
 	"unicode/utf16"
 
 	"golang.org/x/text/encoding/charmap"
@@ -20,38 +22,76 @@ type WorkBook struct {
 	Formats  map[uint16]*Format
 	//All the sheets from the workbook
 	sheets         []*WorkSheet
-	Author         string
+	Author         string //user name of the WRITEACCESS record, usually the one who saved the file last
+	Encrypted      bool //FILEPASS record found. The content of encrypted records cannot be read.
 	rs             io.ReadSeeker
 	sst            []string
 	continue_utf16 uint16
 	continue_rich  uint16
 	continue_apsb  uint32
 	dateMode       uint16
+	ctx            context.Context
+	budget         Budget
+	err            error //error of the budget, parsing stops once set
+}
+
+//Budget limits the resources used while parsing. It is charged for the buffers and strings that are kept, and for every cell.
+//Parsing stops once it returns an error.
+type Budget interface {
+	Allocate(size int64) error
+	AddCells(count int64) error
 }
 
 //read workbook from ole2 file
-func newWorkBookFromOle2(rs io.ReadSeeker) *WorkBook {
+func newWorkBookFromOle2(ctx context.Context, rs io.ReadSeeker, budget Budget) (*WorkBook, error) {
 	wb := new(WorkBook)
+	wb.budget = budget
 	wb.Formats = make(map[uint16]*Format)
 	// wb.bts = bts
 	wb.rs = rs
 	wb.sheets = make([]*WorkSheet, 0)
-	wb.Parse(rs)
-	return wb
+	if err := wb.ParseContext(ctx, rs); err != nil {
+		return nil, err
+	}
+	return wb, nil
 }
 
 func (w *WorkBook) Parse(buf io.ReadSeeker) {
+	w.ParseContext(context.Background(), buf)
+}
+
+//ParseContext parses the workbook records. It stops and returns the error if the context is cancelled.
+//The context is kept to abort parsing of sheets later.
+func (w *WorkBook) ParseContext(ctx context.Context, buf io.ReadSeeker) error {
+	w.ctx = ctx
 	b := new(bof)
 	bof_pre := new(bof)
 	// buf := bytes.NewReader(bts)
 	offset := 0
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if w.err != nil {
+			return w.err
+		}
 		if err := binary.Read(buf, binary.LittleEndian, b); err == nil {
 			bof_pre, b, offset = w.parseBof(buf, b, bof_pre, offset)
 		} else {
 			break
 		}
 	}
+	return w.err
+}
+
+//cancelled checks if the context used for parsing is cancelled or the budget is exceeded
+func (w *WorkBook) cancelled() bool {
+	return w.err != nil || (w.ctx != nil && w.ctx.Err() != nil)
+}
+
+//Err returns the error of the budget if it was exceeded while parsing the workbook or a sheet
+func (w *WorkBook) Err() error {
+	return w.err
 }
 
 func (w *WorkBook) addXf(xf st_xf_data) {
@@ -73,7 +113,7 @@ func (w *WorkBook) addFormat(format *Format) {
 func (wb *WorkBook) parseBof(buf io.ReadSeeker, b *bof, pre *bof, offset_pre int) (after *bof, after_using *bof, offset int) {
 	after = b
 	after_using = pre
-	bts := xlsAllocateBytes(int(b.Size))
+	bts := wb.allocateTemporary(int(b.Size))
 	if bts == nil {
 		return
 	}
@@ -102,6 +142,9 @@ func (wb *WorkBook) parseBof(buf io.ReadSeeker, b *bof, pre *bof, offset_pre int
 			for err == nil && offset_pre < len(wb.sst) {
 				var str string
 				str, err = wb.get_string(buf_item, size)
+				if !wb.allocate(int64(len(wb.sst[offset_pre]) + len(str))) {
+					break
+				}
 				wb.sst[offset_pre] = wb.sst[offset_pre] + str
 
 				if err == io.EOF {
@@ -118,7 +161,7 @@ func (wb *WorkBook) parseBof(buf io.ReadSeeker, b *bof, pre *bof, offset_pre int
 	case 0xfc: // SST
 		info := new(SstInfo)
 		binary.Read(buf_item, binary.LittleEndian, info)
-		wb.sst = xlsAllocateString(int(info.Count))
+		wb.sst = wb.allocateStrings(int(info.Count))
 		if wb.sst == nil {
 			return
 		}
@@ -166,9 +209,50 @@ func (wb *WorkBook) parseBof(buf io.ReadSeeker, b *bof, pre *bof, offset_pre int
 		wb.addFormat(font)
 	case 0x22: //DATEMODE
 		binary.Read(buf_item, binary.LittleEndian, &wb.dateMode)
+	case 0x2f: //FILEPASS
+		wb.Encrypted = true
+	case 0x5c: //WRITEACCESS
+		wb.Author = wb.parseWriteAccess(buf_item)
 	}
 	return
 }
+
+//parseWriteAccess returns the user name of the WRITEACCESS record. It is padded with spaces.
+func (wb *WorkBook) parseWriteAccess(buf io.Reader) string {
+	var bts []byte
+	if wb.Is5ver {
+		var size uint8
+		if binary.Read(buf, binary.LittleEndian, &size) != nil {
+			return ""
+		}
+		bts = make([]byte, size)
+		n, _ := io.ReadFull(buf, bts)
+		return strings.TrimRight(decodeWindows1251(bts[:n]), " \x00")
+	}
+
+	var size uint16
+	var flag byte
+	if binary.Read(buf, binary.LittleEndian, &size) != nil || binary.Read(buf, binary.LittleEndian, &flag) != nil {
+		return ""
+	}
+
+	var chars []uint16
+	if flag&0x1 != 0 {
+		bts = make([]byte, 2*int(size))
+		n, _ := io.ReadFull(buf, bts)
+		for i := 0; i+1 < n; i += 2 {
+			chars = append(chars, binary.LittleEndian.Uint16(bts[i:]))
+		}
+	} else {
+		bts = make([]byte, size)
+		n, _ := io.ReadFull(buf, bts)
+		for _, v := range bts[:n] {
+			chars = append(chars, uint16(v))
+		}
+	}
+
+	return strings.TrimRight(string(utf16.Decode(chars)), " \x00")
+}
 func decodeWindows1251(enc []byte) string {
 	dec := charmap.Windows1251.NewDecoder()
 	out, _ := dec.Bytes(enc)
@@ -176,7 +260,7 @@ func decodeWindows1251(enc []byte) string {
 }
 func (w *WorkBook) get_string(buf io.ReadSeeker, size uint16) (res string, err error) {
 	if w.Is5ver {
-		bts := xlsAllocateBytes(int(size))
+		bts := w.allocateBytes(int(size))
 		if bts == nil {
 			return
 		}
@@ -201,6 +285,9 @@ func (w *WorkBook) get_string(buf io.ReadSeeker, size uint16) (res string, err e
 			w.continue_apsb = 0
 		}
 		if flag&0x1 != 0 {
+			if !w.allocate(2 * int64(size)) {
+				return
+			}
 			var bts = make([]uint16, size)
 			var i = uint16(0)
 			for ; i < size && err == nil; i++ {
@@ -220,7 +307,7 @@ func (w *WorkBook) get_string(buf io.ReadSeeker, size uint16) (res string, err e
 			}
 
 		} else {
-			bts := xlsAllocateBytes(int(size))
+			bts := w.allocateBytes(int(size))
 			if bts == nil {
 				return
 			}
@@ -246,7 +333,7 @@ func (w *WorkBook) get_string(buf io.ReadSeeker, size uint16) (res string, err e
 			} else {
 				seek_size = int64(4 * richtext_num)
 			}
-			bts = xlsAllocateBytes(int(seek_size))
+			bts = w.allocateTemporary(int(seek_size))
 			if bts == nil {
 				return
 			}
@@ -259,7 +346,7 @@ func (w *WorkBook) get_string(buf io.ReadSeeker, size uint16) (res string, err e
 		}
 		if phonetic_size > 0 {
 			var bts []byte
-			bts = xlsAllocateBytes(int(phonetic_size))
+			bts = w.allocateTemporary(int(phonetic_size))
 			if bts == nil {
 				return
 			}
@@ -344,8 +431,8 @@ func (w *WorkBook) ReadAllCells(max int) (res [][]string) {
 // Functions below check for excessive allocations and prevent it.
 const xlsAllocateLimit = 1 * 1024 * 1024
 
-func xlsAllocateBytes(size int) []byte {
-	if size > xlsAllocateLimit {
+func (w *WorkBook) allocateBytes(size int) []byte {
+	if size > xlsAllocateLimit || !w.allocate(int64(size)) {
 		//fmt.Printf("Size warning: %d\n", size)
 		return nil
 	}
@@ -353,11 +440,36 @@ func xlsAllocateBytes(size int) []byte {
 	return make([]byte, size)
 }
 
-func xlsAllocateString(size int) []string {
+//allocateTemporary returns a buffer that is only used while parsing a record. It is not charged to the budget, which limits the memory that is kept.
+func (w *WorkBook) allocateTemporary(size int) []byte {
 	if size > xlsAllocateLimit {
+		return nil
+	}
+
+	return make([]byte, size)
+}
+
+func (w *WorkBook) allocateStrings(size int) []string {
+	if size > xlsAllocateLimit || !w.allocate(int64(size)*16) {
 		//fmt.Printf("Size warning: %d\n", size)
 		return nil
 	}
 
 	return make([]string, size)
 }
+
+//allocate charges the budget for allocated bytes. It returns false if the budget is exceeded.
+func (w *WorkBook) allocate(size int64) bool {
+	if w.budget != nil && w.err == nil {
+		w.err = w.budget.Allocate(size)
+	}
+	return w.err == nil
+}
+
+//addCells charges the budget for cells. It returns false if the budget is exceeded.
+func (w *WorkBook) addCells(count int64) bool {
+	if w.budget != nil && w.err == nil {
+		w.err = w.budget.AddCells(count)
+	}
+	return w.err == nil
+}
@@ -37,6 +37,9 @@ func (w *WorkSheet) parse(buf io.ReadSeeker) {
 	b := new(bof)
 	var bof_pre *bof
 	for {
+		if w.wb.cancelled() {
+			break
+		}
 		if err := binary.Read(buf, binary.LittleEndian, b); err == nil {
 			bof_pre = w.parseBof(buf, b, bof_pre)
 			if b.Id == 0xa {
@@ -62,6 +65,9 @@ func (w *WorkSheet) parseBof(buf io.ReadSeeker, b *bof, pre *bof) *bof {
 	case 0x0BD: //MULRK
 		mc := new(MulrkCol)
 		size := (b.Size - 6) / 6
+		if !w.wb.allocate(int64(size) * 6) {
+			break
+		}
 		binary.Read(buf, binary.LittleEndian, &mc.Col)
 		mc.Xfrks = make([]XfRk, size)
 		for i := uint16(0); i < size; i++ {
@@ -72,6 +78,9 @@ func (w *WorkSheet) parseBof(buf io.ReadSeeker, b *bof, pre *bof) *bof {
 	case 0x0BE: //MULBLANK
 		mc := new(MulBlankCol)
 		size := (b.Size - 6) / 2
+		if !w.wb.allocate(int64(size) * 2) {
+			break
+		}
 		binary.Read(buf, binary.LittleEndian, &mc.Col)
 		mc.Xfs = make([]uint16, size)
 		for i := uint16(0); i < size; i++ {
@@ -85,6 +94,9 @@ func (w *WorkSheet) parseBof(buf io.ReadSeeker, b *bof, pre *bof) *bof {
 	case 0x06: //FORMULA
 		c := new(FormulaCol)
 		binary.Read(buf, binary.LittleEndian, &c.Header)
+		if !w.wb.allocate(int64(b.Size) - 20) {
+			break
+		}
 		c.Bts = make([]byte, b.Size-20)
 		binary.Read(buf, binary.LittleEndian, &c.Bts)
 		col = c
@@ -175,14 +187,29 @@ func (w *WorkSheet) add(content interface{}) {
 }
 
 func (w *WorkSheet) addCell(col Coler, ch contentHandler) {
+	if !w.wb.addCells(cellCount(ch.FirstCol(), ch.LastCol())) {
+		return
+	}
 	w.addContent(col.Row(), ch)
 }
 
 func (w *WorkSheet) addRange(rang Ranger, ch contentHandler) {
+	if !w.wb.addCells(cellCount(rang.FirstRow(), rang.LastRow())) {
+		return
+	}
+
+	// int prevents an endless loop if the last row is 0xFFFF
+	for i := int(rang.FirstRow()); i <= int(rang.LastRow()); i++ {
+		w.addContent(uint16(i), ch)
+	}
+}
 
-	for i := rang.FirstRow(); i <= rang.LastRow(); i++ {
-		w.addContent(i, ch)
+//cellCount returns the number of cells from first to last, but at least 1 for invalid ranges
+func cellCount(first, last uint16) int64 {
+	if last < first {
+		return 1
 	}
+	return int64(last) - int64(first) + 1
 }
 
 func (w *WorkSheet) addContent(row_num uint16, ch contentHandler) {
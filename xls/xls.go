@@ -1,6 +1,7 @@
 package xls
 
 import (
+	"context"
 	"io"
 	"os"
 
@@ -28,6 +29,17 @@ func OpenWithCloser(file string, charset string) (*WorkBook, io.Closer, error) {
 
 //Open xls file from reader
 func OpenReader(reader io.ReadSeeker, charset string) (wb *WorkBook, err error) {
+	return OpenReaderContext(context.Background(), reader, charset)
+}
+
+//Open xls file from reader. Parsing stops if the context is cancelled.
+func OpenReaderContext(ctx context.Context, reader io.ReadSeeker, charset string) (wb *WorkBook, err error) {
+	return OpenReaderBudget(ctx, reader, charset, nil)
+}
+
+//Open xls file from reader and charge the budget while parsing. Parsing stops if the context is cancelled or the budget is exceeded.
+//The budget is also charged when sheets are parsed, check WorkBook.Err after GetSheet.
+func OpenReaderBudget(ctx context.Context, reader io.ReadSeeker, charset string, budget Budget) (wb *WorkBook, err error) {
 	var ole *ole2.Ole
 	if ole, err = ole2.Open(reader, charset); err == nil {
 		var dir []*ole2.File
@@ -52,7 +64,7 @@ func OpenReader(reader io.ReadSeeker, charset string) (wb *WorkBook, err error)
 				}
 			}
 			if book != nil {
-				wb = newWorkBookFromOle2(ole.OpenFile(book, root))
+				wb, err = newWorkBookFromOle2(ctx, ole.OpenFile(book, root), budget)
 				return
 			}
 		}